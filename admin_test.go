@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminEndpointsRequireAdminAddress(t *testing.T) {
+	setupSnapshotDB(t)
+	origAdmins := ADMIN_ADDRESSES
+	ADMIN_ADDRESSES = parseAdminAddresses(" 0xAAAA000000000000000000000000000000000001 ,")
+	t.Cleanup(func() { ADMIN_ADDRESSES = origAdmins })
+
+	now := time.Now().Unix()
+	sessions := []struct {
+		token         string
+		address       string
+		authenticated int
+	}{
+		{"admin-token", "0xaaaa000000000000000000000000000000000001", 1},
+		{"user-token", "0xbbbb000000000000000000000000000000000002", 1},
+		{"pending-token", "0xaaaa000000000000000000000000000000000001", 0},
+	}
+	for _, s := range sessions {
+		if _, err := db.Exec("INSERT INTO sessions(token, address, authenticated, created) VALUES (?, ?, ?, ?)",
+			s.token, s.address, s.authenticated, now); err != nil {
+			t.Fatalf("insert session: %v", err)
+		}
+	}
+	db.Exec("INSERT INTO sessions(token, created) VALUES ('stale-token', ?)", now-2*3600)
+	db.Exec("INSERT INTO identity_snapshots(address, state, stake, ts) VALUES ('0x01', 'Human', 20000, ?)",
+		time.Now().AddDate(0, 0, -40).Unix())
+
+	handler := routes()
+	request := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"no token", "/admin/prune", "", http.StatusUnauthorized},
+		{"unknown token", "/admin/prune", "nope", http.StatusUnauthorized},
+		{"unauthenticated admin session", "/admin/prune", "pending-token", http.StatusUnauthorized},
+		{"non-admin address", "/admin/prune", "user-token", http.StatusForbidden},
+		{"non-admin reindex", "/reindex", "user-token", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rr := request(test.path, test.token); rr.Code != test.status {
+				t.Errorf("Expected %d, got %d: %s", test.status, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	rr := request("/admin/prune", "admin-token")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for the admin address, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		SessionsDeleted  int `json:"sessions_deleted"`
+		SnapshotsDeleted int `json:"snapshots_deleted"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.SessionsDeleted != 1 || resp.SnapshotsDeleted != 1 {
+		t.Errorf("Expected 1 session and 1 snapshot pruned, got %+v", resp)
+	}
+
+	// The token counts only under the Bearer scheme
+	for _, header := range []string{"admin-token", "Basic admin-token", "Bearer", "Beareradmin-token"} {
+		req := httptest.NewRequest("POST", "/admin/prune", nil)
+		req.Header.Set("Authorization", header)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", header, rr.Code)
+		}
+	}
+	req := httptest.NewRequest("POST", "/admin/prune", nil)
+	req.Header.Set("Authorization", "bearer admin-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the scheme to match case-insensitively, got %d", rr.Code)
+	}
+
+	ADMIN_ADDRESSES = parseAdminAddresses("")
+	if rr := request("/admin/prune", "admin-token"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 with no admins configured, got %d", rr.Code)
+	}
+}
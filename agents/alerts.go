@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// notifier delivers operator alerts to an external channel.
+type notifier interface {
+	Notify(message string) error
+}
+
+// webhookNotifier posts alerts to a Slack- or Discord-compatible incoming
+// webhook. Slack reads "text" and Discord reads "content", so both are sent.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *webhookNotifier) Notify(message string) error {
+	body, err := json.Marshal(map[string]string{
+		"text":    message,
+		"content": message,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// fetchAlerter counts consecutive failed fetches and notifies once when the
+// count reaches threshold, then once more on recovery. A nil *fetchAlerter
+// is valid and never notifies.
+type fetchAlerter struct {
+	notifier  notifier
+	threshold int
+
+	mu       sync.Mutex
+	failures int
+	alerting bool
+}
+
+func newFetchAlerter(n notifier, threshold int) *fetchAlerter {
+	if n == nil {
+		return nil
+	}
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &fetchAlerter{notifier: n, threshold: threshold}
+}
+
+func (a *fetchAlerter) recordFailure(fetchErr error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.failures++
+	send := !a.alerting && a.failures >= a.threshold
+	if send {
+		a.alerting = true
+	}
+	failures := a.failures
+	a.mu.Unlock()
+
+	if send {
+		a.notify(fmt.Sprintf("Idena indexer: %d consecutive fetches failed, last error: %v", failures, fetchErr))
+	}
+}
+
+func (a *fetchAlerter) recordSuccess() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	recovered := a.alerting
+	failures := a.failures
+	a.failures = 0
+	a.alerting = false
+	a.mu.Unlock()
+
+	if recovered {
+		a.notify(fmt.Sprintf("Idena indexer: fetching recovered after %d failed attempts", failures))
+	}
+}
+
+// escalate notifies immediately, bypassing the failure threshold, for
+// problems that will not go away on their own.
+func (a *fetchAlerter) escalate(message string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.alerting = true
+	a.mu.Unlock()
+	a.notify(message)
+}
+
+func (a *fetchAlerter) notify(message string) {
+	if err := a.notifier.Notify(message); err != nil {
+		log.Printf("Alert delivery failed: %v", err)
+	}
+}
+
+// defaultRPCAuthGrace is the number of consecutive key rejections tolerated
+// before they are reported as a misconfiguration.
+const defaultRPCAuthGrace = 2
+
+// rpcAuthWatch counts consecutive fetches the node rejected for the RPC key.
+type rpcAuthWatch struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (w *rpcAuthWatch) failure() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failures++
+	return w.failures
+}
+
+func (w *rpcAuthWatch) reset() {
+	w.mu.Lock()
+	w.failures = 0
+	w.mu.Unlock()
+}
+
+// stakeCrossing is an identity whose stake moved across the minimum stake
+// for its state between two fetches.
+type stakeCrossing struct {
+	Address   string
+	State     string
+	OldStake  float64
+	NewStake  float64
+	Threshold float64
+	// Direction is "above" or "below"
+	Direction string
+}
+
+// crossingDirection reports which way a stake change from old to new crossed
+// threshold, or "" if it did not.
+func crossingDirection(old, new, threshold float64) string {
+	switch {
+	case old < threshold && new >= threshold:
+		return "above"
+	case old >= threshold && new < threshold:
+		return "below"
+	}
+	return ""
+}
+
+func (c stakeCrossing) String() string {
+	return fmt.Sprintf("Idena indexer: %s stake moved %s the %s threshold of %s (%s -> %s)",
+		c.Address, c.Direction, c.State, formatIDNA(c.Threshold), formatIDNA(c.OldStake), formatIDNA(c.NewStake))
+}
+
+// reportStakeCrossings logs and sends one alert per crossing; it does
+// nothing unless stake alerts are enabled.
+func (s *Server) reportStakeCrossings(crossings []stakeCrossing) {
+	if s.stakeAlerts == nil {
+		return
+	}
+	for _, crossing := range crossings {
+		log.Print(crossing)
+		if err := s.stakeAlerts.Notify(crossing.String()); err != nil {
+			log.Printf("Alert delivery failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"idenauthgo/internal/idenarpc"
+)
+
+// epochSnapshot is the identity set at the start of a past epoch, as read
+// from a snapshot file or the node's history RPC. Timestamp (unix seconds)
+// is recorded as the history rows' changed_at.
+type epochSnapshot struct {
+	Epoch      int            `json:"epoch"`
+	Timestamp  int64          `json:"timestamp"`
+	Identities []nodeIdentity `json:"identities"`
+}
+
+// historyRPCMethod returns an epochSnapshot for the epoch given as its only
+// parameter. Stock nodes don't serve it; point IDENA_RPC_URL at an archive
+// node or indexer that does, or use BACKFILL_SNAPSHOT_DIR.
+const historyRPCMethod = "dna_epochIdentities"
+
+// decodeEpochSnapshot decodes a snapshot, bare or wrapped in a JSON-RPC
+// response.
+func decodeEpochSnapshot(data []byte) (epochSnapshot, error) {
+	var response idenarpc.Response
+	if err := json.Unmarshal(data, &response); err == nil && len(response.Result) > 0 {
+		data = response.Result
+	}
+	var snapshot epochSnapshot
+	if err := json.Unmarshal(bytes.TrimSpace(data), &snapshot); err != nil {
+		return epochSnapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// loadEpochSnapshot returns the snapshot of epoch from
+// Config.BackfillSnapshotDir, where it is stored as <epoch>.json, or else
+// from the node.
+func (s *Server) loadEpochSnapshot(ctx context.Context, epoch int) (epochSnapshot, error) {
+	var snapshot epochSnapshot
+	if dir := s.config.BackfillSnapshotDir; dir != "" {
+		path := filepath.Join(dir, strconv.Itoa(epoch)+".json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return epochSnapshot{}, err
+		}
+		if snapshot, err = decodeEpochSnapshot(data); err != nil {
+			return epochSnapshot{}, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	} else {
+		var raw json.RawMessage
+		if err := s.rpcClient().Call(ctx, historyRPCMethod, []interface{}{epoch}, &raw); err != nil {
+			return epochSnapshot{}, err
+		}
+		var err error
+		if snapshot, err = decodeEpochSnapshot(raw); err != nil {
+			return epochSnapshot{}, err
+		}
+	}
+
+	if snapshot.Epoch == 0 {
+		snapshot.Epoch = epoch
+	}
+	if snapshot.Epoch != epoch {
+		return epochSnapshot{}, fmt.Errorf("asked for epoch %d, got %d", epoch, snapshot.Epoch)
+	}
+	if snapshot.Timestamp <= 0 {
+		return epochSnapshot{}, fmt.Errorf("epoch %d: missing timestamp", epoch)
+	}
+	return snapshot, nil
+}
+
+// backfillEpoch adds a history row for every identity in snapshot whose
+// state or stake differs from its latest row at or before the snapshot's
+// timestamp, and returns how many were added. Rows already recorded are
+// matched this way too, so running the same epoch again adds nothing.
+func (s *Server) backfillEpoch(snapshot epochSnapshot) (int, error) {
+	var added int
+	err := s.writeTx(func(tx *sql.Tx) error {
+		added = 0
+		for _, identity := range snapshot.Identities {
+			address := strings.ToLower(identity.Address)
+			var prevState string
+			var prevStake float64
+			err := tx.QueryRow(`
+				SELECT state, stake FROM identity_history
+				WHERE address = ? AND changed_at <= ?
+				ORDER BY changed_at DESC, rowid DESC LIMIT 1`,
+				address, snapshot.Timestamp,
+			).Scan(&prevState, &prevStake)
+			if err == nil && prevState == identity.State && prevStake == identity.Stake.Value {
+				continue
+			}
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			// As in upsertIdentities, an unknown stake is recorded as 0
+			if _, err := tx.Exec(
+				"INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, ?, ?, ?)",
+				address, identity.State, identity.Stake.Value, snapshot.Timestamp,
+			); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	return added, err
+}
+
+// runBackfill implements the backfill command: it walks epochs from..to in
+// order, at most Config.BackfillRate per second, and fills identity_history
+// with the states they held. Only history is written; identities keeps the
+// live state. It stops at the first epoch that cannot be loaded.
+func (s *Server) runBackfill(ctx context.Context, from, to int) (int, error) {
+	if from < 0 || to < from {
+		return 0, fmt.Errorf("invalid epoch range %d..%d", from, to)
+	}
+	limit := newRPCLimiter(s.config.BackfillRate, 0)
+	total := 0
+	for epoch := from; epoch <= to; epoch++ {
+		release, err := limit.acquire(ctx)
+		if err != nil {
+			return total, err
+		}
+		snapshot, err := s.loadEpochSnapshot(ctx, epoch)
+		release()
+		if err != nil {
+			return total, fmt.Errorf("epoch %d: %w", epoch, err)
+		}
+		added, err := s.backfillEpoch(snapshot)
+		if err != nil {
+			return total, fmt.Errorf("epoch %d: %w", epoch, err)
+		}
+		log.Printf("Backfill epoch %d: %d identities, %d history rows added", epoch, len(snapshot.Identities), added)
+		total += added
+	}
+	return total, nil
+}
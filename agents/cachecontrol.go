@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// cachePolicy is the Cache-Control of a group of endpoints: how long
+// browsers (MaxAge) and shared caches such as CDNs (SMaxAge) may reuse a
+// response. The zero value has them revalidate every time, which with an
+// ETag still saves the body. NoStore forbids caching altogether.
+type cachePolicy struct {
+	MaxAge  time.Duration
+	SMaxAge time.Duration
+	NoStore bool
+}
+
+// noStore is the policy of sign-in, admin, export and status endpoints.
+var noStore = cachePolicy{NoStore: true}
+
+func newCachePolicy(maxAgeSeconds, sMaxAgeSeconds int) cachePolicy {
+	return cachePolicy{
+		MaxAge:  time.Duration(max(maxAgeSeconds, 0)) * time.Second,
+		SMaxAge: time.Duration(max(sMaxAgeSeconds, 0)) * time.Second,
+	}
+}
+
+func (p cachePolicy) header() string {
+	switch {
+	case p.NoStore:
+		return "no-store"
+	case p.MaxAge == 0 && p.SMaxAge == 0:
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d, s-maxage=%d", int(p.MaxAge/time.Second), int(p.SMaxAge/time.Second))
+}
+
+// cacheControl sets policy's Cache-Control on next's responses. Error
+// responses are sent no-store so a CDN doesn't keep serving a passing
+// failure.
+func cacheControl(policy cachePolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", policy.header())
+		next(&cacheControlWriter{ResponseWriter: w}, r)
+	}
+}
+
+type cacheControlWriter struct {
+	http.ResponseWriter
+}
+
+func (c *cacheControlWriter) WriteHeader(status int) {
+	if status >= 400 {
+		c.Header().Set("Cache-Control", "no-store")
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheControlWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
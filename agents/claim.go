@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+
+	"idenauthgo/internal/merkle"
+)
+
+// ClaimBundle is everything a wallet needs to claim on-chain for one
+// address: its proof against the current whitelist root, and the root
+// signed by the server when Config.ClaimKey is set.
+type ClaimBundle struct {
+	Address       string          `json:"address"`
+	Index         int             `json:"index"`
+	Proof         []merkle.Step   `json:"proof"`
+	MerkleRoot    string          `json:"merkle_root"`
+	HashAlgorithm merkle.HashAlgo `json:"hash_algorithm"`
+	Count         int             `json:"count"`
+	// Signer is the address of Config.ClaimKey and RootSignature its
+	// signature over MerkleRoot; both are empty without a key
+	Signer        string `json:"signer,omitempty"`
+	RootSignature string `json:"root_signature,omitempty"`
+}
+
+// parseClaimKey parses CLAIM_SIGNING_KEY, a hex secp256k1 private key.
+func parseClaimKey(value string) (*ecdsa.PrivateKey, error) {
+	return crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(value), "0x"))
+}
+
+// claimRootHash is the digest signed for a root: the EIP-191 personal
+// message hash of the root's 32 bytes, what OpenZeppelin's
+// ECDSA.toEthSignedMessageHash(bytes32) computes on-chain.
+func claimRootHash(root []byte) []byte {
+	return crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), root)
+}
+
+// signClaimRoot returns key's 65-byte signature over the hex root, with v
+// as 27 or 28 for ecrecover.
+func signClaimRoot(key *ecdsa.PrivateKey, root string) (string, error) {
+	digest, err := hex.DecodeString(root)
+	if err != nil {
+		return "", err
+	}
+	signature, err := crypto.Sign(claimRootHash(digest), key)
+	if err != nil {
+		return "", err
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return "0x" + hex.EncodeToString(signature), nil
+}
+
+// handleClaim serves the ClaimBundle of {address}, or 404 when it is not
+// on the whitelist. The proof and signature are for the tree over the
+// whitelist as of the request, the one whose root /merkle_root publishes.
+func (s *Server) handleClaim(w http.ResponseWriter, r *http.Request) {
+	address, err := normalizeAddress(mux.Vars(r)["address"], queryBool(r, "strict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tree, err := s.merkleTree()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	index, proof, ok := tree.Proof(address)
+	if !ok {
+		http.Error(w, "Address not eligible", http.StatusNotFound)
+		return
+	}
+
+	bundle := ClaimBundle{
+		Address:       tree.Address(index),
+		Index:         index,
+		Proof:         proof,
+		MerkleRoot:    tree.Root(),
+		HashAlgorithm: tree.HashAlgo(),
+		Count:         tree.Len(),
+	}
+	if key := s.config.ClaimKey; key != nil {
+		if bundle.RootSignature, err = signClaimRoot(key, bundle.MerkleRoot); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		bundle.Signer = strings.ToLower(crypto.PubkeyToAddress(key.PublicKey).Hex())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// dashboardFS holds the operator dashboard. It is plain HTML and JavaScript
+// that talks to the JSON endpoints, so there is no build step.
+//
+//go:embed dashboard
+var dashboardFS embed.FS
+
+// dashboardHandler serves the embedded dashboard, with index.html at "/".
+func dashboardHandler() http.Handler {
+	assets, err := fs.Sub(dashboardFS, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(assets))
+}
+
+// IndexerStats summarizes the identities table for the dashboard.
+type IndexerStats struct {
+	Total     int            `json:"total"`
+	Eligible  int            `json:"eligible"`
+	ByState   map[string]int `json:"by_state"`
+	LastFetch int64          `json:"last_fetch,omitempty"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query("SELECT state, COUNT(*) FROM identities GROUP BY state")
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	stats := IndexerStats{ByState: make(map[string]int)}
+	for rows.Next() {
+		var state string
+		var count int
+		if err := rows.Scan(&state, &count); err != nil {
+			continue
+		}
+		stats.ByState[state] = count
+		stats.Total += count
+	}
+
+	addresses, _, err := s.whitelist()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	stats.Eligible = len(addresses)
+
+	if last := s.fetches.lastFetch(); !last.IsZero() {
+		stats.LastFetch = last.Unix()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// statsBuckets maps the accepted ?bucket= values to their width.
+var statsBuckets = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// StatsPoint is one bucket of /stats/history: the last totals recorded
+// within [Timestamp, Timestamp+bucket).
+type StatsPoint struct {
+	Timestamp  int64       `json:"timestamp"`
+	Total      int         `json:"total"`
+	Eligible   int         `json:"eligible"`
+	TotalStake stakeAmount `json:"total_stake"`
+}
+
+// handleStatsHistory returns bucketed totals between ?from= and ?to= (now by
+// default). Both accept RFC3339 or a duration back from now, e.g. from=168h.
+func (s *Server) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	query := r.URL.Query()
+
+	from, err := parseTimeParam("from", query.Get("from"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := now
+	if query.Get("to") != "" {
+		if to, err = parseTimeParam("to", query.Get("to"), now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	bucketName := query.Get("bucket")
+	if bucketName == "" {
+		bucketName = "hour"
+	}
+	bucket, ok := statsBuckets[bucketName]
+	if !ok {
+		http.Error(w, "bucket must be hour or day", http.StatusBadRequest)
+		return
+	}
+	width := int64(bucket / time.Second)
+
+	// SQLite takes the bare columns from the row holding MAX(recorded_at)
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT (recorded_at / ?) * ?, MAX(recorded_at), total, eligible, total_stake
+		FROM stats_history
+		WHERE recorded_at >= ? AND recorded_at <= ?
+		GROUP BY recorded_at / ?
+		ORDER BY 1`,
+		width, width, from.Unix(), to.Unix(), width,
+	)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	points := make([]StatsPoint, 0)
+	for rows.Next() {
+		var point StatsPoint
+		var recordedAt int64
+		if err := rows.Scan(&point.Timestamp, &recordedAt, &point.Total, &point.Eligible, &point.TotalStake); err != nil {
+			continue
+		}
+		points = append(points, point)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bucket": bucketName,
+		"points": points,
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Write transactions that fail on a lock are retried writeRetries times,
+// waiting writeRetryBackoff, then twice as long each time, plus jitter.
+const (
+	writeRetries      = 4
+	writeRetryBackoff = 20 * time.Millisecond
+)
+
+// sqliteDSN adds busyTimeout to path. The driver applies DSN parameters to
+// every connection it opens, which a PRAGMA run once on the pool would not.
+func sqliteDSN(path string, busyTimeout time.Duration) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return fmt.Sprintf("%s%s_busy_timeout=%d", path, separator, busyTimeout.Milliseconds())
+}
+
+// isBusy reports whether err is SQLite failing on another connection's
+// lock. busy_timeout covers most of these, but not two transactions that
+// both read and then want to write: one of them fails at once.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// writeTx runs fn in a transaction and commits it, starting over when a
+// lock gets in the way. fn may run more than once, so it must not keep
+// state from a failed attempt.
+func (s *Server) writeTx(fn func(tx *sql.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTx(s.db, fn)
+		if err == nil || !isBusy(err) || attempt == writeRetries {
+			return err
+		}
+		backoff := writeRetryBackoff << attempt
+		backoff += time.Duration(rand.Int63n(int64(backoff)))
+		log.Printf("Database busy (attempt %d/%d), retrying in %v: %v", attempt+1, writeRetries+1, backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+func runTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// handleDebugRPCIdentity proxies dna_identity for ?address= to the node and
+// returns its JSON-RPC response verbatim, errors included, so operators
+// can see what the node reports without RPC tooling. Only routed with
+// Config.DebugEnabled, behind the API key.
+func (s *Server) handleDebugRPCIdentity(w http.ResponseWriter, r *http.Request) {
+	address, ok := overrideAddress(r.URL.Query().Get("address"))
+	if !ok {
+		http.Error(w, "Invalid address", http.StatusBadRequest)
+		return
+	}
+
+	release, err := s.rpcLimit.acquire(r.Context())
+	if err != nil {
+		http.Error(w, "Request cancelled", http.StatusServiceUnavailable)
+		return
+	}
+	client := s.rpcClient()
+	body, err := client.Post(r.Context(), client.NewRequest(1, "dna_identity", address))
+	release()
+	if err != nil {
+		log.Printf("Debug RPC dna_identity %s failed: %v", address, err)
+		http.Error(w, "Node error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
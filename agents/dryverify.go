@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var errEmptyWhitelist = errors.New("no eligible addresses")
+
+// whitelistDigest is what dry-verify reports about the current whitelist.
+type whitelistDigest struct {
+	MerkleRoot string
+	Count      int
+	// AddressesHash is the sha256 of the ordered addresses joined by "\n",
+	// so the exact list can be compared without shipping it around.
+	AddressesHash string
+}
+
+// digestWhitelist computes the eligible set straight from the database,
+// without the stale fallback of whitelist, and summarizes it. The root is
+// that of the tree /whitelist/paginated-merkle and /claim publish, with
+// Config.MerkleHash.
+func (s *Server) digestWhitelist() (whitelistDigest, error) {
+	addresses, err := s.eligibleAddresses()
+	if err != nil {
+		return whitelistDigest{}, err
+	}
+	if len(addresses) == 0 {
+		return whitelistDigest{}, errEmptyWhitelist
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(addresses, "\n")))
+	return whitelistDigest{
+		MerkleRoot:    s.whitelistTree(addresses).Root(),
+		Count:         len(addresses),
+		AddressesHash: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// runDryVerify implements the dry-verify command: it prints the merkle root,
+// address count and list hash to out and returns the process exit code,
+// non-zero when the whitelist is empty or cannot be read.
+func runDryVerify(s *Server, out, errOut io.Writer) int {
+	digest, err := s.digestWhitelist()
+	if err != nil {
+		fmt.Fprintf(errOut, "dry-verify: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "merkle_root: %s\n", digest.MerkleRoot)
+	fmt.Fprintf(out, "count: %d\n", digest.Count)
+	fmt.Fprintf(out, "addresses_sha256: %s\n", digest.AddressesHash)
+	return 0
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// EligibilityConfig describes the eligibility rules in force, for clients
+// that render them rather than hardcoding a copy that drifts.
+type EligibilityConfig struct {
+	EligibleStates []string `json:"eligible_states"`
+	// MinStake applies to eligible states without a threshold of their
+	// own; StateMinStake gives the minimum for each eligible state
+	MinStake      stakeAmount            `json:"min_stake"`
+	StateMinStake map[string]stakeAmount `json:"state_min_stake"`
+	// GraceStates stay eligible for GracePeriodHours after leaving an
+	// eligible state; both are omitted without a grace period
+	GraceStates      []string `json:"grace_states,omitempty"`
+	GracePeriodHours float64  `json:"grace_period_hours,omitempty"`
+	// StableFetches is in how many consecutive fetches an address must
+	// qualify before it is listed
+	StableFetches int `json:"stable_fetches,omitempty"`
+	// MaxEpochsSinceValidation is how many epochs behind the latest
+	// validation an identity's last one may be
+	MaxEpochsSinceValidation int            `json:"max_epochs_since_validation,omitempty"`
+	Profiles                 []string       `json:"profiles"`
+	Overrides                overrideCounts `json:"overrides"`
+}
+
+// overrideCounts counts the addresses the operator's overrides add to or
+// drop from the whitelist. The addresses themselves are only listed for
+// requests carrying the API key.
+type overrideCounts struct {
+	Allowlisted int      `json:"allowlisted"`
+	Denylisted  int      `json:"denylisted"`
+	Allowlist   []string `json:"allowlist,omitempty"`
+	Denylist    []string `json:"denylist,omitempty"`
+}
+
+// handleEligibilityConfig serves the EligibilityConfig of the default
+// rules, or of ?profile=. It reflects /admin/reload and override changes
+// immediately.
+func (s *Server) handleEligibilityConfig(w http.ResponseWriter, r *http.Request) {
+	view, ok := s.profileView(r)
+	if !ok {
+		http.Error(w, "Unknown profile", http.StatusBadRequest)
+		return
+	}
+	allow, deny, err := view.overrideSets()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	config := EligibilityConfig{
+		EligibleStates: view.eligibleStates(),
+		MinStake:       defaultMinStake,
+		StateMinStake:  make(map[string]stakeAmount),
+		Profiles:       []string{},
+	}
+	for _, state := range config.EligibleStates {
+		config.StateMinStake[state] = stakeAmount(view.minStake(state))
+	}
+	if s.config.GracePeriod > 0 {
+		for state := range graceStates {
+			config.GraceStates = append(config.GraceStates, state)
+		}
+		sort.Strings(config.GraceStates)
+		config.GracePeriodHours = s.config.GracePeriod.Hours()
+	}
+	config.StableFetches = s.config.StableFetches
+	config.MaxEpochsSinceValidation = s.config.MaxEpochsSinceValidation
+	for name := range s.rules().Profiles {
+		config.Profiles = append(config.Profiles, name)
+	}
+	sort.Strings(config.Profiles)
+
+	authorized := s.hasAPIKey(r)
+	for address := range allow {
+		if deny[address] {
+			continue
+		}
+		config.Overrides.Allowlisted++
+		if authorized {
+			config.Overrides.Allowlist = append(config.Overrides.Allowlist, address)
+		}
+	}
+	config.Overrides.Denylisted = len(deny)
+	if authorized {
+		for address := range deny {
+			config.Overrides.Denylist = append(config.Overrides.Denylist, address)
+		}
+	}
+	sort.Strings(config.Overrides.Allowlist)
+	sort.Strings(config.Overrides.Denylist)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
@@ -0,0 +1,58 @@
+package main
+
+import "sync"
+
+// eligibleCache holds the result of eligibleAddresses between writes, so
+// whitelist reads don't scan the identities table every time. Only
+// rebuildMerkleTree, which runs after every write, fills it; reads never
+// do, so a server whose data changes behind its back (a test, a CLI
+// command) reads the table as before. The zero value is an empty cache.
+type eligibleCache struct {
+	mu         sync.Mutex
+	addresses  []string
+	valid      bool
+	generation int
+}
+
+// get returns the cached addresses. Callers must not modify them.
+func (c *eligibleCache) get() ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addresses, c.valid
+}
+
+// set caches addresses unless the cache was invalidated after generation
+// was handed out, in which case they may already be out of date.
+func (c *eligibleCache) set(addresses []string, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.addresses, c.valid = addresses, true
+	}
+}
+
+func (c *eligibleCache) invalidate() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addresses, c.valid = nil, false
+	c.generation++
+	return c.generation
+}
+
+// eligibleCacheable reports whether the whitelist only changes on writes.
+// With a grace period it also changes as time passes, and with a stability
+// requirement on fetches that changed nothing, so it is read fresh.
+func (s *Server) eligibleCacheable() bool {
+	return s.config.GracePeriod <= 0 && s.config.StableFetches <= 0
+}
+
+// refreshEligibleAddresses reads the whitelist from the table and caches it
+// for the reads until the next write.
+func (s *Server) refreshEligibleAddresses() ([]string, error) {
+	generation := s.eligible.invalidate()
+	addresses, err := s.loadEligibleAddresses()
+	if err == nil && s.eligibleCacheable() {
+		s.eligible.set(addresses, generation)
+	}
+	return addresses, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"idenauthgo/internal/idenarpc"
+)
+
+// enrichStakeCacheSize bounds the stakes remembered between fetches.
+const enrichStakeCacheSize = 10000
+
+// enrichStakes fills in the stake of identities the node listed without
+// one by asking dna_getBalance, so their eligibility is decided on the
+// stake rather than reported as unknown. Only identities in an eligible
+// state are looked up, since the stake decides nothing for the others.
+// Stakes found are kept in s.stakeCache for Config.EnrichStakeTTL; an
+// identity whose lookup fails keeps its unknown stake.
+func (s *Server) enrichStakes(ctx context.Context, identities []nodeIdentity) {
+	enriched, failed := 0, 0
+	var lastErr error
+	for i := range identities {
+		identity := &identities[i]
+		if identity.Stake.Known || !s.isEligibleState(identity.State) {
+			continue
+		}
+		if cached, ok := s.stakeCache.get(identity.Address); ok {
+			identity.Stake = cached.(nodeStake)
+			continue
+		}
+		stake, err := s.lookupStake(ctx, identity.Address)
+		if err != nil {
+			// Stop asking a node that is down, or after a cancelled fetch
+			if ctx.Err() != nil || errors.Is(err, idenarpc.ErrCircuitOpen) {
+				log.Printf("Stake enrichment stopped: %v", err)
+				return
+			}
+			failed++
+			lastErr = err
+			continue
+		}
+		s.stakeCache.set(identity.Address, stake)
+		identity.Stake = stake
+		enriched++
+	}
+	if enriched > 0 {
+		log.Printf("Stake enrichment: looked up %d stakes the node did not list", enriched)
+	}
+	if failed > 0 {
+		log.Printf("Stake enrichment: %d lookups failed, their stakes stay unknown (last error: %v)", failed, lastErr)
+	}
+}
+
+// lookupStake returns the stake dna_getBalance reports for address.
+func (s *Server) lookupStake(ctx context.Context, address string) (nodeStake, error) {
+	release, err := s.rpcLimit.acquire(ctx)
+	if err != nil {
+		return nodeStake{}, err
+	}
+	balance, err := s.rpcClient().Balance(ctx, address)
+	release()
+	if err != nil {
+		return nodeStake{}, err
+	}
+	value, err := strconv.ParseFloat(balance.Stake, 64)
+	if err != nil {
+		return nodeStake{}, fmt.Errorf("dna_getBalance %s: invalid stake %q", address, balance.Stake)
+	}
+	return nodeStake{Value: value, Known: true}, nil
+}
+
+// fetchValidationData fills in the online status and flips count of
+// identities the node listed without them by asking dna_identity for each.
+// Unlike stakes they are not cached: both change during an epoch. An
+// identity whose lookup fails keeps what was stored for it before.
+func (s *Server) fetchValidationData(ctx context.Context, identities []nodeIdentity) {
+	fetched, failed := 0, 0
+	var lastErr error
+	for i := range identities {
+		identity := &identities[i]
+		if identity.Online != nil && identity.MadeFlips != nil {
+			continue
+		}
+		validation, err := s.lookupValidation(ctx, identity.Address)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, idenarpc.ErrCircuitOpen) {
+				log.Printf("Validation data lookups stopped: %v", err)
+				return
+			}
+			failed++
+			lastErr = err
+			continue
+		}
+		identity.Online = &validation.Online
+		identity.MadeFlips = &validation.MadeFlips
+		fetched++
+	}
+	if fetched > 0 {
+		log.Printf("Validation data: looked up %d identities the node listed without it", fetched)
+	}
+	if failed > 0 {
+		log.Printf("Validation data: %d lookups failed, their stored values are kept (last error: %v)", failed, lastErr)
+	}
+}
+
+// lookupValidation returns the validation fields dna_identity reports for
+// address.
+func (s *Server) lookupValidation(ctx context.Context, address string) (idenarpc.Validation, error) {
+	release, err := s.rpcLimit.acquire(ctx)
+	if err != nil {
+		return idenarpc.Validation{}, err
+	}
+	validation, err := s.rpcClient().Validation(ctx, address)
+	release()
+	return validation, err
+}
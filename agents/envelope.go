@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// responseMeta describes a list response sent with ?envelope=true.
+type responseMeta struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Count       int       `json:"count"`
+	// MerkleRoot is set on whitelist responses, matching /merkle_root
+	MerkleRoot    string `json:"merkle_root,omitempty"`
+	ServerVersion string `json:"server_version"`
+	// Stale mirrors WhitelistResponse.Stale
+	Stale bool `json:"stale,omitempty"`
+	// Total and NextOffset are set on offset-paged lists; NextOffset is
+	// left out on the last page
+	Total      *int `json:"total,omitempty"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type listEnvelope struct {
+	Data interface{}  `json:"data"`
+	Meta responseMeta `json:"meta"`
+}
+
+// writeList encodes a list endpoint's response. By default bare is sent as
+// before; with ?envelope=true the items in data are wrapped with meta, whose
+// generated_at and server_version are filled in here.
+func writeList(w http.ResponseWriter, r *http.Request, bare, data interface{}, meta responseMeta) {
+	w.Header().Set("Content-Type", "application/json")
+	if !queryBool(r, "envelope") {
+		json.NewEncoder(w).Encode(bare)
+		return
+	}
+	meta.GeneratedAt = time.Now().UTC()
+	meta.ServerVersion = version
+	json.NewEncoder(w).Encode(listEnvelope{Data: data, Meta: meta})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// epochCache holds /whitelist/check results for the current epoch. Within
+// an epoch eligibility only changes when the indexer stores a new state or
+// stake for the address, which removes its entry, so entries need no TTL;
+// the whole cache is dropped when the epoch advances. A nil *epochCache is
+// valid and behaves as a disabled cache.
+type epochCache struct {
+	mu      sync.Mutex
+	size    int
+	epoch   int
+	known   bool
+	entries map[string]EligibilityCheck
+}
+
+func newEpochCache(size int) *epochCache {
+	if size <= 0 {
+		return nil
+	}
+	return &epochCache{size: size, entries: make(map[string]EligibilityCheck)}
+}
+
+// setEpoch records the node's current epoch and reports whether it changed,
+// in which case every cached result is dropped.
+func (c *epochCache) setEpoch(epoch int) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.known && c.epoch == epoch {
+		return false
+	}
+	c.epoch, c.known = epoch, true
+	c.entries = make(map[string]EligibilityCheck)
+	return true
+}
+
+// get returns the cached result for address; nothing is cached until the
+// epoch is known.
+func (c *epochCache) get(address string) (EligibilityCheck, bool) {
+	if c == nil {
+		return EligibilityCheck{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	check, ok := c.entries[address]
+	return check, ok
+}
+
+// set caches check for address. Once size addresses are cached, further
+// ones are looked up in the database until the next epoch.
+func (c *epochCache) set(address string, check EligibilityCheck) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.known || len(c.entries) >= c.size {
+		return
+	}
+	c.entries[address] = check
+}
+
+func (c *epochCache) remove(address string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, address)
+	c.mu.Unlock()
+}
+
+// clear drops every cached result but keeps the epoch.
+func (c *epochCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries = make(map[string]EligibilityCheck)
+	c.mu.Unlock()
+}
+
+// epochCacheable reports whether an evaluateEligibility result holds for
+// the rest of the epoch. Database errors don't, and neither do results that
+// can change before it ends: addresses waiting out Config.StableFetches,
+// and eligibility resting on a grace period, which can run out at any time.
+func epochCacheable(check EligibilityCheck) bool {
+	switch check.Code {
+	case codeDatabaseError, codeNotYetStable:
+		return false
+	}
+	return !check.inGrace
+}
+
+// refreshEpoch asks the node for the current epoch so the eligibility cache
+// is dropped when it advances. It is a no-op when that cache is disabled or
+// identities come from Config.SourceFile.
+func (s *Server) refreshEpoch(ctx context.Context) {
+	if s.eligibility == nil || s.config.SourceFile != "" {
+		return
+	}
+	release, err := s.rpcLimit.acquire(ctx)
+	if err != nil {
+		return
+	}
+	epoch, err := s.rpcClient().Epoch(ctx)
+	release()
+	if err != nil {
+		log.Printf("Epoch lookup failed: %v", err)
+		return
+	}
+	if s.eligibility.setEpoch(epoch) {
+		log.Printf("Epoch %d: eligibility cache reset", epoch)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// internalError answers a failed request with 500 and a short error ID,
+// and logs err under that ID. The client only gets the ID, to quote when
+// reporting the failure; the detail stays in the log.
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	id := newErrorID()
+	log.Printf("Error %s: %s %s: %v", id, r.Method, r.URL.Path, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Error-ID", id)
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":    "Internal server error",
+		"error_id": id,
+	})
+}
+
+// newErrorID returns 12 random hex characters.
+func newErrorID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
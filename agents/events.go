@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultEventsMaxSubscribers is used when Config.EventsMaxSubscribers
+	// is unset.
+	defaultEventsMaxSubscribers = 1000
+	// eventsKeepAlive is how often an idle stream gets a comment line so
+	// proxies don't close it.
+	eventsKeepAlive = 30 * time.Second
+	// eventBuffer is how many events a slow subscriber may lag behind
+	// before further events are dropped for it.
+	eventBuffer = 8
+)
+
+// IdentityEvent is sent on /identity/{address}/events when the indexer
+// records a state or stake change for the address.
+type IdentityEvent struct {
+	Address      string      `json:"address"`
+	State        string      `json:"state"`
+	Stake        stakeAmount `json:"stake"`
+	StakeUnknown bool        `json:"stake_unknown,omitempty"`
+	ChangedAt    time.Time   `json:"changed_at"`
+}
+
+// addressWatchers is a registry of event subscribers keyed by lowercase
+// address. The zero value is ready to use.
+type addressWatchers struct {
+	mu    sync.Mutex
+	subs  map[string]map[chan IdentityEvent]struct{}
+	count int
+}
+
+// subscribe registers a subscriber for address unless max subscribers are
+// already registered.
+func (w *addressWatchers) subscribe(address string, max int) (chan IdentityEvent, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.count >= max {
+		return nil, false
+	}
+	if w.subs == nil {
+		w.subs = make(map[string]map[chan IdentityEvent]struct{})
+	}
+	if w.subs[address] == nil {
+		w.subs[address] = make(map[chan IdentityEvent]struct{})
+	}
+	ch := make(chan IdentityEvent, eventBuffer)
+	w.subs[address][ch] = struct{}{}
+	w.count++
+	return ch, true
+}
+
+func (w *addressWatchers) unsubscribe(address string, ch chan IdentityEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.subs[address][ch]; !ok {
+		return
+	}
+	delete(w.subs[address], ch)
+	if len(w.subs[address]) == 0 {
+		delete(w.subs, address)
+	}
+	w.count--
+}
+
+// publish hands event to the address's subscribers without blocking; a
+// subscriber whose buffer is full misses it.
+func (w *addressWatchers) publish(event IdentityEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs[event.Address] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (s *Server) eventsMaxSubscribers() int {
+	if s.config.EventsMaxSubscribers > 0 {
+		return s.config.EventsMaxSubscribers
+	}
+	return defaultEventsMaxSubscribers
+}
+
+// handleIdentityEvents streams an address's state and stake changes as
+// Server-Sent Events until the client disconnects or the server shuts down.
+func (s *Server) handleIdentityEvents(w http.ResponseWriter, r *http.Request) {
+	address, err := normalizeAddress(mux.Vars(r)["address"], queryBool(r, "strict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, ok := s.watchers.subscribe(address, s.eventsMaxSubscribers())
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.watchers.unsubscribe(address, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, ": watching %s\n\n", address)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			data, err := s.marshalJSON(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: identity\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-s.drain.draining():
+			// End the stream cleanly so clients can reconnect elsewhere
+			fmt.Fprint(w, "event: shutdown\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
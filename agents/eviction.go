@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// evictIdentities deletes the identities beyond Config.MaxIdentities,
+// least recently updated first. Rows written by the same fetch share
+// updated_at; among those the ones whose state or stake changed least
+// recently go first. Their history is kept. It returns how many rows were
+// deleted.
+func (s *Server) evictIdentities() (int, error) {
+	if s.config.MaxIdentities <= 0 {
+		return 0, nil
+	}
+	rows, err := s.db.Query(`
+		SELECT address FROM identities i
+		ORDER BY updated_at DESC,
+			(SELECT MAX(changed_at) FROM identity_history h WHERE h.address = i.address) DESC,
+			address
+		LIMIT -1 OFFSET ?`, s.config.MaxIdentities)
+	if err != nil {
+		return 0, err
+	}
+	var evicted []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		evicted = append(evicted, address)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(evicted) == 0 {
+		return 0, nil
+	}
+
+	err = s.writeTx(func(tx *sql.Tx) error {
+		for _, address := range evicted {
+			if _, err := tx.Exec("DELETE FROM identities WHERE address = ?", address); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, address := range evicted {
+		s.cache.invalidateAddress(address)
+		s.eligibility.remove(address)
+	}
+	s.rebuildMerkleTree()
+	s.whitelistChanges.broadcast()
+	log.Printf("Evicted %d identities beyond MAX_IDENTITIES=%d", len(evicted), s.config.MaxIdentities)
+	return len(evicted), nil
+}
+
+// unchangedSinceEviction reports whether an identity missing from the table
+// matches its last history row. With MaxIdentities set, evicted identities
+// come back on every fetch, and re-inserting one that did not change must
+// not count as a change. History records an unknown stake as 0.
+func unchangedSinceEviction(tx *sql.Tx, address string, identity Identity) (bool, error) {
+	var state string
+	var stake float64
+	err := tx.QueryRow(
+		"SELECT state, stake FROM identity_history WHERE address = ? ORDER BY changed_at DESC, rowid DESC LIMIT 1",
+		address,
+	).Scan(&state, &stake)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return state == identity.State && stake == float64(identity.Stake), nil
+}
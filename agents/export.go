@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireAPIKey only lets requests through that present Config.APIKey in
+// X-API-Key or as a bearer token. Without a configured key the wrapped
+// endpoint is disabled.
+func (s *Server) requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.APIKey == "" {
+			http.Error(w, "Endpoint disabled: API_KEY is not set", http.StatusForbidden)
+			return
+		}
+		if !s.hasAPIKey(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAPIKey reports whether r carries Config.APIKey, in X-API-Key or as a
+// bearer token. It is always false while no key is set.
+func (s *Server) hasAPIKey(r *http.Request) bool {
+	if s.config.APIKey == "" {
+		return false
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(s.config.APIKey)) == 1
+}
+
+// handleExport streams the identities table as gzipped NDJSON, one row at a
+// time in address order. The sha256 of the uncompressed NDJSON, the row
+// count and the last address written are sent as trailers, since they are
+// only known once the last row is written.
+//
+// Exports resume by address: ?after= starts past that address, so a client
+// whose download broke off passes the address of the last complete line, and
+// ?limit= caps a response so the table can be pulled in chunks, each
+// continuing after the previous X-Last-Address.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "ndjson.gz" {
+		http.Error(w, "format must be ndjson.gz", http.StatusBadRequest)
+		return
+	}
+	after := strings.ToLower(query.Get("after"))
+	if after != "" {
+		if len(after) != 42 || !strings.HasPrefix(after, "0x") {
+			http.Error(w, "invalid after address", http.StatusBadRequest)
+			return
+		}
+		if _, err := hex.DecodeString(after[2:]); err != nil {
+			http.Error(w, "invalid after address", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := -1
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	rows, err := s.db.QueryContext(r.Context(),
+		"SELECT "+identitySelectColumns+" FROM identities WHERE address > ? ORDER BY address LIMIT ?", after, limit)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Trailer", "X-Content-SHA256, X-Row-Count, X-Last-Address")
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="identities.ndjson.gz"`)
+
+	zw := gzip.NewWriter(w)
+	hash := sha256.New()
+	out := io.MultiWriter(zw, hash)
+
+	count, last := 0, ""
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			continue
+		}
+		data, err := s.marshalJSON(identity)
+		if err != nil {
+			continue
+		}
+		if _, err := out.Write(append(data, '\n')); err != nil {
+			// Client went away
+			return
+		}
+		count++
+		last = identity.Address
+	}
+	if err := rows.Err(); err != nil {
+		// Leave the gzip stream unterminated so the dump is visibly truncated
+		log.Printf("Export aborted after %d rows: %v", count, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+
+	w.Header().Set("X-Content-SHA256", hex.EncodeToString(hash.Sum(nil)))
+	w.Header().Set("X-Row-Count", strconv.Itoa(count))
+	w.Header().Set("X-Last-Address", last)
+}
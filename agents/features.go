@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Endpoint groups an operator can turn off with DISABLED_ENDPOINTS. Routes
+// of a disabled group are not registered at all, so they answer 404 like
+// any unknown path.
+const (
+	endpointsAuth   = "auth"   // /signin, /callback
+	endpointsAdmin  = "admin"  // /reconcile, /overrides
+	endpointsExport = "export" // /export
+	endpointsMerkle = "merkle" // /merkle_root, /whitelist/paginated-merkle, /merkle_multiproof
+)
+
+var endpointGroups = []string{endpointsAuth, endpointsAdmin, endpointsExport, endpointsMerkle}
+
+// parseDisabledEndpoints parses a comma-separated list of endpoint groups,
+// e.g. "admin,export".
+func parseDisabledEndpoints(value string) (map[string]bool, error) {
+	disabled := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		group := strings.ToLower(strings.TrimSpace(part))
+		if group == "" {
+			continue
+		}
+		known := false
+		for _, g := range endpointGroups {
+			known = known || g == group
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown endpoint group %q (known: %s)", group, strings.Join(endpointGroups, ", "))
+		}
+		disabled[group] = true
+	}
+	return disabled, nil
+}
+
+func (s *Server) endpointEnabled(group string) bool {
+	return !s.config.DisabledEndpoints[group]
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Field casings for JSON responses. Handlers write snake_case; with camel
+// the keys are rewritten on the way out, e.g. updated_at as updatedAt.
+const (
+	fieldCaseSnake = "snake"
+	fieldCaseCamel = "camel"
+)
+
+// parseFieldCase validates JSON_FIELD_CASE or a ?case= value; "" selects
+// snake_case.
+func parseFieldCase(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "", fieldCaseSnake:
+		return fieldCaseSnake, nil
+	case fieldCaseCamel:
+		return fieldCaseCamel, nil
+	}
+	return "", fmt.Errorf("unknown field case %q (use snake or camel)", value)
+}
+
+// fieldCase is middleware applying Config.FieldCase, or ?case= when the
+// request sets it, to JSON responses. Other responses, including event
+// streams and exports, pass through untouched.
+func (s *Server) fieldCase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fieldCase := s.config.FieldCase
+		if value := r.URL.Query().Get("case"); value != "" {
+			var err error
+			if fieldCase, err = parseFieldCase(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if fieldCase != fieldCaseCamel {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &jsonRewriter{ResponseWriter: w, rewrite: camelizeJSON}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+// jsonRewriter buffers a JSON response to pass it through rewrite once
+// complete; anything else is written straight through.
+type jsonRewriter struct {
+	http.ResponseWriter
+	rewrite   func([]byte) ([]byte, error)
+	decided   bool
+	buffering bool
+	status    int
+	buf       bytes.Buffer
+}
+
+func (c *jsonRewriter) decide() {
+	if !c.decided {
+		c.decided = true
+		c.buffering = strings.HasPrefix(c.Header().Get("Content-Type"), "application/json")
+	}
+}
+
+func (c *jsonRewriter) WriteHeader(status int) {
+	c.decide()
+	if c.buffering {
+		c.status = status
+		return
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *jsonRewriter) Write(p []byte) (int, error) {
+	c.decide()
+	if c.buffering {
+		return c.buf.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *jsonRewriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok && !c.buffering {
+		f.Flush()
+	}
+}
+
+func (c *jsonRewriter) finish() {
+	if !c.buffering {
+		return
+	}
+	body, err := c.rewrite(c.buf.Bytes())
+	if err != nil {
+		body = c.buf.Bytes()
+	}
+	c.Header().Del("Content-Length")
+	if c.status != 0 {
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+	c.ResponseWriter.Write(body)
+}
+
+// camelCase turns a snake_case key into lowerCamelCase.
+func camelCase(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// camelizeJSON rewrites every object key in a JSON document to camelCase,
+// keeping key order and the exact text of numbers.
+func camelizeJSON(data []byte) ([]byte, error) {
+	return rewriteJSON(data, camelCase, nil)
+}
+
+// rewriteJSON re-encodes a JSON document token by token, passing each object
+// key through key and each number through number, which also gets the key it
+// sits under and the key of the object holding it ("" inside arrays and at
+// the top). A nil func leaves its tokens as they are; key order and the text
+// of untouched numbers are kept.
+func rewriteJSON(data []byte, key func(string) string, number func(key, parent string, n json.Number) []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	// written counts the keys and values already written in each open
+	// object, or the elements in each open array; name is the key the
+	// object or array sits under, last the key being written in an object
+	type frame struct {
+		object  bool
+		written int
+		name    string
+		last    string
+	}
+	var stack []frame
+	var out bytes.Buffer
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF && len(stack) == 0 {
+				break
+			}
+			return nil, err
+		}
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			out.WriteByte(byte(delim))
+			continue
+		}
+
+		var name, parent string
+		if len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.object && top.written%2 == 0 {
+				if top.written > 0 {
+					out.WriteByte(',')
+				}
+				top.last = tok.(string)
+				written := top.last
+				if key != nil {
+					written = key(written)
+				}
+				encoded, _ := json.Marshal(written)
+				out.Write(encoded)
+				out.WriteByte(':')
+				top.written++
+				continue
+			}
+			if !top.object && top.written > 0 {
+				out.WriteByte(',')
+			}
+			top.written++
+			if top.object {
+				name, parent = top.last, top.name
+			}
+		}
+
+		switch value := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(value))
+			stack = append(stack, frame{object: value == '{', name: name})
+		case json.Number:
+			if number != nil {
+				out.Write(number(name, parent, value))
+			} else {
+				out.WriteString(value.String())
+			}
+		default:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(encoded)
+		}
+	}
+	if bytes.HasSuffix(data, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
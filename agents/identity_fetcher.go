@@ -2,99 +2,643 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
+
+	"idenauthgo/internal/idenarpc"
+	"idenauthgo/internal/merkle"
+	"idenauthgo/internal/pathtemplate"
+)
+
+// Build information, populated at build time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "1.0.0"
+	commit    = "unknown"
+	buildTime = "unknown"
 )
 
 type Config struct {
-	BaseURL    string
+	BaseURL     string
+	IdenaRPCURL string
 	IdenaRPCKey string
+	// SourceFile, when set, is a dna_identities dump the indexer reads on
+	// every pass instead of calling the node, for air-gapped or archival
+	// setups.
+	SourceFile string
 	Port       string
+	// DBPath is the SQLite file; it may use the pathtemplate variables,
+	// e.g. identities-{{.Date}}.db, resolved once at startup.
+	DBPath string
+	// DBBusyTimeout is how long a connection waits on another's lock
+	// before SQLite reports the database busy.
+	DBBusyTimeout time.Duration
+	// Mode selects what the process runs: "combined" (default) fetches and
+	// serves from one process, "server" only serves, "indexer" only fetches.
+	Mode string
+	// IntervalMinutes is the delay between two indexer fetches.
+	IntervalMinutes int
+	// MinInterval and MaxInterval bound the adaptive polling interval: it
+	// backs off towards MaxInterval while nothing changes and speeds up
+	// towards MinInterval when it does. Unset bounds pin it to IntervalMinutes.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// MaxStaleness is how long after the last successful fetch /readyz
+	// keeps reporting ready; zero disables the check.
+	MaxStaleness time.Duration
+	// PageConcurrency bounds how many dna_identities pages are fetched at once.
+	PageConcurrency int
+	// StrictDecoding fails a fetch whose dna_identities result does not
+	// decode, instead of salvaging the fields it can find.
+	StrictDecoding bool
+	// RPCRateLimit caps node calls per second and RPCConcurrency the calls in
+	// flight, across all indexer requests; zero means unlimited.
+	RPCRateLimit   float64
+	RPCConcurrency int
+	// AlertWebhookURL receives a message after AlertAfterFailures
+	// consecutive failed fetches and again on recovery.
+	AlertWebhookURL    string
+	AlertAfterFailures int
+	// StakeAlerts also notifies AlertWebhookURL when an identity's stake
+	// crosses the minimum stake for its state between fetches.
+	StakeAlerts bool
+	// RPCAuthGrace is how many consecutive fetches the node may reject for a
+	// bad or missing IdenaRPCKey before it is reported as a misconfiguration;
+	// zero selects defaultRPCAuthGrace.
+	RPCAuthGrace int
+	// RPCTLS trusts a private CA, presents a client certificate or skips
+	// verification for HTTPS node URLs; the zero value keeps Go's defaults.
+	RPCTLS idenarpc.TLSOptions
+	// RPCBreakerThreshold consecutive node failures open the RPC circuit
+	// for RPCBreakerCooldown; zero disables the breaker.
+	RPCBreakerThreshold int
+	RPCBreakerCooldown  time.Duration
+	// CacheSize is the number of address lookups kept in memory; 0 disables the cache.
+	CacheSize int
+	CacheTTL  time.Duration
+	// GracePeriod keeps Suspended/Zombie identities eligible for this long
+	// after leaving an eligible state; 0 disables the grace policy.
+	GracePeriod time.Duration
+	// APIKey guards heavy endpoints such as /export; empty disables them.
+	APIKey string
+	// DebugEnabled routes the /debug endpoints, which also need APIKey.
+	DebugEnabled bool
+	// DisabledEndpoints holds the endpoint groups (endpointsAuth, ...) whose
+	// routes are not registered.
+	DisabledEndpoints map[string]bool
+	// WhitelistMaxWaiters caps concurrent /whitelist long-polls and
+	// WhitelistMaxWait caps their ?wait=; zero selects the defaults.
+	WhitelistMaxWaiters int
+	WhitelistMaxWait    time.Duration
+	// MaxWhitelistAge is how old the last successful fetch may be before
+	// /whitelist stops vouching for its data: with WhitelistStaleMode
+	// staleFail it answers 503, with staleFlag it sets stale. Zero
+	// disables the check.
+	MaxWhitelistAge    time.Duration
+	WhitelistStaleMode string
+	// EventsMaxSubscribers caps open /identity/{address}/events streams;
+	// zero selects defaultEventsMaxSubscribers.
+	EventsMaxSubscribers int
+	// MaxInFlight caps the requests served at once; beyond it requests get
+	// 503 until one finishes. Zero means unlimited.
+	MaxInFlight int
+	// ShutdownGrace is how long shutdown waits for in-flight requests
+	// before closing their connections; zero selects defaultShutdownGrace.
+	ShutdownGrace time.Duration
+	// MaxIdentities caps the identities table; after each fetch the least
+	// recently updated rows beyond it are deleted. Zero keeps everything.
+	MaxIdentities int
+	// EnrichStake looks up with dna_getBalance the stake of eligible-state
+	// identities the node lists without one, caching each for
+	// EnrichStakeTTL.
+	EnrichStake    bool
+	EnrichStakeTTL time.Duration
+	// FetchValidationData looks up with dna_identity the online status and
+	// flips made of identities the node lists without them.
+	FetchValidationData bool
+	// HistoryKeep limits identity_history to this many rows per address
+	// and HistoryMaxAge drops rows older than it, every
+	// HistoryPruneInterval; zero disables either limit. Rows grace periods
+	// and stability windows still need are kept (see pruneHistory).
+	HistoryKeep          int
+	HistoryMaxAge        time.Duration
+	HistoryPruneInterval time.Duration
+	// StakeScale divides every stake read from the node, for nodes or
+	// proxies that report stakes in dna (1e18) rather than iDNA; zero or
+	// one leaves them as they are.
+	StakeScale float64
+	// WhitelistCache is the Cache-Control of the whitelist and merkle
+	// endpoints, IdentityCache that of identity lookups and lists.
+	WhitelistCache cachePolicy
+	IdentityCache  cachePolicy
+	// StakeAsString writes stake amounts as 18-decimal strings rather
+	// than JSON numbers
+	StakeAsString bool
+	// FieldCase is the key casing of JSON responses, fieldCaseSnake or
+	// fieldCaseCamel; requests may pick their own with ?case=.
+	FieldCase string
+	// Allowlist and Denylist override the eligibility rules for the listed
+	// (lowercase) addresses; an address on both is denied.
+	Allowlist map[string]bool
+	Denylist  map[string]bool
+	// MerkleHash is the hash of the cached whitelist tree behind
+	// /whitelist/paginated-merkle; "" selects sha256.
+	MerkleHash merkle.HashAlgo
+	// ClaimKey signs the merkle root of /claim bundles; nil leaves them
+	// unsigned.
+	ClaimKey *ecdsa.PrivateKey
+	// StableFetches keeps an address off the whitelist until it has been
+	// eligible in this many consecutive fetches; zero disables the check.
+	StableFetches int
+	// MaxEpochsSinceValidation excludes identities that last validated more
+	// than this many epochs before the latest validation on record, or
+	// never did; zero disables the check.
+	MaxEpochsSinceValidation int
+	// BackfillSnapshotDir holds <epoch>.json snapshots for the backfill
+	// command; "" asks the node's history RPC instead.
+	BackfillSnapshotDir string
+	// BackfillRate is the most epochs backfill loads per second; zero
+	// disables the limit.
+	BackfillRate float64
+	// EligibilityCacheSize bounds the per-epoch /whitelist/check cache;
+	// zero disables it.
+	EligibilityCacheSize int
+	// StateThresholds overrides the minimum stake for the listed states;
+	// the others need defaultMinStake.
+	StateThresholds map[string]float64
+	// EligibleStates are the states that qualify; nil selects
+	// eligibleStates. Only profiles set it.
+	EligibleStates []string
+	// Profiles are the named rule sets selectable with ?profile=; requests
+	// without one use the rules above.
+	Profiles map[string]eligibilityProfile
+	// StakeTiers classifies identities by stake, lowest tier first. Nil
+	// selects defaultStakeTiers.
+	StakeTiers stakeTiers
+	// DegradeAfterErrors is the number of consecutive database errors after
+	// which whitelist reads are served stale from memory.
+	DegradeAfterErrors int
 }
 
 type Identity struct {
-	Address   string    `json:"address"`
-	State     string    `json:"state"`
-	Stake     float64   `json:"stake"`
-	Timestamp time.Time `json:"timestamp"`
+	Address      string      `json:"address"`
+	State        string      `json:"state"`
+	Stake        stakeAmount `json:"stake"`
+	StakeUnknown bool        `json:"stake_unknown,omitempty"` // the node sent no stake; Stake is 0
+	StakeDisplay string      `json:"stake_display,omitempty"` // set with ?format_stake=true
+	Tier         string      `json:"tier,omitempty"`
+	Online       *bool       `json:"online,omitempty"`
+	FlipsCount   *int        `json:"flips_count,omitempty"`
+	Delegatee    string      `json:"delegatee,omitempty"` // pool the identity delegates to
+	// LastValidationEpoch is the epoch of the identity's last validation,
+	// nil when it never validated or the node doesn't report it
+	LastValidationEpoch *int      `json:"last_validation_epoch,omitempty"`
+	Timestamp           time.Time `json:"timestamp"`
+	// Tags are the operator's labels, set with ?verbose=true
+	Tags []string `json:"tags,omitempty"`
 }
 
 type WhitelistResponse struct {
 	Addresses []string `json:"addresses"`
 	Count     int      `json:"count"`
+	// Stale is set when the database is failing and the last good whitelist
+	// is served instead, or the data is older than Config.MaxWhitelistAge.
+	Stale bool `json:"stale,omitempty"`
+	// Entries is set with ?verbose=true
+	Entries []WhitelistEntry `json:"entries,omitempty"`
+}
+
+// WhitelistEntry is a whitelisted address with the time its current run of
+// eligibility began, when the history records it.
+type WhitelistEntry struct {
+	Address     string     `json:"address"`
+	StableSince *time.Time `json:"stable_since,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
 }
 
 type EligibilityCheck struct {
-	Address  string `json:"address"`
-	Eligible bool   `json:"eligible"`
-	Reason   string `json:"reason,omitempty"`
+	Address  string          `json:"address"`
+	Eligible bool            `json:"eligible"`
+	Code     EligibilityCode `json:"code"`
+	Reason   string          `json:"reason,omitempty"`
+	// inGrace marks an OK that rests on a grace period
+	inGrace bool
 }
 
+// EligibilityCode is the machine-readable form of an EligibilityCheck's
+// Reason, for clients to branch on; the wording of Reason may change.
+type EligibilityCode string
+
+const (
+	codeOK                   EligibilityCode = "OK"
+	codeInsufficientStake    EligibilityCode = "InsufficientStake"
+	codeStakeUnknown         EligibilityCode = "StakeUnknown"
+	codeIneligibleState      EligibilityCode = "IneligibleState"
+	codeNotFound             EligibilityCode = "NotFound"
+	codeDenylisted           EligibilityCode = "Denylisted"
+	codeNotYetStable         EligibilityCode = "NotYetStable"
+	codeNotRecentlyValidated EligibilityCode = "NotRecentlyValidated"
+	codeDatabaseError        EligibilityCode = "DatabaseError"
+)
+
 type Server struct {
-	db     *sql.DB
-	config Config
+	db      *sql.DB
+	config  Config
+	cache   *lruCache
+	health  dbHealth
+	alerts  *fetchAlerter
+	fetches fetchStatus
+	// stakeAlerts receives stake threshold crossings; nil disables them
+	stakeAlerts notifier
+	// rpcLimit throttles the indexer's node calls
+	rpcLimit *rpcLimiter
+	// rpcHTTP carries node calls with Config.RPCTLS applied; nil uses the
+	// default client
+	rpcHTTP *http.Client
+	// rpcBreaker skips node calls while the node is failing; nil disables it
+	rpcBreaker *idenarpc.Breaker
+	// rpcAuth counts fetches rejected for a bad RPC key
+	rpcAuth rpcAuthWatch
+	// merkle caches the whitelist tree, rebuilt after each change
+	merkle merkleCache
+	// whitelistChanges wakes /whitelist long-polls after each write
+	whitelistChanges changeBroadcaster
+	// watchers holds the /identity/{address}/events subscribers
+	watchers addressWatchers
+	// drain is closed on shutdown to end long-polls and event streams
+	drain drainSignal
+	// eligibility caches /whitelist/check results for the current epoch
+	eligibility *epochCache
+	// reloaded holds the eligibility rules from the last /admin/reload;
+	// until then those in config apply
+	reloaded atomic.Pointer[eligibilityRules]
+	// env reloads the .env file on /admin/reload; nil skips it
+	env *dotEnv
+	// stakeCache holds the stakes found by enrichStakes
+	stakeCache *lruCache
+	// eligible caches eligibleAddresses until the next write
+	eligible eligibleCache
 }
 
+// dbHealth tracks consecutive database failures so read endpoints can fall
+// back to the last good whitelist during short outages.
+type dbHealth struct {
+	mu            sync.Mutex
+	failures      int
+	lastWhitelist []string
+	haveWhitelist bool
+}
+
+// defaultDegradeAfterErrors is used when Config.DegradeAfterErrors is unset.
+const defaultDegradeAfterErrors = 3
+
 func main() {
+	seedPath := flag.String("seed", "", "CSV of address,state,stake to load into the database before the first fetch")
+	validateConfig := flag.Bool("validate-config", false, "check the configuration and exit")
+	flag.Parse()
+
 	// Load environment variables
-	err := godotenv.Load()
+	env := newDotEnv(".env")
+	err := env.load()
 	if err != nil {
 		log.Println("No .env file found, using system environment variables")
 	}
 
+	intervalMinutes := getEnvInt("FETCH_INTERVAL_MINUTES", 10)
+	if intervalMinutes < 1 {
+		log.Printf("FETCH_INTERVAL_MINUTES=%d is not positive, using 1", intervalMinutes)
+		intervalMinutes = 1
+	}
+	maxInterval := time.Duration(getEnvInt("FETCH_MAX_INTERVAL_MINUTES", 0)) * time.Minute
+	// Ready as long as no more than one fetch was missed by default
+	staleness := 2 * max(time.Duration(intervalMinutes)*time.Minute, maxInterval)
+
 	config := Config{
-		BaseURL:     getEnv("BASE_URL", "http://localhost:3030"),
-		IdenaRPCKey: getEnv("IDENA_RPC_KEY", ""),
-		Port:        getEnv("PORT", "3030"),
+		BaseURL:                  getEnv("BASE_URL", "http://localhost:3030"),
+		Mode:                     getEnv("MODE", "combined"),
+		IdenaRPCURL:              getEnv("IDENA_RPC_URL", "http://localhost:9009"),
+		IdenaRPCKey:              getEnv("IDENA_RPC_KEY", ""),
+		SourceFile:               getEnv("SOURCE_FILE", ""),
+		IntervalMinutes:          intervalMinutes,
+		MinInterval:              time.Duration(getEnvInt("FETCH_MIN_INTERVAL_MINUTES", 0)) * time.Minute,
+		MaxInterval:              maxInterval,
+		PageConcurrency:          getEnvInt("RPC_PAGE_CONCURRENCY", 1),
+		StrictDecoding:           getEnv("RPC_STRICT_DECODING", "false") == "true",
+		RPCRateLimit:             getEnvFloat("RPC_RATE_LIMIT", 0),
+		RPCConcurrency:           getEnvInt("RPC_CONCURRENCY", 0),
+		AlertWebhookURL:          getEnv("ALERT_WEBHOOK_URL", ""),
+		AlertAfterFailures:       getEnvInt("ALERT_AFTER_FAILURES", 3),
+		StakeAlerts:              getEnv("STAKE_ALERTS", "false") == "true",
+		RPCAuthGrace:             getEnvInt("RPC_AUTH_GRACE", defaultRPCAuthGrace),
+		RPCBreakerThreshold:      getEnvInt("RPC_BREAKER_THRESHOLD", 5),
+		RPCBreakerCooldown:       time.Duration(getEnvInt("RPC_BREAKER_COOLDOWN_SECONDS", 60)) * time.Second,
+		Port:                     getEnv("PORT", "3030"),
+		DBPath:                   getEnv("DB_PATH", "./identities.db"),
+		DBBusyTimeout:            time.Duration(getEnvInt("DB_BUSY_TIMEOUT_MS", 5000)) * time.Millisecond,
+		CacheSize:                getEnvInt("CACHE_SIZE", 1024),
+		CacheTTL:                 time.Duration(getEnvInt("CACHE_TTL_SECONDS", 60)) * time.Second,
+		DegradeAfterErrors:       getEnvInt("DB_DEGRADE_AFTER_ERRORS", defaultDegradeAfterErrors),
+		MaxStaleness:             time.Duration(getEnvInt("READY_MAX_STALENESS_SECONDS", int(staleness/time.Second))) * time.Second,
+		GracePeriod:              time.Duration(getEnvInt("SUSPENDED_GRACE_HOURS", 0)) * time.Hour,
+		WhitelistMaxWaiters:      getEnvInt("WHITELIST_MAX_WAITERS", defaultWhitelistMaxWaiters),
+		WhitelistMaxWait:         time.Duration(getEnvInt("WHITELIST_MAX_WAIT_SECONDS", 60)) * time.Second,
+		EventsMaxSubscribers:     getEnvInt("EVENTS_MAX_SUBSCRIBERS", defaultEventsMaxSubscribers),
+		ShutdownGrace:            time.Duration(getEnvInt("SHUTDOWN_GRACE_SECONDS", 10)) * time.Second,
+		MaxInFlight:              getEnvInt("MAX_IN_FLIGHT_REQUESTS", 0),
+		EligibilityCacheSize:     getEnvInt("ELIGIBILITY_CACHE_SIZE", 0),
+		StableFetches:            getEnvInt("ELIGIBLE_STABLE_FETCHES", 0),
+		MaxEpochsSinceValidation: getEnvInt("MAX_EPOCHS_SINCE_VALIDATION", 0),
+		MaxIdentities:            getEnvInt("MAX_IDENTITIES", 0),
+		HistoryKeep:              getEnvInt("HISTORY_KEEP_PER_ADDRESS", 0),
+		HistoryMaxAge:            time.Duration(getEnvInt("HISTORY_RETENTION_DAYS", 0)) * 24 * time.Hour,
+		HistoryPruneInterval:     time.Duration(getEnvInt("HISTORY_PRUNE_INTERVAL_MINUTES", 60)) * time.Minute,
+		StakeScale:               getEnvFloat("STAKE_SCALE", 1),
+		EnrichStake:              getEnv("ENRICH_STAKE", "false") == "true",
+		EnrichStakeTTL:           time.Duration(getEnvInt("ENRICH_STAKE_CACHE_MINUTES", 60)) * time.Minute,
+		FetchValidationData:      getEnv("FETCH_VALIDATION_DATA", "false") == "true",
+		BackfillSnapshotDir:      getEnv("BACKFILL_SNAPSHOT_DIR", ""),
+		BackfillRate:             getEnvFloat("BACKFILL_RATE", 1),
+		APIKey:                   getEnv("API_KEY", ""),
+		DebugEnabled:             getEnv("DEBUG_ENDPOINTS", "false") == "true",
+		MaxWhitelistAge:          time.Duration(getEnvInt("MAX_WHITELIST_AGE_SECONDS", 0)) * time.Second,
+		WhitelistStaleMode:       getEnv("WHITELIST_STALE_MODE", staleFail),
+	}
+	if getEnvInt("ELIGIBLE_STABLE_HOURS", 0) != 0 {
+		log.Printf("ELIGIBLE_STABLE_HOURS is no longer read; stability is counted in fetches, set ELIGIBLE_STABLE_FETCHES")
+	}
+	if config.WhitelistStaleMode != staleFail && config.WhitelistStaleMode != staleFlag {
+		log.Fatalf("Invalid WHITELIST_STALE_MODE %q (use %s or %s)", config.WhitelistStaleMode, staleFail, staleFlag)
+	}
+	// The whitelist changes at most once per fetch
+	whitelistAge := getEnvInt("CACHE_WHITELIST_MAX_AGE", config.IntervalMinutes*60)
+	config.WhitelistCache = newCachePolicy(whitelistAge, getEnvInt("CACHE_WHITELIST_S_MAXAGE", whitelistAge))
+	identityAge := getEnvInt("CACHE_IDENTITY_MAX_AGE", 60)
+	config.IdentityCache = newCachePolicy(identityAge, getEnvInt("CACHE_IDENTITY_S_MAXAGE", identityAge))
+
+	if value := os.Getenv("STAKE_TIERS"); value != "" {
+		config.StakeTiers, err = parseStakeTiers(value)
+		if err != nil {
+			log.Fatalf("Invalid STAKE_TIERS: %v", err)
+		}
+	}
+
+	config.MerkleHash, err = merkle.ParseHashAlgo(os.Getenv("MERKLE_HASH"))
+	if err != nil {
+		log.Fatalf("Invalid MERKLE_HASH: %v", err)
+	}
+
+	if value := os.Getenv("CLAIM_SIGNING_KEY"); value != "" {
+		if config.ClaimKey, err = parseClaimKey(value); err != nil {
+			log.Fatalf("Invalid CLAIM_SIGNING_KEY: %v", err)
+		}
+	}
+
+	if config.StakeAsString, err = parseStakeEncoding(os.Getenv("STAKE_ENCODING")); err != nil {
+		log.Fatalf("Invalid STAKE_ENCODING: %v", err)
+	}
+
+	if config.FieldCase, err = parseFieldCase(os.Getenv("JSON_FIELD_CASE")); err != nil {
+		log.Fatalf("Invalid JSON_FIELD_CASE: %v", err)
+	}
+
+	rules, err := loadEligibilityRules(os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid %v", err)
+	}
+	rules.apply(&config)
+
+	if value := os.Getenv("DISABLED_ENDPOINTS"); value != "" {
+		config.DisabledEndpoints, err = parseDisabledEndpoints(value)
+		if err != nil {
+			log.Fatalf("Invalid DISABLED_ENDPOINTS: %v", err)
+		}
+	}
+
+	config.RPCTLS = idenarpc.TLSOptions{
+		CAFile:             getEnv("IDENA_RPC_CA_FILE", ""),
+		CertFile:           getEnv("IDENA_RPC_CLIENT_CERT", ""),
+		KeyFile:            getEnv("IDENA_RPC_CLIENT_KEY", ""),
+		InsecureSkipVerify: getEnv("IDENA_RPC_INSECURE_SKIP_VERIFY", "false") == "true",
+	}
+	rpcHTTP, err := config.RPCTLS.HTTPClient(30 * time.Second)
+	if err != nil {
+		log.Fatalf("Invalid node TLS settings: %v", err)
+	}
+	if config.RPCTLS.InsecureSkipVerify {
+		log.Println("WARNING: IDENA_RPC_INSECURE_SKIP_VERIFY is set; the node's TLS certificate is NOT verified and RPC traffic can be intercepted")
+	}
+
+	// Every setting above is checked; the rest needs the node or database
+	if *validateConfig {
+		log.Println("Configuration is valid")
+		return
+	}
+
+	config.DBPath, err = pathtemplate.Expand(config.DBPath, pathtemplate.Vars{
+		Now: time.Now(),
+		EpochFunc: func() (int, error) {
+			client := idenarpc.NewClient(config.IdenaRPCURL, config.IdenaRPCKey, 30*time.Second)
+			client.HTTP = rpcHTTP
+			return client.Epoch(context.Background())
+		},
+	})
+	if err != nil {
+		log.Fatalf("Invalid DB_PATH: %v", err)
 	}
 
 	// Initialize database
-	db, err := initDB()
+	db, err := initDB(config.DBPath, config.DBBusyTimeout)
 	if err != nil {
 		log.Fatalf("Database initialization error: %v", err)
 	}
 	defer db.Close()
 
 	server := &Server{
-		db:     db,
-		config: config,
+		db:          db,
+		config:      config,
+		cache:       newLRUCache(config.CacheSize, config.CacheTTL),
+		eligibility: newEpochCache(config.EligibilityCacheSize),
+		rpcLimit:    newRPCLimiter(config.RPCRateLimit, config.RPCConcurrency),
+		rpcHTTP:     rpcHTTP,
+		rpcBreaker:  idenarpc.NewBreaker(config.RPCBreakerThreshold, config.RPCBreakerCooldown),
+		env:         env,
+	}
+	if config.EnrichStake {
+		server.stakeCache = newLRUCache(enrichStakeCacheSize, config.EnrichStakeTTL)
+	}
+	if config.AlertWebhookURL != "" {
+		server.alerts = newFetchAlerter(newWebhookNotifier(config.AlertWebhookURL), config.AlertAfterFailures)
+		if config.StakeAlerts {
+			server.stakeAlerts = newWebhookNotifier(config.AlertWebhookURL)
+		}
+	} else if config.StakeAlerts {
+		log.Println("STAKE_ALERTS is set but ALERT_WEBHOOK_URL is not; stake alerts disabled")
+	}
+
+	// "dry-verify" prints the whitelist root and exits, for release scripts
+	if flag.Arg(0) == "dry-verify" {
+		code := runDryVerify(server, os.Stdout, os.Stderr)
+		db.Close()
+		os.Exit(code)
+	}
+
+	// "onchain-diff <file>" compares the whitelist with the on-chain list
+	if flag.Arg(0) == "onchain-diff" {
+		if flag.Arg(1) == "" {
+			log.Fatal("Usage: onchain-diff <address-file>")
+		}
+		code := runOnchainDiff(server, flag.Arg(1), os.Stdout, os.Stderr)
+		db.Close()
+		os.Exit(code)
+	}
+
+	// "backfill <from> <to>" fills identity_history from past epochs and exits
+	if flag.Arg(0) == "backfill" {
+		from, errFrom := strconv.Atoi(flag.Arg(1))
+		to, errTo := strconv.Atoi(flag.Arg(2))
+		if errFrom != nil || errTo != nil {
+			log.Fatal("Usage: backfill <from-epoch> <to-epoch>")
+		}
+		added, err := server.runBackfill(context.Background(), from, to)
+		db.Close()
+		if err != nil {
+			log.Fatalf("Backfill failed after %d history rows: %v", added, err)
+		}
+		log.Printf("Backfill of epochs %d-%d added %d history rows", from, to, added)
+		return
+	}
+
+	if config.SourceFile != "" {
+		log.Printf("Indexing from %s instead of the node RPC", config.SourceFile)
+	}
+
+	if *seedPath != "" {
+		count, err := server.seedFromCSV(*seedPath)
+		if err != nil {
+			log.Fatalf("Seeding failed: %v", err)
+		}
+		log.Printf("Seeded %d identities from %s", count, *seedPath)
 	}
 
-	// Configure routes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The process that writes the history also prunes it
+	if config.Mode != "server" {
+		go server.runHistoryRetention(ctx)
+	}
+
+	switch config.Mode {
+	case "indexer":
+		log.Printf("Indexer %s (commit %s, built %s) started", version, commit, buildTime)
+		server.runIndexer(ctx)
+		return
+	case "server":
+		// API only; another process keeps the database up to date
+	default:
+		// Combined: fetch and serve from the same process and database
+		go server.runIndexer(ctx)
+	}
+
+	log.Printf("Server %s (commit %s, built %s) started on port %s", version, commit, buildTime, config.Port)
+	srv := &http.Server{Addr: ":" + config.Port, Handler: server.routes()}
+	if err := server.serve(ctx, srv); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// routes registers every HTTP endpoint of the server.
+func (s *Server) routes() *mux.Router {
 	router := mux.NewRouter()
-	
+	whitelist, identity := s.config.WhitelistCache, s.config.IdentityCache
+
 	// Authentication routes
-	router.HandleFunc("/signin", server.handleSignIn).Methods("GET")
-	router.HandleFunc("/callback", server.handleCallback).Methods("GET")
-	
+	if s.endpointEnabled(endpointsAuth) {
+		router.HandleFunc("/signin", cacheControl(noStore, s.handleSignIn)).Methods("GET")
+		router.HandleFunc("/callback", cacheControl(noStore, s.handleCallback)).Methods("GET")
+	}
+
 	// Whitelist routes
-	router.HandleFunc("/whitelist", server.handleWhitelist).Methods("GET")
-	router.HandleFunc("/whitelist/check", server.handleWhitelistCheck).Methods("GET")
-	
-	// Merkle root route (implemented)
-	router.HandleFunc("/merkle_root", server.handleMerkleRoot).Methods("GET")
-	
+	router.HandleFunc("/whitelist", cacheControl(whitelist, s.handleWhitelist)).Methods("GET")
+	router.HandleFunc("/whitelist/check", cacheControl(whitelist, s.handleWhitelistCheck)).Methods("GET")
+	// Lists override addresses for API key holders, so never cached
+	router.HandleFunc("/config/eligibility", cacheControl(noStore, s.handleEligibilityConfig)).Methods("GET")
+
+	// Merkle routes
+	if s.endpointEnabled(endpointsMerkle) {
+		router.HandleFunc("/whitelist/paginated-merkle", cacheControl(whitelist, s.handlePaginatedMerkle)).Methods("GET")
+		router.HandleFunc("/merkle_root", cacheControl(whitelist, s.handleMerkleRoot)).Methods("GET")
+		router.HandleFunc("/merkle_multiproof", s.handleMerkleMultiproof).Methods("POST")
+		router.HandleFunc("/claim/{address}", cacheControl(whitelist, s.handleClaim)).Methods("GET")
+	}
+
+	// Identity routes
+	router.HandleFunc("/identities/latest", cacheControl(identity, s.handleLatestIdentities)).Methods("GET")
+	router.HandleFunc("/identities/changed", cacheControl(identity, s.handleChangedIdentities)).Methods("GET")
+	router.HandleFunc("/identity/{address}", cacheControl(identity, s.handleSingleIdentity)).Methods("GET")
+	router.HandleFunc("/identity/{address}/events", s.handleIdentityEvents).Methods("GET")
+	router.HandleFunc("/state/{state}", cacheControl(identity, s.handleStateIdentities)).Methods("GET")
+	router.HandleFunc("/pool/{address}/stake", cacheControl(identity, s.handlePoolStake)).Methods("GET")
+	if s.endpointEnabled(endpointsExport) {
+		router.HandleFunc("/export", cacheControl(noStore, s.requireAPIKey(s.handleExport))).Methods("GET")
+	}
+	if s.endpointEnabled(endpointsAdmin) {
+		router.HandleFunc("/reconcile", cacheControl(noStore, s.requireAPIKey(s.handleReconcile))).Methods("GET")
+		router.HandleFunc("/overrides", cacheControl(noStore, s.requireAPIKey(s.handleListOverrides))).Methods("GET")
+		router.HandleFunc("/overrides", s.requireAPIKey(s.handleSetOverride)).Methods("POST")
+		router.HandleFunc("/overrides/{address}", s.requireAPIKey(s.handleDeleteOverride)).Methods("DELETE")
+		router.HandleFunc("/tags", cacheControl(noStore, s.requireAPIKey(s.handleListTags))).Methods("GET")
+		router.HandleFunc("/tags/{address}/{tag}", s.requireAPIKey(s.handleAddTag)).Methods("PUT")
+		router.HandleFunc("/tags/{address}/{tag}", s.requireAPIKey(s.handleDeleteTag)).Methods("DELETE")
+		router.HandleFunc("/admin/reload", cacheControl(noStore, s.requireAPIKey(s.handleReload))).Methods("POST")
+	}
+	if s.config.DebugEnabled {
+		router.HandleFunc("/debug/rpc/identity", cacheControl(noStore, s.requireAPIKey(s.handleDebugRPCIdentity))).Methods("GET")
+	}
+
 	// Status routes
-	router.HandleFunc("/health", server.handleHealth).Methods("GET")
+	router.HandleFunc("/health", cacheControl(noStore, s.handleHealth)).Methods("GET")
+	router.HandleFunc("/readyz", cacheControl(noStore, s.handleReady)).Methods("GET")
+	router.HandleFunc("/version", s.handleVersion).Methods("GET")
+
+	// Dashboard
+	router.HandleFunc("/stats", s.handleStats).Methods("GET")
+	router.HandleFunc("/stats/history", s.handleStatsHistory).Methods("GET")
+	router.HandleFunc("/stats/tiers", s.handleStatsTiers).Methods("GET")
+	router.Handle("/", dashboardHandler()).Methods("GET")
 
-	log.Printf("Server started on port %s", config.Port)
-	log.Fatal(http.ListenAndServe(":"+config.Port, router))
+	router.Use(limitInFlight(s.config.MaxInFlight))
+	router.Use(s.fieldCase)
+	// Inside fieldCase, so it finds stakes by their snake_case keys
+	router.Use(s.stakeEncoding)
+	return router
 }
 
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./identities.db")
+func initDB(path string, busyTimeout time.Duration) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", sqliteDSN(path, busyTimeout))
 	if err != nil {
 		return nil, err
 	}
@@ -104,18 +648,192 @@ func initDB() (*sql.DB, error) {
 	CREATE TABLE IF NOT EXISTS identities (
 		address TEXT PRIMARY KEY,
 		state TEXT NOT NULL,
-		stake REAL NOT NULL,
+		stake REAL,
 		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
-
-	CREATE INDEX IF NOT EXISTS idx_state ON identities(state);
-	CREATE INDEX IF NOT EXISTS idx_stake ON identities(stake);
-	CREATE INDEX IF NOT EXISTS idx_timestamp ON identities(timestamp);
 	`
 
-	_, err = db.Exec(createTables)
-	return db, err
+	if _, err := db.Exec(createTables); err != nil {
+		return db, err
+	}
+	return db, migrateDB(db)
+}
+
+// identityColumns lists columns added to identities after the initial
+// schema. migrateDB adds the missing ones so existing databases keep working.
+var identityColumns = []struct {
+	name       string
+	definition string
+}{
+	{"online", "INTEGER"},
+	{"flips_count", "INTEGER"},
+	{"delegatee", "TEXT"},
+	{"last_validation_epoch", "INTEGER"},
+}
+
+// identityIndexes are created after migrateDB has settled the identities
+// table, which may have been rebuilt.
+var identityIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS idx_state ON identities(state)`,
+	`CREATE INDEX IF NOT EXISTS idx_stake ON identities(stake)`,
+	`CREATE INDEX IF NOT EXISTS idx_timestamp ON identities(timestamp)`,
+	`CREATE INDEX IF NOT EXISTS idx_delegatee ON identities(delegatee)`,
+	`CREATE INDEX IF NOT EXISTS idx_last_validation_epoch ON identities(last_validation_epoch)`,
+}
+
+// schemaTables holds tables introduced after the initial schema. Each
+// statement must be idempotent.
+var schemaTables = []string{
+	`CREATE TABLE IF NOT EXISTS identity_history (
+		address TEXT NOT NULL,
+		state TEXT NOT NULL,
+		stake REAL NOT NULL,
+		changed_at INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_history_address ON identity_history(address, changed_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_history_changed_at ON identity_history(changed_at)`,
+	`CREATE TABLE IF NOT EXISTS stats_history (
+		recorded_at INTEGER NOT NULL,
+		total INTEGER NOT NULL,
+		eligible INTEGER NOT NULL,
+		total_stake REAL NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_stats_recorded_at ON stats_history(recorded_at)`,
+	`CREATE TABLE IF NOT EXISTS overrides (
+		address TEXT PRIMARY KEY,
+		kind TEXT NOT NULL CHECK (kind IN ('allow', 'deny')),
+		note TEXT,
+		created_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS tags (
+		address TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (address, tag)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag)`,
+}
+
+func migrateDB(db *sql.DB) error {
+	for _, stmt := range schemaTables {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	columns, err := tableColumns(db, "identities")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for _, col := range columns {
+		existing[col.name] = true
+	}
+
+	for _, col := range identityColumns {
+		if existing[col.name] {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE identities ADD COLUMN %s %s", col.name, col.definition)
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("adding column %s: %w", col.name, err)
+		}
+		columns = append(columns, tableColumn{name: col.name, definition: col.definition})
+	}
+
+	// Databases created before the node could report a null stake declared
+	// it NOT NULL, which SQLite can only drop by rebuilding the table
+	for _, col := range columns {
+		if col.name == "stake" && col.notNull {
+			if err := rebuildIdentitiesNullableStake(db, columns); err != nil {
+				return fmt.Errorf("allowing null stake: %w", err)
+			}
+			break
+		}
+	}
+
+	for _, stmt := range identityIndexes {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableColumn is a column as reported by PRAGMA table_info.
+type tableColumn struct {
+	name       string
+	definition string
+	notNull    bool
+	primaryKey bool
+}
+
+func tableColumns(db *sql.DB, table string) ([]tableColumn, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []tableColumn
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		definition := colType
+		if defaultValue.Valid {
+			definition += " DEFAULT " + defaultValue.String
+		}
+		columns = append(columns, tableColumn{
+			name:       name,
+			definition: definition,
+			notNull:    notNull == 1,
+			primaryKey: pk > 0,
+		})
+	}
+	return columns, rows.Err()
+}
+
+// rebuildIdentitiesNullableStake recreates identities with the same columns
+// and data but without NOT NULL on stake. Indexes are dropped with the old
+// table and recreated by migrateDB.
+func rebuildIdentitiesNullableStake(db *sql.DB, columns []tableColumn) error {
+	definitions := make([]string, len(columns))
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		definitions[i] = col.name + " " + col.definition
+		if col.primaryKey {
+			definitions[i] += " PRIMARY KEY"
+		}
+		if col.notNull && col.name != "stake" {
+			definitions[i] += " NOT NULL"
+		}
+		names[i] = col.name
+	}
+	list := strings.Join(names, ", ")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"ALTER TABLE identities RENAME TO identities_old",
+		"CREATE TABLE identities (" + strings.Join(definitions, ", ") + ")",
+		"INSERT INTO identities (" + list + ") SELECT " + list + " FROM identities_old",
+		"DROP TABLE identities_old",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (s *Server) handleSignIn(w http.ResponseWriter, r *http.Request) {
@@ -155,47 +873,135 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check eligibility
-	eligible, reason := s.checkEligibility(address)
+	check := s.evaluateEligibility(address)
 
 	response := map[string]interface{}{
 		"success":  true,
 		"address":  address,
-		"eligible": eligible,
-		"reason":   reason,
+		"eligible": check.Eligible,
+		"code":     check.Code,
+		"reason":   check.Reason,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// handleWhitelist serves the eligible addresses with an ETag derived from the
+// merkle root. A client sending a matching If-None-Match (or ?etag=) gets 304;
+// with ?wait=30s the request is held until the whitelist changes or the wait
+// runs out.
 func (s *Server) handleWhitelist(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.db.Query(`
-		SELECT address FROM identities 
-		WHERE state IN ('Human', 'Verified', 'Newbie') AND stake >= 10000
-		ORDER BY address
-	`)
+	wait, err := parseWait(r, s.whitelistMaxWait())
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view, ok := s.profileView(r)
+	if !ok {
+		http.Error(w, "Unknown profile", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	var addresses []string
-	for rows.Next() {
-		var address string
-		if err := rows.Scan(&address); err != nil {
-			continue
+	addresses, stale, err := view.whitelist()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if outdated, err := s.whitelistOutdated(); err != nil {
+		internalError(w, r, err)
+		return
+	} else if outdated && s.config.WhitelistStaleMode == staleFlag {
+		stale = true
+	} else if outdated {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Whitelist data is older than the maximum age", http.StatusServiceUnavailable)
+		return
+	}
+
+	root := view.whitelistTree(addresses).Root()
+	etag := whitelistETag(root)
+	if etagMatches(r, etag) && wait > 0 {
+		if !s.whitelistChanges.acquire(s.whitelistMaxWaiters()) {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Too many waiting clients", http.StatusServiceUnavailable)
+			return
+		}
+		addresses, stale, err = s.waitForWhitelistChange(r, view, etag, wait)
+		s.whitelistChanges.release()
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		root = view.whitelistTree(addresses).Root()
+		etag = whitelistETag(root)
+	}
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if queryBool(r, "checksum") {
+		checksummed := make([]string, len(addresses))
+		for i, address := range addresses {
+			checksummed[i] = toChecksumAddress(address)
 		}
-		addresses = append(addresses, address)
+		addresses = checksummed
 	}
 
 	response := WhitelistResponse{
 		Addresses: addresses,
 		Count:     len(addresses),
+		Stale:     stale,
+	}
+	var data interface{} = addresses
+	if queryBool(r, "verbose") {
+		since, err := view.stableSince("")
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		tags, err := s.tagsByAddress()
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		response.Entries = make([]WhitelistEntry, len(addresses))
+		for i, address := range addresses {
+			response.Entries[i].Address = address
+			if start, ok := since[strings.ToLower(address)]; ok {
+				response.Entries[i].StableSince = &start
+			}
+			response.Entries[i].Tags = tags[strings.ToLower(address)]
+		}
+		data = response.Entries
 	}
+	writeList(w, r, response, data, responseMeta{
+		Count:      len(addresses),
+		MerkleRoot: root,
+		Stale:      stale,
+	})
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// Modes of Config.WhitelistStaleMode
+const (
+	staleFail = "fail"
+	staleFlag = "flag"
+)
+
+// whitelistOutdated reports whether the last fetch is older than
+// Config.MaxWhitelistAge, or nothing was fetched yet.
+func (s *Server) whitelistOutdated() (bool, error) {
+	if s.config.MaxWhitelistAge <= 0 {
+		return false, nil
+	}
+	last, err := s.lastIndexed()
+	if err != nil {
+		return false, err
+	}
+	return last.IsZero() || time.Since(last) > s.config.MaxWhitelistAge, nil
 }
 
 func (s *Server) handleWhitelistCheck(w http.ResponseWriter, r *http.Request) {
@@ -204,138 +1010,1277 @@ func (s *Server) handleWhitelistCheck(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing address", http.StatusBadRequest)
 		return
 	}
+	address, err := normalizeAddress(address, queryBool(r, "strict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Profile views have no caches
+	view, ok := s.profileView(r)
+	if !ok {
+		http.Error(w, "Unknown profile", http.StatusBadRequest)
+		return
+	}
 
-	eligible, reason := s.checkEligibility(address)
+	var response EligibilityCheck
+	if check, ok := view.eligibility.get(address); ok {
+		response = check
+		w.Header().Set("X-Cache", "HIT")
+	} else if cached, ok := view.cache.get(eligibilityCacheKey(address)); ok {
+		response = cached.(EligibilityCheck)
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		response = view.evaluateEligibility(address)
+		if view.cache != nil && response.Code != codeDatabaseError {
+			view.cache.set(eligibilityCacheKey(address), response)
+			w.Header().Set("X-Cache", "MISS")
+		}
+		if view.eligibility != nil && epochCacheable(response) {
+			view.eligibility.set(address, response)
+			w.Header().Set("X-Cache", "MISS")
+		}
+	}
 
-	response := EligibilityCheck{
-		Address:  address,
-		Eligible: eligible,
-		Reason:   reason,
+	if queryBool(r, "checksum") {
+		address = toChecksumAddress(address)
 	}
+	response.Address = address
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
 func (s *Server) handleMerkleRoot(w http.ResponseWriter, r *http.Request) {
+	view, ok := s.profileView(r)
+	if !ok {
+		http.Error(w, "Unknown profile", http.StatusBadRequest)
+		return
+	}
 	// Get all eligible addresses
-	rows, err := s.db.Query(`
-		SELECT address FROM identities 
-		WHERE state IN ('Human', 'Verified', 'Newbie') AND stake >= 10000
-		ORDER BY address
-	`)
+	addresses, stale, err := view.whitelist()
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		internalError(w, r, err)
 		return
 	}
-	defer rows.Close()
-
-	var addresses []string
-	for rows.Next() {
-		var address string
-		if err := rows.Scan(&address); err != nil {
-			continue
-		}
-		addresses = append(addresses, address)
-	}
 
-	// Calculate merkle root
-	merkleRoot := calculateMerkleRoot(addresses)
+	// The tree /whitelist/paginated-merkle and /claim serve proofs from
+	tree := view.whitelistTree(addresses)
 
 	response := map[string]interface{}{
-		"merkle_root":    merkleRoot,
+		"merkle_root":     tree.Root(),
+		"hash_algorithm":  tree.HashAlgo(),
 		"addresses_count": len(addresses),
-		"timestamp":      time.Now().Unix(),
+		"timestamp":       time.Now().Unix(),
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	// Check database connection
-	err := s.db.Ping()
-	if err != nil {
-		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
-		return
+	if stale {
+		response["stale"] = true
 	}
 
-	response := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().Unix(),
-		"version":   "1.0.0",
+	// Breakdown of what went into the tree; skipped when the DB is down
+	if composition, err := s.whitelistComposition(addresses); err == nil {
+		response["by_state"] = composition.ByState
+		response["min_stake"] = composition.MinStake
+		response["total_stake"] = composition.TotalStake
+	} else {
+		log.Printf("Merkle root composition unavailable: %v", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) checkEligibility(address string) (bool, string) {
-	var state string
-	var stake float64
+// whitelistComposition summarizes a whitelist by identity state and stake.
+type whitelistComposition struct {
+	ByState    map[string]int
+	MinStake   float64
+	TotalStake float64
+}
 
-	err := s.db.QueryRow(
-		"SELECT state, stake FROM identities WHERE address = ?", 
-		address,
-	).Scan(&state, &stake)
+// unknownCompositionState counts the whitelisted addresses without a state
+// and stake to report: allowlisted addresses not indexed yet and identities
+// with a NULL stake. With it ByState adds up to the whitelist's size.
+const unknownCompositionState = "Unknown"
+
+func (s *Server) whitelistComposition(addresses []string) (whitelistComposition, error) {
+	composition := whitelistComposition{ByState: make(map[string]int)}
+	included := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		included[strings.ToLower(address)] = true
+	}
 
+	rows, err := s.db.Query("SELECT address, state, stake FROM identities")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, "Address not found in database"
-		}
-		return false, "Database error"
+		return composition, err
 	}
+	defer rows.Close()
 
-	// Check eligibility criteria
-	validStates := []string{"Human", "Verified", "Newbie"}
-	isValidState := false
-	for _, validState := range validStates {
-		if state == validState {
-			isValidState = true
-			break
+	indexed, counted := 0, 0
+	for rows.Next() {
+		var address, state string
+		var stake sql.NullFloat64
+		if err := rows.Scan(&address, &state, &stake); err != nil {
+			return composition, err
+		}
+		if !included[strings.ToLower(address)] {
+			continue
 		}
+		indexed++
+		if !stake.Valid {
+			composition.ByState[unknownCompositionState]++
+			continue
+		}
+		if counted == 0 || stake.Float64 < composition.MinStake {
+			composition.MinStake = stake.Float64
+		}
+		counted++
+		composition.ByState[state]++
+		composition.TotalStake += stake.Float64
 	}
-
-	if !isValidState {
-		return false, fmt.Sprintf("Ineligible state: %s", state)
+	if err := rows.Err(); err != nil {
+		return composition, err
 	}
+	if unindexed := len(included) - indexed; unindexed > 0 {
+		composition.ByState[unknownCompositionState] += unindexed
+	}
+	return composition, nil
+}
 
-	if stake < 10000 {
-		return false, fmt.Sprintf("Insufficient stake: %.2f iDNA (minimum 10,000)", stake)
+// handleLatestIdentities returns the current record of every identity, most
+// recently updated first. Clients sending Accept: application/x-ndjson (or
+// ?format=ndjson) get one JSON object per line, streamed row by row.
+// ?limit= pages the result, by ?offset= or, in address order, by the
+// ?after= cursor. ?sort= and ?order= pick another order.
+func (s *Server) handleLatestIdentities(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("limit") != "" || query.Get("offset") != "" || query.Get("after") != "" {
+		s.handleLatestIdentitiesPage(w, r)
+		return
 	}
 
-	return true, "Eligible"
-}
+	where, args, err := identityFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	present, err := s.identityPresenter(r)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if where != "" {
+		where = "WHERE " + where + " "
+	}
+	order, _, err := identityOrder(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := s.db.QueryContext(r.Context(),
+		"SELECT "+identitySelectColumns+" FROM identities "+where+order,
+		args...,
+	)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
 
-// Utility functions
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+	if wantsNDJSON(r) {
+		s.streamIdentities(w, rows, present)
+		return
 	}
-	return value
-}
 
-func generateSessionToken() string {
-	return fmt.Sprintf("token_%d", time.Now().UnixNano())
+	identities := make([]Identity, 0)
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			continue
+		}
+		present(&identity)
+		identities = append(identities, identity)
+	}
+	writeList(w, r, identities, identities, responseMeta{Count: len(identities)})
 }
 
-func verifySignature(address, token, signature string) bool {
-	// Simplified implementation - in production, verify cryptographic signature
-	return len(signature) > 0 && len(address) > 0
+// handleChangedIdentities returns the current record of every identity whose
+// state or stake changed after ?since=, for incremental syncing. since is an
+// RFC3339 timestamp or a duration relative to now, such as 1h.
+func (s *Server) handleChangedIdentities(w http.ResponseWriter, r *http.Request) {
+	since, err := parseTimeParam("since", r.URL.Query().Get("since"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	where, args, err := identityFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	present, err := s.identityPresenter(r)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if where != "" {
+		where = "AND " + where
+	}
+	rows, err := s.db.QueryContext(r.Context(), `
+		SELECT `+identitySelectColumns+` FROM identities
+		WHERE address IN (SELECT address FROM identity_history WHERE changed_at > ?) `+where+`
+		ORDER BY address`,
+		append([]interface{}{since.Unix()}, args...)...,
+	)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	identities := make([]Identity, 0)
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			continue
+		}
+		present(&identity)
+		identities = append(identities, identity)
+	}
+	writeList(w, r, identities, identities, responseMeta{Count: len(identities)})
 }
 
-func calculateMerkleRoot(addresses []string) string {
-	if len(addresses) == 0 {
-		return ""
+// identityFilter returns the conditions of the list filters, or "" when
+// none is set. ?validated_since_epoch=N keeps identities that last
+// validated in epoch N or later; identities with no validation on record
+// never match. ?tag= keeps those carrying the tag.
+func identityFilter(r *http.Request) (string, []interface{}, error) {
+	query := r.URL.Query()
+	var conditions []string
+	var args []interface{}
+	if value := query.Get("validated_since_epoch"); value != "" {
+		epoch, err := strconv.Atoi(value)
+		if err != nil || epoch < 0 {
+			return "", nil, fmt.Errorf("invalid validated_since_epoch")
+		}
+		conditions = append(conditions, "last_validation_epoch >= ?")
+		args = append(args, epoch)
 	}
-	
-	// Simplified merkle tree implementation
-	// In production, use complete implementation with SHA256 hashing
-	hash := ""
-	for _, addr := range addresses {
-		hash += addr
+	if value := query.Get("tag"); value != "" {
+		tag, ok := normalizeTag(value)
+		if !ok {
+			return "", nil, fmt.Errorf("invalid tag")
+		}
+		conditions = append(conditions, "address IN (SELECT address FROM tags WHERE tag = ?)")
+		args = append(args, tag)
 	}
-	
-	return fmt.Sprintf("merkle_%x", len(hash))
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// identitySortColumns maps the accepted ?sort= keys to their columns; only
+// these ever reach the query.
+var identitySortColumns = map[string]string{
+	"updated_at": "updated_at",
+	"stake":      "stake",
+	"state":      "state",
+	"address":    "address",
+}
+
+// identityOrder returns the ORDER BY clause for ?sort= and ?order=, by
+// default updated_at descending, with address breaking ties. Addresses
+// sort ascending by default, and are the default with ?after=. byAddress
+// reports whether rows are in ascending address order, the only order
+// ?after= cursors follow: unlike updated_at, which every fetch bumps, an
+// address never moves, so pages neither skip nor repeat rows.
+func identityOrder(r *http.Request) (clause string, byAddress bool, err error) {
+	query := r.URL.Query()
+	key := query.Get("sort")
+	if key == "" && query.Get("after") != "" {
+		key = "address"
+	} else if key == "" {
+		key = "updated_at"
+	}
+	column, ok := identitySortColumns[key]
+	if !ok {
+		return "", false, fmt.Errorf("invalid sort: use address, stake, state or updated_at")
+	}
+	direction := "DESC"
+	if column == "address" {
+		direction = "ASC"
+	}
+	switch query.Get("order") {
+	case "":
+	case "desc":
+		direction = "DESC"
+	case "asc":
+		direction = "ASC"
+	default:
+		return "", false, fmt.Errorf("invalid order: use asc or desc")
+	}
+	if column == "address" {
+		return "ORDER BY address " + direction, direction == "ASC", nil
+	}
+	return "ORDER BY " + column + " " + direction + ", address", false, nil
+}
+
+// parseTimeParam parses the named query value as an RFC3339 timestamp or a
+// Go duration counted back from now.
+func parseTimeParam(name, value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("%s parameter required", name)
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s: use an RFC3339 timestamp or a duration like 1h", name)
+	}
+	return now.Add(-d), nil
+}
+
+// Page sizes for /identities/latest
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// identityCursor is the position after the last row of a page. Rows are
+// ordered by address, so the cursor stays valid when other rows are
+// inserted or updated between requests.
+type identityCursor struct {
+	Address string `json:"a"`
+}
+
+func (c identityCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeIdentityCursor(value string) (identityCursor, error) {
+	var cursor identityCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil || cursor.Address == "" {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// handleLatestIdentitiesPage serves one page of /identities/latest. The
+// cursor for the following page, if any, is sent in X-Next-Cursor when
+// rows are in address order; other sorts page by offset only. Offset
+// pages also get Link headers and, with ?envelope=true, total and
+// next_offset in meta.
+func (s *Server) handleLatestIdentitiesPage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultPageLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	where, args, err := identityFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	present, err := s.identityPresenter(r)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	order, byAddress, err := identityOrder(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, filterArgs := where, append([]interface{}(nil), args...)
+	cursorPaged := query.Get("after") != ""
+	if value := query.Get("after"); value != "" {
+		if !byAddress {
+			http.Error(w, "after only works with sort=address; page with offset", http.StatusBadRequest)
+			return
+		}
+		cursor, err := decodeIdentityCursor(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if where != "" {
+			where += " AND "
+		}
+		where += "address > ?"
+		args = append(args, cursor.Address)
+	}
+	if where != "" {
+		where = "WHERE " + where
+	}
+
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	meta := responseMeta{}
+	if !cursorPaged {
+		if filter != "" {
+			filter = "WHERE " + filter
+		}
+		var total int
+		if err := s.db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM identities "+filter, filterArgs...).Scan(&total); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		setPageLinks(w, r, offset, limit, total)
+		meta.Total = &total
+		if next, ok := nextOffset(offset, limit, total); ok {
+			meta.NextOffset = &next
+		}
+	}
+
+	// One extra row tells whether there is a next page
+	args = append(args, limit+1, offset)
+	rows, err := s.db.QueryContext(r.Context(),
+		"SELECT "+identitySelectColumns+" FROM identities "+where+" "+order+" LIMIT ? OFFSET ?",
+		args...,
+	)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	identities := make([]Identity, 0, limit)
+	var next identityCursor
+	hasMore := false
+	for rows.Next() {
+		if len(identities) == limit {
+			hasMore = true
+			break
+		}
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			continue
+		}
+		// The cursor holds the stored address, before ?checksum=true
+		next = identityCursor{Address: identity.Address}
+		present(&identity)
+		identities = append(identities, identity)
+	}
+
+	if hasMore && byAddress {
+		w.Header().Set("X-Next-Cursor", next.encode())
+		if cursorPaged {
+			setCursorLink(w, r, next.encode())
+		}
+	}
+	meta.Count = len(identities)
+	writeList(w, r, identities, identities, meta)
+}
+
+// identityPresenter returns a function that fills in the derived and
+// optional fields of an identity response: tier always, the checksummed
+// address with ?checksum=true, stake_display with ?format_stake=true and
+// tags with ?verbose=true. It reads the tags up front, so call it before
+// querying the identities.
+func (s *Server) identityPresenter(r *http.Request) (func(*Identity), error) {
+	checksum := queryBool(r, "checksum")
+	formatStake := queryBool(r, "format_stake")
+	tiers := s.stakeTiers()
+	var tags map[string][]string
+	if queryBool(r, "verbose") {
+		var err error
+		if tags, err = s.tagsByAddress(); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(identity *Identity) {
+		if tags != nil {
+			identity.Tags = tags[strings.ToLower(identity.Address)]
+		}
+		if !identity.StakeUnknown {
+			identity.Tier = tiers.classify(float64(identity.Stake))
+		}
+		if checksum {
+			identity.Address = toChecksumAddress(identity.Address)
+		}
+		if formatStake && !identity.StakeUnknown {
+			identity.StakeDisplay = formatIDNA(float64(identity.Stake))
+		}
+	}, nil
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// streamIdentities writes rows as NDJSON, flushing after each line so no
+// more than one row is held in memory.
+func (s *Server) streamIdentities(w http.ResponseWriter, rows *sql.Rows, present func(*Identity)) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			continue
+		}
+		present(&identity)
+		data, err := s.marshalJSON(identity)
+		if err != nil {
+			continue
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			// Client went away
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("NDJSON stream aborted: %v", err)
+	}
+}
+
+func (s *Server) handleSingleIdentity(w http.ResponseWriter, r *http.Request) {
+	address, err := normalizeAddress(mux.Vars(r)["address"], queryBool(r, "strict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	present, err := s.identityPresenter(r)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	if cached, ok := s.cache.get(identityCacheKey(address)); ok {
+		identity := cached.(Identity)
+		present(&identity)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache", "HIT")
+		json.NewEncoder(w).Encode(identity)
+		return
+	}
+
+	identity, err := scanIdentity(s.db.QueryRow(
+		"SELECT "+identitySelectColumns+" FROM identities WHERE address = ?",
+		address,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if s.cache != nil {
+		s.cache.set(identityCacheKey(address), identity)
+		w.Header().Set("X-Cache", "MISS")
+	}
+	present(&identity)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identity)
+}
+
+func (s *Server) handleStateIdentities(w http.ResponseWriter, r *http.Request) {
+	state := mux.Vars(r)["state"]
+
+	where, args, err := identityFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	present, err := s.identityPresenter(r)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if where != "" {
+		where = "AND " + where + " "
+	}
+	rows, err := s.db.Query(
+		"SELECT "+identitySelectColumns+" FROM identities WHERE state = ? "+where+"ORDER BY address",
+		append([]interface{}{state}, args...)...,
+	)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	identities := make([]Identity, 0)
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			continue
+		}
+		present(&identity)
+		identities = append(identities, identity)
+	}
+	writeList(w, r, identities, identities, responseMeta{Count: len(identities)})
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	// Check database connection
+	err := s.db.Ping()
+	if err != nil {
+		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":     "healthy",
+		"timestamp":  time.Now().Unix(),
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	}
+	if s.rpcBreaker != nil {
+		response["rpc_circuit"] = s.rpcBreaker.State()
+		response["rpc_consecutive_failures"] = s.rpcBreaker.Failures()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// lastIndexed returns when identities were last fetched: by this process,
+// or else, as in MODE=server, the newest identities.updated_at written by
+// the indexer. It is zero when nothing was fetched yet.
+func (s *Server) lastIndexed() (time.Time, error) {
+	if last := s.fetches.lastFetch(); !last.IsZero() {
+		return last, nil
+	}
+	var updated sql.NullInt64
+	err := s.db.QueryRow("SELECT CAST(strftime('%s', MAX(updated_at)) AS INTEGER) FROM identities").Scan(&updated)
+	if err != nil || !updated.Valid {
+		return time.Time{}, err
+	}
+	return time.Unix(updated.Int64, 0), nil
+}
+
+// handleReady reports whether the server can serve fresh data. It fails
+// while whitelist reads are degraded, even though they still return 200,
+// and once the last fetch is more than Config.MaxStaleness old.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"status":    "ready",
+		"timestamp": time.Now().Unix(),
+	}
+	status := http.StatusOK
+
+	if err := s.db.Ping(); err != nil {
+		response["status"] = "not ready"
+		response["reason"] = "database unavailable"
+		status = http.StatusServiceUnavailable
+	} else if s.degraded() && !s.recoverWhitelist() {
+		response["status"] = "not ready"
+		response["reason"] = "database errors, serving stale whitelist"
+		status = http.StatusServiceUnavailable
+	} else if s.config.MaxStaleness > 0 {
+		response["max_staleness_seconds"] = int(s.config.MaxStaleness / time.Second)
+		last, err := s.lastIndexed()
+		switch {
+		case err != nil:
+			response["status"] = "not ready"
+			response["reason"] = "database unavailable"
+			status = http.StatusServiceUnavailable
+		case last.IsZero():
+			response["status"] = "not ready"
+			response["reason"] = "no identities fetched yet"
+			status = http.StatusServiceUnavailable
+		default:
+			since := time.Since(last)
+			response["seconds_since_fetch"] = int(since / time.Second)
+			if since > s.config.MaxStaleness {
+				response["status"] = "not ready"
+				response["reason"] = "last fetch older than max staleness"
+				status = http.StatusServiceUnavailable
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	response := map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// eligibleAddresses returns the sorted addresses currently meeting the
+// eligibility criteria, with the operator's overrides applied. The result
+// is shared with other callers and must not be modified.
+func (s *Server) eligibleAddresses() ([]string, error) {
+	if addresses, ok := s.eligible.get(); ok {
+		return addresses, nil
+	}
+	return s.loadEligibleAddresses()
+}
+
+// loadEligibleAddresses computes eligibleAddresses from the table.
+func (s *Server) loadEligibleAddresses() ([]string, error) {
+	states := s.eligibleStates()
+	args := make([]interface{}, len(states))
+	for i, state := range states {
+		args[i] = state
+	}
+	where := "WHERE state IN (" + placeholders(len(states)) + ") AND stake IS NOT NULL"
+	if condition, conditionArgs := s.recentValidationCondition(); condition != "" {
+		where += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	// The candidates bound the result, so the slice is allocated once
+	var candidates int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM identities "+where, args...).Scan(&candidates); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("SELECT address, state, stake FROM identities "+where+" ORDER BY address", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := make([]string, 0, candidates)
+	for rows.Next() {
+		var address, state string
+		var stake float64
+		if err := rows.Scan(&address, &state, &stake); err != nil {
+			continue
+		}
+		if stake >= s.minStake(state) {
+			addresses = append(addresses, address)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if addresses, err = s.filterStable(addresses); err != nil {
+		return nil, err
+	}
+
+	if s.config.GracePeriod > 0 {
+		graced, err := s.graceAddresses()
+		if err != nil {
+			return nil, err
+		}
+		if len(graced) > 0 {
+			addresses = append(addresses, graced...)
+			sort.Strings(addresses)
+		}
+	}
+	return s.applyOverrides(addresses)
+}
+
+// graceAddresses returns Suspended/Zombie identities with enough stake that
+// are still inside their grace period.
+func (s *Server) graceAddresses() ([]string, error) {
+	query := `
+		SELECT address, state, stake FROM identities
+		WHERE state IN ('Suspended', 'Zombie') AND stake IS NOT NULL`
+	condition, args := s.recentValidationCondition()
+	if condition != "" {
+		query += " AND " + condition
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for rows.Next() {
+		var address, state string
+		var stake float64
+		if err := rows.Scan(&address, &state, &stake); err != nil {
+			continue
+		}
+		if stake >= s.minStake(state) {
+			candidates = append(candidates, address)
+		}
+	}
+	rows.Close()
+
+	now := time.Now()
+	var graced []string
+	for _, address := range candidates {
+		ok, err := s.inGracePeriod(address, now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			graced = append(graced, address)
+		}
+	}
+	return graced, nil
+}
+
+// whitelist wraps eligibleAddresses with graceful degradation: once the
+// database has failed DegradeAfterErrors times in a row, the last good
+// whitelist is returned with stale set instead of an error.
+func (s *Server) whitelist() (addresses []string, stale bool, err error) {
+	addresses, err = s.eligibleAddresses()
+
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+
+	if err == nil {
+		s.health.failures = 0
+		s.health.lastWhitelist = addresses
+		s.health.haveWhitelist = true
+		return addresses, false, nil
+	}
+
+	s.health.failures++
+	log.Printf("Whitelist query failed (%d consecutive): %v", s.health.failures, err)
+	if s.health.failures >= s.degradeAfterErrors() && s.health.haveWhitelist {
+		return s.health.lastWhitelist, true, nil
+	}
+	return nil, false, err
+}
+
+func (s *Server) degradeAfterErrors() int {
+	if s.config.DegradeAfterErrors > 0 {
+		return s.config.DegradeAfterErrors
+	}
+	return defaultDegradeAfterErrors
+}
+
+// degraded reports whether whitelist reads are currently served stale.
+func (s *Server) degraded() bool {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	return s.health.failures >= s.degradeAfterErrors()
+}
+
+// recoverWhitelist retries the whitelist read while degraded and reports
+// whether it succeeded, which ends degraded mode. A ping alone can't tell:
+// a locked database or a failing query still answers it.
+func (s *Server) recoverWhitelist() bool {
+	_, stale, err := s.whitelist()
+	return err == nil && !stale
+}
+
+// reasonDatabaseError is returned by checkEligibility when the lookup itself
+// failed; such results are never cached.
+const reasonDatabaseError = "Database error"
+
+func (s *Server) checkEligibility(address string) (bool, string) {
+	check := s.evaluateEligibility(address)
+	return check.Eligible, check.Reason
+}
+
+// evaluateEligibility is checkEligibility with the result's code; Address
+// is left to the caller.
+func (s *Server) evaluateEligibility(address string) EligibilityCheck {
+	dbError := EligibilityCheck{Code: codeDatabaseError, Reason: reasonDatabaseError}
+	if eligible, reason, ok, err := s.override(address); err != nil {
+		return dbError
+	} else if ok && eligible {
+		return EligibilityCheck{Eligible: true, Code: codeOK, Reason: reason}
+	} else if ok {
+		return EligibilityCheck{Code: codeDenylisted, Reason: reason}
+	}
+
+	var state string
+	var stake sql.NullFloat64
+	var lastValidation sql.NullInt64
+
+	err := s.db.QueryRow(
+		"SELECT state, stake, last_validation_epoch FROM identities WHERE address = ?", 
+		address,
+	).Scan(&state, &stake, &lastValidation)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return EligibilityCheck{Code: codeNotFound, Reason: "Address not found in database"}
+		}
+		return dbError
+	}
+
+	// Check eligibility criteria
+	isValidState := s.isEligibleState(state)
+
+	inGrace := false
+	if !isValidState && graceStates[state] && s.config.GracePeriod > 0 {
+		inGrace, err = s.inGracePeriod(address, time.Now())
+		if err != nil {
+			return dbError
+		}
+	}
+
+	if !isValidState && !inGrace {
+		return EligibilityCheck{Code: codeIneligibleState, Reason: fmt.Sprintf("Ineligible state: %s", state)}
+	}
+
+	// A missing stake is not a zero stake: the node simply didn't report it
+	if !stake.Valid {
+		return EligibilityCheck{Code: codeStakeUnknown, Reason: "Stake unknown"}
+	}
+	if minimum := s.minStake(state); stake.Float64 < minimum {
+		return EligibilityCheck{Code: codeInsufficientStake,
+			Reason: insufficientStakeReason(stake.Float64, minimum, state, s.rules().StateThresholds)}
+	}
+
+	if recent, reason, err := s.checkRecentValidation(lastValidation); err != nil {
+		return dbError
+	} else if !recent {
+		return EligibilityCheck{Code: codeNotRecentlyValidated, Reason: reason}
+	}
+
+	if !inGrace && s.config.StableFetches > 0 {
+		stable, reason, err := s.checkStable(address)
+		if err != nil {
+			return dbError
+		}
+		if !stable {
+			return EligibilityCheck{Code: codeNotYetStable, Reason: reason}
+		}
+	}
+
+	if inGrace {
+		return EligibilityCheck{Eligible: true, Code: codeOK, Reason: fmt.Sprintf("Eligible: %s within grace period", state), inGrace: true}
+	}
+	return EligibilityCheck{Eligible: true, Code: codeOK, Reason: "Eligible"}
+}
+
+// eligibleStates are the identity states that qualify without conditions.
+var eligibleStates = []string{"Human", "Verified", "Newbie"}
+
+// graceStates are temporary states an identity can recover from. They stay
+// eligible for Config.GracePeriod after leaving an eligible state.
+var graceStates = map[string]bool{"Suspended": true, "Zombie": true}
+
+// eligibleStates returns the states that qualify, Config.EligibleStates
+// or the package default.
+func (s *Server) eligibleStates() []string {
+	if states := s.rules().EligibleStates; states != nil {
+		return states
+	}
+	return eligibleStates
+}
+
+func (s *Server) isEligibleState(state string) bool {
+	for _, validState := range s.eligibleStates() {
+		if state == validState {
+			return true
+		}
+	}
+	return false
+}
+
+// inGracePeriod reports whether address left an eligible state less than
+// Config.GracePeriod before now, according to identity_history. Identities
+// with no eligible state on record get no grace.
+func (s *Server) inGracePeriod(address string, now time.Time) (bool, error) {
+	states := s.eligibleStates()
+	args := []interface{}{address, address}
+	for _, state := range states {
+		args = append(args, state)
+	}
+	var leftAt sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT MIN(changed_at) FROM identity_history
+		WHERE address = ? AND changed_at > (
+			SELECT MAX(changed_at) FROM identity_history
+			WHERE address = ? AND state IN (`+placeholders(len(states))+`)
+		)
+	`, args...).Scan(&leftAt)
+	if err != nil {
+		return false, err
+	}
+	if !leftAt.Valid {
+		return false, nil
+	}
+	return now.Sub(time.Unix(leftAt.Int64, 0)) <= s.config.GracePeriod, nil
+}
+
+// updateDatabase upserts the given identities and drops any cached lookups
+// for them, so readers never see data older than the last write.
+func (s *Server) updateDatabase(identities []Identity) error {
+	_, err := s.storeIdentities(identities)
+	return err
+}
+
+// storeIdentities does the work of updateDatabase and returns how many
+// identities changed state or stake.
+func (s *Server) storeIdentities(identities []Identity) (int, error) {
+	now := time.Now().Unix()
+	var changes int
+	var events []IdentityEvent
+	var crossings []stakeCrossing
+	err := s.writeTx(func(tx *sql.Tx) error {
+		// A retried transaction starts over
+		changes, events, crossings = 0, nil, nil
+		stmt, err := tx.Prepare(`
+			INSERT INTO identities (address, state, stake, online, flips_count, delegatee, last_validation_epoch, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(address) DO UPDATE SET
+				state = excluded.state,
+				stake = excluded.stake,
+				online = COALESCE(excluded.online, identities.online),
+				flips_count = COALESCE(excluded.flips_count, identities.flips_count),
+				delegatee = excluded.delegatee,
+				last_validation_epoch = excluded.last_validation_epoch,
+				updated_at = CURRENT_TIMESTAMP
+		`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, identity := range identities {
+			address := strings.ToLower(identity.Address)
+
+			// Record a history row whenever state or stake changes
+			var prevState string
+			var prevStake sql.NullFloat64
+			err := tx.QueryRow("SELECT state, stake FROM identities WHERE address = ?", address).Scan(&prevState, &prevStake)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			stake := sql.NullFloat64{Float64: float64(identity.Stake), Valid: !identity.StakeUnknown}
+			changed := err == sql.ErrNoRows || prevState != identity.State || prevStake != stake
+			if err == sql.ErrNoRows && s.config.MaxIdentities > 0 {
+				unchanged, historyErr := unchangedSinceEviction(tx, address, identity)
+				if historyErr != nil {
+					return historyErr
+				}
+				changed = !unchanged
+			}
+			if err == nil && prevStake.Valid && stake.Valid {
+				threshold := s.minStake(identity.State)
+				if direction := crossingDirection(prevStake.Float64, stake.Float64, threshold); direction != "" {
+					crossings = append(crossings, stakeCrossing{Address: address, State: identity.State,
+						OldStake: prevStake.Float64, NewStake: stake.Float64, Threshold: threshold, Direction: direction})
+				}
+			}
+
+			delegatee := sql.NullString{String: strings.ToLower(identity.Delegatee), Valid: identity.Delegatee != ""}
+			if _, err := stmt.Exec(address, identity.State, stake,
+				identity.Online, identity.FlipsCount, delegatee, identity.LastValidationEpoch); err != nil {
+				return err
+			}
+			if changed {
+				changes++
+				events = append(events, IdentityEvent{Address: address, State: identity.State,
+					Stake: identity.Stake, StakeUnknown: identity.StakeUnknown, ChangedAt: time.Unix(now, 0).UTC()})
+				// History keeps its NOT NULL stake; an unknown stake is recorded as 0
+				if _, err := tx.Exec(
+					"INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, ?, ?, ?)",
+					address, identity.State, identity.Stake, now,
+				); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Snapshot the totals for /stats/history (grace periods, stability
+		// and overrides not applied)
+		eligible, args := s.eligibleStakeCondition()
+		if condition, conditionArgs := s.recentValidationCondition(); condition != "" {
+			eligible += " AND " + condition
+			args = append(args, conditionArgs...)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO stats_history (recorded_at, total, eligible, total_stake)
+			SELECT ?, COUNT(*),
+				COALESCE(SUM(CASE WHEN `+eligible+` THEN 1 ELSE 0 END), 0),
+				COALESCE(SUM(stake), 0)
+			FROM identities`, append([]interface{}{now}, args...)...,
+		)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, identity := range identities {
+		s.cache.invalidateAddress(strings.ToLower(identity.Address))
+		s.eligibility.remove(strings.ToLower(identity.Address))
+	}
+	if changes > 0 {
+		s.rebuildMerkleTree()
+		s.whitelistChanges.broadcast()
+	}
+	for _, event := range events {
+		s.watchers.publish(event)
+	}
+	s.reportStakeCrossings(crossings)
+	return changes, nil
+}
+
+// identitySelectColumns matches the scan order of scanIdentity.
+const identitySelectColumns = "address, state, stake, online, flips_count, delegatee, last_validation_epoch, updated_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanIdentity scans identitySelectColumns, followed by any extra columns
+// into extra.
+func scanIdentity(row rowScanner, extra ...interface{}) (Identity, error) {
+	var identity Identity
+	var online sql.NullBool
+	var flipsCount sql.NullInt64
+	var stake sql.NullFloat64
+	var delegatee sql.NullString
+	var lastValidation sql.NullInt64
+
+	dest := append([]interface{}{&identity.Address, &identity.State, &stake,
+		&online, &flipsCount, &delegatee, &lastValidation, &identity.Timestamp}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return identity, err
+	}
+
+	if online.Valid {
+		identity.Online = &online.Bool
+	}
+	if flipsCount.Valid {
+		count := int(flipsCount.Int64)
+		identity.FlipsCount = &count
+	}
+	identity.Stake = stakeAmount(stake.Float64)
+	identity.StakeUnknown = !stake.Valid
+	identity.Delegatee = delegatee.String
+	if lastValidation.Valid {
+		epoch := int(lastValidation.Int64)
+		identity.LastValidationEpoch = &epoch
+	}
+	return identity, nil
+}
+
+// Utility functions
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// formatIDNA formats a stake with two decimals and thousands separators,
+// e.g. 15000 as "15,000.00 iDNA".
+func formatIDNA(stake float64) string {
+	digits := strconv.FormatFloat(stake, 'f', 2, 64)
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	whole, fraction := digits[:len(digits)-3], digits[len(digits)-3:]
+
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return sign + grouped.String() + fraction + " iDNA"
+}
+
+// queryBool reports whether the named query parameter is set to a true value.
+func queryBool(r *http.Request, name string) bool {
+	value, _ := strconv.ParseBool(r.URL.Query().Get(name))
+	return value
+}
+
+// toChecksumAddress returns the EIP-55 mixed-case form of a hex address.
+func toChecksumAddress(address string) string {
+	lower := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(address, "0x"), "0X"))
+	hash := hex.EncodeToString(crypto.Keccak256([]byte(lower)))
+
+	out := []byte("0x" + lower)
+	for i := 0; i < len(lower) && i < len(hash); i++ {
+		if lower[i] >= 'a' && lower[i] <= 'f' && hash[i] >= '8' {
+			out[i+2] = lower[i] - 'a' + 'A'
+		}
+	}
+	return string(out)
+}
+
+// isChecksumAddress reports whether address is a 20-byte hex address
+// written exactly in its EIP-55 checksummed form.
+func isChecksumAddress(address string) bool {
+	if len(address) != 42 || !strings.HasPrefix(address, "0x") {
+		return false
+	}
+	if _, err := hex.DecodeString(address[2:]); err != nil {
+		return false
+	}
+	return address == toChecksumAddress(address)
+}
+
+// normalizeAddress returns the lowercase 0x-prefixed form used for storage
+// and lookups. Pasted variants resolve to it: surrounding spaces, a missing
+// or uppercase 0X prefix and any letter case. Anything but 40 hex digits is
+// an error. In strict mode the input must carry a valid EIP-55 checksum.
+func normalizeAddress(address string, strict bool) (string, error) {
+	address = strings.TrimSpace(address)
+	if strict && !isChecksumAddress(address) {
+		return "", fmt.Errorf("Invalid EIP-55 checksum for address %s", address)
+	}
+	digits := address
+	if len(digits) >= 2 && (digits[:2] == "0x" || digits[:2] == "0X") {
+		digits = digits[2:]
+	}
+	if len(digits) != 40 {
+		return "", fmt.Errorf("Invalid address %q: expected 40 hex digits, with or without 0x", address)
+	}
+	if _, err := hex.DecodeString(digits); err != nil {
+		return "", fmt.Errorf("Invalid address %q: not hexadecimal", address)
+	}
+	return "0x" + strings.ToLower(digits), nil
+}
+
+func generateSessionToken() string {
+	return fmt.Sprintf("token_%d", time.Now().UnixNano())
+}
+
+func verifySignature(address, token, signature string) bool {
+	// Simplified implementation - in production, verify cryptographic signature
+	return len(signature) > 0 && len(address) > 0
 }
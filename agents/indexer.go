@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"idenauthgo/internal/idenarpc"
+)
+
+// nodeIdentity is an identity as returned by the node.
+type nodeIdentity struct {
+	Address string    `json:"address"`
+	State   string    `json:"state"`
+	Stake   nodeStake `json:"stake"`
+	// Delegatee is the pool the identity delegates to, if any
+	Delegatee string `json:"delegatee"`
+	// LastValidationEpoch is nil for identities that never validated
+	LastValidationEpoch *int `json:"lastValidationEpoch"`
+	// Online and MadeFlips are nil when the node leaves them out
+	Online    *bool `json:"online"`
+	MadeFlips *int  `json:"madeFlips"`
+}
+
+// nodeStake is a stake the node encodes as a decimal string. Candidates and
+// killed identities may come with a null or missing stake, which is kept
+// apart from a real zero: Known is false and Value 0. It also scans the
+// nullable identities.stake column.
+type nodeStake struct {
+	Value float64
+	Known bool
+}
+
+func (s *nodeStake) UnmarshalJSON(data []byte) error {
+	*s = nodeStake{}
+	if string(data) == "null" {
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("stake must be a decimal string: %v", err)
+	}
+	if value == "" {
+		return nil
+	}
+	stake, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid stake %q", value)
+	}
+	*s = nodeStake{Value: stake, Known: true}
+	return nil
+}
+
+func (s *nodeStake) Scan(src interface{}) error {
+	var stake sql.NullFloat64
+	if err := stake.Scan(src); err != nil {
+		return err
+	}
+	*s = nodeStake{Value: stake.Float64, Known: stake.Valid}
+	return nil
+}
+
+// identitiesPage is one page of a paginated dna_identities response. Nodes
+// that don't paginate return a bare array instead.
+type identitiesPage struct {
+	Identities        []nodeIdentity `json:"identities"`
+	ContinuationToken string         `json:"continuationToken"`
+	Total             int            `json:"total"`
+}
+
+// maxIdentityPages guards against a node handing out tokens forever.
+const maxIdentityPages = 10000
+
+// fetchStatus records when the indexer last completed a fetch.
+type fetchStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+}
+
+func (f *fetchStatus) recordSuccess(at time.Time) {
+	f.mu.Lock()
+	f.lastSuccess = at
+	f.mu.Unlock()
+}
+
+func (f *fetchStatus) lastFetch() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastSuccess
+}
+
+// rpcClient returns a client for the configured node, sharing the
+// server's TLS settings and circuit breaker.
+func (s *Server) rpcClient() *idenarpc.Client {
+	client := idenarpc.NewClient(s.config.IdenaRPCURL, s.config.IdenaRPCKey, 30*time.Second)
+	if s.rpcHTTP != nil {
+		client.HTTP = s.rpcHTTP
+	}
+	client.Breaker = s.rpcBreaker
+	return client
+}
+
+func (s *Server) fetchIdentitiesPage(ctx context.Context, token string) (identitiesPage, error) {
+	var params []interface{}
+	if token != "" {
+		params = append(params, map[string]string{"continuationToken": token})
+	}
+
+	release, err := s.rpcLimit.acquire(ctx)
+	if err != nil {
+		return identitiesPage{}, err
+	}
+	var raw json.RawMessage
+	err = s.rpcClient().Call(ctx, "dna_identities", params, &raw)
+	release()
+	if err != nil {
+		return identitiesPage{}, err
+	}
+	return decodeIdentitiesPage(raw, s.config.StrictDecoding)
+}
+
+// decodeIdentitiesPage decodes a dna_identities result, paginated or not.
+// Unless strict, a result that does not decode is logged and handed to
+// decodeIdentitiesTolerant, so a change in the node's response shape
+// loses only the fields it renamed rather than the whole fetch.
+func decodeIdentitiesPage(raw []byte, strict bool) (identitiesPage, error) {
+	page, err := decodeIdentitiesStrict(raw)
+	if err == nil || strict {
+		return page, err
+	}
+	tolerant, skipped, ok := decodeIdentitiesTolerant(raw)
+	if !ok {
+		log.Printf("Unexpected dna_identities payload (%v), no identities found; sample: %s", err, payloadSample(raw))
+		return page, err
+	}
+	log.Printf("Unexpected dna_identities payload (%v), decoded tolerantly: %d identities kept, %d skipped; sample: %s",
+		err, len(tolerant.Identities), skipped, payloadSample(raw))
+	return tolerant, nil
+}
+
+// decodeIdentitiesStrict decodes the documented shapes only. Besides
+// syntax and type errors it rejects the renames json.Unmarshal would let
+// through silently: an object without "identities" and identities without
+// an address or a state.
+func decodeIdentitiesStrict(raw []byte) (identitiesPage, error) {
+	var page identitiesPage
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		// Single, unpaginated response
+		if err := json.Unmarshal(trimmed, &page.Identities); err != nil {
+			return page, err
+		}
+	} else {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return page, err
+		}
+		if _, ok := fields["identities"]; !ok {
+			return page, errors.New("result has no identities field")
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return page, err
+		}
+	}
+	for i, identity := range page.Identities {
+		if identity.Address == "" {
+			return page, fmt.Errorf("identity %d has no address", i)
+		}
+		if identity.State == "" {
+			return page, fmt.Errorf("identity %s has no state", identity.Address)
+		}
+	}
+	return page, nil
+}
+
+// readSourceFile loads the identities from a node dump at path: the
+// dna_identities result itself (an array or a page object) or a whole
+// JSON-RPC response carrying it. The file is read again on every pass so a
+// refreshed dump is picked up.
+func readSourceFile(path string, strict bool) ([]nodeIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var response idenarpc.Response
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &response); err == nil && len(response.Result) > 0 {
+			data = response.Result
+		}
+	}
+	page, err := decodeIdentitiesPage(data, strict)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return page.Identities, nil
+}
+
+// fetchAllIdentities pulls every identity from the node, following
+// continuation tokens. When the node reports a total and uses numeric
+// (offset) tokens, the remaining pages are fetched concurrently, up to
+// Config.PageConcurrency at a time.
+func (s *Server) fetchAllIdentities(ctx context.Context) ([]nodeIdentity, error) {
+	first, err := s.fetchIdentitiesPage(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	identities := first.Identities
+	if first.ContinuationToken == "" {
+		return identities, nil
+	}
+
+	offset, numeric := strconv.Atoi(first.ContinuationToken)
+	if s.config.PageConcurrency > 1 && numeric == nil && first.Total > 0 && len(first.Identities) > 0 {
+		rest, err := s.fetchPagesConcurrently(ctx, offset, len(first.Identities), first.Total)
+		if err != nil {
+			return nil, err
+		}
+		return append(identities, rest...), nil
+	}
+
+	token := first.ContinuationToken
+	for pages := 1; token != ""; pages++ {
+		if pages >= maxIdentityPages {
+			return nil, fmt.Errorf("dna_identities exceeded %d pages", maxIdentityPages)
+		}
+		page, err := s.fetchIdentitiesPage(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, page.Identities...)
+		if page.ContinuationToken == token {
+			return nil, fmt.Errorf("node repeated continuation token %q", token)
+		}
+		token = page.ContinuationToken
+	}
+	return identities, nil
+}
+
+// fetchPagesConcurrently fetches the pages starting at offset, pageSize
+// apart, until total, and returns their identities in page order.
+func (s *Server) fetchPagesConcurrently(ctx context.Context, offset, pageSize, total int) ([]nodeIdentity, error) {
+	var offsets []int
+	for o := offset; o < total && len(offsets) < maxIdentityPages; o += pageSize {
+		offsets = append(offsets, o)
+	}
+
+	results := make([][]nodeIdentity, len(offsets))
+	errs := make([]error, len(offsets))
+	sem := make(chan struct{}, s.config.PageConcurrency)
+	var wg sync.WaitGroup
+
+	for i, o := range offsets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, o int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			page, err := s.fetchIdentitiesPage(ctx, strconv.Itoa(o))
+			results[i], errs[i] = page.Identities, err
+		}(i, o)
+	}
+	wg.Wait()
+
+	var identities []nodeIdentity
+	for i := range offsets {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		identities = append(identities, results[i]...)
+	}
+	return identities, nil
+}
+
+// pollInterval adapts the delay between indexer fetches: it doubles after a
+// fetch that changed nothing, up to max, and halves after one that changed
+// something, down to min.
+type pollInterval struct {
+	current time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+// minPollInterval replaces a base interval that is not positive, which
+// would have the indexer fetch in a tight loop.
+const minPollInterval = time.Minute
+
+func newPollInterval(base, min, max time.Duration) *pollInterval {
+	if base <= 0 {
+		log.Printf("Indexer interval %s is not positive, using %s", base, minPollInterval)
+		base = minPollInterval
+	}
+	if min <= 0 || min > base {
+		min = base
+	}
+	if max < base {
+		max = base
+	}
+	return &pollInterval{current: base, min: min, max: max}
+}
+
+// next returns the delay before the following fetch given whether the last
+// one saw changes.
+func (p *pollInterval) next(changed bool) time.Duration {
+	previous := p.current
+	if changed {
+		p.current /= 2
+		if p.current < p.min {
+			p.current = p.min
+		}
+	} else {
+		p.current *= 2
+		if p.current > p.max {
+			p.current = p.max
+		}
+	}
+	if p.current != previous {
+		log.Printf("Indexer interval %s -> %s (changes detected: %t)", previous, p.current, changed)
+	}
+	return p.current
+}
+
+// runIndexer fetches identities immediately and then again after an
+// interval that adapts to how often the data changes, until ctx is cancelled.
+func (s *Server) runIndexer(ctx context.Context) {
+	interval := newPollInterval(
+		time.Duration(s.config.IntervalMinutes)*time.Minute,
+		s.config.MinInterval,
+		s.config.MaxInterval,
+	)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		// A failed fetch says nothing about change frequency
+		delay := interval.current
+		if changes, err := s.runFetch(ctx); err == nil {
+			delay = interval.next(changes > 0)
+		}
+		timer.Reset(delay)
+	}
+}
+
+// runFetch performs one indexing pass, reports its outcome to the alerter
+// and returns the number of identities that changed.
+func (s *Server) runFetch(ctx context.Context) (int, error) {
+	changes, err := s.indexOnce(ctx)
+	if err != nil {
+		if idenarpc.IsAuthError(err) {
+			s.recordRPCAuthFailure(err)
+		} else if errors.Is(err, idenarpc.ErrCircuitOpen) {
+			log.Printf("Indexer fetch skipped: node circuit open after %d failures", s.rpcBreaker.Failures())
+		} else {
+			log.Printf("Indexer fetch failed: %v", err)
+		}
+		s.alerts.recordFailure(err)
+		return 0, err
+	}
+	s.rpcAuth.reset()
+	s.fetches.recordSuccess(time.Now())
+	s.refreshEpoch(ctx)
+	s.alerts.recordSuccess()
+	// With a stability requirement every fetch can complete an address's
+	// run, not only those that change identities
+	if changes == 0 && s.config.StableFetches > 0 {
+		s.rebuildMerkleTree()
+		s.whitelistChanges.broadcast()
+	}
+	return changes, nil
+}
+
+// recordRPCAuthFailure counts a fetch the node rejected for the RPC key.
+// A couple of rejections may be a node restarting with a new key; past the
+// grace it is a misconfiguration and is logged as such on every fetch, with
+// one alert sent straight away instead of after AlertAfterFailures.
+func (s *Server) recordRPCAuthFailure(err error) {
+	grace := s.config.RPCAuthGrace
+	if grace <= 0 {
+		grace = defaultRPCAuthGrace
+	}
+	failures := s.rpcAuth.failure()
+	if failures < grace {
+		log.Printf("Indexer fetch rejected by the node's key check (%d/%d): %v", failures, grace, err)
+		return
+	}
+	message := fmt.Sprintf("Idena indexer: the node rejected IDENA_RPC_KEY on %d consecutive fetches (%v); identities will go stale until the key is fixed", failures, err)
+	log.Printf("FATAL: %s", message)
+	if failures == grace {
+		s.alerts.escalate(message)
+	}
+}
+
+// indexOnce fetches every identity from the node, or reads them from
+// Config.SourceFile when set, and stores the result.
+func (s *Server) indexOnce(ctx context.Context) (int, error) {
+	var fetched []nodeIdentity
+	var err error
+	if s.config.SourceFile != "" {
+		fetched, err = readSourceFile(s.config.SourceFile, s.config.StrictDecoding)
+	} else {
+		fetched, err = s.fetchAllIdentities(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if s.config.EnrichStake && s.config.SourceFile == "" {
+		s.enrichStakes(ctx, fetched)
+	}
+	if s.config.FetchValidationData && s.config.SourceFile == "" {
+		s.fetchValidationData(ctx, fetched)
+	}
+	s.scaleStakes(fetched)
+
+	identities := make([]Identity, 0, len(fetched))
+	for _, identity := range fetched {
+		identities = append(identities, Identity{
+			Address:             identity.Address,
+			State:               identity.State,
+			Stake:               stakeAmount(identity.Stake.Value),
+			StakeUnknown:        !identity.Stake.Known,
+			Delegatee:           identity.Delegatee,
+			LastValidationEpoch: identity.LastValidationEpoch,
+			Online:              identity.Online,
+			FlipsCount:          identity.MadeFlips,
+		})
+	}
+	changes, err := s.storeIdentities(identities)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.evictIdentities(); err != nil {
+		log.Printf("Identity eviction failed: %v", err)
+	}
+	return changes, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// nextOffset returns the offset of the page after the one at offset, if
+// there is one.
+func nextOffset(offset, limit, total int) (int, bool) {
+	if offset+limit >= total {
+		return 0, false
+	}
+	return offset + limit, true
+}
+
+// setPageLinks sets an RFC 5988 Link header with the first, prev, next and
+// last pages of an offset-paged list of total items, so generic clients can
+// follow them. The links repeat the request's path and query with offset
+// and limit replaced, and are relative to the request URL.
+func setPageLinks(w http.ResponseWriter, r *http.Request, offset, limit, total int) {
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+	links := []string{pageLink(r, 0, limit, "first")}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(r, prev, limit, "prev"))
+	}
+	if next, ok := nextOffset(offset, limit, total); ok {
+		links = append(links, pageLink(r, next, limit, "next"))
+	}
+	links = append(links, pageLink(r, last, limit, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// setCursorLink sets a Link header to the page after the cursor, for
+// responses paged by ?after= where only the next page is known.
+func setCursorLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	query := r.URL.Query()
+	query.Set("after", cursor)
+	query.Del("offset")
+	target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, target.String()))
+}
+
+func pageLink(r *http.Request, offset, limit int, rel string) string {
+	query := r.URL.Query()
+	query.Del("after")
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+	target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, target.String(), rel)
+}
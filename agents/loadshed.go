@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// shedExempt reports whether r bypasses the in-flight limit: health checks,
+// so an orchestrator doesn't restart a busy but working server, and event
+// streams, which stay open for as long as the client wants and are capped
+// by Config.EventsMaxSubscribers instead. /whitelist long-polls are not
+// exempt but give their slot back while they wait; see releaseInFlight.
+func shedExempt(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/health", "/readyz", "/version":
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/identity/") && strings.HasSuffix(r.URL.Path, "/events")
+}
+
+// limitInFlight serves at most max requests at a time and answers the rest
+// with 503 and Retry-After straight away, rather than queueing them until
+// memory or the database gives out. A max of zero or less disables it.
+func limitInFlight(max int) func(http.Handler) http.Handler {
+	if max <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	slots := make(chan struct{}, max)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if shedExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+				var once sync.Once
+				release := func() { once.Do(func() { <-slots }) }
+				defer release()
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inFlightSlotKey{}, release)))
+			default:
+				w.Header().Set("Retry-After", "1")
+				w.Header().Set("Cache-Control", noStore.header())
+				http.Error(w, "Server busy, retry shortly", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// inFlightSlotKey is the context key of the function releasing a request's
+// limitInFlight slot.
+type inFlightSlotKey struct{}
+
+// releaseInFlight gives r's limitInFlight slot back before the request
+// ends, for a handler about to sit idle, so that waiting clients don't
+// starve those doing work. It does nothing without a limit or once called.
+func releaseInFlight(r *http.Request) {
+	if release, ok := r.Context().Value(inFlightSlotKey{}).(func()); ok {
+		release()
+	}
+}
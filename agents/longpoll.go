@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Long-poll limits used when the corresponding Config fields are unset.
+const (
+	defaultWhitelistMaxWaiters = 100
+	defaultWhitelistMaxWait    = 60 * time.Second
+)
+
+// changeBroadcaster wakes every waiter at once by closing the current
+// channel and replacing it. The zero value is ready to use.
+type changeBroadcaster struct {
+	mu      sync.Mutex
+	ch      chan struct{}
+	waiters int
+}
+
+// changed returns a channel that is closed on the next broadcast.
+func (b *changeBroadcaster) changed() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ch == nil {
+		b.ch = make(chan struct{})
+	}
+	return b.ch
+}
+
+func (b *changeBroadcaster) broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ch != nil {
+		close(b.ch)
+		b.ch = nil
+	}
+}
+
+// acquire reserves one of max waiter slots and reports whether it got one.
+func (b *changeBroadcaster) acquire(max int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.waiters >= max {
+		return false
+	}
+	b.waiters++
+	return true
+}
+
+func (b *changeBroadcaster) release() {
+	b.mu.Lock()
+	b.waiters--
+	b.mu.Unlock()
+}
+
+// whitelistETag identifies a whitelist by the root of its merkle tree,
+// which changes with any address. It is weak since ?checksum=true changes
+// the representation but not the list.
+func whitelistETag(root string) string {
+	return fmt.Sprintf(`W/"%s"`, root)
+}
+
+// etagMatches reports whether the client's If-None-Match (or ?etag=) names
+// the current ETag.
+func etagMatches(r *http.Request, etag string) bool {
+	client := r.Header.Get("If-None-Match")
+	if client == "" {
+		client = r.URL.Query().Get("etag")
+	}
+	for _, candidate := range strings.Split(client, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == etag || "W/"+candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) whitelistMaxWaiters() int {
+	if s.config.WhitelistMaxWaiters > 0 {
+		return s.config.WhitelistMaxWaiters
+	}
+	return defaultWhitelistMaxWaiters
+}
+
+func (s *Server) whitelistMaxWait() time.Duration {
+	if s.config.WhitelistMaxWait > 0 {
+		return s.config.WhitelistMaxWait
+	}
+	return defaultWhitelistMaxWait
+}
+
+// waitForWhitelistChange blocks until the whitelist's ETag differs from etag,
+// wait elapses, the client goes away or the server shuts down, and returns
+// the whitelist as of then. The whitelist is read through view, s or one
+// of its profile views. The request's in-flight slot is released for the
+// wait, which is capped by Config.WhitelistMaxWaiters instead.
+func (s *Server) waitForWhitelistChange(r *http.Request, view *Server, etag string, wait time.Duration) ([]string, bool, error) {
+	releaseInFlight(r)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		// Subscribe before reading so a write in between isn't missed
+		changed := s.whitelistChanges.changed()
+		addresses, stale, err := view.whitelist()
+		if err != nil || whitelistETag(view.whitelistTree(addresses).Root()) != etag {
+			return addresses, stale, err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return addresses, stale, nil
+		case <-r.Context().Done():
+			return addresses, stale, nil
+		case <-s.drain.draining():
+			return addresses, stale, nil
+		}
+	}
+}
+
+// parseWait reads ?wait= as a duration ("30s") or whole seconds, capped at
+// max. It returns 0 when the parameter is absent.
+func parseWait(r *http.Request, max time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, fmt.Errorf("wait must be a duration such as 30s")
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait must not be negative")
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait, nil
+}
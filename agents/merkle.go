@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"idenauthgo/internal/merkle"
+)
+
+// merkleCache holds the whitelist tree. It is only served for the address
+// set it was built from, since the whitelist also changes without a write
+// in this process: in MODE=server the indexer writes elsewhere, and grace
+// periods run out with time. The generation is bumped on every
+// invalidation so a build that started before a write cannot replace the
+// tree built after it. Invalidating keeps the tree, so readers are served
+// the previous one while its replacement is built. The OpenZeppelin-style
+// tree is only built once /merkle_multiproof asks for it, and is kept for
+// the tree it was built with.
+type merkleCache struct {
+	mu          sync.Mutex
+	tree        *merkle.Tree
+	standard    *merkle.StandardTree
+	standardFor *merkle.Tree
+	generation  int
+}
+
+func (c *merkleCache) get() (*merkle.Tree, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tree, c.generation
+}
+
+func (c *merkleCache) set(tree *merkle.Tree, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.tree = tree
+	}
+}
+
+func (c *merkleCache) invalidate() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.standard, c.standardFor = nil, nil
+	c.generation++
+	return c.generation
+}
+
+// drop empties the cache after the build of generation failed, so the next
+// request builds the tree rather than being served the outdated one.
+func (c *merkleCache) drop(generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generation {
+		c.tree = nil
+	}
+}
+
+// getStandard returns the cached standard tree if it was built alongside
+// tree.
+func (c *merkleCache) getStandard(tree *merkle.Tree) *merkle.StandardTree {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.standardFor != tree {
+		return nil
+	}
+	return c.standard
+}
+
+func (c *merkleCache) setStandard(standard *merkle.StandardTree, tree *merkle.Tree) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tree == tree {
+		c.standard, c.standardFor = standard, tree
+	}
+}
+
+// merkleTree returns the tree over the current whitelist: the cached one
+// when it holds exactly those addresses, or else one updated from it and
+// cached in its place.
+func (s *Server) merkleTree() (*merkle.Tree, error) {
+	cached, generation := s.merkle.get()
+	addresses, err := s.eligibleAddresses()
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && sameLeaves(cached, addresses) {
+		return cached, nil
+	}
+	tree := s.updatedMerkleTree(cached, addresses)
+	s.merkle.set(tree, generation)
+	return tree, nil
+}
+
+// whitelistTree returns the tree over addresses, a whitelist just read:
+// the cached tree when it holds exactly those addresses, or else one built
+// for them, as when a write landed in between or addresses is the stale
+// fallback of whitelist.
+func (s *Server) whitelistTree(addresses []string) *merkle.Tree {
+	if tree, _ := s.merkle.get(); tree != nil && sameLeaves(tree, addresses) {
+		return tree
+	}
+	return merkle.BuildWith(addresses, s.config.MerkleHash)
+}
+
+// sameLeaves reports whether tree holds addresses, in that order.
+func sameLeaves(tree *merkle.Tree, addresses []string) bool {
+	if tree.Len() != len(addresses) {
+		return false
+	}
+	for i, address := range addresses {
+		if tree.Address(i) != address {
+			return false
+		}
+	}
+	return true
+}
+
+// standardTree returns the OpenZeppelin-style tree over the current
+// whitelist, cached alongside merkleTree's.
+func (s *Server) standardTree() (*merkle.StandardTree, error) {
+	tree, err := s.merkleTree()
+	if err != nil {
+		return nil, err
+	}
+	if standard := s.merkle.getStandard(tree); standard != nil {
+		return standard, nil
+	}
+	standard := merkle.BuildStandard(tree.Addresses())
+	s.merkle.setStandard(standard, tree)
+	return standard, nil
+}
+
+// rebuildMerkleTree replaces the cached tree and whitelist after the
+// identities changed.
+// When a tree was cached, only the addresses that joined or left the
+// whitelist are applied to it, so a few changes don't rehash every leaf.
+// Readers keep the previous tree until the new one is set. On error the
+// cache is emptied and the next request builds it.
+func (s *Server) rebuildMerkleTree() {
+	previous, _ := s.merkle.get()
+	generation := s.merkle.invalidate()
+	addresses, err := s.refreshEligibleAddresses()
+	if err != nil {
+		log.Printf("Merkle tree rebuild failed: %v", err)
+		s.merkle.drop(generation)
+		return
+	}
+	s.merkle.set(s.updatedMerkleTree(previous, addresses), generation)
+}
+
+// updatedMerkleTree returns the tree over addresses, updating previous in
+// place of a full build when it can.
+func (s *Server) updatedMerkleTree(previous *merkle.Tree, addresses []string) *merkle.Tree {
+	algo := s.config.MerkleHash
+	if algo == "" {
+		algo = merkle.SHA256
+	}
+	if previous == nil || previous.HashAlgo() != algo {
+		return merkle.BuildWith(addresses, algo)
+	}
+	diff := diffSorted(addresses, previous.Addresses())
+	tree, err := previous.Update(diff.Add, diff.Remove)
+	if err != nil {
+		return merkle.BuildWith(addresses, algo)
+	}
+	return tree
+}
+
+type merkleNode struct {
+	Index   int    `json:"index"`
+	Hash    string `json:"hash"`
+	Address string `json:"address,omitempty"`
+}
+
+// handlePaginatedMerkle serves the cached whitelist tree. With ?address= it
+// returns that address's proof; otherwise one page of the nodes at ?level=
+// (0, the default, are the leaves; depth-1 is the root) using ?offset= and
+// ?limit=, with Link headers and next_offset pointing to the next page.
+func (s *Server) handlePaginatedMerkle(w http.ResponseWriter, r *http.Request) {
+	tree, err := s.merkleTree()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+
+	if address := query.Get("address"); address != "" {
+		index, proof, ok := tree.Proof(address)
+		if !ok {
+			http.Error(w, "Address not in whitelist", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"merkle_root":    tree.Root(),
+			"hash_algorithm": tree.HashAlgo(),
+			"address":        tree.Address(index),
+			"index":          index,
+			"proof":          proof,
+		})
+		return
+	}
+
+	params := map[string]int{"level": 0, "offset": 0, "limit": defaultPageLimit}
+	for name := range params {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (name == "limit" && n == 0) {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			params[name] = n
+		}
+	}
+	level, offset, limit := params["level"], params["offset"], params["limit"]
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	if tree.Depth() > 0 && level >= tree.Depth() {
+		http.Error(w, "invalid level", http.StatusBadRequest)
+		return
+	}
+
+	nodes := make([]merkleNode, 0, limit)
+	for i, hash := range tree.Level(level, offset, limit) {
+		node := merkleNode{Index: offset + i, Hash: hash}
+		if level == 0 {
+			node.Address = tree.Address(offset + i)
+		}
+		nodes = append(nodes, node)
+	}
+	response := map[string]interface{}{
+		"merkle_root":    tree.Root(),
+		"hash_algorithm": tree.HashAlgo(),
+		"count":          tree.Len(),
+		"depth":          tree.Depth(),
+		"level":          level,
+		"offset":         offset,
+		"limit":          limit,
+		"nodes":          nodes,
+	}
+	size := tree.LevelLen(level)
+	if next, ok := nextOffset(offset, limit, size); ok {
+		response["next_offset"] = next
+	}
+	setPageLinks(w, r, offset, limit, size)
+	json.NewEncoder(w).Encode(response)
+}
+
+// maxMultiproofAddresses caps the addresses in one /merkle_multiproof request.
+const maxMultiproofAddresses = 1000
+
+// handleMerkleMultiproof proves several whitelisted addresses at once against
+// the OpenZeppelin StandardMerkleTree root, for a contract to check with
+// MerkleProof.multiProofVerify. That root differs from /merkle_root. Leaves
+// come back in the order the verifier consumes them.
+func (s *Server) handleMerkleMultiproof(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Addresses []string `json:"addresses"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Addresses) == 0 {
+		http.Error(w, "addresses is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Addresses) > maxMultiproofAddresses {
+		http.Error(w, "too many addresses (max "+strconv.Itoa(maxMultiproofAddresses)+")", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(req.Addresses))
+	for _, address := range req.Addresses {
+		address = strings.ToLower(address)
+		if seen[address] {
+			http.Error(w, "duplicate address "+address, http.StatusBadRequest)
+			return
+		}
+		seen[address] = true
+	}
+
+	tree, err := s.standardTree()
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	proof, err := tree.MultiProof(req.Addresses)
+	if err != nil {
+		http.Error(w, "Address not in whitelist", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"root":        tree.Root(),
+		"leaves":      proof.Leaves,
+		"addresses":   proof.Addresses,
+		"indices":     proof.Indices,
+		"proof":       proof.Proof,
+		"proof_flags": proof.ProofFlags,
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// whitelistDiff is what onchain-diff reports: the changes that bring the
+// on-chain list in line with the database.
+type whitelistDiff struct {
+	// Add holds eligible addresses missing on-chain, Remove on-chain
+	// addresses that are no longer eligible; both sorted.
+	Add       []string `json:"add"`
+	Remove    []string `json:"remove"`
+	Eligible  int      `json:"eligible"`
+	OnChain   int      `json:"onchain"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// readAddressFile reads one address per line, skipping blank lines and
+// # comments, and returns them lowercase, sorted and deduplicated.
+func readAddressFile(r io.Reader) ([]string, error) {
+	seen := make(map[string]bool)
+	var addresses []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		address, ok := overrideAddress(text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid address %q", line, text)
+		}
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// diffSorted walks two sorted address lists and returns what is only in
+// eligible (to add) and only in onchain (to remove).
+func diffSorted(eligible, onchain []string) whitelistDiff {
+	diff := whitelistDiff{Add: []string{}, Remove: []string{}, Eligible: len(eligible), OnChain: len(onchain)}
+	i, j := 0, 0
+	for i < len(eligible) || j < len(onchain) {
+		switch {
+		case j == len(onchain) || (i < len(eligible) && eligible[i] < onchain[j]):
+			diff.Add = append(diff.Add, eligible[i])
+			i++
+		case i == len(eligible) || onchain[j] < eligible[i]:
+			diff.Remove = append(diff.Remove, onchain[j])
+			j++
+		default:
+			diff.Unchanged++
+			i++
+			j++
+		}
+	}
+	return diff
+}
+
+// runOnchainDiff implements the onchain-diff command: it compares the
+// eligible addresses in the database with the on-chain list at path,
+// writes the diff as JSON to out and a summary to errOut, and returns the
+// process exit code.
+func runOnchainDiff(s *Server, path string, out, errOut io.Writer) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(errOut, "onchain-diff: %v\n", err)
+		return 1
+	}
+	onchain, err := readAddressFile(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(errOut, "onchain-diff: %s: %v\n", path, err)
+		return 1
+	}
+	eligible, err := s.eligibleAddresses()
+	if err != nil {
+		fmt.Fprintf(errOut, "onchain-diff: %v\n", err)
+		return 1
+	}
+
+	diff := diffSorted(eligible, onchain)
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(diff); err != nil {
+		fmt.Fprintf(errOut, "onchain-diff: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(errOut, "%d eligible, %d on-chain: %d to add, %d to remove, %d unchanged\n",
+		diff.Eligible, diff.OnChain, len(diff.Add), len(diff.Remove), diff.Unchanged)
+	return 0
+}
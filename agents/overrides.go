@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Reasons checkEligibility gives for an operator override.
+const (
+	reasonAllowlisted = "Manually allowlisted"
+	reasonDenylisted  = "Manually denylisted"
+)
+
+// Override kinds, as stored in the overrides table.
+const (
+	overrideAllow = "allow"
+	overrideDeny  = "deny"
+)
+
+// Override is a row of the overrides table, managed at runtime through
+// /overrides. It adds to Config.Allowlist and Config.Denylist.
+type Override struct {
+	Address   string `json:"address"`
+	Kind      string `json:"kind"`
+	Note      string `json:"note,omitempty"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// overrideAddress returns the lowercase form of a 0x-prefixed 20-byte hex
+// address; ok is false for anything else.
+func overrideAddress(value string) (address string, ok bool) {
+	address = strings.ToLower(strings.TrimSpace(value))
+	if len(address) != 42 || !strings.HasPrefix(address, "0x") {
+		return "", false
+	}
+	if _, err := hex.DecodeString(address[2:]); err != nil {
+		return "", false
+	}
+	return address, true
+}
+
+// parseAddressList parses a comma-separated list of addresses into a set of
+// their lowercase forms.
+func parseAddressList(value string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		address, ok := overrideAddress(item)
+		if !ok {
+			return nil, fmt.Errorf("invalid address %q", item)
+		}
+		set[address] = true
+	}
+	return set, nil
+}
+
+// override returns the operator's decision for address, if any, from the
+// configured lists and the overrides table. A deny from either wins over
+// any allow.
+func (s *Server) override(address string) (eligible bool, reason string, ok bool, err error) {
+	address = strings.ToLower(address)
+	var kind string
+	err = s.db.QueryRow("SELECT kind FROM overrides WHERE address = ?", address).Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		return false, "", false, err
+	}
+	rules := s.rules()
+	switch {
+	case rules.Denylist[address] || kind == overrideDeny:
+		return false, reasonDenylisted, true, nil
+	case rules.Allowlist[address] || kind == overrideAllow:
+		return true, reasonAllowlisted, true, nil
+	}
+	return false, "", false, nil
+}
+
+// overrideSets returns the addresses allowlisted and denylisted by the
+// configured lists and the overrides table together. An address may be in
+// both; the denylist wins.
+func (s *Server) overrideSets() (allow, deny map[string]bool, err error) {
+	rules := s.rules()
+	allow = make(map[string]bool, len(rules.Allowlist))
+	deny = make(map[string]bool, len(rules.Denylist))
+	for address := range rules.Allowlist {
+		allow[address] = true
+	}
+	for address := range rules.Denylist {
+		deny[address] = true
+	}
+	rows, err := s.db.Query("SELECT address, kind FROM overrides")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var address, kind string
+		if err := rows.Scan(&address, &kind); err != nil {
+			return nil, nil, err
+		}
+		if kind == overrideDeny {
+			deny[address] = true
+		} else {
+			allow[address] = true
+		}
+	}
+	return allow, deny, rows.Err()
+}
+
+// applyOverrides drops denylisted addresses from the sorted eligible list
+// and adds allowlisted ones, whether or not they are indexed.
+func (s *Server) applyOverrides(addresses []string) ([]string, error) {
+	allow, deny, err := s.overrideSets()
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return addresses, nil
+	}
+
+	listed := make(map[string]bool, len(addresses))
+	kept := addresses[:0]
+	for _, address := range addresses {
+		listed[address] = true
+		if !deny[address] {
+			kept = append(kept, address)
+		}
+	}
+	for address := range allow {
+		if !listed[address] && !deny[address] {
+			kept = append(kept, address)
+		}
+	}
+	sort.Strings(kept)
+	return kept, nil
+}
+
+// overrideChanged drops what was computed with the old override for
+// address and rebuilds the whitelist tree.
+func (s *Server) overrideChanged(address string) {
+	s.cache.invalidateAddress(address)
+	s.eligibility.remove(address)
+	s.rebuildMerkleTree()
+	s.whitelistChanges.broadcast()
+}
+
+// handleListOverrides returns the overrides table, oldest first.
+func (s *Server) handleListOverrides(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query("SELECT address, kind, COALESCE(note, ''), created_by, created_at FROM overrides ORDER BY created_at, address")
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	overrides := []Override{}
+	for rows.Next() {
+		var o Override
+		if err := rows.Scan(&o.Address, &o.Kind, &o.Note, &o.CreatedBy, &o.CreatedAt); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		overrides = append(overrides, o)
+	}
+	if err := rows.Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"overrides": overrides})
+}
+
+// handleSetOverride adds or replaces the override for an address. The body
+// is {"address", "kind": "allow"|"deny", "by", "note"}; by names the
+// operator, since the API key is shared.
+func (s *Server) handleSetOverride(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Address string `json:"address"`
+		Kind    string `json:"kind"`
+		By      string `json:"by"`
+		Note    string `json:"note"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	address, ok := overrideAddress(req.Address)
+	if !ok {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return
+	}
+	if req.Kind != overrideAllow && req.Kind != overrideDeny {
+		http.Error(w, "kind must be allow or deny", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.By) == "" {
+		http.Error(w, "by is required", http.StatusBadRequest)
+		return
+	}
+
+	o := Override{Address: address, Kind: req.Kind, Note: req.Note, CreatedBy: strings.TrimSpace(req.By), CreatedAt: time.Now().Unix()}
+	_, err := s.db.Exec(`
+		INSERT INTO overrides (address, kind, note, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(address) DO UPDATE SET
+			kind = excluded.kind,
+			note = excluded.note,
+			created_by = excluded.created_by,
+			created_at = excluded.created_at`,
+		o.Address, o.Kind, o.Note, o.CreatedBy, o.CreatedAt)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	s.overrideChanged(address)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// handleDeleteOverride removes the override for {address}; 404 when there
+// is none. Overrides from the environment cannot be removed here.
+func (s *Server) handleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(mux.Vars(r)["address"])
+	res, err := s.db.Exec("DELETE FROM overrides WHERE address = ?", address)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "No override for address", http.StatusNotFound)
+		return
+	}
+	s.overrideChanged(address)
+	w.WriteHeader(http.StatusNoContent)
+}
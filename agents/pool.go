@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// PoolDelegator is one identity delegating to a pool.
+type PoolDelegator struct {
+	Address  string      `json:"address"`
+	State    string      `json:"state"`
+	Stake    stakeAmount `json:"stake"`
+	Eligible bool        `json:"eligible"`
+}
+
+// PoolStake aggregates the identities delegating to a pool address.
+type PoolStake struct {
+	Pool          string          `json:"pool"`
+	TotalStake    stakeAmount     `json:"total_stake"`
+	EligibleStake stakeAmount     `json:"eligible_stake"`
+	Delegators    []PoolDelegator `json:"delegators"`
+	Count         int             `json:"count"`
+	EligibleCount int             `json:"eligible_count"`
+}
+
+// handlePoolStake sums the stake delegated to a pool. A delegator counts as
+// eligible when its state and stake qualify on their own; grace periods are
+// not applied, and an unknown stake counts as 0.
+func (s *Server) handlePoolStake(w http.ResponseWriter, r *http.Request) {
+	pool, err := normalizeAddress(mux.Vars(r)["address"], queryBool(r, "strict"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.QueryContext(r.Context(),
+		"SELECT address, state, COALESCE(stake, 0) FROM identities WHERE delegatee = ? ORDER BY address", pool)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	result := PoolStake{Pool: pool, Delegators: []PoolDelegator{}}
+	for rows.Next() {
+		var delegator PoolDelegator
+		if err := rows.Scan(&delegator.Address, &delegator.State, &delegator.Stake); err != nil {
+			continue
+		}
+		delegator.Eligible = s.isEligibleState(delegator.State) && float64(delegator.Stake) >= s.minStake(delegator.State)
+		result.TotalStake += delegator.Stake
+		if delegator.Eligible {
+			result.EligibleStake += delegator.Stake
+			result.EligibleCount++
+		}
+		result.Delegators = append(result.Delegators, delegator)
+	}
+	if err := rows.Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	result.Count = len(result.Delegators)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
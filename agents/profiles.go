@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultProfile names the top-level rules in ?profile=.
+const defaultProfile = "default"
+
+// eligibilityProfile is a named set of eligibility rules, for one indexer
+// serving communities with different requirements. It replaces the
+// top-level states, thresholds and configured allow/deny lists; grace
+// periods, the stability window and the overrides table still apply.
+type eligibilityProfile struct {
+	States          []string
+	StateThresholds map[string]float64
+	Allowlist       map[string]bool
+	Denylist        map[string]bool
+}
+
+// profileFile is how a profile is written in ELIGIBILITY_PROFILES_FILE.
+// MinStake applies to every state in States, StateThresholds to single
+// states on top of it.
+type profileFile struct {
+	States          []string           `json:"states"`
+	MinStake        *float64           `json:"min_stake"`
+	StateThresholds map[string]float64 `json:"state_thresholds"`
+	Allowlist       []string           `json:"allowlist"`
+	Denylist        []string           `json:"denylist"`
+}
+
+// loadProfiles reads a JSON object of profile name to profileFile.
+func loadProfiles(path string) (map[string]eligibilityProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var files map[string]profileFile
+	if err := decodeConfigStrict(data, &files); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	profiles := make(map[string]eligibilityProfile, len(files))
+	for name, file := range files {
+		profile, err := file.profile()
+		if err == nil && (name == "" || name == defaultProfile) {
+			err = errors.New("reserved name")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", name, err)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// decodeConfigStrict decodes a JSON config file into v, rejecting keys v
+// has no field for, so a typo such as "min_stek" fails instead of being
+// silently ignored.
+func decodeConfigStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Errorf("unknown key %s", field)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f profileFile) profile() (eligibilityProfile, error) {
+	profile := eligibilityProfile{
+		States:          eligibleStates,
+		StateThresholds: make(map[string]float64),
+	}
+	if f.States != nil {
+		if len(f.States) == 0 {
+			return eligibilityProfile{}, errors.New("states is empty")
+		}
+		profile.States = f.States
+	}
+	if f.MinStake != nil {
+		if *f.MinStake < 0 {
+			return eligibilityProfile{}, errors.New("min_stake is negative")
+		}
+		for _, state := range profile.States {
+			profile.StateThresholds[state] = *f.MinStake
+		}
+	}
+	for state, min := range f.StateThresholds {
+		if min < 0 {
+			return eligibilityProfile{}, fmt.Errorf("threshold for %s is negative", state)
+		}
+		profile.StateThresholds[state] = min
+	}
+	var err error
+	if profile.Allowlist, err = parseAddressList(strings.Join(f.Allowlist, ",")); err != nil {
+		return eligibilityProfile{}, fmt.Errorf("allowlist: %w", err)
+	}
+	if profile.Denylist, err = parseAddressList(strings.Join(f.Denylist, ",")); err != nil {
+		return eligibilityProfile{}, fmt.Errorf("denylist: %w", err)
+	}
+	return profile, nil
+}
+
+// profileView returns the server to evaluate r's ?profile= with: s itself
+// for none or "default", else a view sharing s's database with the
+// profile's rules. Views have no caches, so their results are always
+// read fresh. ok is false for an unknown profile.
+func (s *Server) profileView(r *http.Request) (*Server, bool) {
+	name := strings.TrimSpace(r.URL.Query().Get("profile"))
+	if name == "" || name == defaultProfile {
+		return s, true
+	}
+	profile, ok := s.rules().Profiles[name]
+	if !ok {
+		return nil, false
+	}
+	config := s.config
+	config.EligibleStates = profile.States
+	config.StateThresholds = profile.StateThresholds
+	config.Allowlist = profile.Allowlist
+	config.Denylist = profile.Denylist
+	return &Server{db: s.db, config: config}, true
+}
+
+// placeholders returns n comma-separated SQL placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
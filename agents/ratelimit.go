@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rpcLimiter bounds outbound node calls with a token bucket refilled at rate
+// per second (burst of one, so calls are spaced 1/rate apart) and a
+// semaphore capping calls in flight. A nil *rpcLimiter imposes no limit.
+type rpcLimiter struct {
+	rate float64
+	sem  chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRPCLimiter returns a limiter for rate calls per second and at most
+// concurrency calls at once; zero disables either bound. It returns nil
+// when both are disabled.
+func newRPCLimiter(rate float64, concurrency int) *rpcLimiter {
+	if rate <= 0 && concurrency <= 0 {
+		return nil
+	}
+	l := &rpcLimiter{rate: rate, tokens: 1}
+	if concurrency > 0 {
+		l.sem = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// acquire blocks until a call may start and returns the function that
+// marks it finished.
+func (l *rpcLimiter) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.wait(ctx); err != nil {
+		return nil, err
+	}
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return func() { <-l.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait takes one token from the bucket, sleeping until one is available.
+func (l *rpcLimiter) wait(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > 1 {
+				l.tokens = 1
+			}
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
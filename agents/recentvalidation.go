@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Config.MaxEpochsSinceValidation counts epochs back from the latest
+// validation on record, the last ceremony the indexer has seen: an identity
+// that validated in it is 0 epochs behind, one that validated in the
+// ceremony before is 1 behind. Counting from the stored data rather than
+// the node's epoch keeps the rule working with Config.SourceFile.
+
+// latestValidationQuery selects the epoch the window counts back from.
+const latestValidationQuery = "SELECT MAX(last_validation_epoch) FROM identities"
+
+// recentValidationCondition returns the condition on the identities table
+// keeping those that validated within Config.MaxEpochsSinceValidation, or ""
+// when the rule is off. Identities with no validation on record never
+// match.
+func (s *Server) recentValidationCondition() (string, []interface{}) {
+	if s.config.MaxEpochsSinceValidation <= 0 {
+		return "", nil
+	}
+	return "last_validation_epoch >= (" + latestValidationQuery + ") - ?",
+		[]interface{}{s.config.MaxEpochsSinceValidation}
+}
+
+// checkRecentValidation is checkEligibility's validation step for an
+// identity whose last validation is lastValidation.
+func (s *Server) checkRecentValidation(lastValidation sql.NullInt64) (bool, string, error) {
+	maxEpochs := s.config.MaxEpochsSinceValidation
+	if maxEpochs <= 0 {
+		return true, "", nil
+	}
+	if !lastValidation.Valid {
+		return false, "No validation on record", nil
+	}
+	var latest sql.NullInt64
+	if err := s.db.QueryRow(latestValidationQuery).Scan(&latest); err != nil {
+		return false, "", err
+	}
+	if behind := latest.Int64 - lastValidation.Int64; behind > int64(maxEpochs) {
+		return false, fmt.Sprintf("Last validated %d epochs ago, at most %d allowed", behind, maxEpochs), nil
+	}
+	return true, "", nil
+}
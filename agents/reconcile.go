@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// reconcileSampleSize caps the addresses listed per category; the counts
+// are always complete.
+const reconcileSampleSize = 100
+
+// ReconcileReport compares the identities table with a fresh node pull.
+type ReconcileReport struct {
+	NodeTotal int `json:"node_total"`
+	DBTotal   int `json:"db_total"`
+	// MissingFromDB are on the node but not indexed, GoneFromNode are
+	// indexed but no longer on the node, and Differing are in both with a
+	// different state or stake.
+	MissingFromDB driftSet `json:"missing_from_db"`
+	GoneFromNode  driftSet `json:"gone_from_node"`
+	Differing     driftSet `json:"differing"`
+}
+
+type driftSet struct {
+	Count     int      `json:"count"`
+	Addresses []string `json:"addresses"`
+}
+
+func (d *driftSet) add(address string) {
+	d.Count++
+	d.Addresses = append(d.Addresses, address)
+}
+
+func (d *driftSet) finish() {
+	sort.Strings(d.Addresses)
+	if len(d.Addresses) > reconcileSampleSize {
+		d.Addresses = d.Addresses[:reconcileSampleSize]
+	}
+	if d.Addresses == nil {
+		d.Addresses = []string{}
+	}
+}
+
+// handleReconcile pulls every identity from the node and reports how the
+// database has drifted from it. Nothing is written.
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	fetched, err := s.fetchAllIdentities(r.Context())
+	if err != nil {
+		log.Printf("Reconcile: node fetch failed: %v", err)
+		http.Error(w, "Node error", http.StatusBadGateway)
+		return
+	}
+	s.scaleStakes(fetched)
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT address, state, stake FROM identities")
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	indexed := make(map[string]nodeIdentity)
+	for rows.Next() {
+		var identity nodeIdentity
+		if err := rows.Scan(&identity.Address, &identity.State, &identity.Stake); err != nil {
+			continue
+		}
+		indexed[identity.Address] = identity
+	}
+	if err := rows.Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	report := ReconcileReport{NodeTotal: len(fetched), DBTotal: len(indexed)}
+	seen := make(map[string]bool, len(fetched))
+	for _, identity := range fetched {
+		address := strings.ToLower(identity.Address)
+		seen[address] = true
+		stored, ok := indexed[address]
+		switch {
+		case !ok:
+			report.MissingFromDB.add(address)
+		case stored.State != identity.State || stored.Stake != identity.Stake:
+			report.Differing.add(address)
+		}
+	}
+	for address := range indexed {
+		if !seen[address] {
+			report.GoneFromNode.add(address)
+		}
+	}
+	report.MissingFromDB.finish()
+	report.GoneFromNode.finish()
+	report.Differing.finish()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
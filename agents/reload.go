@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// eligibilityRules are the settings POST /admin/reload can change without
+// a restart. Everything else in Config still needs one.
+type eligibilityRules struct {
+	EligibleStates  []string
+	StateThresholds map[string]float64
+	Allowlist       map[string]bool
+	Denylist        map[string]bool
+	Profiles        map[string]eligibilityProfile
+}
+
+// loadEligibilityRules reads ELIGIBLE_STATES, STATE_STAKE_THRESHOLDS,
+// ELIGIBILITY_ALLOWLIST, ELIGIBILITY_DENYLIST and ELIGIBILITY_PROFILES_FILE
+// through getenv, os.Getenv or a pending reload's view of the environment.
+// Errors name the offending variable.
+func loadEligibilityRules(getenv func(string) string) (eligibilityRules, error) {
+	var rules eligibilityRules
+	var err error
+	if value := getenv("ELIGIBLE_STATES"); value != "" {
+		for _, state := range strings.Split(value, ",") {
+			if state = strings.TrimSpace(state); state != "" {
+				rules.EligibleStates = append(rules.EligibleStates, state)
+			}
+		}
+		if len(rules.EligibleStates) == 0 {
+			return eligibilityRules{}, errors.New("ELIGIBLE_STATES: no states given")
+		}
+	}
+	if value := getenv("STATE_STAKE_THRESHOLDS"); value != "" {
+		if rules.StateThresholds, err = parseStateThresholds(value); err != nil {
+			return eligibilityRules{}, fmt.Errorf("STATE_STAKE_THRESHOLDS: %w", err)
+		}
+	}
+	if rules.Allowlist, err = parseAddressList(getenv("ELIGIBILITY_ALLOWLIST")); err != nil {
+		return eligibilityRules{}, fmt.Errorf("ELIGIBILITY_ALLOWLIST: %w", err)
+	}
+	if rules.Denylist, err = parseAddressList(getenv("ELIGIBILITY_DENYLIST")); err != nil {
+		return eligibilityRules{}, fmt.Errorf("ELIGIBILITY_DENYLIST: %w", err)
+	}
+	if path := getenv("ELIGIBILITY_PROFILES_FILE"); path != "" {
+		if rules.Profiles, err = loadProfiles(path); err != nil {
+			return eligibilityRules{}, fmt.Errorf("ELIGIBILITY_PROFILES_FILE: %w", err)
+		}
+	}
+	return rules, nil
+}
+
+// apply copies the rules into config.
+func (r eligibilityRules) apply(config *Config) {
+	config.EligibleStates = r.EligibleStates
+	config.StateThresholds = r.StateThresholds
+	config.Allowlist = r.Allowlist
+	config.Denylist = r.Denylist
+	config.Profiles = r.Profiles
+}
+
+// rules returns the eligibility rules in force: the last reload's, or
+// those the server started with.
+func (s *Server) rules() eligibilityRules {
+	if rules := s.reloaded.Load(); rules != nil {
+		return *rules
+	}
+	return eligibilityRules{
+		EligibleStates:  s.config.EligibleStates,
+		StateThresholds: s.config.StateThresholds,
+		Allowlist:       s.config.Allowlist,
+		Denylist:        s.config.Denylist,
+		Profiles:        s.config.Profiles,
+	}
+}
+
+// dotEnv loads a .env file into the environment and can load it again.
+// Variables the process was started with take precedence, as with
+// godotenv.Load, and those that disappear from the file are unset on the
+// next load.
+type dotEnv struct {
+	mu       sync.Mutex
+	path     string
+	fromFile map[string]bool
+}
+
+func newDotEnv(path string) *dotEnv {
+	return &dotEnv{path: path, fromFile: make(map[string]bool)}
+}
+
+func (d *dotEnv) load() error {
+	return d.reload(nil)
+}
+
+// reload reads the file and, when validate accepts the environment it
+// would produce, applies it. validate sees that environment through its
+// getenv argument; until it returns nil nothing is set or unset, so a
+// rejected file leaves the process as it was. A nil validate accepts
+// anything.
+func (d *dotEnv) reload(validate func(getenv func(string) string) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	values, err := godotenv.Read(d.path)
+	if err != nil {
+		return err
+	}
+	if validate != nil {
+		if err := validate(d.pending(values)); err != nil {
+			return err
+		}
+	}
+	d.apply(values)
+	return nil
+}
+
+// pending returns a getenv for the environment as it will be once values
+// are applied. d.mu must be held.
+func (d *dotEnv) pending(values map[string]string) func(string) string {
+	return func(key string) string {
+		_, set := os.LookupEnv(key)
+		if set && !d.fromFile[key] {
+			return os.Getenv(key)
+		}
+		return values[key]
+	}
+}
+
+// apply sets values in the environment, skipping variables the process
+// was started with, and unsets those that left the file. d.mu must be
+// held.
+func (d *dotEnv) apply(values map[string]string) {
+	for key := range d.fromFile {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+			delete(d.fromFile, key)
+		}
+	}
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set && !d.fromFile[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		d.fromFile[key] = true
+	}
+}
+
+// handleReload re-reads the .env file and the environment and swaps in the
+// new eligibility rules, then drops everything computed with the old
+// ones. Invalid settings are answered with 400 and change nothing, the
+// environment included.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	var rules eligibilityRules
+	validate := func(getenv func(string) string) (err error) {
+		rules, err = loadEligibilityRules(getenv)
+		return err
+	}
+	var err error
+	if s.env != nil {
+		err = s.env.reload(validate)
+	}
+	if s.env == nil || errors.Is(err, os.ErrNotExist) {
+		err = validate(os.Getenv)
+	}
+	if err != nil {
+		log.Printf("Reload rejected, keeping the current configuration: %v", err)
+		writeReloadError(w, err)
+		return
+	}
+
+	s.reloaded.Store(&rules)
+	s.cache.clear()
+	s.eligibility.clear()
+	s.rebuildMerkleTree()
+	s.whitelistChanges.broadcast()
+	log.Printf("Eligibility configuration reloaded")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reloaded":         true,
+		"eligible_states":  s.eligibleStates(),
+		"state_thresholds": rules.StateThresholds,
+		"allowlisted":      len(rules.Allowlist),
+		"denylisted":       len(rules.Denylist),
+		"profiles":         len(rules.Profiles),
+	})
+}
+
+func writeReloadError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// historyRetentionEnabled reports whether Config.HistoryKeep or
+// Config.HistoryMaxAge limits identity_history.
+func (s *Server) historyRetentionEnabled() bool {
+	return s.config.HistoryKeep > 0 || s.config.HistoryMaxAge > 0
+}
+
+// pruneHistory deletes the identity_history rows beyond Config.HistoryKeep
+// per address or older than Config.HistoryMaxAge, and returns how many it
+// deleted.
+//
+// Eligibility reads the history as of GracePeriod ago, or as of the
+// StableFetches-th latest fetch when that is earlier, so the rows after
+// that point are always kept, and so is each address's last row before
+// it: its state when the window began. Until that many fetches are on
+// record every row is kept. That row is where a
+// grace period started or where the current run of eligibility is known
+// to have begun by, so grace and stability come out the same after a
+// prune. Without either setting the window is empty and the kept row is
+// the address's latest.
+func (s *Server) pruneHistory(now time.Time) (int64, error) {
+	if !s.historyRetentionEnabled() {
+		return 0, nil
+	}
+	protectFrom := now.Add(-s.config.GracePeriod).Unix()
+	if s.config.StableFetches > 0 {
+		cutoff, ok, err := s.stableCutoff()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			protectFrom = 0
+		} else if cutoff.Unix() < protectFrom {
+			protectFrom = cutoff.Unix()
+		}
+	}
+
+	condition := "0"
+	var args []interface{}
+	if s.config.HistoryKeep > 0 {
+		condition += " OR recent > ?"
+		args = append(args, s.config.HistoryKeep)
+	}
+	if s.config.HistoryMaxAge > 0 {
+		condition += " OR changed_at < ?"
+		args = append(args, now.Add(-s.config.HistoryMaxAge).Unix())
+	}
+	res, err := s.db.Exec(`
+		DELETE FROM identity_history WHERE rowid IN (
+			SELECT id FROM (
+				SELECT rowid AS id, changed_at,
+					ROW_NUMBER() OVER (PARTITION BY address ORDER BY changed_at DESC, rowid DESC) AS recent,
+					ROW_NUMBER() OVER (PARTITION BY address, changed_at <= ? ORDER BY changed_at DESC, rowid DESC) AS earlier
+				FROM identity_history
+			)
+			WHERE changed_at <= ? AND earlier > 1 AND (`+condition+`)
+		)`,
+		append([]interface{}{protectFrom, protectFrom}, args...)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runHistoryRetention prunes identity_history every
+// Config.HistoryPruneInterval until ctx is done. It returns at once when
+// no retention is configured.
+func (s *Server) runHistoryRetention(ctx context.Context) {
+	if !s.historyRetentionEnabled() {
+		return
+	}
+	interval := s.config.HistoryPruneInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if deleted, err := s.pruneHistory(time.Now()); err != nil {
+			log.Printf("Identity history pruning failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Pruned %d identity history rows", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultShutdownGrace is used when Config.ShutdownGrace is unset.
+const defaultShutdownGrace = 10 * time.Second
+
+// drainSignal is closed once when the server starts shutting down, telling
+// long-polls and event streams to finish. The zero value is ready to use.
+type drainSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (d *drainSignal) draining() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
+
+func (d *drainSignal) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	select {
+	case <-d.ch:
+	default:
+		close(d.ch)
+	}
+}
+
+func (s *Server) shutdownGrace() time.Duration {
+	if s.config.ShutdownGrace > 0 {
+		return s.config.ShutdownGrace
+	}
+	return defaultShutdownGrace
+}
+
+// serve runs srv until ctx is cancelled, then shuts it down gracefully.
+func (s *Server) serve(ctx context.Context, srv *http.Server) error {
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down, draining connections for up to %s", s.shutdownGrace())
+	return s.shutdown(srv)
+}
+
+// shutdown releases long-polls and ends event streams with a final event,
+// then waits for in-flight requests until the grace period runs out and
+// closes whatever is left.
+func (s *Server) shutdown(srv *http.Server) error {
+	s.drain.start()
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownGrace())
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown grace period elapsed, closing remaining connections: %v", err)
+		return srv.Close()
+	}
+	return nil
+}
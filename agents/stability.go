@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// notYetStableReason prefixes the /whitelist/check reason for an address
+// that qualifies but has not done so in Config.StableFetches consecutive
+// fetches yet.
+const notYetStableReason = "Not yet stable"
+
+// stableSince returns, per address, when its current unbroken run of
+// eligible history rows began; an address whose latest row is not eligible
+// is absent. With address set only that address is read. Grace periods are
+// not considered, and an unknown stake (recorded as 0) breaks a run.
+func (s *Server) stableSince(address string) (map[string]time.Time, error) {
+	query := "SELECT address, state, stake, changed_at FROM identity_history"
+	var args []interface{}
+	if address != "" {
+		query += " WHERE address = ?"
+		args = append(args, address)
+	}
+	rows, err := s.db.Query(query+" ORDER BY address, changed_at, rowid", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	since := make(map[string]time.Time)
+	for rows.Next() {
+		var addr, state string
+		var stake float64
+		var changedAt int64
+		if err := rows.Scan(&addr, &state, &stake, &changedAt); err != nil {
+			return nil, err
+		}
+		if !s.isEligibleState(state) || stake < s.minStake(state) {
+			delete(since, addr)
+		} else if _, ok := since[addr]; !ok {
+			since[addr] = time.Unix(changedAt, 0).UTC()
+		}
+	}
+	return since, rows.Err()
+}
+
+// stableCutoff returns when the Config.StableFetches-th latest fetch was
+// stored, going by the stats_history row each fetch leaves. An address
+// whose run of eligibility began by then has been eligible in that many
+// consecutive fetches. ok is false while fewer fetches are on record.
+func (s *Server) stableCutoff() (cutoff time.Time, ok bool, err error) {
+	var recordedAt int64
+	err = s.db.QueryRow("SELECT recorded_at FROM stats_history ORDER BY recorded_at DESC LIMIT 1 OFFSET ?",
+		s.config.StableFetches-1).Scan(&recordedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(recordedAt, 0).UTC(), true, nil
+}
+
+// isStable reports whether an address that is eligible now has been in
+// Config.StableFetches consecutive fetches. Addresses without history
+// predate history tracking and count as stable.
+func isStable(since map[string]time.Time, address string, cutoff time.Time, ok bool) bool {
+	start, tracked := since[address]
+	return !tracked || ok && !start.After(cutoff)
+}
+
+// filterStable drops the eligible addresses that have not been eligible
+// in Config.StableFetches consecutive fetches yet.
+func (s *Server) filterStable(addresses []string) ([]string, error) {
+	if s.config.StableFetches <= 0 {
+		return addresses, nil
+	}
+	since, err := s.stableSince("")
+	if err != nil {
+		return nil, err
+	}
+	cutoff, ok, err := s.stableCutoff()
+	if err != nil {
+		return nil, err
+	}
+	stable := addresses[:0]
+	for _, address := range addresses {
+		if isStable(since, address, cutoff, ok) {
+			stable = append(stable, address)
+		}
+	}
+	return stable, nil
+}
+
+// checkStable is checkEligibility's stability step for an eligible address.
+func (s *Server) checkStable(address string) (bool, string, error) {
+	since, err := s.stableSince(address)
+	if err != nil {
+		return false, "", err
+	}
+	cutoff, ok, err := s.stableCutoff()
+	if err != nil {
+		return false, "", err
+	}
+	if isStable(since, address, cutoff, ok) {
+		return true, "", nil
+	}
+	var fetches int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM stats_history WHERE recorded_at >= ?",
+		since[address].Unix()).Scan(&fetches); err != nil {
+		return false, "", err
+	}
+	return false, fmt.Sprintf("%s: eligible in %d of %d consecutive fetches required, since %s",
+		notYetStableReason, fetches, s.config.StableFetches, since[address].Format(time.RFC3339)), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// stakeDecimals is the precision of iDNA amounts on the node (1 iDNA =
+// 10^18 dna).
+const stakeDecimals = 18
+
+// stakeAmount is an iDNA amount in API responses. It is always written in
+// fixed notation, never with an exponent, as a JSON number; with
+// Config.StakeAsString the server rewrites it on the way out as a string
+// padded to stakeDecimals decimals, see stringifyStakes.
+type stakeAmount float64
+
+func (a stakeAmount) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatFloat(float64(a), 'f', -1, 64)), nil
+}
+
+// padded formats a with exactly stakeDecimals decimals, e.g.
+// "15000.000000000000000000".
+func (a stakeAmount) padded() string {
+	digits := strconv.FormatFloat(float64(a), 'f', -1, 64)
+	whole, fraction, _ := strings.Cut(digits, ".")
+	if len(fraction) > stakeDecimals {
+		return strconv.FormatFloat(float64(a), 'f', stakeDecimals, 64)
+	}
+	return whole + "." + fraction + strings.Repeat("0", stakeDecimals-len(fraction))
+}
+
+// UnmarshalJSON accepts either encoding, so responses round-trip.
+func (a *stakeAmount) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	value, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid stake %s: %w", data, err)
+	}
+	*a = stakeAmount(value)
+	return nil
+}
+
+// implausibleStake is an iDNA stake no identity can have (the whole supply
+// is far below it). Stakes above it after scaling almost certainly arrived
+// in dna with Config.StakeScale unset.
+const implausibleStake = 1e12
+
+// scaleStakes converts the stakes of identities fetched from the node to
+// iDNA using Config.StakeScale, and warns when the result still looks like
+// dna.
+func (s *Server) scaleStakes(identities []nodeIdentity) {
+	scale := s.config.StakeScale
+	suspect := 0
+	var example nodeIdentity
+	for i := range identities {
+		stake := &identities[i].Stake
+		if !stake.Known {
+			continue
+		}
+		if scale > 0 && scale != 1 {
+			stake.Value /= scale
+		}
+		if stake.Value > implausibleStake {
+			if suspect == 0 {
+				example = identities[i]
+			}
+			suspect++
+		}
+	}
+	if suspect > 0 {
+		log.Printf("Warning: %d stakes exceed %g iDNA (e.g. %s with %g); the node probably reports dna, check STAKE_SCALE (currently %g)",
+			suspect, float64(implausibleStake), example.Address, example.Stake.Value, scale)
+	}
+}
+
+// parseStakeEncoding validates STAKE_ENCODING.
+func parseStakeEncoding(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "number":
+		return false, nil
+	case "string":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown stake encoding %q (use number or string)", value)
+}
+
+// stakeFields are the response keys holding a stake amount, and
+// stakeMaps those of objects whose every value is one.
+var (
+	stakeFields = map[string]bool{"stake": true, "total_stake": true, "eligible_stake": true, "min_stake": true}
+	stakeMaps   = map[string]bool{"state_min_stake": true}
+)
+
+// stringifyStakes rewrites the stake amounts in a JSON document as padded
+// strings, for consumers that parse numbers as doubles. Other numbers keep
+// their exact text.
+func stringifyStakes(data []byte) ([]byte, error) {
+	return rewriteJSON(data, nil, func(key, parent string, n json.Number) []byte {
+		value, err := n.Float64()
+		if err != nil || !(stakeFields[key] || stakeMaps[parent]) {
+			return []byte(n.String())
+		}
+		return []byte(`"` + stakeAmount(value).padded() + `"`)
+	})
+}
+
+// stakeEncoding is middleware applying Config.StakeAsString to JSON
+// responses.
+func (s *Server) stakeEncoding(next http.Handler) http.Handler {
+	if !s.config.StakeAsString {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &jsonRewriter{ResponseWriter: w, rewrite: stringifyStakes}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+// marshalJSON is json.Marshal applying Config.StakeAsString, for the
+// streams and exports stakeEncoding doesn't see.
+func (s *Server) marshalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || !s.config.StakeAsString {
+		return data, err
+	}
+	return stringifyStakes(data)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tagPattern is what a tag may look like once lowercased.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Tag is a row of the tags table: an operator's label on an address, such
+// as "team" or "flagged". Tags have no effect on eligibility.
+type Tag struct {
+	Address   string `json:"address"`
+	Tag       string `json:"tag"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// normalizeTag returns the lowercase form of a tag; ok is false for
+// anything tagPattern rejects.
+func normalizeTag(value string) (tag string, ok bool) {
+	tag = strings.ToLower(strings.TrimSpace(value))
+	return tag, tagPattern.MatchString(tag)
+}
+
+// tagsByAddress returns every address's tags, sorted.
+func (s *Server) tagsByAddress() (map[string][]string, error) {
+	rows, err := s.db.Query("SELECT address, tag FROM tags ORDER BY address, tag")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var address, tag string
+		if err := rows.Scan(&address, &tag); err != nil {
+			return nil, err
+		}
+		tags[address] = append(tags[address], tag)
+	}
+	return tags, rows.Err()
+}
+
+// handleListTags returns the tags table, by address then tag, narrowed to
+// one tag with ?tag=.
+func (s *Server) handleListTags(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT address, tag, created_at FROM tags"
+	var args []interface{}
+	if value := r.URL.Query().Get("tag"); value != "" {
+		tag, ok := normalizeTag(value)
+		if !ok {
+			http.Error(w, "invalid tag", http.StatusBadRequest)
+			return
+		}
+		query += " WHERE tag = ?"
+		args = append(args, tag)
+	}
+	rows, err := s.db.Query(query+" ORDER BY address, tag", args...)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Address, &t.Tag, &t.CreatedAt); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		tags = append(tags, t)
+	}
+	if err := rows.Err(); err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tags": tags})
+}
+
+// tagRoute parses the {address} and {tag} of a /tags route, answering 400
+// when either is invalid.
+func tagRoute(w http.ResponseWriter, r *http.Request) (address, tag string, ok bool) {
+	vars := mux.Vars(r)
+	if address, ok = overrideAddress(vars["address"]); !ok {
+		http.Error(w, "invalid address", http.StatusBadRequest)
+		return "", "", false
+	}
+	if tag, ok = normalizeTag(vars["tag"]); !ok {
+		http.Error(w, "invalid tag: use up to 32 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return "", "", false
+	}
+	return address, tag, true
+}
+
+// handleAddTag tags {address} with {tag}. The address need not be indexed,
+// and tagging it again changes nothing.
+func (s *Server) handleAddTag(w http.ResponseWriter, r *http.Request) {
+	address, tag, ok := tagRoute(w, r)
+	if !ok {
+		return
+	}
+	_, err := s.db.Exec("INSERT OR IGNORE INTO tags (address, tag, created_at) VALUES (?, ?, ?)",
+		address, tag, time.Now().Unix())
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteTag removes {tag} from {address}; 404 when it isn't there.
+func (s *Server) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
+	address, tag, ok := tagRoute(w, r)
+	if !ok {
+		return
+	}
+	res, err := s.db.Exec("DELETE FROM tags WHERE address = ? AND tag = ?", address, tag)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "No such tag on address", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
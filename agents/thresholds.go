@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultMinStake is the stake an identity needs unless its state has its
+// own threshold.
+const defaultMinStake = 10000
+
+// parseStateThresholds parses a comma-separated list of state:min_stake
+// pairs, e.g. "Newbie:20000,Verified:10000".
+func parseStateThresholds(value string) (map[string]float64, error) {
+	thresholds := make(map[string]float64)
+	for _, part := range strings.Split(value, ",") {
+		state, min, ok := strings.Cut(strings.TrimSpace(part), ":")
+		state = strings.TrimSpace(state)
+		if !ok || state == "" {
+			return nil, fmt.Errorf("threshold %q must be state:min_stake", part)
+		}
+		stake, err := strconv.ParseFloat(strings.TrimSpace(min), 64)
+		if err != nil || stake < 0 {
+			return nil, fmt.Errorf("threshold for %s has an invalid min_stake", state)
+		}
+		thresholds[state] = stake
+	}
+	return thresholds, nil
+}
+
+// minStake returns the stake required for an identity in state.
+func (s *Server) minStake(state string) float64 {
+	if min, ok := s.rules().StateThresholds[state]; ok {
+		return min
+	}
+	return defaultMinStake
+}
+
+// eligibleStakeCondition returns the condition on the identities table
+// keeping those in an eligible state with at least its minimum stake, for
+// queries that count eligible identities in SQL.
+func (s *Server) eligibleStakeCondition() (string, []interface{}) {
+	states := s.eligibleStates()
+	if len(states) == 0 {
+		return "0", nil
+	}
+	clauses := make([]string, len(states))
+	args := make([]interface{}, 0, 2*len(states))
+	for i, state := range states {
+		clauses[i] = "(state = ? AND stake >= ?)"
+		args = append(args, state, s.minStake(state))
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// insufficientStakeReason explains a rejection, naming the state when its
+// threshold differs from the default.
+func insufficientStakeReason(stake, minimum float64, state string, thresholds map[string]float64) string {
+	formatted := strings.TrimSuffix(strings.TrimSuffix(formatIDNA(minimum), " iDNA"), ".00")
+	if _, ok := thresholds[state]; ok {
+		return fmt.Sprintf("Insufficient stake: %s (minimum %s for %s)", formatIDNA(stake), formatted, state)
+	}
+	return fmt.Sprintf("Insufficient stake: %s (minimum %s)", formatIDNA(stake), formatted)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// stakeTier is a named stake band starting at MinStake and running up to the
+// next tier's MinStake.
+type stakeTier struct {
+	Label    string  `json:"tier"`
+	MinStake float64 `json:"min_stake"`
+}
+
+// stakeTiers is an ordered tier definition, lowest MinStake first.
+type stakeTiers []stakeTier
+
+// defaultStakeTiers is used when STAKE_TIERS is not set.
+var defaultStakeTiers = stakeTiers{
+	{Label: "<1k", MinStake: 0},
+	{Label: "1k-10k", MinStake: 1000},
+	{Label: "10k-100k", MinStake: 10000},
+	{Label: "100k+", MinStake: 100000},
+}
+
+// parseStakeTiers parses a comma-separated list of label:min_stake pairs,
+// e.g. "small:0,medium:1000,large:10000". Minimums must strictly increase.
+func parseStakeTiers(value string) (stakeTiers, error) {
+	var tiers stakeTiers
+	for _, part := range strings.Split(value, ",") {
+		label, min, ok := strings.Cut(strings.TrimSpace(part), ":")
+		label = strings.TrimSpace(label)
+		if !ok || label == "" {
+			return nil, fmt.Errorf("tier %q must be label:min_stake", part)
+		}
+		stake, err := strconv.ParseFloat(strings.TrimSpace(min), 64)
+		if err != nil || stake < 0 {
+			return nil, fmt.Errorf("tier %q has an invalid min_stake", label)
+		}
+		if n := len(tiers); n > 0 && stake <= tiers[n-1].MinStake {
+			return nil, fmt.Errorf("tier %q must have a higher min_stake than %q", label, tiers[n-1].Label)
+		}
+		tiers = append(tiers, stakeTier{Label: label, MinStake: stake})
+	}
+	return tiers, nil
+}
+
+// classify returns the label of the highest tier whose MinStake is at most
+// stake, or "" when stake is below every tier.
+func (t stakeTiers) classify(stake float64) string {
+	label := ""
+	for _, tier := range t {
+		if stake < tier.MinStake {
+			break
+		}
+		label = tier.Label
+	}
+	return label
+}
+
+// stakeTiers returns the configured tiers, falling back to the defaults.
+func (s *Server) stakeTiers() stakeTiers {
+	if len(s.config.StakeTiers) > 0 {
+		return s.config.StakeTiers
+	}
+	return defaultStakeTiers
+}
+
+// TierCount is one entry of /stats/tiers.
+type TierCount struct {
+	stakeTier
+	Count int `json:"count"`
+}
+
+// handleStatsTiers counts indexed identities per stake tier, in tier order.
+func (s *Server) handleStatsTiers(w http.ResponseWriter, r *http.Request) {
+	tiers := s.stakeTiers()
+	counts := make([]TierCount, len(tiers))
+	index := make(map[string]int, len(tiers))
+	for i, tier := range tiers {
+		counts[i].stakeTier = tier
+		index[tier.Label] = i
+	}
+
+	rows, err := s.db.QueryContext(r.Context(), "SELECT stake FROM identities WHERE stake IS NOT NULL")
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stake float64
+		if err := rows.Scan(&stake); err != nil {
+			continue
+		}
+		if i, ok := index[tiers.classify(stake)]; ok {
+			counts[i].Count++
+		}
+	}
+
+	writeList(w, r, counts, counts, responseMeta{Count: len(counts)})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// payloadSampleSize bounds how much of an unexpected payload is logged.
+const payloadSampleSize = 512
+
+// maxTolerantDepth bounds how deep decodeIdentitiesTolerant looks for the
+// identity list, so a huge unrelated document is not walked entirely.
+const maxTolerantDepth = 4
+
+// Field aliases decodeIdentitiesTolerant accepts, as normalized by
+// normalizeKey.
+var (
+	addressKeys      = []string{"address", "addr"}
+	stateKeys        = []string{"state", "status", "identitystate"}
+	stakeKeys        = []string{"stake", "stakeamount"}
+	delegateeKeys    = []string{"delegatee", "delegatedto"}
+	lastEpochKeys    = []string{"lastvalidationepoch"}
+	identityListKeys = []string{"identities", "items", "data", "result"}
+	tokenKeys        = []string{"continuationtoken", "nexttoken", "cursor"}
+	totalKeys        = []string{"total", "totalcount"}
+)
+
+// decodeIdentitiesTolerant recovers what it can from a dna_identities
+// result the strict decoder rejected: the identity list may sit deeper in
+// the document, fields may be renamed within addressKeys and friends or
+// wrapped in an object of their own, and stakes may be numbers. Entries
+// without an address or a state are skipped and counted, so the stored
+// identity is kept rather than overwritten with an empty state. ok is false
+// when no identity list is found at all.
+func decodeIdentitiesTolerant(raw []byte) (page identitiesPage, skipped int, ok bool) {
+	var document interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return identitiesPage{}, 0, false
+	}
+	list, parent, ok := findIdentityList(document, nil, 0)
+	if !ok {
+		return identitiesPage{}, 0, false
+	}
+	// Paging fields sit next to the list, or else at the top
+	for _, holder := range []interface{}{parent, document} {
+		fields, isObject := holder.(map[string]interface{})
+		if !isObject {
+			continue
+		}
+		if token, found := lookupField(fields, tokenKeys); found && page.ContinuationToken == "" {
+			page.ContinuationToken = scalarString(token)
+		}
+		if total, found := lookupField(fields, totalKeys); found && page.Total == 0 {
+			page.Total, _ = strconv.Atoi(scalarString(total))
+		}
+	}
+	for _, item := range list {
+		fields, isObject := item.(map[string]interface{})
+		if !isObject {
+			skipped++
+			continue
+		}
+		identity, ok := tolerantIdentity(fields)
+		if !ok {
+			skipped++
+			continue
+		}
+		page.Identities = append(page.Identities, identity)
+	}
+	return page, skipped, true
+}
+
+func tolerantIdentity(fields map[string]interface{}) (nodeIdentity, bool) {
+	value, _ := lookupField(fields, addressKeys)
+	address, _ := value.(string)
+	if address == "" {
+		return nodeIdentity{}, false
+	}
+	identity := nodeIdentity{Address: address}
+	value, _ = lookupField(fields, stateKeys)
+	if identity.State, _ = value.(string); identity.State == "" {
+		return nodeIdentity{}, false
+	}
+	if value, found := lookupField(fields, stakeKeys); found {
+		if stake, err := strconv.ParseFloat(scalarString(value), 64); err == nil {
+			identity.Stake = nodeStake{Value: stake, Known: true}
+		}
+	}
+	if value, found := lookupField(fields, delegateeKeys); found {
+		identity.Delegatee, _ = value.(string)
+	}
+	if value, found := lookupField(fields, lastEpochKeys); found {
+		if epoch, err := strconv.Atoi(scalarString(value)); err == nil {
+			identity.LastValidationEpoch = &epoch
+		}
+	}
+	return identity, true
+}
+
+// findIdentityList returns the first array of objects carrying an address,
+// looking under identityListKeys before the other keys of an object, along
+// with the object holding it (nil for a bare array).
+func findIdentityList(value interface{}, parent map[string]interface{}, depth int) ([]interface{}, map[string]interface{}, bool) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			if fields, ok := item.(map[string]interface{}); ok {
+				if _, found := lookupField(fields, addressKeys); found {
+					return value, parent, true
+				}
+			}
+		}
+	case map[string]interface{}:
+		if depth >= maxTolerantDepth {
+			return nil, nil, false
+		}
+		if list, found := lookupField(value, identityListKeys); found {
+			if list, parent, ok := findIdentityList(list, value, depth+1); ok {
+				return list, parent, true
+			}
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if list, parent, ok := findIdentityList(value[key], value, depth+1); ok {
+				return list, parent, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// lookupField finds the first of aliases among fields' keys, ignoring case,
+// '_' and '-', then among the fields of directly nested objects.
+func lookupField(fields map[string]interface{}, aliases []string) (interface{}, bool) {
+	for _, alias := range aliases {
+		for key, value := range fields {
+			if normalizeKey(key) == alias {
+				return value, true
+			}
+		}
+	}
+	for _, value := range fields {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, alias := range aliases {
+			for key, value := range nested {
+				if normalizeKey(key) == alias {
+					return value, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+// scalarString renders a JSON string or number as a string, and anything
+// else as "".
+func scalarString(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
+
+// payloadSample returns the start of raw for logging.
+func payloadSample(raw []byte) string {
+	if len(raw) <= payloadSampleSize {
+		return string(raw)
+	}
+	return string(raw[:payloadSampleSize]) + "..."
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Batch authentication: a wallet controlling several addresses signs the
+// session nonce with each of them and sends all signatures to authenticate
+// at once. AUTH_BATCH_POLICY decides whether the session is authenticated
+// when "any" (the default) or "all" of the addresses pass.
+var (
+	AUTH_BATCH_POLICY = getenv("AUTH_BATCH_POLICY", "any")
+	AUTH_BATCH_MAX    = getenvInt("AUTH_BATCH_MAX", 20)
+)
+
+// validateBatchPolicy rejects an AUTH_BATCH_POLICY other than "any" or
+// "all", which would otherwise be read as "any" and let a session through
+// on one address where all were meant to pass.
+func validateBatchPolicy(policy string) error {
+	if policy != "any" && policy != "all" {
+		return fmt.Errorf("%q is not any or all", policy)
+	}
+	return nil
+}
+
+// addressSignature is one entry of a batch authenticate request.
+type addressSignature struct {
+	Address   string `json:"address"`
+	Signature string `json:"signature"`
+}
+
+// batchAuthResult is the per-address outcome of a batch authenticate.
+type batchAuthResult struct {
+	Address       string  `json:"address"`
+	Authenticated bool    `json:"authenticated"`
+	State         string  `json:"state,omitempty"`
+	Stake         float64 `json:"stake,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	// verified is set when the signature checked out, eligible or not
+	verified bool
+}
+
+// authOutcome is what authenticate stores on the session. Address is the
+// one whose state and stake are recorded; verified lists every address
+// whose signature checked out.
+type authOutcome struct {
+	eligible bool
+	address  string
+	state    string
+	stake    float64
+	verified []string
+	results  []batchAuthResult
+}
+
+// isEligibleIdentity reports whether state and stake qualify for access.
+func isEligibleIdentity(state string, stake float64) bool {
+	return (state == "Newbie" || state == "Verified" || state == "Human") && stake >= stakeThreshold
+}
+
+// validateBatch checks a batch before any signature is verified and returns
+// the protocol error to send, or "".
+func validateBatch(signatures []addressSignature) string {
+	if len(signatures) > AUTH_BATCH_MAX {
+		return "Too many signatures"
+	}
+	seen := make(map[string]bool, len(signatures))
+	for _, s := range signatures {
+		address, ok := normalizeAddress(s.Address)
+		if !ok || s.Signature == "" {
+			return "Invalid signatures"
+		}
+		if seen[address] {
+			return "Duplicate address " + address
+		}
+		seen[address] = true
+	}
+	return ""
+}
+
+// batchSignatureKey is the batch's stand-in for a single signature in the
+// replay and idempotency checks: the same set of signatures gives the same
+// key in any order.
+func batchSignatureKey(signatures []addressSignature) string {
+	parts := make([]string, len(signatures))
+	for i, s := range signatures {
+		address, _ := normalizeAddress(s.Address)
+		parts[i] = address + ":" + strings.ToLower(s.Signature)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// authenticateBatch verifies each signature against nonce. Locked-out
+// addresses, or all of them when clientAddr is locked out, are skipped, and
+// bad signatures count towards the lockouts as in single authenticate. The session takes the state and stake
+// of the first address that passes, or of the first verified one.
+func authenticateBatch(nonce, clientAddr string, signatures []addressSignature) authOutcome {
+	now := time.Now()
+	out := authOutcome{results: make([]batchAuthResult, 0, len(signatures))}
+	passed := 0
+	for _, s := range signatures {
+		address, _ := normalizeAddress(s.Address)
+		result := batchAuthResult{Address: address}
+		switch {
+		case !authLockedUntil(clientAddr, address, now).IsZero():
+			log.Printf("[AUTH][BATCH] Address %s from %s locked out", address, clientAddr)
+			result.Error = "Too many failed attempts"
+		case !verifySignature(nonce, address, s.Signature):
+			log.Printf("[AUTH][BATCH] Signature verification failed for address %s from %s", address, clientAddr)
+			recordAuthFailure(clientAddr, address, now)
+			result.Error = "Invalid signature"
+		default:
+			resetAuthFailures(address)
+			out.verified = append(out.verified, address)
+			result.verified = true
+			result.State, result.Stake = lookupIdentity(address)
+			result.Authenticated = isEligibleIdentity(result.State, result.Stake)
+			if !result.Authenticated {
+				result.Error = "Not eligible"
+			}
+			if (result.Authenticated && passed == 0) || out.address == "" {
+				out.address, out.state, out.stake = address, result.State, result.Stake
+			}
+			if result.Authenticated {
+				passed++
+			}
+		}
+		out.results = append(out.results, result)
+	}
+
+	if AUTH_BATCH_POLICY == "all" {
+		out.eligible = passed == len(signatures)
+	} else {
+		out.eligible = passed > 0
+	}
+	log.Printf("[AUTH][BATCH] %d of %d addresses passed, policy %s, authenticated: %t",
+		passed, len(signatures), AUTH_BATCH_POLICY, out.eligible)
+	return out
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// Brute-force protection: after AUTH_MAX_FAILURES bad signatures for one
+// address within AUTH_FAILURE_WINDOW, from any number of clients,
+// authenticate is refused for that address for AUTH_LOCKOUT. Optionally,
+// AUTH_MAX_FAILURES_PER_IP also locks out a client IP that sends that many
+// bad signatures, for whatever addresses, so one client can't try many
+// addresses either. Counters live in the database so a restart doesn't
+// clear them.
+var (
+	AUTH_MAX_FAILURES        = getenvInt("AUTH_MAX_FAILURES", 5)
+	AUTH_MAX_FAILURES_PER_IP = getenvInt("AUTH_MAX_FAILURES_PER_IP", 0)
+	AUTH_FAILURE_WINDOW      = time.Duration(getenvInt("AUTH_FAILURE_WINDOW_MINUTES", 15)) * time.Minute
+	AUTH_LOCKOUT             = time.Duration(getenvInt("AUTH_LOCKOUT_MINUTES", 15)) * time.Minute
+)
+
+const authAttemptsSchema = `
+        CREATE TABLE IF NOT EXISTS auth_attempts (
+            address TEXT PRIMARY KEY,
+            failures INTEGER NOT NULL,
+            window_start INTEGER NOT NULL,
+            locked_until INTEGER NOT NULL DEFAULT 0
+        )
+    `
+
+func createAuthAttemptsTable() {
+	if err := migrateAuthAttempts(); err != nil {
+		log.Fatal(err)
+	}
+	_, err := db.Exec(authAttemptsSchema)
+	if err == nil {
+		_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS auth_ip_attempts (
+            client_ip TEXT PRIMARY KEY,
+            failures INTEGER NOT NULL,
+            window_start INTEGER NOT NULL,
+            locked_until INTEGER NOT NULL DEFAULT 0
+        )
+    `)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateAuthAttempts converts an auth_attempts table keyed by client IP
+// and address back to one keyed by address, adding up each address's
+// failures across clients and keeping its latest lockout.
+func migrateAuthAttempts() error {
+	if _, err := db.Exec("SELECT client_ip FROM auth_attempts LIMIT 0"); err != nil {
+		// No table yet, or already keyed by address
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range []string{
+		"ALTER TABLE auth_attempts RENAME TO auth_attempts_by_client",
+		authAttemptsSchema,
+		`INSERT INTO auth_attempts (address, failures, window_start, locked_until)
+            SELECT address, SUM(failures), MIN(window_start), MAX(locked_until)
+            FROM auth_attempts_by_client GROUP BY address`,
+		"DROP TABLE auth_attempts_by_client",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// authLockedUntil returns when the lockout for address, or for clientAddr
+// when AUTH_MAX_FAILURES_PER_IP is set, ends, whichever is later, or the
+// zero time if neither is locked out at now.
+func authLockedUntil(clientAddr, address string, now time.Time) time.Time {
+	until := lockedUntil("SELECT locked_until FROM auth_attempts WHERE address=?", strings.ToLower(address), now)
+	if AUTH_MAX_FAILURES_PER_IP > 0 {
+		if ip := lockedUntil("SELECT locked_until FROM auth_ip_attempts WHERE client_ip=?", clientAddr, now); ip.After(until) {
+			until = ip
+		}
+	}
+	return until
+}
+
+func lockedUntil(query, key string, now time.Time) time.Time {
+	var lockedUntil int64
+	err := db.QueryRow(query, key).Scan(&lockedUntil)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[AUTH][LIMIT] DB error: %v", err)
+		}
+		return time.Time{}
+	}
+	if lockedUntil <= now.Unix() {
+		return time.Time{}
+	}
+	return time.Unix(lockedUntil, 0)
+}
+
+// recordAuthFailure counts a failed signature for address, and for
+// clientAddr when AUTH_MAX_FAILURES_PER_IP is set, starting a new window if
+// the previous one has passed, and locks either out once its count reaches
+// its limit.
+func recordAuthFailure(clientAddr, address string, now time.Time) {
+	recordFailure("auth_attempts", "address", strings.ToLower(address), AUTH_MAX_FAILURES, now)
+	if AUTH_MAX_FAILURES_PER_IP > 0 {
+		recordFailure("auth_ip_attempts", "client_ip", clientAddr, AUTH_MAX_FAILURES_PER_IP, now)
+	}
+}
+
+func recordFailure(table, column, key string, max int, now time.Time) {
+	windowStart := now.Add(-AUTH_FAILURE_WINDOW).Unix()
+	_, err := db.Exec(`
+        INSERT INTO `+table+` (`+column+`, failures, window_start) VALUES (?, 1, ?)
+        ON CONFLICT(`+column+`) DO UPDATE SET
+            failures = CASE WHEN window_start <= ? THEN 1 ELSE failures + 1 END,
+            window_start = CASE WHEN window_start <= ? THEN excluded.window_start ELSE window_start END`,
+		key, now.Unix(), windowStart, windowStart)
+	if err == nil {
+		_, err = db.Exec("UPDATE "+table+" SET locked_until=?, failures=0 WHERE "+column+"=? AND failures>=?",
+			now.Add(AUTH_LOCKOUT).Unix(), key, max)
+	}
+	if err != nil {
+		log.Printf("[AUTH][LIMIT] DB error: %v", err)
+	}
+}
+
+// resetAuthFailures clears the counter for address after a valid signature.
+// A client's count is left to run out, so one valid key doesn't clear the
+// way for guessing others.
+func resetAuthFailures(address string) {
+	if _, err := db.Exec("DELETE FROM auth_attempts WHERE address=?", strings.ToLower(address)); err != nil {
+		log.Printf("[AUTH][LIMIT] DB error: %v", err)
+	}
+}
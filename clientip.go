@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TRUSTED_PROXIES lists the CIDRs (or bare IPs) of reverse proxies whose
+// X-Forwarded-For header is believed. Empty means the header is ignored.
+var TRUSTED_PROXIES = parseTrustedProxies(getenv("TRUSTED_PROXIES", ""))
+
+// parseTrustedProxies parses a comma-separated list of CIDRs and IPs.
+// Invalid entries are logged and skipped.
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("[PROXY] Ignoring invalid trusted proxy %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range TRUSTED_PROXIES {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client behind r. X-Forwarded-For is
+// only honored when the immediate peer is a trusted proxy, and then read
+// right to left, skipping trusted hops, so entries a client prepended itself
+// are never used.
+func clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	ip := net.ParseIP(peer)
+	if ip == nil || !isTrustedProxy(ip) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Garbage in the header; trust nothing further left
+			break
+		}
+		client = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
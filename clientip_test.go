@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	orig := TRUSTED_PROXIES
+	TRUSTED_PROXIES = parseTrustedProxies("10.0.0.0/8, 192.168.1.5, ::1, not-a-cidr")
+	t.Cleanup(func() { TRUSTED_PROXIES = orig })
+
+	if len(TRUSTED_PROXIES) != 3 {
+		t.Fatalf("Expected 3 trusted proxies, got %d", len(TRUSTED_PROXIES))
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"direct client spoofing the header", "203.0.113.7:5000", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:443", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"trusted proxy without header", "10.0.0.2:443", nil, "10.0.0.2"},
+		{"client-prepended hop is ignored", "10.0.0.2:443", []string{"1.2.3.4, 198.51.100.9"}, "198.51.100.9"},
+		{"chain of trusted proxies", "192.168.1.5:80", []string{"198.51.100.9, 10.1.2.3"}, "198.51.100.9"},
+		{"multiple header lines", "10.0.0.2:443", []string{"1.2.3.4", "198.51.100.9, 10.9.9.9"}, "198.51.100.9"},
+		{"only trusted hops", "10.0.0.2:443", []string{"10.3.3.3"}, "10.3.3.3"},
+		{"garbage hop", "10.0.0.2:443", []string{"198.51.100.9, bogus"}, "10.0.0.2"},
+		{"ipv6 proxy", "[::1]:8080", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(req); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
@@ -7,12 +7,12 @@ toolchain go1.22.3
 require (
 	github.com/ethereum/go-ethereum v1.14.2
 	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/crypto v0.22.0
 )
 
 require (
 	github.com/btcsuite/btcd/btcec/v2 v2.2.0 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
 	github.com/holiman/uint256 v1.2.4 // indirect
-	golang.org/x/crypto v0.22.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 )
@@ -0,0 +1,114 @@
+package idenarpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling the node while the
+// client's Breaker is open.
+var ErrCircuitOpen = errors.New("node circuit open, call skipped")
+
+// Breaker states, as reported by State.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker is a circuit breaker for calls to one node. After threshold
+// consecutive failures it opens and rejects calls for cooldown, so a node
+// coming back from an outage is not met by every pending retry at once.
+// Then it lets a single probe through (half-open): success closes it,
+// failure opens it for another cooldown. A nil *Breaker never opens.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	// now is replaced in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a breaker opening after threshold consecutive
+// failures, or nil when threshold is not positive.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a call may go to the node now.
+func (b *Breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// record counts the outcome of a call allow let through. Only an
+// unreachable or failing node counts against it. Rejected keys and
+// cancelled requests say nothing about the node's health either way, so
+// they leave the breaker as it was; a cancelled probe just lets the next
+// call probe instead.
+func (b *Breaker) record(ctx context.Context, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil && (IsAuthError(err) || ctx.Err() != nil) {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// State returns BreakerClosed, BreakerOpen or BreakerHalfOpen, the latter
+// once the cooldown is over and the next call will probe the node.
+func (b *Breaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return BreakerClosed
+	case b.probing || b.now().Sub(b.openedAt) >= b.cooldown:
+		return BreakerHalfOpen
+	}
+	return BreakerOpen
+}
+
+// Failures returns the number of consecutive failed calls.
+func (b *Breaker) Failures() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
@@ -0,0 +1,148 @@
+package idenarpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrNoResult is returned by Call when the node answers with a null result.
+var ErrNoResult = errors.New("no result in RPC response")
+
+// Client calls an Idena node, or a proxy in front of one, over JSON-RPC.
+type Client struct {
+	URL  string
+	Key  string
+	HTTP *http.Client
+	// Breaker, when set, skips calls while the node is failing. Share one
+	// between the clients of a node.
+	Breaker *Breaker
+}
+
+// NewClient returns a client for the node at url. key may be empty.
+func NewClient(url, key string, timeout time.Duration) *Client {
+	return &Client{
+		URL:  url,
+		Key:  key,
+		HTTP: &http.Client{Timeout: timeout},
+	}
+}
+
+// NewRequest builds a request for method carrying the client's API key.
+func (c *Client) NewRequest(id int, method string, params ...interface{}) Request {
+	if params == nil {
+		params = []interface{}{}
+	}
+	return Request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      id,
+		Key:     c.Key,
+	}
+}
+
+// Call invokes method and decodes its result into result.
+func (c *Client) Call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	body, err := c.Post(ctx, c.NewRequest(1, method, params...))
+	if err != nil {
+		return err
+	}
+
+	var resp Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return ErrNoResult
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Post sends payload, a Request or a batch of them, and returns the raw
+// response body. The API key is also sent as a bearer token for proxies
+// that authenticate at the HTTP layer.
+func (c *Client) Post(ctx context.Context, payload interface{}) ([]byte, error) {
+	if err := c.Breaker.allow(); err != nil {
+		return nil, err
+	}
+	body, err := c.post(ctx, payload)
+	c.Breaker.record(ctx, err)
+	return body, err
+}
+
+func (c *Client) post(ctx context.Context, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Key)
+	}
+
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{StatusCode: resp.StatusCode}
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Epoch returns the node's current epoch number.
+func (c *Client) Epoch(ctx context.Context) (int, error) {
+	var result struct {
+		Epoch int `json:"epoch"`
+	}
+	err := c.Call(ctx, "dna_epoch", nil, &result)
+	return result.Epoch, err
+}
+
+// Balance is an address's dna_getBalance result, amounts in iDNA as the
+// node's decimal strings.
+type Balance struct {
+	Balance string `json:"balance"`
+	Stake   string `json:"stake"`
+}
+
+// Balance returns the balance and stake of address.
+func (c *Client) Balance(ctx context.Context, address string) (Balance, error) {
+	var result Balance
+	err := c.Call(ctx, "dna_getBalance", []interface{}{address}, &result)
+	return result, err
+}
+
+// Validation is the part of an address's dna_identity result describing
+// its participation in validation.
+type Validation struct {
+	Online    bool `json:"online"`
+	MadeFlips int  `json:"madeFlips"`
+}
+
+// Validation returns the online status and flips made this epoch of
+// address.
+func (c *Client) Validation(ctx context.Context, address string) (Validation, error) {
+	var result Validation
+	err := c.Call(ctx, "dna_identity", []interface{}{address}, &result)
+	return result, err
+}
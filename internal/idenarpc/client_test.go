@@ -0,0 +1,237 @@
+package idenarpc
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientCall(t *testing.T) {
+	var got Request
+	var auth string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		switch got.Method {
+		case "dna_identity":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"state":"Human"}}`))
+		case "dna_epoch":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+		case "dna_broken":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found"}}`))
+		}
+	}))
+	defer node.Close()
+
+	client := NewClient(node.URL, "secret", 5*time.Second)
+	ctx := context.Background()
+
+	var identity struct {
+		State string `json:"state"`
+	}
+	if err := client.Call(ctx, "dna_identity", []interface{}{"0x01"}, &identity); err != nil {
+		t.Fatalf("Call error: %v", err)
+	}
+	if identity.State != "Human" {
+		t.Errorf("Expected state Human, got %q", identity.State)
+	}
+	if got.JSONRPC != "2.0" || got.Key != "secret" || len(got.Params) != 1 || got.Params[0] != "0x01" {
+		t.Errorf("Unexpected request: %+v", got)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("Expected bearer token, got %q", auth)
+	}
+
+	var ignored interface{}
+	var rpcErr *Error
+	if err := client.Call(ctx, "dna_unknown", nil, &ignored); !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Errorf("Expected RPC error -32601, got %v", err)
+	}
+	if err := client.Call(ctx, "dna_epoch", nil, &ignored); !errors.Is(err, ErrNoResult) {
+		t.Errorf("Expected ErrNoResult, got %v", err)
+	}
+	if err := client.Call(ctx, "dna_broken", nil, &ignored); err == nil || err.Error() != "node returned HTTP 503" {
+		t.Errorf("Expected HTTP error, got %v", err)
+	}
+}
+
+func TestClientOmitsEmptyKey(t *testing.T) {
+	var body map[string]interface{}
+	var auth string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"result":1}`))
+	}))
+	defer node.Close()
+
+	var result int
+	if err := NewClient(node.URL, "", time.Second).Call(context.Background(), "dna_epoch", nil, &result); err != nil {
+		t.Fatalf("Call error: %v", err)
+	}
+	if _, ok := body["key"]; ok || auth != "" {
+		t.Errorf("Expected no key to be sent, got body %v and auth %q", body, auth)
+	}
+	if params, ok := body["params"].([]interface{}); !ok || len(params) != 0 {
+		t.Errorf("Expected empty params array, got %v", body["params"])
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&Error{Code: -32800, Message: "the key is invalid"}, true},
+		{&HTTPError{StatusCode: http.StatusUnauthorized}, true},
+		{&HTTPError{StatusCode: http.StatusForbidden}, true},
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable}, false},
+		{&Error{Code: -32800, Message: "Unauthorized"}, true},
+		{&Error{Code: -32601, Message: "method not found"}, false},
+		{&Error{Code: -32000, Message: "duplicate key"}, false},
+		{&Error{Code: -32000, Message: "unknown key: foo"}, false},
+		{&Error{Code: -32000, Message: "key not found in keystore"}, false},
+		{ErrNoResult, false},
+	}
+	for _, test := range tests {
+		if got := IsAuthError(test.err); got != test.want {
+			t.Errorf("IsAuthError(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var calls int
+	down := true
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if down {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"epoch":7}}`))
+	}))
+	defer node.Close()
+
+	now := time.Unix(1000, 0)
+	breaker := NewBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+	client := NewClient(node.URL, "", time.Second)
+	client.Breaker = breaker
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Epoch(ctx); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("call %d: expected the node's error, got %v", i+1, err)
+		}
+	}
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("expected open after 3 failures, got %s", state)
+	}
+	if _, err := client.Epoch(ctx); !errors.Is(err, ErrCircuitOpen) || calls != 3 {
+		t.Errorf("expected the call to be skipped, got %v after %d calls", err, calls)
+	}
+
+	// After the cooldown one probe goes through; failing, it reopens
+	now = now.Add(time.Minute)
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Errorf("expected half-open after the cooldown, got %s", state)
+	}
+	if _, err := client.Epoch(ctx); err == nil || errors.Is(err, ErrCircuitOpen) || calls != 4 {
+		t.Errorf("expected a failed probe, got %v after %d calls", err, calls)
+	}
+	if _, err := client.Epoch(ctx); !errors.Is(err, ErrCircuitOpen) || calls != 4 {
+		t.Errorf("expected open again after a failed probe, got %v after %d calls", err, calls)
+	}
+
+	// A cancelled probe proves nothing: the circuit stays open and the
+	// next call probes again
+	now = now.Add(time.Minute)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := client.Epoch(cancelled); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected the cancelled probe to be let through, got %v", err)
+	}
+	if state := breaker.State(); state == BreakerClosed || breaker.Failures() != 4 {
+		t.Errorf("expected the circuit still open with 4 failures, got %s with %d", state, breaker.Failures())
+	}
+
+	// A successful probe closes it
+	down = false
+	if epoch, err := client.Epoch(ctx); err != nil || epoch != 7 {
+		t.Fatalf("expected the probe to succeed, got %d, %v", epoch, err)
+	}
+	if state := breaker.State(); state != BreakerClosed || breaker.Failures() != 0 {
+		t.Errorf("expected closed with no failures, got %s with %d", state, breaker.Failures())
+	}
+
+	// Rejected keys don't count either way
+	authBreaker := NewBreaker(2, time.Minute)
+	authBreaker.record(ctx, &HTTPError{StatusCode: http.StatusUnauthorized})
+	if state := authBreaker.State(); state != BreakerClosed {
+		t.Errorf("expected an auth error to leave the breaker closed, got %s", state)
+	}
+	authBreaker.record(ctx, errors.New("connection refused"))
+	authBreaker.record(ctx, &HTTPError{StatusCode: http.StatusUnauthorized})
+	if authBreaker.Failures() != 1 {
+		t.Errorf("expected an auth error to keep the failure count, got %d", authBreaker.Failures())
+	}
+	if NewBreaker(0, time.Minute) != nil {
+		t.Error("expected a zero threshold to disable the breaker")
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	node := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"epoch":42}}`))
+	}))
+	defer node.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: node.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	epoch := func(opts TLSOptions) (int, error) {
+		httpClient, err := opts.HTTPClient(time.Second)
+		if err != nil {
+			return 0, err
+		}
+		client := NewClient(node.URL, "", time.Second)
+		client.HTTP = httpClient
+		return client.Epoch(context.Background())
+	}
+
+	if _, err := epoch(TLSOptions{}); err == nil {
+		t.Error("Expected the default client to reject the test CA")
+	}
+	if got, err := epoch(TLSOptions{CAFile: caFile}); err != nil || got != 42 {
+		t.Errorf("Expected epoch 42 with the CA bundle, got %d, %v", got, err)
+	}
+	if got, err := epoch(TLSOptions{InsecureSkipVerify: true}); err != nil || got != 42 {
+		t.Errorf("Expected epoch 42 without verification, got %d, %v", got, err)
+	}
+
+	invalid := []TLSOptions{
+		{CAFile: filepath.Join(dir, "missing.pem")},
+		{CAFile: filepath.Join(dir, "empty.pem")},
+		{CertFile: caFile},
+		{CertFile: caFile, KeyFile: caFile},
+	}
+	os.WriteFile(filepath.Join(dir, "empty.pem"), nil, 0o600)
+	for _, opts := range invalid {
+		if _, err := opts.Config(); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Package idenarpc holds the JSON-RPC types shared by the components that
+// talk to an Idena node.
+package idenarpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Request is a JSON-RPC request. Idena nodes read the API key from Key.
+type Request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      int           `json:"id"`
+	Key     string        `json:"key,omitempty"`
+}
+
+// Response is a JSON-RPC response with the result left undecoded.
+type Response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+	ID     int             `json:"id"`
+}
+
+// Error is the error object of a failed call.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// HTTPError is returned when the node answers with a status other than 200.
+type HTTPError struct {
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("node returned HTTP %d", e.StatusCode)
+}
+
+// authMessages are the RPC error messages that mean the key was rejected:
+// the node's own, and the one some proxies answer with.
+var authMessages = []string{"the key is invalid", "unauthorized"}
+
+// IsAuthError reports whether err means the node rejected the API key:
+// an HTTP 401/403 from a proxy, or an RPC error with one of authMessages.
+// Other errors that merely mention a key ("duplicate key") don't count.
+func IsAuthError(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden
+	}
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		message := strings.ToLower(strings.TrimSpace(rpcErr.Message))
+		for _, auth := range authMessages {
+			if message == auth {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package idenarpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TLSOptions configures TLS to nodes behind a self-signed or private CA
+// certificate, or requiring client certificates. The zero value keeps Go's
+// defaults: the system roots and full verification.
+type TLSOptions struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key for
+	// mutual TLS; both or neither must be set.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any server certificate. For testing only:
+	// it leaves the connection open to interception.
+	InsecureSkipVerify bool
+}
+
+// Config builds the tls.Config for o, or returns nil for the zero value.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if o == (TLSOptions{}) {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// HTTPClient returns an http.Client for the node using o. Build it once and
+// share it between Clients so connections are reused.
+func (o TLSOptions) HTTPClient(timeout time.Duration) (*http.Client, error) {
+	config, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
@@ -0,0 +1,256 @@
+// Package merkle keeps a whitelist merkle tree in memory so proofs can be
+// served in O(log n) without rebuilding the tree per request.
+//
+// With SHA256 (the default) the tree matches the auth server's /merkle_root
+// and /merkle_proof: leaves are the SHA-256 of the lowercased address,
+// parents the SHA-256 of left||right. With Keccak256 it is the tree Solidity
+// tooling expects: leaves are keccak256(abi.encodePacked(address)) and
+// parents the keccak256 of the pair sorted, as OpenZeppelin's
+// MerkleProof.verify hashes them. Either way an unpaired last node is
+// promoted to the next level unchanged.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/sha3"
+)
+
+// HashAlgo selects how a Tree hashes its leaves and pairs.
+type HashAlgo string
+
+const (
+	SHA256    HashAlgo = "sha256"
+	Keccak256 HashAlgo = "keccak256"
+)
+
+// ParseHashAlgo validates a hash algorithm name; "" selects SHA256.
+func ParseHashAlgo(name string) (HashAlgo, error) {
+	switch algo := HashAlgo(strings.ToLower(strings.TrimSpace(name))); algo {
+	case "":
+		return SHA256, nil
+	case SHA256, Keccak256:
+		return algo, nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q (use sha256 or keccak256)", name)
+}
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// leaf hashes a lowercased address.
+func (a HashAlgo) leaf(address string) []byte {
+	if a == Keccak256 {
+		return keccak256(common.HexToAddress(address).Bytes())
+	}
+	h := sha256.Sum256([]byte(address))
+	return h[:]
+}
+
+// parent hashes two sibling nodes.
+func (a HashAlgo) parent(left, right []byte) []byte {
+	if a == Keccak256 {
+		if bytes.Compare(left, right) > 0 {
+			left, right = right, left
+		}
+		return keccak256(left, right)
+	}
+	pair := make([]byte, 0, len(left)+len(right))
+	h := sha256.Sum256(append(append(pair, left...), right...))
+	return h[:]
+}
+
+// Step is one sibling on the path from a leaf to the root. Left is set when
+// the sibling is hashed on the left.
+type Step struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// Tree is an immutable merkle tree over a list of addresses.
+type Tree struct {
+	algo      HashAlgo
+	addresses []string
+	// levels[0] are the leaves and the last level holds only the root
+	levels [][][]byte
+	// index is nil for trees made by Update, which look addresses up by
+	// binary search instead
+	index map[string]int
+	// sorted is set when the lowercased addresses are in strictly
+	// ascending order, which Update requires
+	sorted bool
+}
+
+// Build hashes addresses, in the given order, into a SHA256 tree.
+func Build(addresses []string) *Tree {
+	return BuildWith(addresses, SHA256)
+}
+
+// BuildWith hashes addresses, in the given order, into a tree using algo;
+// "" selects SHA256.
+func BuildWith(addresses []string, algo HashAlgo) *Tree {
+	if algo == "" {
+		algo = SHA256
+	}
+	t := &Tree{
+		algo:      algo,
+		addresses: addresses,
+		index:     make(map[string]int, len(addresses)),
+		sorted:    true,
+	}
+	if len(addresses) == 0 {
+		return t
+	}
+
+	leaves := make([][]byte, len(addresses))
+	previous := ""
+	for i, address := range addresses {
+		lower := strings.ToLower(address)
+		leaves[i] = algo.leaf(lower)
+		t.index[lower] = i
+		if i > 0 && lower <= previous {
+			t.sorted = false
+		}
+		previous = lower
+	}
+	t.levels = append(t.levels, leaves)
+
+	for nodes := leaves; len(nodes) > 1; {
+		next := algo.hashLevel(nodes, make([][]byte, 0, (len(nodes)+1)/2), 0)
+		t.levels = append(t.levels, next)
+		nodes = next
+	}
+	return t
+}
+
+// hashLevel appends to next the parents of nodes from parent index from
+// onwards and returns it.
+func (a HashAlgo) hashLevel(nodes, next [][]byte, from int) [][]byte {
+	for i := 2 * from; i < len(nodes); i += 2 {
+		if i+1 == len(nodes) {
+			next = append(next, nodes[i])
+			continue
+		}
+		next = append(next, a.parent(nodes[i], nodes[i+1]))
+	}
+	return next
+}
+
+// Root returns the hex root hash, or "" for an empty tree.
+func (t *Tree) Root() string {
+	if len(t.levels) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(t.levels[len(t.levels)-1][0])
+}
+
+// HashAlgo returns the algorithm the tree was built with.
+func (t *Tree) HashAlgo() HashAlgo {
+	return t.algo
+}
+
+// Len returns the number of leaves.
+func (t *Tree) Len() int {
+	return len(t.addresses)
+}
+
+// Depth returns the number of levels, leaves and root included.
+func (t *Tree) Depth() int {
+	return len(t.levels)
+}
+
+// Address returns the address of leaf i.
+func (t *Tree) Address(i int) string {
+	return t.addresses[i]
+}
+
+// LevelLen returns the number of nodes at level, 0 for a level out of range.
+func (t *Tree) LevelLen(level int) int {
+	if level < 0 || level >= len(t.levels) {
+		return 0
+	}
+	return len(t.levels[level])
+}
+
+// Level returns the hex hashes of up to limit nodes of level, starting at
+// offset. Level 0 are the leaves; Depth()-1 is the root.
+func (t *Tree) Level(level, offset, limit int) []string {
+	if level < 0 || level >= len(t.levels) {
+		return nil
+	}
+	nodes := t.levels[level]
+	if offset >= len(nodes) {
+		return []string{}
+	}
+	end := offset + limit
+	if end > len(nodes) {
+		end = len(nodes)
+	}
+	hashes := make([]string, 0, end-offset)
+	for _, node := range nodes[offset:end] {
+		hashes = append(hashes, hex.EncodeToString(node))
+	}
+	return hashes
+}
+
+// Proof returns the leaf index of address and the siblings needed to
+// recompute the root from it. ok is false when address is not in the tree.
+func (t *Tree) Proof(address string) (index int, proof []Step, ok bool) {
+	index, ok = t.lookup(strings.ToLower(address))
+	if !ok {
+		return 0, nil, false
+	}
+	proof = []Step{}
+	pos := index
+	for _, nodes := range t.levels[:len(t.levels)-1] {
+		if pos%2 == 1 {
+			proof = append(proof, Step{Hash: hex.EncodeToString(nodes[pos-1]), Left: true})
+		} else if pos+1 < len(nodes) {
+			proof = append(proof, Step{Hash: hex.EncodeToString(nodes[pos+1]), Left: false})
+		}
+		pos /= 2
+	}
+	return index, proof, true
+}
+
+// VerifyProof reports whether proof, as returned by Tree.Proof, leads from
+// address to the hex root of a tree built with algo.
+func VerifyProof(algo HashAlgo, root, address string, proof []Step) bool {
+	if algo == "" {
+		algo = SHA256
+	}
+	node := algo.leaf(strings.ToLower(address))
+	for _, step := range proof {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			node = algo.parent(sibling, node)
+		} else {
+			node = algo.parent(node, sibling)
+		}
+	}
+	return hex.EncodeToString(node) == strings.ToLower(root)
+}
+
+// lookup returns the leaf index of a lowercased address.
+func (t *Tree) lookup(lower string) (int, bool) {
+	if t.index != nil {
+		i, ok := t.index[lower]
+		return i, ok
+	}
+	i := sort.SearchStrings(t.addresses, lower)
+	return i, i < len(t.addresses) && t.addresses[i] == lower
+}
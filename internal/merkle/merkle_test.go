@@ -0,0 +1,341 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// verify recomputes the root from address and proof.
+func verify(address string, proof []Step) string {
+	h := sha256.Sum256([]byte(strings.ToLower(address)))
+	cur := h[:]
+	for _, step := range proof {
+		sibling, _ := hex.DecodeString(step.Hash)
+		if step.Left {
+			h = sha256.Sum256(append(sibling, cur...))
+		} else {
+			h = sha256.Sum256(append(cur, sibling...))
+		}
+		cur = h[:]
+	}
+	return hex.EncodeToString(cur)
+}
+
+func testAddresses(n int) []string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("0x%040x", i+1)
+	}
+	return addresses
+}
+
+func TestTreeRoot(t *testing.T) {
+	if root := Build(nil).Root(); root != "" {
+		t.Errorf("Expected empty root, got %q", root)
+	}
+	// Same vector as the auth server's computeMerkleRoot
+	want := "839d9a6ca43af7a125e9ece32839c12217469d40453b82e8a46b91da964f1e03"
+	if root := Build(testAddresses(3)).Root(); root != want {
+		t.Errorf("Expected root %s, got %s", want, root)
+	}
+}
+
+func TestTreeProofs(t *testing.T) {
+	for _, n := range []int{1, 2, 5, 8, 13} {
+		addresses := testAddresses(n)
+		tree := Build(addresses)
+		for i, address := range addresses {
+			index, proof, ok := tree.Proof(strings.ToUpper(address))
+			if !ok || index != i {
+				t.Fatalf("n=%d: expected %s at index %d, got %d (found %t)", n, address, i, index, ok)
+			}
+			if root := verify(address, proof); root != tree.Root() {
+				t.Errorf("n=%d: proof for leaf %d gives root %s, want %s", n, i, root, tree.Root())
+			}
+			if !VerifyProof(SHA256, tree.Root(), address, proof) {
+				t.Errorf("n=%d: VerifyProof rejected leaf %d", n, i)
+			}
+			if n > 1 && VerifyProof(SHA256, tree.Root(), addresses[(i+1)%n], proof) {
+				t.Errorf("n=%d: VerifyProof accepted leaf %d's proof for another address", n, i)
+			}
+		}
+	}
+
+	if _, _, ok := Build(testAddresses(4)).Proof("0xmissing"); ok {
+		t.Error("Expected no proof for an unknown address")
+	}
+}
+
+func TestKeccakTree(t *testing.T) {
+	// keccak256(abi.encodePacked(address(1))), address(2) and address(3),
+	// then keccak256 of each pair sorted: root = H(H(l1, l2), l3)
+	tree := BuildWith(testAddresses(3), Keccak256)
+	wantLeaves := []string{
+		"1468288056310c82aa4c01a7e12a10f8111a0560e72b700555479031b86c357d",
+		"d52688a8f926c816ca1e079067caba944f158e764817b83fc43594370ca9cf62",
+		"5b70e80538acdabd6137353b0f9d8d149f4dba91e8be2e7946e409bfdbe685b9",
+	}
+	for i, leaf := range tree.Level(0, 0, 3) {
+		if leaf != wantLeaves[i] {
+			t.Errorf("Leaf %d: expected %s, got %s", i, wantLeaves[i], leaf)
+		}
+	}
+	want := "344510bd0c324c3912b13373e89df42d1b50450e9764a454b2aa6e2968a4578a"
+	if root := tree.Root(); root != want {
+		t.Errorf("Expected root %s, got %s", want, root)
+	}
+	if tree.HashAlgo() != Keccak256 || Build(nil).HashAlgo() != SHA256 {
+		t.Error("Expected trees to report their hash algorithm")
+	}
+
+	// Proofs verify the way MerkleProof.verify does, ignoring Left
+	for _, n := range []int{1, 2, 5, 8} {
+		addresses := testAddresses(n)
+		tree := BuildWith(addresses, Keccak256)
+		for i, address := range addresses {
+			_, proof, ok := tree.Proof(address)
+			if !ok {
+				t.Fatalf("n=%d: no proof for leaf %d", n, i)
+			}
+			cur := Keccak256.leaf(address)
+			for _, step := range proof {
+				sibling, _ := hex.DecodeString(step.Hash)
+				cur = Keccak256.parent(sibling, cur)
+			}
+			if root := hex.EncodeToString(cur); root != tree.Root() {
+				t.Errorf("n=%d: proof for leaf %d gives root %s, want %s", n, i, root, tree.Root())
+			}
+			if !VerifyProof(Keccak256, tree.Root(), address, proof) {
+				t.Errorf("n=%d: VerifyProof rejected leaf %d", n, i)
+			}
+		}
+	}
+
+	for name, want := range map[string]HashAlgo{"": SHA256, "SHA256": SHA256, " keccak256": Keccak256} {
+		if algo, err := ParseHashAlgo(name); err != nil || algo != want {
+			t.Errorf("ParseHashAlgo(%q): expected %s, got %s (%v)", name, want, algo, err)
+		}
+	}
+	if _, err := ParseHashAlgo("md5"); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+// sameTree fails unless got has the levels and proofs of want.
+func sameTree(t *testing.T, name string, got, want *Tree) {
+	t.Helper()
+	if got.Root() != want.Root() || got.Depth() != want.Depth() || got.Len() != want.Len() {
+		t.Fatalf("%s: got root %s (depth %d, %d leaves), want %s (depth %d, %d leaves)",
+			name, got.Root(), got.Depth(), got.Len(), want.Root(), want.Depth(), want.Len())
+	}
+	for level := 0; level < want.Depth(); level++ {
+		if g, w := fmt.Sprint(got.Level(level, 0, want.Len())), fmt.Sprint(want.Level(level, 0, want.Len())); g != w {
+			t.Fatalf("%s: level %d differs: %s vs %s", name, level, g, w)
+		}
+	}
+	for i := 0; i < want.Len(); i++ {
+		index, proof, ok := got.Proof(want.Address(i))
+		_, wantProof, _ := want.Proof(want.Address(i))
+		if !ok || index != i || fmt.Sprint(proof) != fmt.Sprint(wantProof) {
+			t.Fatalf("%s: proof for leaf %d differs", name, i)
+		}
+	}
+}
+
+func TestTreeUpdate(t *testing.T) {
+	all := testAddresses(40)
+	pick := func(indexes ...int) []string {
+		addresses := make([]string, len(indexes))
+		for i, index := range indexes {
+			addresses[i] = all[index]
+		}
+		return addresses
+	}
+	cases := []struct {
+		name        string
+		start       []int
+		add, remove []int
+		want        []int
+	}{
+		{"insert first", []int{3, 5, 7}, []int{1}, nil, []int{1, 3, 5, 7}},
+		{"insert middle", []int{1, 3, 5, 7, 9}, []int{4}, nil, []int{1, 3, 4, 5, 7, 9}},
+		{"append", []int{1, 2, 3, 4}, []int{5}, nil, []int{1, 2, 3, 4, 5}},
+		{"remove last", []int{1, 2, 3, 4, 5}, nil, []int{5}, []int{1, 2, 3, 4}},
+		{"remove middle", []int{1, 2, 3, 4, 5, 6, 7, 8, 9}, nil, []int{4}, []int{1, 2, 3, 5, 6, 7, 8, 9}},
+		{"into empty", nil, []int{2, 1}, nil, []int{1, 2}},
+		{"to empty", []int{1, 2}, nil, []int{1, 2}, nil},
+		{"batch", []int{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20}, []int{19, 3, 21}, []int{10, 0}, []int{2, 3, 4, 6, 8, 12, 14, 16, 18, 19, 20, 21}},
+		{"no-op", []int{1, 2, 3}, []int{2}, []int{9}, []int{1, 2, 3}},
+	}
+	for _, algo := range []HashAlgo{SHA256, Keccak256} {
+		for _, c := range cases {
+			name := fmt.Sprintf("%s/%s", algo, c.name)
+			before := BuildWith(pick(c.start...), algo)
+			root := before.Root()
+			updated, err := before.Update(pick(c.add...), pick(c.remove...))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			sameTree(t, name, updated, BuildWith(pick(c.want...), algo))
+			if before.Root() != root || before.Len() != len(c.start) {
+				t.Errorf("%s: Update modified the original tree", name)
+			}
+		}
+	}
+
+	// A run of single-leaf updates ends at the full rebuild, and mixed-case
+	// input is stored lowercased
+	tree := Build(nil)
+	var want []string
+	for i := len(all) - 1; i >= 0; i -= 3 {
+		var err error
+		if tree, err = tree.Update([]string{strings.ToUpper(all[i][2:])}, nil); err != nil {
+			t.Fatal(err)
+		}
+		want = append([]string{strings.ToLower(all[i][2:])}, want...)
+	}
+	tree, _ = tree.Update(nil, want[4:5])
+	want = append(want[:4], want[5:]...)
+	sameTree(t, "single leaves", tree, Build(want))
+	if got := fmt.Sprint(tree.Addresses()); got != fmt.Sprint(want) {
+		t.Errorf("Expected addresses %s, got %s", want, got)
+	}
+
+	if _, err := Build(pick(3, 1, 2)).Update(pick(5), nil); err != ErrUnsorted {
+		t.Errorf("Expected ErrUnsorted for an unsorted tree, got %v", err)
+	}
+}
+
+func TestTreeLevel(t *testing.T) {
+	tree := Build(testAddresses(5))
+	if tree.Depth() != 4 {
+		t.Fatalf("Expected 4 levels for 5 leaves, got %d", tree.Depth())
+	}
+	if page := tree.Level(0, 3, 10); len(page) != 2 {
+		t.Errorf("Expected the last 2 leaves, got %d", len(page))
+	}
+	if root := tree.Level(tree.Depth()-1, 0, 10); len(root) != 1 || root[0] != tree.Root() {
+		t.Errorf("Expected the top level to be the root, got %v", root)
+	}
+	if page := tree.Level(0, 10, 10); page == nil || len(page) != 0 {
+		t.Errorf("Expected an empty page past the end, got %v", page)
+	}
+	if tree.Level(9, 0, 10) != nil {
+		t.Error("Expected nil for a level out of range")
+	}
+}
+
+// processMultiProof is OpenZeppelin's MerkleProof.processMultiProof.
+func processMultiProof(t *testing.T, proof MultiProof) string {
+	decode := func(hexes []string) [][]byte {
+		out := make([][]byte, len(hexes))
+		for i, h := range hexes {
+			b, err := hex.DecodeString(strings.TrimPrefix(h, "0x"))
+			if err != nil {
+				t.Fatalf("invalid hash %q", h)
+			}
+			out[i] = b
+		}
+		return out
+	}
+	leaves, proofHashes := decode(proof.Leaves), decode(proof.Proof)
+	if len(leaves)+len(proofHashes) != len(proof.ProofFlags)+1 {
+		t.Fatalf("invalid multiproof: %d leaves, %d proof hashes, %d flags",
+			len(leaves), len(proofHashes), len(proof.ProofFlags))
+	}
+	hashes := make([][]byte, len(proof.ProofFlags))
+	leafPos, hashPos, proofPos := 0, 0, 0
+	next := func() []byte {
+		if leafPos < len(leaves) {
+			leafPos++
+			return leaves[leafPos-1]
+		}
+		hashPos++
+		return hashes[hashPos-1]
+	}
+	for i, flag := range proof.ProofFlags {
+		a := next()
+		var b []byte
+		if flag {
+			b = next()
+		} else {
+			b = proofHashes[proofPos]
+			proofPos++
+		}
+		hashes[i] = hashPair(a, b)
+	}
+	switch {
+	case len(hashes) > 0:
+		return "0x" + hex.EncodeToString(hashes[len(hashes)-1])
+	case len(leaves) > 0:
+		return "0x" + hex.EncodeToString(leaves[0])
+	default:
+		return "0x" + hex.EncodeToString(proofHashes[0])
+	}
+}
+
+func TestStandardMultiProof(t *testing.T) {
+	if root := BuildStandard(nil).Root(); root != "" {
+		t.Errorf("Expected empty root, got %q", root)
+	}
+	single := BuildStandard(testAddresses(1))
+	if want := "0x" + hex.EncodeToString(StandardLeaf(testAddresses(1)[0])); single.Root() != want {
+		t.Errorf("Expected a single leaf to be the root %s, got %s", want, single.Root())
+	}
+
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		addresses := testAddresses(n)
+		tree := BuildStandard(addresses)
+		for _, subset := range [][]string{nil, addresses[:1], addresses[n/2:], addresses} {
+			proof, err := tree.MultiProof(subset)
+			if err != nil {
+				t.Fatalf("n=%d: %v", n, err)
+			}
+			if len(proof.Leaves) != len(subset) || len(proof.Addresses) != len(subset) {
+				t.Fatalf("n=%d: expected %d leaves, got %d", n, len(subset), len(proof.Leaves))
+			}
+			for i, address := range proof.Addresses {
+				if leaf := "0x" + hex.EncodeToString(StandardLeaf(address)); leaf != proof.Leaves[i] {
+					t.Errorf("n=%d: leaf %d is %s, want %s for %s", n, i, proof.Leaves[i], leaf, address)
+				}
+			}
+			if root := processMultiProof(t, proof); root != tree.Root() {
+				t.Errorf("n=%d, %d leaves: multiproof gives root %s, want %s", n, len(subset), root, tree.Root())
+			}
+		}
+	}
+
+	tree := BuildStandard(testAddresses(4))
+	if _, err := tree.MultiProof([]string{"0xmissing"}); err == nil {
+		t.Error("Expected an error for an unknown address")
+	}
+	address := testAddresses(1)[0]
+	if _, err := tree.MultiProof([]string{address, strings.ToUpper(address)}); err == nil {
+		t.Error("Expected an error for a duplicate address")
+	}
+}
+
+const benchmarkLeaves = 200000
+
+// BenchmarkProofRebuild builds the tree for every proof, as the auth
+// server's /merkle_proof does.
+func BenchmarkProofRebuild(b *testing.B) {
+	addresses := testAddresses(benchmarkLeaves)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Build(addresses).Proof(addresses[i%len(addresses)])
+	}
+}
+
+// BenchmarkProofCached serves proofs from a tree built once.
+func BenchmarkProofCached(b *testing.B) {
+	addresses := testAddresses(benchmarkLeaves)
+	tree := Build(addresses)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Proof(addresses[i%len(addresses)])
+	}
+}
@@ -0,0 +1,143 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// StandardTree is the whitelist laid out as OpenZeppelin's
+// StandardMerkleTree.of(addresses, ["address"]) builds it, so its proofs
+// verify with OpenZeppelin's MerkleProof library on-chain. Unlike Tree it
+// uses keccak256 and sorted pairs: leaves are
+// keccak256(keccak256(abi.encode(address))), sorted by hash, and the nodes
+// are stored as a flat binary heap with the leaves at the end. Its root is
+// therefore not the /merkle_root value.
+type StandardTree struct {
+	// nodes[0] is the root; children of i are 2i+1 and 2i+2
+	nodes [][]byte
+	// index maps a lowercase address to its position in nodes, and
+	// addresses is the reverse for the leaf positions
+	index     map[string]int
+	addresses []string
+}
+
+// MultiProof proves several leaves at once, in the form taken by
+// OpenZeppelin's MerkleProof.multiProofVerify(proof, proofFlags, root,
+// leaves). Leaves and Addresses are in the order the verifier consumes
+// them, which is not the order they were requested in; Indices are the
+// leaves' positions in the tree's node array.
+type MultiProof struct {
+	Leaves     []string
+	Addresses  []string
+	Indices    []int
+	Proof      []string
+	ProofFlags []bool
+}
+
+// StandardLeaf returns the leaf hash of address.
+func StandardLeaf(address string) []byte {
+	encoded := common.LeftPadBytes(common.HexToAddress(address).Bytes(), 32)
+	return crypto.Keccak256(crypto.Keccak256(encoded))
+}
+
+// hashPair is OpenZeppelin's commutative keccak256 of two nodes.
+func hashPair(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return crypto.Keccak256(a, b)
+}
+
+// BuildStandard builds a StandardTree over addresses.
+func BuildStandard(addresses []string) *StandardTree {
+	t := &StandardTree{index: make(map[string]int, len(addresses))}
+	if len(addresses) == 0 {
+		return t
+	}
+
+	type leaf struct {
+		address string
+		hash    []byte
+	}
+	leaves := make([]leaf, len(addresses))
+	for i, address := range addresses {
+		leaves[i] = leaf{strings.ToLower(address), StandardLeaf(address)}
+	}
+	sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].hash, leaves[j].hash) < 0 })
+
+	t.nodes = make([][]byte, 2*len(leaves)-1)
+	t.addresses = make([]string, len(t.nodes))
+	for i, l := range leaves {
+		pos := len(t.nodes) - 1 - i
+		t.nodes[pos] = l.hash
+		t.index[l.address] = pos
+		t.addresses[pos] = l.address
+	}
+	for i := len(t.nodes) - 1 - len(leaves); i >= 0; i-- {
+		t.nodes[i] = hashPair(t.nodes[2*i+1], t.nodes[2*i+2])
+	}
+	return t
+}
+
+// Root returns the 0x-prefixed root, or "" for an empty tree.
+func (t *StandardTree) Root() string {
+	if len(t.nodes) == 0 {
+		return ""
+	}
+	return "0x" + hex.EncodeToString(t.nodes[0])
+}
+
+// MultiProof returns a multiproof for addresses, following
+// @openzeppelin/merkle-tree's getMultiProof. It fails if an address is not
+// in the tree or is listed twice.
+func (t *StandardTree) MultiProof(addresses []string) (MultiProof, error) {
+	positions := make([]int, 0, len(addresses))
+	seen := make(map[int]bool, len(addresses))
+	for _, address := range addresses {
+		pos, ok := t.index[strings.ToLower(address)]
+		if !ok {
+			return MultiProof{}, fmt.Errorf("address not in tree: %s", address)
+		}
+		if seen[pos] {
+			return MultiProof{}, fmt.Errorf("duplicate address: %s", address)
+		}
+		seen[pos] = true
+		positions = append(positions, pos)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(positions)))
+
+	proof := MultiProof{Proof: []string{}, ProofFlags: []bool{}}
+	stack := append([]int(nil), positions...)
+	for len(stack) > 0 && stack[0] > 0 {
+		j := stack[0]
+		stack = stack[1:]
+		sibling := j + 1
+		if j%2 == 0 {
+			sibling = j - 1
+		}
+		if len(stack) > 0 && stack[0] == sibling {
+			proof.ProofFlags = append(proof.ProofFlags, true)
+			stack = stack[1:]
+		} else {
+			proof.ProofFlags = append(proof.ProofFlags, false)
+			proof.Proof = append(proof.Proof, "0x"+hex.EncodeToString(t.nodes[sibling]))
+		}
+		stack = append(stack, (j-1)/2)
+	}
+	if len(positions) == 0 && len(t.nodes) > 0 {
+		proof.Proof = append(proof.Proof, t.Root())
+	}
+
+	for _, pos := range positions {
+		proof.Leaves = append(proof.Leaves, "0x"+hex.EncodeToString(t.nodes[pos]))
+		proof.Addresses = append(proof.Addresses, t.addresses[pos])
+		proof.Indices = append(proof.Indices, pos)
+	}
+	return proof, nil
+}
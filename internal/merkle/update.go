@@ -0,0 +1,114 @@
+package merkle
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrUnsorted is returned by Update for a tree whose addresses were not
+// given in ascending order; such a tree can only be rebuilt.
+var ErrUnsorted = errors.New("merkle: tree leaves are not sorted")
+
+// Update returns the tree with the add addresses inserted and the remove
+// addresses dropped, keeping the leaves sorted. Only the nodes covering
+// the first changed leaf or anything after it are rehashed, so a change
+// near the end of the list hashes O(log n) nodes and never more than
+// BuildWith. The rest is still O(n): merging the address lists and
+// copying the unchanged nodes, which is far cheaper than hashing them.
+// t itself is not modified: readers holding it keep a consistent tree.
+// Adding an address already present or removing one that is absent is a
+// no-op; the result is always the tree BuildWith would return for the new
+// sorted list.
+func (t *Tree) Update(add, remove []string) (*Tree, error) {
+	if !t.sorted {
+		return nil, ErrUnsorted
+	}
+	old := t.lowerAddresses()
+
+	drop := make(map[string]bool, len(remove))
+	for _, address := range remove {
+		drop[strings.ToLower(address)] = true
+	}
+	insert := make([]string, 0, len(add))
+	for _, address := range add {
+		insert = append(insert, strings.ToLower(address))
+	}
+	sort.Strings(insert)
+
+	addresses := make([]string, 0, len(old)+len(insert))
+	i, j := 0, 0
+	for i < len(old) || j < len(insert) {
+		var next string
+		switch {
+		case j == len(insert) || (i < len(old) && old[i] < insert[j]):
+			next = old[i]
+			i++
+		case i == len(old) || insert[j] < old[i]:
+			next = insert[j]
+			j++
+		default:
+			next = old[i]
+			i++
+			j++
+		}
+		if drop[next] || (len(addresses) > 0 && addresses[len(addresses)-1] == next) {
+			continue
+		}
+		addresses = append(addresses, next)
+	}
+
+	first := 0
+	for first < len(old) && first < len(addresses) && old[first] == addresses[first] {
+		first++
+	}
+	if first == len(old) && first == len(addresses) {
+		return t, nil
+	}
+
+	updated := &Tree{algo: t.algo, addresses: addresses, sorted: true}
+	if len(addresses) == 0 {
+		return updated, nil
+	}
+	// Nodes left of the first changed position at each level cover only
+	// unchanged leaves, so they are shared with t; the rest are rehashed
+	leaves := t.shared(0, first, len(addresses))
+	for _, address := range addresses[first:] {
+		leaves = append(leaves, t.algo.leaf(address))
+	}
+	updated.levels = append(updated.levels, leaves)
+	for level, nodes := 0, leaves; len(nodes) > 1; level++ {
+		first /= 2
+		next := t.shared(level+1, first, (len(nodes)+1)/2)
+		next = t.algo.hashLevel(nodes, next, first)
+		updated.levels = append(updated.levels, next)
+		nodes = next
+	}
+	return updated, nil
+}
+
+// shared returns a new slice of capacity size holding the first n nodes of
+// level.
+func (t *Tree) shared(level, n, size int) [][]byte {
+	nodes := make([][]byte, n, size)
+	if n > 0 {
+		copy(nodes, t.levels[level][:n])
+	}
+	return nodes
+}
+
+// Addresses returns the leaves' addresses, lowercased, in leaf order.
+func (t *Tree) Addresses() []string {
+	return append([]string(nil), t.lowerAddresses()...)
+}
+
+func (t *Tree) lowerAddresses() []string {
+	if t.index == nil {
+		return t.addresses
+	}
+	lower := make([]string, len(t.addresses))
+	for i, address := range t.addresses {
+		lower[i] = strings.ToLower(address)
+	}
+	return lower
+}
@@ -0,0 +1,56 @@
+// Package pathtemplate expands file paths such as "identities-{{.Date}}.db"
+// so time-sliced databases and snapshots need no external scripting.
+//
+// The available variables are:
+//
+//	{{.Date}}       UTC date, 2006-01-02
+//	{{.Timestamp}}  UTC time, 20060102T150405Z
+//	{{.Epoch}}      current Idena epoch, asked from the node when used
+package pathtemplate
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Vars holds the values a path template can refer to.
+type Vars struct {
+	Now time.Time
+	// EpochFunc looks up the current epoch. It is only called when the
+	// template uses {{.Epoch}}.
+	EpochFunc func() (int, error)
+}
+
+func (v Vars) Date() string {
+	return v.Now.UTC().Format("2006-01-02")
+}
+
+func (v Vars) Timestamp() string {
+	return v.Now.UTC().Format("20060102T150405Z")
+}
+
+func (v Vars) Epoch() (int, error) {
+	if v.EpochFunc == nil {
+		return 0, errors.New("epoch is not available here")
+	}
+	return v.EpochFunc()
+}
+
+// Expand resolves the template variables in pattern. Paths without "{{"
+// are returned unchanged.
+func Expand(pattern string, vars Vars) (string, error) {
+	if !strings.Contains(pattern, "{{") {
+		return pattern, nil
+	}
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,51 @@
+package pathtemplate
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExpand(t *testing.T) {
+	now := time.Date(2024, 3, 9, 14, 5, 6, 0, time.FixedZone("CET", 3600))
+	epochCalls := 0
+	vars := Vars{
+		Now: now,
+		EpochFunc: func() (int, error) {
+			epochCalls++
+			return 142, nil
+		},
+	}
+
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"./identities.db", "./identities.db"},
+		{"identities-{{.Date}}.db", "identities-2024-03-09.db"},
+		{"snapshots/{{.Timestamp}}.json", "snapshots/20240309T130506Z.json"},
+		{"epoch-{{.Epoch}}/snapshot-{{.Date}}.json", "epoch-142/snapshot-2024-03-09.json"},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.pattern, vars)
+		if err != nil {
+			t.Fatalf("Expand(%q) error: %v", test.pattern, err)
+		}
+		if got != test.expected {
+			t.Errorf("Expand(%q) = %q, expected %q", test.pattern, got, test.expected)
+		}
+	}
+	if epochCalls != 1 {
+		t.Errorf("Expected the epoch to be looked up once, got %d", epochCalls)
+	}
+
+	failing := Vars{Now: now, EpochFunc: func() (int, error) { return 0, errors.New("node down") }}
+	for _, pattern := range []string{"{{.Epoch}}.db", "{{.Unknown}}.db", "{{.Date.db"} {
+		if _, err := Expand(pattern, failing); err == nil {
+			t.Errorf("Expected Expand(%q) to fail", pattern)
+		}
+	}
+	if _, err := Expand("{{.Epoch}}.db", Vars{Now: now}); err == nil {
+		t.Error("Expected an error when no epoch source is set")
+	}
+}
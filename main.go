@@ -7,6 +7,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"idenauthgo/agents" // If using modules; may need path adjustment
@@ -20,8 +21,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
-	"github.com/ethereum/go-ethereum/crypto"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -29,6 +30,26 @@ import (
 var (
 	BASE_URL      = getenv("BASE_URL", "http://proofofhuman.work")
 	IDENA_RPC_KEY = getenv("IDENA_RPC_KEY", "")
+	// The Idena protocol requires nonces to start with "signin-"; the length
+	// of the random part can be tuned for clients with parsing quirks.
+	NONCE_PREFIX = getenv("NONCE_PREFIX", "signin-")
+	NONCE_BYTES  = getenvInt("NONCE_BYTES", 16)
+	// Upper bound for auth request bodies
+	MAX_BODY_BYTES = int64(getenvInt("MAX_BODY_BYTES", 8192))
+	// Consumed nonces are remembered this long to reject replays
+	NONCE_REPLAY_TTL = time.Duration(getenvInt("NONCE_REPLAY_TTL_HOURS", 24)) * time.Hour
+	// HTTP server timeouts, so slow clients cannot hold connections open
+	HTTP_READ_HEADER_TIMEOUT = time.Duration(getenvInt("HTTP_READ_HEADER_TIMEOUT_SECONDS", 5)) * time.Second
+	HTTP_READ_TIMEOUT        = time.Duration(getenvInt("HTTP_READ_TIMEOUT_SECONDS", 15)) * time.Second
+	HTTP_WRITE_TIMEOUT       = time.Duration(getenvInt("HTTP_WRITE_TIMEOUT_SECONDS", 30)) * time.Second
+	HTTP_IDLE_TIMEOUT        = time.Duration(getenvInt("HTTP_IDLE_TIMEOUT_SECONDS", 120)) * time.Second
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
 )
 
 const (
@@ -42,6 +63,7 @@ const (
 var (
 	db             *sql.DB
 	stakeThreshold = 10000.0
+	usedNonces     = newNonceStore(NONCE_REPLAY_TTL)
 )
 
 type Session struct {
@@ -62,6 +84,14 @@ func getenv(key, fallback string) string {
 	return val
 }
 
+func getenvInt(key string, fallback int) int {
+	val, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || val <= 0 {
+		return fallback
+	}
+	return val
+}
+
 func fetchStakeThreshold() {
 	url := idenaRpcUrl + "/api/Epoch/Last"
 	if IDENA_RPC_KEY != "" {
@@ -89,6 +119,12 @@ func fetchStakeThreshold() {
 func main() {
 	go agents.RunIdentityFetcher("agents/fetcher_config.json")
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if err := validateNoncePrefix(NONCE_PREFIX); err != nil {
+		log.Fatalf("Invalid NONCE_PREFIX: %v", err)
+	}
+	if err := validateBatchPolicy(AUTH_BATCH_POLICY); err != nil {
+		log.Fatalf("Invalid AUTH_BATCH_POLICY: %v", err)
+	}
 	var err error
 	db, err = sql.Open("sqlite3", dbFile)
 	if err != nil {
@@ -97,26 +133,51 @@ func main() {
 	defer db.Close()
 	createSessionTable()
 	createSnapshotTable()
+	createAuthAttemptsTable()
 	fetchStakeThreshold()
 	exportWhitelist()
 
-	http.Handle("/", http.FileServer(http.Dir("static")))
-	http.HandleFunc("/signin", signinHandler)
-	http.HandleFunc("/auth/v1/start-session", startSessionHandler)
-	http.HandleFunc("/auth/v1/authenticate", authenticateHandler)
-	http.HandleFunc("/callback", callbackHandler)
-	http.HandleFunc("/whitelist", whitelistHandler)
-	http.HandleFunc("/whitelist/check", whitelistCheckHandler)
-	http.HandleFunc("/merkle_root", merkleRootHandler)
-	http.HandleFunc("/merkle_proof", merkleProofHandler)
-
 	go cleanupExpiredSessions()
-	log.Printf("Server running at http://localhost%s", listenAddr)
-	if err := http.ListenAndServe(listenAddr, nil); err != nil {
+	go usedNonces.runSweeper(15 * time.Minute)
+	log.Printf("Server %s (commit %s, built %s) running at http://localhost%s", version, commit, buildTime, listenAddr)
+	if err := newHTTPServer(listenAddr, routes()).ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// newHTTPServer returns a server for handler with the HTTP_*_TIMEOUT limits
+// applied; http.ListenAndServe would use none.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		ReadTimeout:       HTTP_READ_TIMEOUT,
+		WriteTimeout:      HTTP_WRITE_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+}
+
+// routes registers every endpoint with the methods it accepts; other paths
+// are served from static/.
+func routes() http.Handler {
+	rt := newRouter(http.FileServer(http.Dir("static")))
+	rt.handle("/signin", signinHandler, http.MethodGet)
+	rt.handle("/auth/v1/start-session", startSessionHandler, http.MethodPost)
+	rt.handle("/auth/v1/authenticate", authenticateHandler, http.MethodPost)
+	rt.handle("/callback", callbackHandler, http.MethodGet)
+	rt.handle("/whitelist", whitelistHandler, http.MethodGet)
+	rt.handle("/whitelist/check", whitelistCheckHandler, http.MethodGet)
+	rt.handle("/whitelist/snapshot", whitelistSnapshotHandler, http.MethodGet)
+	rt.handle("/merkle_root", merkleRootHandler, http.MethodGet)
+	rt.handle("/merkle_proof", merkleProofHandler, http.MethodGet)
+	rt.handle("/merkle_verify", merkleVerifyHandler, http.MethodPost)
+	rt.handle("/version", versionHandler, http.MethodGet)
+	rt.handle("/reindex", requireAdmin(reindexHandler), http.MethodPost)
+	rt.handle("/admin/prune", requireAdmin(adminPruneHandler), http.MethodPost)
+	return rt
+}
+
 func mustLoadTemplate(path string) *template.Template {
 	abs, _ := filepath.Abs(path)
 	info, err := os.Stat(path)
@@ -142,12 +203,35 @@ func createSessionTable() {
             authenticated INTEGER DEFAULT 0,
             identity_state TEXT,
             stake REAL,
-            created INTEGER
+            created INTEGER,
+            signature TEXT,
+            idempotency_key TEXT,
+            auth_result TEXT,
+            verified_addresses TEXT
         )
     `)
 	if err != nil {
 		log.Fatal(err)
 	}
+	migrateSessionTable()
+}
+
+// sessionColumns were added after the first release; older databases get
+// them via ALTER TABLE.
+var sessionColumns = []string{
+	"signature TEXT",
+	"idempotency_key TEXT",
+	"auth_result TEXT",
+	"verified_addresses TEXT",
+}
+
+func migrateSessionTable() {
+	for _, col := range sessionColumns {
+		_, err := db.Exec("ALTER TABLE sessions ADD COLUMN " + col)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Fatal(err)
+		}
+	}
 }
 
 func createSnapshotTable() {
@@ -172,8 +256,15 @@ func recordIdentitySnapshot(address, state string, stake float64) {
 	}
 }
 
-func cleanupOldSnapshots() {
-	_, _ = db.Exec("DELETE FROM identity_snapshots WHERE ts < ?", time.Now().AddDate(0, 0, -30).Unix())
+// cleanupOldSnapshots drops snapshots older than 30 days and returns how
+// many were deleted.
+func cleanupOldSnapshots() int64 {
+	res, err := db.Exec("DELETE FROM identity_snapshots WHERE ts < ?", time.Now().AddDate(0, 0, -30).Unix())
+	if err != nil {
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return n
 }
 
 func getWhitelist() ([]string, error) {
@@ -287,17 +378,41 @@ func verifyMerkleProof(address string, proof []ProofStep, root string) bool {
 	return hex.EncodeToString(cur) == root
 }
 
+// whitelistSnapshotVersion is bumped whenever the snapshot layout changes.
+const whitelistSnapshotVersion = 1
+
+// WhitelistSnapshot is a self-contained whitelist artifact: the merkle root
+// can be recomputed from Addresses using HashAlgorithm.
+type WhitelistSnapshot struct {
+	Version       int      `json:"version"`
+	HashAlgorithm string   `json:"hash_algorithm"`
+	GeneratedAt   int64    `json:"generated_at"`
+	MerkleRoot    string   `json:"merkle_root"`
+	Count         int      `json:"count"`
+	Addresses     []string `json:"addresses"`
+}
+
+func buildWhitelistSnapshot(list []string) WhitelistSnapshot {
+	if list == nil {
+		list = []string{}
+	}
+	return WhitelistSnapshot{
+		Version:       whitelistSnapshotVersion,
+		HashAlgorithm: "sha256",
+		GeneratedAt:   time.Now().Unix(),
+		MerkleRoot:    computeMerkleRoot(list),
+		Count:         len(list),
+		Addresses:     list,
+	}
+}
+
 func exportWhitelist() {
 	list, err := getWhitelist()
 	if err != nil {
 		log.Printf("[WHITELIST] query error: %v", err)
 		return
 	}
-	data := map[string]interface{}{
-		"merkle_root": computeMerkleRoot(list),
-		"addresses":   list,
-	}
-	b, _ := json.MarshalIndent(data, "", "  ")
+	b, _ := json.MarshalIndent(buildWhitelistSnapshot(list), "", "  ")
 	if err := os.WriteFile("data/whitelist.json", b, 0644); err != nil {
 		log.Printf("[WHITELIST] failed to write whitelist.json: %v", err)
 	}
@@ -309,6 +424,27 @@ func randHex(n int) string {
 	return hex.EncodeToString(b)
 }
 
+// validateNoncePrefix rejects a NONCE_PREFIX that would give nonces the
+// Idena app's sign-in flow can't carry back unchanged: an empty one, or one
+// with whitespace or control characters.
+func validateNoncePrefix(prefix string) error {
+	if prefix == "" {
+		return errors.New("must not be empty")
+	}
+	for _, r := range prefix {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%q contains whitespace or a control character", prefix)
+		}
+	}
+	return nil
+}
+
+// newNonce returns a nonce in the configured format: NONCE_PREFIX followed
+// by NONCE_BYTES random bytes in lowercase hex.
+func newNonce() string {
+	return NONCE_PREFIX + randHex(NONCE_BYTES)
+}
+
 // Start sign-in flow, redirect to Idena app (BASE_URL is used everywhere)
 func signinHandler(w http.ResponseWriter, r *http.Request) {
 	token := "signin-" + randHex(16)
@@ -327,36 +463,25 @@ func signinHandler(w http.ResponseWriter, r *http.Request) {
 		url.QueryEscape(BASE_URL+"/auth/v1/authenticate"),
 		url.QueryEscape(BASE_URL+"/favicon.ico"),
 	)
-	log.Printf("[SIGNIN] New session token=%s", token)
+	log.Printf("[SIGNIN] New session token=%s from %s", token, clientIP(r))
 	log.Printf("[SIGNIN] Redirecting to: %s", idenaUrl)
 	http.Redirect(w, r, idenaUrl, http.StatusFound)
 }
 
 // Handle nonce requests and log all body info
 func startSessionHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[NONCE_ENDPOINT] Called: %s %s", r.Method, r.URL.Path)
+	log.Printf("[NONCE_ENDPOINT] Called: %s %s from %s", r.Method, r.URL.Path, clientIP(r))
 	switch r.Method {
 	case http.MethodPost:
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("[NONCE_ENDPOINT][POST] Failed to read body: %v", err)
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
-		}
-		log.Printf("[NONCE_ENDPOINT][POST] Request body: %s", string(body))
-		r.Body = io.NopCloser(bytes.NewBuffer(body)) // Allow reuse
-
 		var req struct {
 			Token   string `json:"token"`
 			Address string `json:"address"`
 		}
-		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&req); err != nil {
-			log.Printf("[NONCE_ENDPOINT][POST] Invalid body: %v", err)
-			writeError(w, "Invalid request")
+		if !decodeAuthRequest(w, r, "NONCE_ENDPOINT", &req) {
 			return
 		}
-		nonce := "signin-" + randHex(16)
-		_, err = db.Exec("UPDATE sessions SET address=?, nonce=? WHERE token=?", req.Address, nonce, req.Token)
+		nonce := newNonce()
+		_, err := db.Exec("UPDATE sessions SET address=?, nonce=? WHERE token=?", req.Address, nonce, req.Token)
 		if err != nil {
 			log.Printf("[NONCE_ENDPOINT][POST] DB error: %v", err)
 			writeError(w, "DB error")
@@ -378,51 +503,156 @@ func startSessionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Authenticate nonce signature
+// Authenticate nonce signature. The nonce is consumed by the first attempt;
+// a retry with the same signature and Idempotency-Key (the token when no
+// header is sent) gets the original response back. Instead of signature a
+// wallet may send signatures, one per address it controls, all over the
+// same nonce; the response then carries a result per address.
 func authenticateHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[AUTH][RAW] %s %s", r.Method, r.URL.String())
-	bodyBytes, _ := io.ReadAll(r.Body)
-	log.Printf("[AUTH][BODY] %s", string(bodyBytes))
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	// The path only: the query may carry the token and signature
+	log.Printf("[AUTH][RAW] %s %s from %s", r.Method, r.URL.Path, clientIP(r))
 	var req struct {
 		Token     string `json:"token"`
 		Signature string `json:"signature"`
+		// Nonce is optional; when sent it must be the issued nonce verbatim
+		Nonce string `json:"nonce"`
+		// Address is optional; when sent it must be the session's address
+		Address string `json:"address"`
+		// Signatures authenticates several addresses at once
+		Signatures []addressSignature `json:"signatures"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("[AUTH] Invalid request body: %v", err)
-		writeError(w, "Bad request")
+	if !decodeAuthRequest(w, r, "AUTH", &req) {
 		return
 	}
+	batch := len(req.Signatures) > 0
+	signature := req.Signature
+	if batch {
+		if req.Signature != "" || req.Address != "" {
+			writeError(w, "Send either signature or signatures")
+			return
+		}
+		if msg := validateBatch(req.Signatures); msg != "" {
+			log.Printf("[AUTH] Rejected batch for token %s: %s", req.Token, msg)
+			writeError(w, msg)
+			return
+		}
+		signature = batchSignatureKey(req.Signatures)
+	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = req.Token
+	}
 
-	row := db.QueryRow("SELECT nonce, address FROM sessions WHERE token=?", req.Token)
-	var nonce, address string
-	if err := row.Scan(&nonce, &address); err != nil {
+	row := db.QueryRow("SELECT nonce, address, signature, idempotency_key, auth_result FROM sessions WHERE token=?", req.Token)
+	var nonce, address, prevSignature, prevKey, prevResult sql.NullString
+	if err := row.Scan(&nonce, &address, &prevSignature, &prevKey, &prevResult); err != nil || !address.Valid {
 		log.Printf("[AUTH] Token not found: %s", req.Token)
 		writeError(w, "Session not found")
 		return
 	}
-	log.Printf("[AUTH] Authenticating address: %s for token: %s with nonce: %s", address, req.Token, nonce)
 
-	authenticated := verifySignature(nonce, address, req.Signature)
-	if !authenticated {
-		log.Printf("[AUTH] Signature verification failed for address %s", address)
+	if prevResult.Valid {
+		if prevKey.String == idempotencyKey && prevSignature.String == signature {
+			log.Printf("[AUTH] Idempotent retry for token: %s", req.Token)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, prevResult.String)
+			return
+		}
+		log.Printf("[AUTH] Nonce already consumed for token: %s", req.Token)
+		writeError(w, "Nonce replay detected")
+		return
+	}
+	if until := authLockedUntil(clientIP(r), address.String, time.Now()); !batch && !until.IsZero() {
+		log.Printf("[AUTH] Address %s from %s locked out until %s", address.String, clientIP(r), until.Format(time.RFC3339))
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		writeErrorStatus(w, http.StatusTooManyRequests, "Too many failed attempts")
+		return
+	}
+	if req.Address != "" && !sameAddress(req.Address, address.String) {
+		log.Printf("[AUTH] Address %s does not match session address %s", req.Address, address.String)
+		writeError(w, "Address mismatch")
+		return
 	}
+	if !nonce.Valid {
+		log.Printf("[AUTH] No nonce issued for token: %s", req.Token)
+		writeError(w, "Nonce not found")
+		return
+	}
+	if req.Nonce != "" && req.Nonce != nonce.String {
+		log.Printf("[AUTH] Signed nonce %q does not match issued nonce %q", req.Nonce, nonce.String)
+		writeError(w, "Nonce mismatch")
+		return
+	}
+	if usedNonces.used(nonce.String, signature, time.Now()) {
+		log.Printf("[AUTH] Replay rejected for token: %s", req.Token)
+		writeError(w, "Nonce replay detected")
+		return
+	}
+	var outcome authOutcome
+	data := map[string]interface{}{}
+	if batch {
+		log.Printf("[AUTH] Authenticating %d addresses for token: %s with nonce: %s", len(req.Signatures), req.Token, nonce.String)
+		outcome = authenticateBatch(nonce.String, clientIP(r), req.Signatures)
+		if outcome.address == "" {
+			outcome.address = address.String
+		}
+		data["results"] = outcome.results
+	} else {
+		log.Printf("[AUTH] Authenticating address: %s for token: %s with nonce: %s", address.String, req.Token, nonce.String)
 
-	state, stake := getIdentity(address)
-	isEligible := authenticated && (state == "Newbie" || state == "Verified" || state == "Human") && stake >= stakeThreshold
-	log.Printf("[AUTH] Identity state: %s, stake: %.3f, eligible: %t", state, stake, isEligible)
+		authenticated := verifySignature(nonce.String, address.String, req.Signature)
+		if authenticated {
+			resetAuthFailures(address.String)
+			verified, _ := normalizeAddress(address.String)
+			outcome.verified = []string{verified}
+		} else {
+			log.Printf("[AUTH] Signature verification failed for address %s from %s", address.String, clientIP(r))
+			recordAuthFailure(clientIP(r), address.String, time.Now())
+		}
 
-	_, _ = db.Exec(`UPDATE sessions SET authenticated=?, identity_state=?, stake=? WHERE token=?`,
-		boolToInt(isEligible), state, stake, req.Token)
-	recordIdentitySnapshot(address, state, stake)
-	exportWhitelist()
+		outcome.address = address.String
+		outcome.state, outcome.stake = lookupIdentity(address.String)
+		outcome.eligible = authenticated && isEligibleIdentity(outcome.state, outcome.stake)
+		log.Printf("[AUTH] Identity state: %s, stake: %.3f, eligible: %t", outcome.state, outcome.stake, outcome.eligible)
+	}
+	isEligible, state, stake := outcome.eligible, outcome.state, outcome.stake
+	data["authenticated"] = isEligible
 
-	writeJSON(w, map[string]interface{}{
+	result, _ := json.Marshal(map[string]interface{}{
 		"success": true,
-		"data": map[string]interface{}{
-			"authenticated": isEligible,
-		},
+		"data":    data,
 	})
+	result = append(result, '\n')
+
+	// Only the first request for a nonce may consume it
+	res, err := db.Exec(`UPDATE sessions SET address=?, authenticated=?, identity_state=?, stake=?, signature=?, idempotency_key=?, auth_result=?, verified_addresses=?
+		WHERE token=? AND auth_result IS NULL`,
+		outcome.address, boolToInt(isEligible), state, stake, signature, idempotencyKey, string(result),
+		strings.Join(outcome.verified, ","), req.Token)
+	if err != nil {
+		log.Printf("[AUTH] DB error: %v", err)
+		writeError(w, "DB error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("[AUTH] Concurrent authenticate lost the race for token: %s", req.Token)
+		writeError(w, "Nonce replay detected")
+		return
+	}
+	usedNonces.consume(nonce.String, signature, time.Now())
+	if batch {
+		for _, result := range outcome.results {
+			if result.verified {
+				recordIdentitySnapshot(result.Address, result.State, result.Stake)
+			}
+		}
+	} else {
+		recordIdentitySnapshot(address.String, state, stake)
+	}
+	exportWhitelist()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
 }
 
 // Show result, log User-Agent, all params
@@ -478,6 +708,17 @@ func whitelistHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]interface{}{"addresses": list})
 }
 
+// Download the whitelist as a standalone artifact with its merkle root
+func whitelistSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := getWhitelist()
+	if err != nil {
+		http.Error(w, "server error", 500)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="whitelist.json"`)
+	writeJSON(w, buildWhitelistSnapshot(list))
+}
+
 // Check if address is eligible
 func whitelistCheckHandler(w http.ResponseWriter, r *http.Request) {
 	addr := strings.ToLower(r.URL.Query().Get("address"))
@@ -524,26 +765,79 @@ func merkleProofHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Verify Ethereum signature from Idena App
-func verifySignature(nonce, address, signatureHex string) bool {
-	sig, err := hex.DecodeString(strings.TrimPrefix(signatureHex, "0x"))
-	if err != nil || len(sig) != 65 {
-		log.Printf("[VERIFY] Signature format error")
-		return false
+// Verify a client-supplied merkle proof against a client-supplied root.
+// Independent of the current whitelist; useful for checking wallet code.
+func merkleVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	msg := crypto.Keccak256([]byte(nonce))
-	hash := crypto.Keccak256(msg)
-	pubKey, err := crypto.SigToPub(hash, sig)
+	var req struct {
+		Address string      `json:"address"`
+		Proof   []ProofStep `json:"proof"`
+		Root    string      `json:"root"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Address == "" || req.Root == "" {
+		http.Error(w, "address, proof and root are required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]bool{
+		"valid": verifyMerkleProof(req.Address, req.Proof, strings.ToLower(req.Root)),
+	})
+}
+
+// Report the running build
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	})
+}
+
+// verifySignature reports whether signatureHex is address's signature of
+// the sign-in nonce, in the Idena app's format (see signInHash).
+func verifySignature(nonce, address, signatureHex string) bool {
+	recoveredAddr, err := recoverSignInAddress(nonce, signatureHex)
 	if err != nil {
 		log.Printf("[VERIFY] Signature recovery failed: %v", err)
 		return false
 	}
-	recoveredAddr := crypto.PubkeyToAddress(*pubKey).Hex()
-	match := strings.EqualFold(recoveredAddr, address)
-	log.Printf("[VERIFY] Expected: %s, Recovered: %s, Match: %t", address, recoveredAddr, match)
+	expected, ok := normalizeAddress(address)
+	if !ok {
+		log.Printf("[VERIFY] Invalid session address %q", address)
+		return false
+	}
+	match := recoveredAddr == expected
+	log.Printf("[VERIFY] Expected: %s, Recovered: %s, Match: %t", expected, recoveredAddr, match)
 	return match
 }
 
+// sameAddress reports whether a and b are the same valid address, in any
+// letter case.
+func sameAddress(a, b string) bool {
+	na, okA := normalizeAddress(a)
+	nb, okB := normalizeAddress(b)
+	return okA && okB && na == nb
+}
+
+// normalizeAddress lowercases a 0x-prefixed 20-byte hex address so that
+// checksummed and lowercase forms compare equal. ok is false for anything
+// else.
+func normalizeAddress(address string) (normalized string, ok bool) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if len(address) != 42 || !strings.HasPrefix(address, "0x") {
+		return "", false
+	}
+	if _, err := hex.DecodeString(address[2:]); err != nil {
+		return "", false
+	}
+	return address, true
+}
+
+// lookupIdentity resolves an address to its state and stake; tests replace it.
+var lookupIdentity = getIdentity
+
 // Get identity from node or public API as fallback
 func getIdentity(address string) (string, float64) {
 	rpcReq := map[string]interface{}{
@@ -621,7 +915,7 @@ func boolToInt(b bool) int {
 // Clean up expired sessions regularly
 func cleanupExpiredSessions() {
 	for {
-		_, _ = db.Exec("DELETE FROM sessions WHERE created < ?", time.Now().Add(-1*time.Hour).Unix())
+		deleteExpiredSessions()
 		cleanupOldSnapshots()
 		exportWhitelist()
 		log.Println("[CLEANUP] housekeeping done")
@@ -629,12 +923,92 @@ func cleanupExpiredSessions() {
 	}
 }
 
+// deleteExpiredSessions drops sessions older than an hour and returns how
+// many were deleted.
+func deleteExpiredSessions() int64 {
+	res, err := db.Exec("DELETE FROM sessions WHERE created < ?", time.Now().Add(-1*time.Hour).Unix())
+	if err != nil {
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return n
+}
+
 // Helper: write JSON with application/json
 func writeJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
 
+// authQueryParams are the fields an auth endpoint also accepts from the
+// query string, for webviews that cannot send a POST body.
+var authQueryParams = []string{"token", "signature", "address"}
+
+// Helper: decode an auth endpoint body into v, capped at MAX_BODY_BYTES and
+// rejecting unknown fields. An empty body is read from authQueryParams
+// instead; when both are sent the body is used and any query value must
+// agree with it. Writes a 400 and returns false on failure.
+func decodeAuthRequest(w http.ResponseWriter, r *http.Request, tag string, v interface{}) bool {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_BODY_BYTES))
+	if err != nil {
+		log.Printf("[%s] Failed to read body: %v", tag, err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeErrorStatus(w, http.StatusBadRequest, "Request body too large")
+			return false
+		}
+		writeErrorStatus(w, http.StatusBadRequest, "Bad request")
+		return false
+	}
+	log.Printf("[%s][BODY] %s", tag, string(body))
+
+	query := r.URL.Query()
+	if len(bytes.TrimSpace(body)) == 0 {
+		fields := make(map[string]string)
+		for _, name := range authQueryParams {
+			if value := query.Get(name); value != "" {
+				fields[name] = value
+			}
+		}
+		if len(fields) == 0 {
+			log.Printf("[%s] Empty request body and no query parameters", tag)
+			writeErrorStatus(w, http.StatusBadRequest, "Invalid request")
+			return false
+		}
+		log.Printf("[%s] Reading request from query parameters", tag)
+		// Unknown fields are dropped rather than rejected: the query
+		// carries only authQueryParams, some of which v may not use
+		body, _ = json.Marshal(fields)
+		if err := json.Unmarshal(body, v); err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, "Invalid request")
+			return false
+		}
+		return true
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		log.Printf("[%s] Invalid request body: %v", tag, err)
+		writeErrorStatus(w, http.StatusBadRequest, "Invalid request")
+		return false
+	}
+
+	var sent map[string]interface{}
+	json.Unmarshal(body, &sent)
+	for _, name := range authQueryParams {
+		fromQuery := query.Get(name)
+		fromBody, _ := sent[name].(string)
+		if fromQuery != "" && fromBody != "" && fromQuery != fromBody {
+			// Names only: the values may be a token or signature
+			log.Printf("[%s] Query %s conflicts with the body", tag, name)
+			writeErrorStatus(w, http.StatusBadRequest, "Conflicting "+name)
+			return false
+		}
+	}
+	return true
+}
+
 // Helper: write Idena protocol error response
 func writeError(w http.ResponseWriter, msg string) {
 	writeJSON(w, map[string]interface{}{
@@ -642,3 +1016,13 @@ func writeError(w http.ResponseWriter, msg string) {
 		"error":   msg,
 	})
 }
+
+// Helper: write Idena protocol error response with an HTTP status
+func writeErrorStatus(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"error":   msg,
+	})
+}
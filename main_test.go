@@ -1,16 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
+
+	"idenauthgo/internal/idenarpc"
+	"idenauthgo/internal/merkle"
 )
 
 func TestMain(m *testing.M) {
@@ -32,6 +51,8 @@ func setupTestDB() (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Each connection to :memory: opens a separate database
+	db.SetMaxOpenConns(1)
 
 	createTables := `
 	CREATE TABLE identities (
@@ -43,8 +64,10 @@ func setupTestDB() (*sql.DB, error) {
 	);
 	`
 
-	_, err = db.Exec(createTables)
-	return db, err
+	if _, err = db.Exec(createTables); err != nil {
+		return db, err
+	}
+	return db, migrateDB(db)
 }
 
 func insertTestData(db *sql.DB) error {
@@ -98,7 +121,7 @@ func TestCheckEligibility(t *testing.T) {
 		{
 			address:  "0x9876543210fedcba9876543210fedcba98765432",
 			eligible: false,
-			reason:   "Insufficient stake: 5000.00 iDNA (minimum 10,000)",
+			reason:   "Insufficient stake: 5,000.00 iDNA (minimum 10,000)",
 		},
 		{
 			address:  "0xfedcba0987654321fedcba0987654321fedcba09",
@@ -127,6 +150,401 @@ func TestCheckEligibility(t *testing.T) {
 	}
 }
 
+func TestEligibilityCodes(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	denied := "0xabcdef1234567890abcdef1234567890abcdef12"
+	allowed := "0x2222222222222222222222222222222222222222"
+	server := &Server{db: db, config: Config{
+		Denylist:  map[string]bool{denied: true},
+		Allowlist: map[string]bool{allowed: true},
+	}}
+	tests := []struct {
+		address string
+		code    EligibilityCode
+	}{
+		{"0x1234567890abcdef1234567890abcdef12345678", codeOK},
+		{allowed, codeOK},
+		{"0x9876543210fedcba9876543210fedcba98765432", codeInsufficientStake},
+		{"0xfedcba0987654321fedcba0987654321fedcba09", codeIneligibleState},
+		{"0x1111111111111111111111111111111111111111", codeNotFound},
+		{denied, codeDenylisted},
+	}
+	for _, test := range tests {
+		check := server.evaluateEligibility(test.address)
+		if check.Code != test.code || check.Eligible != (test.code == codeOK) {
+			t.Errorf("%s: expected code %s, got %s (eligible %t)", test.address, test.code, check.Code, check.Eligible)
+		}
+		// The code goes out alongside the unchanged message
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist/check?address="+test.address, nil))
+		var response struct {
+			Code   string `json:"code"`
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		if response.Code != string(test.code) || response.Reason != check.Reason {
+			t.Errorf("%s: expected code %s and reason %q, got %+v", test.address, test.code, check.Reason, response)
+		}
+	}
+
+	db.Close()
+	if check := server.evaluateEligibility("0x1111111111111111111111111111111111111111"); check.Code != codeDatabaseError {
+		t.Errorf("Expected %s on a closed database, got %s", codeDatabaseError, check.Code)
+	}
+}
+
+func TestEligibilityConfigEndpoint(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	allowed := "0x1111111111111111111111111111111111111111"
+	denied := "0x2222222222222222222222222222222222222222"
+	if _, err := db.Exec("INSERT INTO overrides (address, kind, created_by, created_at) VALUES (?, 'allow', 'ops', 1)",
+		"0x3333333333333333333333333333333333333333"); err != nil {
+		t.Fatalf("override insert: %v", err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("ELIGIBLE_STATES")
+		os.Unsetenv("STATE_STAKE_THRESHOLDS")
+	})
+	server := &Server{db: db, env: newDotEnv(filepath.Join(t.TempDir(), ".env")), config: Config{
+		APIKey:          "secret",
+		GracePeriod:     24 * time.Hour,
+		StateThresholds: map[string]float64{"Newbie": 20000},
+		Allowlist:       map[string]bool{allowed: true},
+		Denylist:        map[string]bool{denied: true},
+		Profiles:        map[string]eligibilityProfile{"whale": {States: []string{"Human"}}},
+	}}
+	get := func(key string) (EligibilityConfig, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/config/eligibility", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var config EligibilityConfig
+		if err := json.Unmarshal(rr.Body.Bytes(), &config); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		return config, rr.Body.String()
+	}
+
+	config, body := get("")
+	if got := strings.Join(config.EligibleStates, ","); got != "Human,Verified,Newbie" {
+		t.Errorf("Unexpected eligible states %s", got)
+	}
+	if config.MinStake != 10000 || config.StateMinStake["Newbie"] != 20000 || config.StateMinStake["Human"] != 10000 {
+		t.Errorf("Unexpected stakes: %v, %v", config.MinStake, config.StateMinStake)
+	}
+	if fmt.Sprint(config.GraceStates) != "[Suspended Zombie]" || config.GracePeriodHours != 24 {
+		t.Errorf("Unexpected grace settings: %v, %v", config.GraceStates, config.GracePeriodHours)
+	}
+	if fmt.Sprint(config.Profiles) != "[whale]" {
+		t.Errorf("Unexpected profiles %v", config.Profiles)
+	}
+	if config.Overrides.Allowlisted != 2 || config.Overrides.Denylisted != 1 {
+		t.Errorf("Expected 2 allowlisted and 1 denylisted, got %+v", config.Overrides)
+	}
+	if strings.Contains(body, allowed) || strings.Contains(body, denied) {
+		t.Errorf("Override addresses leaked without the API key: %s", body)
+	}
+	if config, _ = get("wrong"); config.Overrides.Allowlist != nil {
+		t.Error("Expected no addresses for a wrong API key")
+	}
+
+	config, _ = get("secret")
+	if fmt.Sprint(config.Overrides.Allowlist) != "[0x1111111111111111111111111111111111111111 0x3333333333333333333333333333333333333333]" ||
+		fmt.Sprint(config.Overrides.Denylist) != "["+denied+"]" {
+		t.Errorf("Expected the override addresses with the API key, got %+v", config.Overrides)
+	}
+
+	// A reload shows up at once: new states and thresholds, and the
+	// configured lists (now unset) drop out of the counts
+	os.Setenv("ELIGIBLE_STATES", "Human,Verified")
+	os.Setenv("STATE_STAKE_THRESHOLDS", "Verified:30000")
+	req := httptest.NewRequest("POST", "/admin/reload", nil)
+	req.Header.Set("X-API-Key", "secret")
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Reload failed: %d %s", rr.Code, rr.Body.String())
+	}
+	config, _ = get("")
+	if got := strings.Join(config.EligibleStates, ","); got != "Human,Verified" {
+		t.Errorf("Expected the reloaded states, got %s", got)
+	}
+	if config.StateMinStake["Verified"] != 30000 || config.StateMinStake["Human"] != 10000 || len(config.StateMinStake) != 2 {
+		t.Errorf("Expected the reloaded thresholds, got %v", config.StateMinStake)
+	}
+	if config.Overrides.Allowlisted != 1 || config.Overrides.Denylisted != 0 || len(config.Profiles) != 0 {
+		t.Errorf("Expected only the table's override and no profiles, got %+v, %v", config.Overrides, config.Profiles)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	human := "0x1234567890abcdef1234567890abcdef12345678"
+	verified := "0xabcdef1234567890abcdef1234567890abcdef12"
+	envPath := filepath.Join(t.TempDir(), ".env")
+	writeEnv := func(content string) {
+		if err := os.WriteFile(envPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+	}
+	t.Cleanup(func() { os.Unsetenv("STATE_STAKE_THRESHOLDS") })
+	writeEnv("")
+	server := &Server{db: db, config: Config{APIKey: "secret"}, cache: newLRUCache(16, time.Minute), env: newDotEnv(envPath)}
+
+	whitelist := func() string {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist", nil))
+		var response WhitelistResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("response parsing error: %v", err)
+		}
+		return strings.Join(response.Addresses, ",")
+	}
+	check := func() EligibilityCheck {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist/check?address="+human, nil))
+		var response EligibilityCheck
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("response parsing error: %v", err)
+		}
+		return response
+	}
+	reload := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/reload", nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		return rr
+	}
+
+	if got := whitelist(); got != human+","+verified {
+		t.Fatalf("Expected both eligible before reload, got %s", got)
+	}
+	if !check().Eligible {
+		t.Fatal("Expected the Human eligible before reload")
+	}
+
+	writeEnv("STATE_STAKE_THRESHOLDS=Human:20000\n")
+	if rr := reload("wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the API key, got %d", rr.Code)
+	}
+	if got := whitelist(); got != human+","+verified {
+		t.Errorf("Expected no change without the API key, got %s", got)
+	}
+	if rr := reload("secret"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := whitelist(); got != verified {
+		t.Errorf("Expected only the Verified after raising the Human threshold, got %s", got)
+	}
+	// The cached result from before the reload is dropped
+	if c := check(); c.Eligible || c.Code != codeInsufficientStake {
+		t.Errorf("Expected the Human rejected for stake, got %+v", c)
+	}
+
+	writeEnv("STATE_STAKE_THRESHOLDS=Human:lots\n")
+	rr := reload("secret")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "STATE_STAKE_THRESHOLDS") {
+		t.Errorf("Expected 400 naming the variable, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := whitelist(); got != verified {
+		t.Errorf("Expected the previous rules kept after a bad reload, got %s", got)
+	}
+	if got := os.Getenv("STATE_STAKE_THRESHOLDS"); got != "Human:20000" {
+		t.Errorf("Expected the environment untouched by a bad reload, got %q", got)
+	}
+
+	// Dropping the setting from the file restores the default
+	writeEnv("")
+	if rr := reload("secret"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	if got := whitelist(); got != human+","+verified {
+		t.Errorf("Expected both eligible again, got %s", got)
+	}
+}
+
+func TestEligibilityProfiles(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	human := "0x1234567890abcdef1234567890abcdef12345678"
+	verified := "0xabcdef1234567890abcdef1234567890abcdef12"
+	newbie := "0x9876543210fedcba9876543210fedcba98765432"
+	candidate := "0xfedcba0987654321fedcba0987654321fedcba09"
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	profilesJSON := `{
+		"whale": {"min_stake": 20000},
+		"open": {"states": ["Newbie", "Candidate"], "min_stake": 5000, "denylist": ["` + candidate + `"]}
+	}`
+	if err := os.WriteFile(path, []byte(profilesJSON), 0o644); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	profiles, err := loadProfiles(path)
+	if err != nil {
+		t.Fatalf("loadProfiles error: %v", err)
+	}
+	server := &Server{db: db, config: Config{Profiles: profiles}, cache: newLRUCache(16, time.Minute)}
+
+	whitelist := func(query string) []string {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist"+query, nil))
+		var response WhitelistResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: response parsing error: %v", query, err)
+		}
+		return response.Addresses
+	}
+	for query, want := range map[string][]string{
+		"":                 {human, verified},
+		"?profile=default": {human, verified},
+		"?profile=whale":   {verified},
+		"?profile=open":    {newbie},
+	} {
+		if got := whitelist(query); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("/whitelist%s: expected %v, got %v", query, want, got)
+		}
+	}
+
+	// The default result is cached; the profile's must not be served from it
+	check := func(query string) EligibilityCheck {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist/check?address="+human+query, nil))
+		var response EligibilityCheck
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: response parsing error: %v", query, err)
+		}
+		return response
+	}
+	if c := check(""); !c.Eligible {
+		t.Errorf("Expected %s eligible by default, got %+v", human, c)
+	}
+	if c := check("&profile=whale"); c.Eligible || c.Code != codeInsufficientStake {
+		t.Errorf("Expected %s short of the whale minimum, got %+v", human, c)
+	}
+	if c := check("&profile=open"); c.Eligible || c.Code != codeIneligibleState {
+		t.Errorf("Expected Human to be ineligible in the open profile, got %+v", c)
+	}
+
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/merkle_root?profile=whale", nil))
+	var root struct {
+		MerkleRoot string `json:"merkle_root"`
+		Count      int    `json:"addresses_count"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &root); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if root.Count != 1 || root.MerkleRoot != merkle.Build([]string{verified}).Root() {
+		t.Errorf("Expected the whale root over %s, got %+v", verified, root)
+	}
+
+	for _, target := range []string{"/whitelist?profile=nope", "/whitelist/check?address=" + human + "&profile=nope", "/merkle_root?profile=nope"} {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 for an unknown profile, got %d", target, rr.Code)
+		}
+	}
+
+	for _, bad := range []string{`{"default": {}}`, `{"x": {"states": []}}`, `{"x": {"min_stake": -1}}`, `{"x": {"allowlist": ["0x12"]}}`} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := loadProfiles(path); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+
+	// A misspelled key is an error rather than a profile without a minimum
+	os.WriteFile(path, []byte(`{"whale": {"min_stek": 20000}}`), 0o644)
+	if _, err := loadProfiles(path); err == nil || !strings.Contains(err.Error(), `unknown key "min_stek"`) {
+		t.Errorf("Expected the unknown key to be reported, got %v", err)
+	}
+}
+
+func TestCheckEligibilityStateThresholds(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	newbie := "0x1111111111111111111111111111111111111111"
+	verified := "0x2222222222222222222222222222222222222222"
+	for address, state := range map[string]string{newbie: "Newbie", verified: "Verified"} {
+		if _, err := db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, ?, 10000)", address, state); err != nil {
+			t.Fatalf("Data insertion error: %v", err)
+		}
+	}
+
+	thresholds, err := parseStateThresholds("Newbie:20000")
+	if err != nil {
+		t.Fatalf("parseStateThresholds error: %v", err)
+	}
+	server := &Server{db: db, config: Config{StateThresholds: thresholds}}
+
+	eligible, reason := server.checkEligibility(newbie)
+	if eligible || reason != "Insufficient stake: 10,000.00 iDNA (minimum 20,000 for Newbie)" {
+		t.Errorf("Newbie at 10k: got eligible=%v, reason=%q", eligible, reason)
+	}
+	eligible, reason = server.checkEligibility(verified)
+	if !eligible || reason != "Eligible" {
+		t.Errorf("Verified at 10k: got eligible=%v, reason=%q", eligible, reason)
+	}
+
+	// The whitelist applies the same thresholds
+	addresses, err := server.eligibleAddresses()
+	if err != nil {
+		t.Fatalf("eligibleAddresses error: %v", err)
+	}
+	if len(addresses) != 1 || addresses[0] != verified {
+		t.Errorf("Expected only the Verified identity, got %v", addresses)
+	}
+
+	for _, value := range []string{"Newbie", "Newbie:lots", ":100", "Newbie:-1"} {
+		if _, err := parseStateThresholds(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
 func TestWhitelistEndpoint(t *testing.T) {
 	db, err := setupTestDB()
 	if err != nil {
@@ -166,7 +584,218 @@ func TestWhitelistEndpoint(t *testing.T) {
 
 	if len(response.Addresses) != expectedCount {
 		t.Errorf("Expected %d addresses, got %d", expectedCount, len(response.Addresses))
-	}, len(response.Addresses))
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	// A slow request holds the only slot until it is unblocked
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	limited := limitInFlight(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-unblock
+		}
+	}))
+	serve := func(handler http.Handler, target, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	slow := make(chan int)
+	go func() { slow <- serve(limited, "/slow", "").Code }()
+	<-started
+
+	rr := serve(limited, "/whitelist/check", "")
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while saturated, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected Retry-After and no-store, got %v", rr.Header())
+	}
+	for _, target := range []string{"/health", "/version"} {
+		if rr := serve(limited, target, ""); rr.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 while saturated, got %d", target, rr.Code)
+		}
+	}
+	close(unblock)
+	<-slow
+	if rr := serve(limited, "/whitelist/check", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 once the slot is free, got %d", rr.Code)
+	}
+
+	// A long-poll gives its slot back while it waits
+	server := &Server{db: db, config: Config{MaxInFlight: 1}}
+	router := server.routes()
+	etag := serve(router, "/whitelist", "").Header().Get("ETag")
+	done := make(chan int)
+	go func() { done <- serve(router, "/whitelist?wait=2s", etag).Code }()
+	waiting := func() bool {
+		server.whitelistChanges.mu.Lock()
+		defer server.whitelistChanges.mu.Unlock()
+		return server.whitelistChanges.waiters > 0
+	}
+	for deadline := time.Now().Add(time.Second); !waiting() && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if rr = serve(router, "/whitelist/check?address=0x1234567890abcdef1234567890abcdef12345678", ""); rr.Code == http.StatusOK {
+			break
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("Expected the long-poll to still be waiting")
+	default:
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 during a long-poll, got %d", rr.Code)
+	}
+	if code := <-done; code != http.StatusNotModified {
+		t.Errorf("Expected the long-poll to finish with 304, got %d", code)
+	}
+}
+
+func TestWhitelistLongPoll(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+
+	rr := httptest.NewRecorder()
+	server.handleWhitelist(rr, httptest.NewRequest("GET", "/whitelist", nil))
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag on /whitelist")
+	}
+
+	// A matching ETag times out with 304
+	req := httptest.NewRequest("GET", "/whitelist?wait=50ms", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	server.handleWhitelist(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304 after the wait elapsed, got %d", rr.Code)
+	}
+
+	// A whitelist change unblocks a waiter
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("GET", "/whitelist?wait=10s", nil)
+		req.Header.Set("If-None-Match", etag)
+		rr := httptest.NewRecorder()
+		server.handleWhitelist(rr, req)
+		done <- rr
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	err = server.updateDatabase([]Identity{
+		{Address: "0x1111111111111111111111111111111111111111", State: "Human", Stake: 30000},
+	})
+	if err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 after a change, got %d", rr.Code)
+		}
+		if rr.Header().Get("ETag") == etag {
+			t.Error("Expected a new ETag after the whitelist changed")
+		}
+		etag = rr.Header().Get("ETag")
+		var response WhitelistResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		if response.Count != 3 {
+			t.Errorf("Expected 3 addresses after the change, got %d", response.Count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiter was not released by the whitelist change")
+	}
+
+	// Waiters beyond the cap are turned away
+	server.config.WhitelistMaxWaiters = 1
+	server.whitelistChanges.acquire(1)
+	defer server.whitelistChanges.release()
+	req = httptest.NewRequest("GET", "/whitelist?wait=10s", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	server.handleWhitelist(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with the waiter cap reached, got %d", rr.Code)
+	}
+}
+
+func TestWhitelistETagTracksAddresses(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.handleWhitelist(rr, httptest.NewRequest("GET", "/whitelist", nil))
+		return rr
+	}
+	before := get().Header().Get("ETag")
+
+	// One address leaves and another joins: same count, different list
+	err = server.updateDatabase([]Identity{
+		{Address: "0x1234567890abcdef1234567890abcdef12345678", State: "Candidate", Stake: 15000},
+		{Address: "0xfedcba0987654321fedcba0987654321fedcba09", State: "Human", Stake: 12000},
+	})
+	if err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+
+	rr := get()
+	var response WhitelistResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if response.Count != 2 {
+		t.Fatalf("Expected the count to stay at 2, got %d", response.Count)
+	}
+	if after := rr.Header().Get("ETag"); after == before {
+		t.Errorf("Expected the ETag to change when an address is swapped, still %s", after)
+	}
+
+	req := httptest.NewRequest("GET", "/whitelist", nil)
+	req.Header.Set("If-None-Match", before)
+	rr = httptest.NewRecorder()
+	server.handleWhitelist(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the old ETag to miss after the swap, got %d", rr.Code)
 	}
 }
 
@@ -245,20 +874,322 @@ func TestMerkleRootEndpoint(t *testing.T) {
 	if response["addresses_count"] == nil {
 		t.Error("addresses_count missing in response")
 	}
+
+	// The root is the one proofs are served against
+	tree, err := server.merkleTree()
+	if err != nil {
+		t.Fatalf("merkleTree error: %v", err)
+	}
+	if response["merkle_root"] != tree.Root() || response["hash_algorithm"] != string(tree.HashAlgo()) {
+		t.Errorf("Expected the cached tree's root %s, got %v", tree.Root(), response)
+	}
 }
 
-func TestHealthEndpoint(t *testing.T) {
+func TestMerkleRootComposition(t *testing.T) {
 	db, err := setupTestDB()
 	if err != nil {
-		t.Fatalf("Erreur de setup DB: %v", err)
+		t.Fatalf("DB setup error: %v", err)
 	}
 	defer db.Close()
 
-	server := &Server{db: db}
-
-	req, err := http.NewRequest("GET", "/health", nil)
-	if err != nil {
-		t.Fatalf("Erreur de création de requête: %v", err)
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, 'Newbie', 10000)",
+		"0x4444444444444444444444444444444444444444"); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	req := httptest.NewRequest("GET", "/merkle_root", nil)
+	rr := httptest.NewRecorder()
+	server.handleMerkleRoot(rr, req)
+
+	var response struct {
+		MerkleRoot     string         `json:"merkle_root"`
+		AddressesCount int            `json:"addresses_count"`
+		ByState        map[string]int `json:"by_state"`
+		MinStake       float64        `json:"min_stake"`
+		TotalStake     float64        `json:"total_stake"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+
+	if response.MerkleRoot == "" || response.AddressesCount != 3 {
+		t.Errorf("Expected root over 3 addresses, got %q over %d", response.MerkleRoot, response.AddressesCount)
+	}
+	expected := map[string]int{"Human": 1, "Verified": 1, "Newbie": 1}
+	if len(response.ByState) != len(expected) {
+		t.Errorf("Expected by_state %v, got %v", expected, response.ByState)
+	}
+	for state, count := range expected {
+		if response.ByState[state] != count {
+			t.Errorf("Expected %d %s, got %d", count, state, response.ByState[state])
+		}
+	}
+	if response.MinStake != 10000 {
+		t.Errorf("Expected min_stake 10000, got %v", response.MinStake)
+	}
+	if response.TotalStake != 50000 {
+		t.Errorf("Expected total_stake 50000, got %v", response.TotalStake)
+	}
+
+	// Allowlisted addresses without a stake or not indexed yet are counted
+	// as Unknown, so by_state still adds up to the whitelist
+	unindexed := "0x5555555555555555555555555555555555555555"
+	noStake := "0x6666666666666666666666666666666666666666"
+	db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, 'Candidate', NULL)", noStake)
+	server = &Server{db: db, config: Config{Allowlist: map[string]bool{unindexed: true, noStake: true}}}
+	rr = httptest.NewRecorder()
+	server.handleMerkleRoot(rr, httptest.NewRequest("GET", "/merkle_root", nil))
+	response.ByState = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	sum := 0
+	for _, count := range response.ByState {
+		sum += count
+	}
+	if response.AddressesCount != 5 || sum != 5 || response.ByState["Unknown"] != 2 {
+		t.Errorf("Expected 5 addresses with 2 Unknown in by_state, got %d and %v", response.AddressesCount, response.ByState)
+	}
+	if response.MinStake != 10000 || response.TotalStake != 50000 {
+		t.Errorf("Expected unknown stakes left out of the totals, got min %v total %v", response.MinStake, response.TotalStake)
+	}
+}
+
+func TestDryVerify(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db}
+	var out, errOut strings.Builder
+
+	// An empty whitelist fails the gate
+	if code := runDryVerify(server, &out, &errOut); code == 0 {
+		t.Errorf("Expected a non-zero exit code for an empty whitelist")
+	}
+	if !strings.Contains(errOut.String(), errEmptyWhitelist.Error()) {
+		t.Errorf("Expected the empty whitelist to be reported, got %q", errOut.String())
+	}
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	out.Reset()
+	if code := runDryVerify(server, &out, &errOut); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	addresses := []string{
+		"0x1234567890abcdef1234567890abcdef12345678",
+		"0xabcdef1234567890abcdef1234567890abcdef12",
+	}
+	sum := sha256.Sum256([]byte(strings.Join(addresses, "\n")))
+	expected := fmt.Sprintf("merkle_root: %s\ncount: 2\naddresses_sha256: %s\n",
+		merkle.Build(addresses).Root(), hex.EncodeToString(sum[:]))
+	if out.String() != expected {
+		t.Errorf("Expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// The root is the one the server publishes for claims
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist/paginated-merkle", nil))
+	var published struct {
+		MerkleRoot string `json:"merkle_root"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &published); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if !strings.Contains(out.String(), "merkle_root: "+published.MerkleRoot+"\n") {
+		t.Errorf("Expected dry-verify to print the published root %s, got:\n%s", published.MerkleRoot, out.String())
+	}
+}
+
+func TestOnchainDiff(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	server := &Server{db: db}
+
+	dir := t.TempDir()
+	onchain := filepath.Join(dir, "onchain.txt")
+	os.WriteFile(onchain, []byte(`# published root 0xabc
+0xABCDEF1234567890ABCDEF1234567890ABCDEF12
+0x9876543210fedcba9876543210fedcba98765432
+
+0x7777777777777777777777777777777777777777
+0xabcdef1234567890abcdef1234567890abcdef12
+`), 0o644)
+
+	var out, errOut strings.Builder
+	if code := runOnchainDiff(server, onchain, &out, &errOut); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, errOut.String())
+	}
+	var diff whitelistDiff
+	if err := json.Unmarshal([]byte(out.String()), &diff); err != nil {
+		t.Fatalf("Invalid JSON output: %v\n%s", err, out.String())
+	}
+	expected := whitelistDiff{
+		Add: []string{"0x1234567890abcdef1234567890abcdef12345678"},
+		Remove: []string{
+			"0x7777777777777777777777777777777777777777", // not indexed
+			"0x9876543210fedcba9876543210fedcba98765432", // indexed, not eligible
+		},
+		Eligible:  2,
+		OnChain:   3,
+		Unchanged: 1,
+	}
+	if fmt.Sprint(diff) != fmt.Sprint(expected) {
+		t.Errorf("Expected %+v, got %+v", expected, diff)
+	}
+	if summary := "2 eligible, 3 on-chain: 1 to add, 2 to remove, 1 unchanged\n"; errOut.String() != summary {
+		t.Errorf("Expected summary %q, got %q", summary, errOut.String())
+	}
+
+	// The same list on both sides leaves nothing to do
+	if diff := diffSorted(expected.Add, expected.Add); len(diff.Add) != 0 || len(diff.Remove) != 0 || diff.Unchanged != 1 {
+		t.Errorf("Expected no changes for identical lists, got %+v", diff)
+	}
+
+	invalid := filepath.Join(dir, "invalid.txt")
+	os.WriteFile(invalid, []byte("0x1234\n"), 0o644)
+	for _, path := range []string{invalid, filepath.Join(dir, "missing.txt")} {
+		errOut.Reset()
+		if code := runOnchainDiff(server, path, &out, &errOut); code == 0 || errOut.Len() == 0 {
+			t.Errorf("%s: expected a failure, got exit code %d", path, code)
+		}
+	}
+}
+
+func TestUpdateDatabaseKeepsValidationData(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db}
+	address := "0x1111111111111111111111111111111111111111"
+	online, flips := true, 3
+	if err := server.updateDatabase([]Identity{{Address: address, State: "Human", Stake: 20000, Online: &online, FlipsCount: &flips}}); err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+
+	// A fetch without validation data keeps what was stored
+	if err := server.updateDatabase([]Identity{{Address: address, State: "Human", Stake: 21000}}); err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+	var storedOnline sql.NullBool
+	var storedFlips sql.NullInt64
+	if err := db.QueryRow("SELECT online, flips_count FROM identities WHERE address = ?", address).Scan(&storedOnline, &storedFlips); err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if !storedOnline.Valid || !storedOnline.Bool || storedFlips.Int64 != 3 {
+		t.Errorf("Expected online=true and flips_count=3 to survive, got %v %v", storedOnline, storedFlips)
+	}
+
+	// Known values, false and 0 included, replace them
+	online, flips = false, 0
+	if err := server.updateDatabase([]Identity{{Address: address, State: "Human", Stake: 21000, Online: &online, FlipsCount: &flips}}); err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+	db.QueryRow("SELECT online, flips_count FROM identities WHERE address = ?", address).Scan(&storedOnline, &storedFlips)
+	if !storedOnline.Valid || storedOnline.Bool || !storedFlips.Valid || storedFlips.Int64 != 0 {
+		t.Errorf("Expected online=false and flips_count=0, got %v %v", storedOnline, storedFlips)
+	}
+}
+
+func TestSingleIdentityValidationData(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+	if _, err := db.Exec("UPDATE identities SET online = 1, flips_count = 3 WHERE address = ?", address); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+
+	server := &Server{db: db}
+	router := mux.NewRouter()
+	router.HandleFunc("/identity/{address}", server.handleSingleIdentity)
+	router.HandleFunc("/state/{state}", server.handleStateIdentities)
+
+	req := httptest.NewRequest("GET", "/identity/"+address, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Wrong status code: got %v, expected %v", status, http.StatusOK)
+	}
+
+	var identity Identity
+	if err := json.Unmarshal(rr.Body.Bytes(), &identity); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if identity.Online == nil || !*identity.Online {
+		t.Errorf("Expected online=true, got %v", identity.Online)
+	}
+	if identity.FlipsCount == nil || *identity.FlipsCount != 3 {
+		t.Errorf("Expected flips_count=3, got %v", identity.FlipsCount)
+	}
+
+	// Identities never fetched with validation data omit the fields
+	req = httptest.NewRequest("GET", "/state/Verified", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var identities []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if len(identities) != 1 {
+		t.Fatalf("Expected 1 Verified identity, got %d", len(identities))
+	}
+	if _, ok := identities[0]["online"]; ok {
+		t.Errorf("online should be omitted when unknown")
+	}
+}
+
+func TestMigrateDBIsIdempotent(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := migrateDB(db); err != nil {
+		t.Fatalf("Second migration failed: %v", err)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Erreur de setup DB: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db}
+
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatalf("Erreur de création de requête: %v", err)
 	}
 
 	rr := httptest.NewRecorder()
@@ -277,25 +1208,4511 @@ func TestHealthEndpoint(t *testing.T) {
 	if response["status"] != "healthy" {
 		t.Errorf("Expected status=healthy, got=%v", response["status"])
 	}
+
+	if response["version"] != version || response["commit"] != commit {
+		t.Errorf("Health should report build info, got version=%v commit=%v", response["version"], response["commit"])
+	}
 }
 
-// Benchmark for performance
-func BenchmarkCheckEligibility(b *testing.B) {
+func TestRPCCircuitBreaker(t *testing.T) {
 	db, err := setupTestDB()
 	if err != nil {
-		b.Fatalf("DB setup error: %v", err)
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	var calls, down int32 = 0, 1
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"15000"}]}`))
+	}))
+	defer node.Close()
+
+	const cooldown = 50 * time.Millisecond
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL},
+		rpcBreaker: idenarpc.NewBreaker(2, cooldown)}
+	health := func() string {
+		rr := httptest.NewRecorder()
+		server.handleHealth(rr, httptest.NewRequest("GET", "/health", nil))
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return fmt.Sprint(response["rpc_circuit"])
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := server.runFetch(ctx); err == nil {
+			t.Fatal("expected the fetch to fail while the node is down")
+		}
+	}
+	if state := health(); state != idenarpc.BreakerOpen {
+		t.Fatalf("expected /health to report an open circuit, got %s", state)
+	}
+	if _, err := server.runFetch(ctx); !errors.Is(err, idenarpc.ErrCircuitOpen) {
+		t.Errorf("expected the fetch to be skipped, got %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 calls to the node, got %d", n)
+	}
+
+	// Once the node is back, the probe after the cooldown closes it
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(cooldown)
+	if state := health(); state != idenarpc.BreakerHalfOpen {
+		t.Errorf("expected half-open after the cooldown, got %s", state)
+	}
+	if changes, err := server.runFetch(ctx); err != nil || changes != 1 {
+		t.Fatalf("expected the probe fetch to store 1 identity, got %d, %v", changes, err)
+	}
+	if state := health(); state != idenarpc.BreakerClosed {
+		t.Errorf("expected a closed circuit, got %s", state)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	origVersion, origCommit, origBuildTime := version, commit, buildTime
+	t.Cleanup(func() { version, commit, buildTime = origVersion, origCommit, origBuildTime })
+	version, commit, buildTime = "v9.9.9", "abc1234", "2024-01-02T03:04:05Z"
+
+	server := &Server{}
+	req := httptest.NewRequest("GET", "/version", nil)
+	rr := httptest.NewRecorder()
+	server.handleVersion(rr, req)
+
+	var response map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+
+	expected := map[string]string{"version": "v9.9.9", "commit": "abc1234", "build_time": "2024-01-02T03:04:05Z"}
+	for key, want := range expected {
+		if response[key] != want {
+			t.Errorf("Expected %s=%s, got=%s", key, want, response[key])
+		}
+	}
+}
+
+func TestDashboardServesIndex(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	dashboardHandler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "<title>Idena Indexer Dashboard</title>") {
+		t.Errorf("Expected dashboard title in response body")
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
 	}
 	defer db.Close()
 
 	if err := insertTestData(db); err != nil {
-		b.Fatalf("Data insertion error: %v", err)
+		t.Fatalf("Data insertion error: %v", err)
 	}
 
 	server := &Server{db: db}
-	address := "0x1234567890abcdef1234567890abcdef12345678"
+	server.fetches.recordSuccess(time.Unix(1700000000, 0))
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		server.checkEligibility(address)
+	req := httptest.NewRequest("GET", "/stats", nil)
+	rr := httptest.NewRecorder()
+	server.handleStats(rr, req)
+
+	var stats IndexerStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if stats.Total != 4 {
+		t.Errorf("Expected 4 identities, got %d", stats.Total)
+	}
+	if stats.Eligible != 2 {
+		t.Errorf("Expected 2 eligible identities, got %d", stats.Eligible)
+	}
+	if stats.ByState["Human"] != 1 || stats.ByState["Candidate"] != 1 {
+		t.Errorf("Unexpected per-state breakdown: %v", stats.ByState)
+	}
+	if stats.LastFetch != 1700000000 {
+		t.Errorf("Expected last_fetch 1700000000, got %d", stats.LastFetch)
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	base := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rows := []struct {
+		at       time.Time
+		total    int
+		eligible int
+		stake    float64
+	}{
+		{base.Add(10 * time.Minute), 100, 40, 1e6},
+		{base.Add(50 * time.Minute), 110, 45, 1.1e6},
+		{base.Add(90 * time.Minute), 120, 50, 1.2e6},
+		{base.Add(26 * time.Hour), 130, 55, 1.3e6},
+		{base.Add(72 * time.Hour), 140, 60, 1.4e6},
+	}
+	for _, row := range rows {
+		if _, err := db.Exec(
+			"INSERT INTO stats_history (recorded_at, total, eligible, total_stake) VALUES (?, ?, ?, ?)",
+			row.at.Unix(), row.total, row.eligible, row.stake,
+		); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	server := &Server{db: db}
+	from := base.Format(time.RFC3339)
+	to := base.Add(48 * time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		bucket   string
+		expected []StatsPoint
+	}{
+		{"hour", []StatsPoint{
+			{base.Unix(), 110, 45, 1.1e6},
+			{base.Add(time.Hour).Unix(), 120, 50, 1.2e6},
+			{base.Add(26 * time.Hour).Unix(), 130, 55, 1.3e6},
+		}},
+		{"day", []StatsPoint{
+			{base.Unix(), 120, 50, 1.2e6},
+			{base.Add(24 * time.Hour).Unix(), 130, 55, 1.3e6},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.bucket, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/stats/history?from="+from+"&to="+to+"&bucket="+test.bucket, nil)
+			rr := httptest.NewRecorder()
+			server.handleStatsHistory(rr, req)
+
+			var response struct {
+				Bucket string       `json:"bucket"`
+				Points []StatsPoint `json:"points"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Response parsing error: %v (%s)", err, rr.Body.String())
+			}
+			if len(response.Points) != len(test.expected) {
+				t.Fatalf("Expected %d points, got %+v", len(test.expected), response.Points)
+			}
+			for i, point := range response.Points {
+				if point != test.expected[i] {
+					t.Errorf("Point %d: expected %+v, got %+v", i, test.expected[i], point)
+				}
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/stats/history?from=1h&bucket=week", nil)
+	rr := httptest.NewRecorder()
+	server.handleStatsHistory(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown bucket, got %d", rr.Code)
+	}
+}
+
+func TestStakeTierBoundaries(t *testing.T) {
+	tests := []struct {
+		stake float64
+		tier  string
+	}{
+		{0, "<1k"},
+		{999.99, "<1k"},
+		{1000, "1k-10k"},
+		{9999.99, "1k-10k"},
+		{10000, "10k-100k"},
+		{99999.99, "10k-100k"},
+		{100000, "100k+"},
+		{5000000, "100k+"},
+	}
+	for _, tt := range tests {
+		if got := defaultStakeTiers.classify(tt.stake); got != tt.tier {
+			t.Errorf("classify(%v) = %q, expected %q", tt.stake, got, tt.tier)
+		}
+	}
+
+	tiers, err := parseStakeTiers("small:500, large:20000")
+	if err != nil {
+		t.Fatalf("parseStakeTiers error: %v", err)
+	}
+	if got := tiers.classify(499); got != "" {
+		t.Errorf("Expected no tier below the lowest minimum, got %q", got)
+	}
+	if got := tiers.classify(500); got != "small" {
+		t.Errorf("Expected small at 500, got %q", got)
+	}
+	if got := tiers.classify(20000); got != "large" {
+		t.Errorf("Expected large at 20000, got %q", got)
+	}
+
+	for _, value := range []string{"a:10,b:10", "a:10,b:5", "a", ":5", "a:x", "a:-1"} {
+		if _, err := parseStakeTiers(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
 	}
-}
\ No newline at end of file
+}
+
+func TestStatsTiers(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	req := httptest.NewRequest("GET", "/stats/tiers", nil)
+	rr := httptest.NewRecorder()
+	server.handleStatsTiers(rr, req)
+
+	var counts []TierCount
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	expected := []int{0, 1, 3, 0}
+	if len(counts) != len(expected) {
+		t.Fatalf("Expected %d tiers, got %d", len(expected), len(counts))
+	}
+	for i, count := range counts {
+		if count.Label != defaultStakeTiers[i].Label || count.Count != expected[i] {
+			t.Errorf("Tier %d: got %s=%d, expected %s=%d", i, count.Label, count.Count, defaultStakeTiers[i].Label, expected[i])
+		}
+	}
+
+	// The tier label is included in identity responses
+	req = httptest.NewRequest("GET", "/identity/0x9876543210fedcba9876543210fedcba98765432", nil)
+	req = mux.SetURLVars(req, map[string]string{"address": "0x9876543210fedcba9876543210fedcba98765432"})
+	rr = httptest.NewRecorder()
+	server.handleSingleIdentity(rr, req)
+
+	var identity Identity
+	if err := json.Unmarshal(rr.Body.Bytes(), &identity); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if identity.Tier != "1k-10k" {
+		t.Errorf("Expected tier 1k-10k, got %q", identity.Tier)
+	}
+}
+
+func TestUpdateDatabaseRecordsStats(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db}
+	err = server.updateDatabase([]Identity{
+		{Address: "0x1111111111111111111111111111111111111111", State: "Human", Stake: 20000},
+		{Address: "0x2222222222222222222222222222222222222222", State: "Candidate", Stake: 500},
+	})
+	if err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+
+	var total, eligible int
+	var stake float64
+	if err := db.QueryRow("SELECT total, eligible, total_stake FROM stats_history").Scan(&total, &eligible, &stake); err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if total != 2 || eligible != 1 || stake != 20500 {
+		t.Errorf("Expected 2/1/20500, got %d/%d/%v", total, eligible, stake)
+	}
+
+	// The eligible count follows the configured states and thresholds
+	if _, err := db.Exec("DELETE FROM stats_history"); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	server = &Server{db: db, config: Config{
+		EligibleStates:  []string{"Human", "Newbie"},
+		StateThresholds: map[string]float64{"Newbie": 20000},
+	}}
+	err = server.updateDatabase([]Identity{
+		{Address: "0x3333333333333333333333333333333333333333", State: "Newbie", Stake: 15000},
+		{Address: "0x4444444444444444444444444444444444444444", State: "Verified", Stake: 30000},
+	})
+	if err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+	if err := db.QueryRow("SELECT eligible FROM stats_history").Scan(&eligible); err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if eligible != 1 {
+		t.Errorf("Expected only the Human to count as eligible, got %d", eligible)
+	}
+}
+
+func TestEligibilityCacheInvalidation(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db, cache: newLRUCache(16, time.Minute)}
+	address := "0x9876543210fedcba9876543210fedcba98765432"
+
+	check := func() (EligibilityCheck, string) {
+		req := httptest.NewRequest("GET", "/whitelist/check?address="+address, nil)
+		rr := httptest.NewRecorder()
+		server.handleWhitelistCheck(rr, req)
+
+		var response EligibilityCheck
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		return response, rr.Header().Get("X-Cache")
+	}
+
+	if response, cache := check(); response.Eligible || cache != "MISS" {
+		t.Fatalf("Expected uncached ineligible result, got eligible=%v X-Cache=%s", response.Eligible, cache)
+	}
+	if _, cache := check(); cache != "HIT" {
+		t.Fatalf("Expected cache hit, got X-Cache=%s", cache)
+	}
+
+	// Raising the stake through updateDatabase must evict the stale entry
+	err = server.updateDatabase([]Identity{{Address: address, State: "Newbie", Stake: 20000}})
+	if err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+	response, cache := check()
+	if cache != "MISS" {
+		t.Errorf("Expected cache miss after update, got X-Cache=%s", cache)
+	}
+	if !response.Eligible {
+		t.Errorf("Expected address to be eligible after update, reason=%q", response.Reason)
+	}
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	cache := newLRUCache(2, time.Minute)
+	cache.set("a", 1)
+	cache.set("b", 2)
+	cache.get("a")
+	cache.set("c", 3)
+
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("Least recently used entry should have been evicted")
+	}
+	if _, ok := cache.get("a"); !ok {
+		t.Errorf("Recently used entry should be kept")
+	}
+}
+
+func TestToChecksumAddress(t *testing.T) {
+	// Test vectors from EIP-55
+	checksummed := []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	}
+
+	for _, want := range checksummed {
+		t.Run(want, func(t *testing.T) {
+			if got := toChecksumAddress(strings.ToLower(want)); got != want {
+				t.Errorf("Expected %s, got %s", want, got)
+			}
+			if !isChecksumAddress(want) {
+				t.Errorf("Expected %s to be a valid checksum address", want)
+			}
+			if isChecksumAddress(strings.ToLower(want)) {
+				t.Errorf("Lowercase address should not pass strict validation")
+			}
+		})
+	}
+}
+
+func TestFormatIDNA(t *testing.T) {
+	tests := []struct {
+		stake    float64
+		expected string
+	}{
+		{0, "0.00 iDNA"},
+		{12.5, "12.50 iDNA"},
+		{999.999, "1,000.00 iDNA"},
+		{5000, "5,000.00 iDNA"},
+		{15000, "15,000.00 iDNA"},
+		{1234567.891, "1,234,567.89 iDNA"},
+		{-2500, "-2,500.00 iDNA"},
+	}
+	for _, test := range tests {
+		if got := formatIDNA(test.stake); got != test.expected {
+			t.Errorf("formatIDNA(%v): expected %q, got %q", test.stake, test.expected, got)
+		}
+	}
+}
+
+func TestFormatStakeParam(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	address := "0xabcdef1234567890abcdef1234567890abcdef12"
+
+	for _, query := range []string{"", "?format_stake=true"} {
+		req := httptest.NewRequest("GET", "/identity/"+address+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"address": address})
+		rr := httptest.NewRecorder()
+		server.handleSingleIdentity(rr, req)
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		if response["stake"] != 25000.0 {
+			t.Errorf("%q: expected numeric stake 25000, got %v", query, response["stake"])
+		}
+		display, ok := response["stake_display"]
+		if query == "" && ok {
+			t.Errorf("Expected no stake_display by default, got %v", display)
+		}
+		if query != "" && display != "25,000.00 iDNA" {
+			t.Errorf("Expected stake_display 25,000.00 iDNA, got %v", display)
+		}
+	}
+}
+
+func TestWhitelistCheckChecksum(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+	checksummed := toChecksumAddress(address)
+
+	tests := []struct {
+		query   string
+		status  int
+		address string
+	}{
+		{"address=" + checksummed + "&checksum=true", http.StatusOK, checksummed},
+		{"address=" + checksummed + "&strict=true", http.StatusOK, address},
+		{"address=" + address + "&strict=true", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/whitelist/check?"+test.query, nil)
+			rr := httptest.NewRecorder()
+			server.handleWhitelistCheck(rr, req)
+
+			if rr.Code != test.status {
+				t.Fatalf("Wrong status code: got %v, expected %v", rr.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var response EligibilityCheck
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Response parsing error: %v", err)
+			}
+			if response.Address != test.address || !response.Eligible {
+				t.Errorf("Expected eligible %s, got %+v", test.address, response)
+			}
+		})
+	}
+}
+
+func TestAddressInputFormats(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	router := server.routes()
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+
+	tests := []struct {
+		name   string
+		input  string
+		status int
+	}{
+		{"canonical", address, http.StatusOK},
+		{"no prefix", "1234567890abcdef1234567890abcdef12345678", http.StatusOK},
+		{"uppercase", "0x1234567890ABCDEF1234567890ABCDEF12345678", http.StatusOK},
+		{"uppercase prefix", "0X1234567890ABCDEF1234567890ABCDEF12345678", http.StatusOK},
+		{"no prefix uppercase", "1234567890ABCDEF1234567890ABCDEF12345678", http.StatusOK},
+		{"spaces", "%20" + address + "%20", http.StatusOK},
+		{"too short", "0x1234567890abcdef", http.StatusBadRequest},
+		{"too long", address + "00", http.StatusBadRequest},
+		{"not hex", "0x1234567890abcdef1234567890abcdef1234567g", http.StatusBadRequest},
+		{"prefix only", "0x", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, path := range []string{"/whitelist/check?address=" + test.input, "/identity/" + test.input} {
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+				if rr.Code != test.status {
+					t.Fatalf("%s: got %d, expected %d: %s", path, rr.Code, test.status, rr.Body.String())
+				}
+				if test.status != http.StatusOK {
+					if !strings.Contains(rr.Body.String(), "Invalid address") {
+						t.Errorf("%s: expected a clear error, got %q", path, rr.Body.String())
+					}
+					continue
+				}
+				var response struct {
+					Address string `json:"address"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+					t.Fatalf("%s: response parsing error: %v", path, err)
+				}
+				if response.Address != address {
+					t.Errorf("%s: expected %s, got %s", path, address, response.Address)
+				}
+			}
+		})
+	}
+}
+
+func TestWhitelistServesStaleOnDBErrors(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db, config: Config{DegradeAfterErrors: 2}}
+
+	get := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	if rr := get(server.handleWhitelist, "/whitelist"); rr.Code != http.StatusOK {
+		t.Fatalf("Initial whitelist failed: %v", rr.Code)
+	}
+
+	// Simulate the database going away
+	db.Close()
+
+	if rr := get(server.handleWhitelist, "/whitelist"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("First DB error should still fail, got %v", rr.Code)
+	}
+	if rr := get(server.handleReady, "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz should fail while the DB is down, got %v", rr.Code)
+	}
+
+	rr := get(server.handleWhitelist, "/whitelist")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Degraded whitelist should return 200, got %v", rr.Code)
+	}
+	var response WhitelistResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if !response.Stale || response.Count != 2 {
+		t.Errorf("Expected stale cached whitelist of 2, got %+v", response)
+	}
+
+	if rr := get(server.handleReady, "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz should report not ready while degraded, got %v", rr.Code)
+	}
+}
+
+func TestReadyRecoversFromDBErrors(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db, config: Config{DegradeAfterErrors: 2}}
+	get := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+	get(server.handleWhitelist, "/whitelist")
+
+	// Whitelist queries fail while the database still answers pings
+	if _, err := db.Exec("ALTER TABLE identities RENAME TO identities_moved"); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	get(server.handleWhitelist, "/whitelist")
+	get(server.handleWhitelist, "/whitelist")
+	if !server.degraded() {
+		t.Fatal("Expected the server to be degraded after repeated errors")
+	}
+	if rr := get(server.handleReady, "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz should report not ready while queries fail, got %v", rr.Code)
+	}
+
+	// Once the queries work again readyz recovers, and so does /whitelist
+	if _, err := db.Exec("ALTER TABLE identities_moved RENAME TO identities"); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	if rr := get(server.handleReady, "/readyz"); rr.Code != http.StatusOK {
+		t.Errorf("readyz should recover with the database, got %v %s", rr.Code, rr.Body.String())
+	}
+	if server.degraded() {
+		t.Error("Expected degraded mode to end after the database recovered")
+	}
+	var response WhitelistResponse
+	json.Unmarshal(get(server.handleWhitelist, "/whitelist").Body.Bytes(), &response)
+	if response.Stale || response.Count != 2 {
+		t.Errorf("Expected a fresh whitelist of 2, got %+v", response)
+	}
+}
+
+func TestWhitelistMaxAge(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	get := func(server *Server) (int, WhitelistResponse) {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist", nil))
+		var response WhitelistResponse
+		if rr.Code == http.StatusOK {
+			json.Unmarshal(rr.Body.Bytes(), &response)
+		}
+		return rr.Code, response
+	}
+
+	fail := &Server{db: db, config: Config{MaxWhitelistAge: time.Hour, WhitelistStaleMode: staleFail}}
+	flagged := &Server{db: db, config: Config{MaxWhitelistAge: time.Hour, WhitelistStaleMode: staleFlag}}
+
+	// Without a fetch of its own the server goes by identities.updated_at,
+	// which insertTestData sets to now
+	for _, server := range []*Server{fail, flagged} {
+		if code, response := get(server); code != http.StatusOK || response.Stale || response.Count != 2 {
+			t.Errorf("%s: expected fresh data, got %d %+v", server.config.WhitelistStaleMode, code, response)
+		}
+	}
+
+	if _, err := db.Exec("UPDATE identities SET updated_at = datetime('now', '-2 hours')"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(fail); code != http.StatusServiceUnavailable {
+		t.Errorf("fail: expected 503 for stale data, got %d", code)
+	}
+	if code, response := get(flagged); code != http.StatusOK || !response.Stale || response.Count != 2 {
+		t.Errorf("flag: expected the whitelist flagged stale, got %d %+v", code, response)
+	}
+
+	// A recent fetch by this process makes it fresh again
+	fail.fetches.recordSuccess(time.Now().Add(-time.Minute))
+	if code, _ := get(fail); code != http.StatusOK {
+		t.Errorf("expected 200 after a recent fetch, got %d", code)
+	}
+	fail.fetches.recordSuccess(time.Now().Add(-61 * time.Minute))
+	if code, _ := get(fail); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once the fetch is older than the max age, got %d", code)
+	}
+
+	// Disabled by default
+	if code, _ := get(&Server{db: db}); code != http.StatusOK {
+		t.Errorf("expected no age check by default, got %d", code)
+	}
+}
+
+func TestReadyMaxStaleness(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db, config: Config{MaxStaleness: 20 * time.Minute}}
+	ready := func() (int, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		server.handleReady(rr, httptest.NewRequest("GET", "/readyz", nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		return rr.Code, body
+	}
+
+	if code, body := ready(); code != http.StatusServiceUnavailable || body["reason"] != "no identities fetched yet" {
+		t.Errorf("Expected not ready before the first fetch, got %d %v", code, body)
+	}
+
+	server.fetches.recordSuccess(time.Now().Add(-20*time.Minute + 5*time.Second))
+	code, body := ready()
+	if code != http.StatusOK {
+		t.Errorf("Expected ready just under the threshold, got %d %v", code, body)
+	}
+	if body["max_staleness_seconds"] != float64(1200) || body["seconds_since_fetch"] != float64(1195) {
+		t.Errorf("Expected seconds_since_fetch 1195 of 1200, got %v", body)
+	}
+
+	server.fetches.recordSuccess(time.Now().Add(-20*time.Minute - 5*time.Second))
+	if code, body := ready(); code != http.StatusServiceUnavailable || body["seconds_since_fetch"] != float64(1205) {
+		t.Errorf("Expected not ready just over the threshold, got %d %v", code, body)
+	}
+
+	// An API-only replica goes by what the indexer wrote
+	server = &Server{db: db, config: Config{MaxStaleness: 20 * time.Minute}}
+	if _, err := db.Exec("INSERT INTO identities (address, state, stake, updated_at) VALUES (?, 'Human', 20000, datetime('now', '-19 minutes'))",
+		"0x1111111111111111111111111111111111111111"); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+	if code, body := ready(); code != http.StatusOK {
+		t.Errorf("Expected a replica to be ready from updated_at, got %d %v", code, body)
+	}
+
+	// Zero disables the check
+	server = &Server{db: db}
+	if code, body := ready(); code != http.StatusOK || body["max_staleness_seconds"] != nil {
+		t.Errorf("Expected no staleness check without MaxStaleness, got %d %v", code, body)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db, config: Config{
+		APIKey:         "secret",
+		WhitelistCache: newCachePolicy(600, 300),
+		IdentityCache:  newCachePolicy(30, 30),
+	}}
+	router := server.routes()
+	get := func(url string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	const (
+		whitelist = "public, max-age=600, s-maxage=300"
+		identity  = "public, max-age=30, s-maxage=30"
+	)
+	tests := []struct {
+		url    string
+		status int
+		want   string
+	}{
+		{"/whitelist", http.StatusOK, whitelist},
+		{"/whitelist/check?address=0x1234567890abcdef1234567890abcdef12345678", http.StatusOK, whitelist},
+		{"/merkle_root", http.StatusOK, whitelist},
+		{"/identities/latest", http.StatusOK, identity},
+		{"/identity/0x1234567890abcdef1234567890abcdef12345678", http.StatusOK, identity},
+		{"/state/Human", http.StatusOK, identity},
+		{"/signin", http.StatusOK, "no-store"},
+		{"/health", http.StatusOK, "no-store"},
+		// errors are never cached
+		{"/identity/0x7777777777777777777777777777777777777777", http.StatusNotFound, "no-store"},
+		{"/identity/0xabcdef1234567890abcdef1234567890abcdef12?strict=true", http.StatusBadRequest, "no-store"},
+		{"/export", http.StatusUnauthorized, "no-store"},
+	}
+	for _, test := range tests {
+		rr := get(test.url, nil)
+		if rr.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.url, test.status, rr.Code)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != test.want {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.url, test.want, got)
+		}
+	}
+
+	// A revalidation by ETag keeps the policy on the 304
+	etag := get("/whitelist", nil).Header().Get("ETag")
+	rr := get("/whitelist", http.Header{"If-None-Match": {etag}})
+	if rr.Code != http.StatusNotModified || rr.Header().Get("Cache-Control") != whitelist {
+		t.Errorf("expected 304 with %q, got %d with %q", whitelist, rr.Code, rr.Header().Get("Cache-Control"))
+	}
+
+	// Zero ages make caches revalidate every time
+	server.config.IdentityCache = newCachePolicy(0, -5)
+	rr = httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/identities/latest", nil))
+	if got := rr.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("expected no-cache for zero ages, got %q", got)
+	}
+}
+
+func TestFieldCase(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	get := func(server *Server, url string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		var body map[string]interface{}
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatalf("%s: invalid JSON: %v", url, err)
+			}
+		}
+		return rr.Code, body
+	}
+	const url = "/identity/0x1234567890abcdef1234567890abcdef12345678?format_stake=true"
+
+	snake := &Server{db: db, config: Config{}}
+	camel := &Server{db: db, config: Config{FieldCase: fieldCaseCamel}}
+	cases := []struct {
+		name    string
+		server  *Server
+		url     string
+		want    string
+		notWant string
+	}{
+		{"default", snake, url, "stake_display", "stakeDisplay"},
+		{"config camel", camel, url, "stakeDisplay", "stake_display"},
+		{"query camel", snake, url + "&case=camel", "stakeDisplay", "stake_display"},
+		{"query snake", camel, url + "&case=snake", "stake_display", "stakeDisplay"},
+	}
+	for _, tc := range cases {
+		code, body := get(tc.server, tc.url)
+		if code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tc.name, code)
+		}
+		if _, ok := body[tc.want]; !ok {
+			t.Errorf("%s: missing key %s in %v", tc.name, tc.want, body)
+		}
+		if _, ok := body[tc.notWant]; ok {
+			t.Errorf("%s: unexpected key %s", tc.name, tc.notWant)
+		}
+		if body["stake"] != float64(15000) || body["state"] != "Human" {
+			t.Errorf("%s: values changed: %v", tc.name, body)
+		}
+	}
+
+	if code, _ := get(snake, url+"&case=kebab"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown case, got %d", code)
+	}
+}
+
+func TestEligibilityOverrides(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	const (
+		human  = "0x1234567890abcdef1234567890abcdef12345678" // eligible
+		newbie = "0x9876543210fedcba9876543210fedcba98765432" // stake too low
+		absent = "0x7777777777777777777777777777777777777777" // not indexed
+		both   = "0xabcdef1234567890abcdef1234567890abcdef12" // eligible, on both lists
+	)
+	if _, err := parseAddressList(absent + ",0x12"); err == nil {
+		t.Error("Expected an invalid address to be rejected")
+	}
+	allow, _ := parseAddressList("0x" + strings.ToUpper(newbie[2:]) + ", " + absent + "," + both)
+	deny, _ := parseAddressList(human + "," + both)
+	server := &Server{db: db, config: Config{Allowlist: allow, Denylist: deny}}
+
+	tests := []struct {
+		address  string
+		eligible bool
+		reason   string
+	}{
+		{human, false, reasonDenylisted},
+		{newbie, true, reasonAllowlisted},
+		{absent, true, reasonAllowlisted},
+		{both, false, reasonDenylisted},
+	}
+	for _, test := range tests {
+		if eligible, reason := server.checkEligibility(test.address); eligible != test.eligible || reason != test.reason {
+			t.Errorf("%s: expected %t %q, got %t %q", test.address, test.eligible, test.reason, eligible, reason)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist", nil))
+	var response WhitelistResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if want := []string{absent, newbie}; strings.Join(response.Addresses, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected whitelist %v, got %v", want, response.Addresses)
+	}
+
+	tree, err := server.merkleTree()
+	if err != nil {
+		t.Fatalf("Merkle tree error: %v", err)
+	}
+	if want := merkle.Build([]string{absent, newbie}).Root(); tree.Root() != want {
+		t.Errorf("Expected the merkle root to reflect the overrides, got %s want %s", tree.Root(), want)
+	}
+}
+
+func TestOverridesEndpoints(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	const newbie = "0x9876543210fedcba9876543210fedcba98765432" // stake too low
+	server := &Server{db: db, config: Config{APIKey: "secret"}, eligibility: newEpochCache(10)}
+	server.eligibility.setEpoch(1)
+	router := server.routes()
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-API-Key", "secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	check := func() EligibilityCheck {
+		var result EligibilityCheck
+		json.Unmarshal(do("GET", "/whitelist/check?address="+newbie, "").Body.Bytes(), &result)
+		return result
+	}
+
+	if result := check(); result.Eligible {
+		t.Fatalf("Expected the Newbie to start ineligible, got %+v", result)
+	}
+
+	rr := do("POST", "/overrides", `{"address":"`+strings.ToUpper(newbie)+`","kind":"allow","by":"alice","note":"verified off-chain"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 adding an override, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if result := check(); !result.Eligible || result.Reason != reasonAllowlisted {
+		t.Errorf("Expected the allowlisted Newbie to be eligible, got %+v", result)
+	}
+
+	var list struct {
+		Overrides []Override `json:"overrides"`
+	}
+	json.Unmarshal(do("GET", "/overrides", "").Body.Bytes(), &list)
+	if len(list.Overrides) != 1 || list.Overrides[0].Address != newbie || list.Overrides[0].CreatedBy != "alice" || list.Overrides[0].CreatedAt == 0 {
+		t.Errorf("Expected the override recorded with who and when, got %+v", list.Overrides)
+	}
+
+	// Replacing it with a deny takes effect too
+	do("POST", "/overrides", `{"address":"`+newbie+`","kind":"deny","by":"bob"}`)
+	if result := check(); result.Eligible || result.Reason != reasonDenylisted {
+		t.Errorf("Expected the denylisted Newbie to be ineligible, got %+v", result)
+	}
+
+	if rr := do("DELETE", "/overrides/"+newbie, ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 deleting the override, got %d", rr.Code)
+	}
+	if result := check(); result.Eligible || result.Reason == reasonDenylisted {
+		t.Errorf("Expected the rules to apply again, got %+v", result)
+	}
+	if rr := do("DELETE", "/overrides/"+newbie, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing override, got %d", rr.Code)
+	}
+
+	for _, body := range []string{
+		`{"address":"0x12","kind":"allow","by":"alice"}`,
+		`{"address":"` + newbie + `","kind":"maybe","by":"alice"}`,
+		`{"address":"` + newbie + `","kind":"allow"}`,
+	} {
+		if rr := do("POST", "/overrides", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/overrides", strings.NewReader(`{"address":"`+newbie+`","kind":"allow","by":"eve"}`))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the API key, got %d", rr.Code)
+	}
+}
+
+func TestSuspendedGracePeriod(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	address := "0x5555555555555555555555555555555555555555"
+	now := time.Now()
+	if _, err := db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, 'Suspended', 20000)", address); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	history := []struct {
+		state string
+		at    time.Time
+	}{
+		{"Human", now.Add(-240 * time.Hour)},
+		{"Suspended", now.Add(-48 * time.Hour)},
+	}
+	for _, h := range history {
+		if _, err := db.Exec("INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, ?, 20000, ?)",
+			address, h.state, h.at.Unix()); err != nil {
+			t.Fatalf("History insertion error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		grace    time.Duration
+		eligible bool
+		reason   string
+	}{
+		{0, false, "Ineligible state: Suspended"},
+		{47 * time.Hour, false, "Ineligible state: Suspended"},
+		{49 * time.Hour, true, "Eligible: Suspended within grace period"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.grace.String(), func(t *testing.T) {
+			server := &Server{db: db, config: Config{GracePeriod: test.grace}}
+
+			eligible, reason := server.checkEligibility(address)
+			if eligible != test.eligible || reason != test.reason {
+				t.Errorf("Expected (%v, %q), got (%v, %q)", test.eligible, test.reason, eligible, reason)
+			}
+			// Eligibility resting on the grace period can run out mid-epoch
+			if cacheable := epochCacheable(server.evaluateEligibility(address)); cacheable == test.eligible {
+				t.Errorf("Expected epochCacheable %v, got %v", !test.eligible, cacheable)
+			}
+
+			addresses, err := server.eligibleAddresses()
+			if err != nil {
+				t.Fatalf("eligibleAddresses error: %v", err)
+			}
+			listed := len(addresses) == 1 && addresses[0] == address
+			if listed != test.eligible {
+				t.Errorf("Whitelist membership %v does not match eligibility %v", listed, test.eligible)
+			}
+		})
+	}
+}
+
+func TestUpdateDatabaseRecordsHistory(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db}
+	address := "0x5555555555555555555555555555555555555555"
+
+	updates := [][]Identity{
+		{{Address: address, State: "Human", Stake: 20000}},
+		{{Address: address, State: "Human", Stake: 20000}},
+		{{Address: address, State: "Suspended", Stake: 20000}},
+	}
+	for _, update := range updates {
+		if err := server.updateDatabase(update); err != nil {
+			t.Fatalf("updateDatabase error: %v", err)
+		}
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM identity_history WHERE address = ?", address).Scan(&count); err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 history rows (unchanged update skipped), got %d", count)
+	}
+}
+
+func TestChangedIdentities(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	now := time.Now()
+	changes := []struct {
+		address string
+		at      time.Time
+	}{
+		{"0x1234567890abcdef1234567890abcdef12345678", now.Add(-48 * time.Hour)},
+		{"0xabcdef1234567890abcdef1234567890abcdef12", now.Add(-30 * time.Minute)},
+		{"0x9876543210fedcba9876543210fedcba98765432", now.Add(-5 * time.Minute)},
+	}
+	for _, change := range changes {
+		if _, err := db.Exec(
+			"INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, 'Human', 1, ?)",
+			change.address, change.at.Unix(),
+		); err != nil {
+			t.Fatalf("History insertion error: %v", err)
+		}
+	}
+
+	server := &Server{db: db}
+	tests := []struct {
+		since    string
+		expected []string
+	}{
+		{"1h", []string{"0x9876543210fedcba9876543210fedcba98765432", "0xabcdef1234567890abcdef1234567890abcdef12"}},
+		{"10m", []string{"0x9876543210fedcba9876543210fedcba98765432"}},
+		{now.Add(-72 * time.Hour).UTC().Format(time.RFC3339), []string{
+			"0x1234567890abcdef1234567890abcdef12345678",
+			"0x9876543210fedcba9876543210fedcba98765432",
+			"0xabcdef1234567890abcdef1234567890abcdef12",
+		}},
+		{now.Add(time.Hour).UTC().Format(time.RFC3339), []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.since, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/identities/changed?since="+test.since, nil)
+			rr := httptest.NewRecorder()
+			server.handleChangedIdentities(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", rr.Code)
+			}
+			var identities []Identity
+			if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil {
+				t.Fatalf("Response parsing error: %v", err)
+			}
+			if len(identities) != len(test.expected) {
+				t.Fatalf("Expected %d identities, got %d", len(test.expected), len(identities))
+			}
+			for i, identity := range identities {
+				if identity.Address != test.expected[i] {
+					t.Errorf("Expected %s at %d, got %s", test.expected[i], i, identity.Address)
+				}
+			}
+		})
+	}
+
+	for _, since := range []string{"", "yesterday", "-1h"} {
+		req := httptest.NewRequest("GET", "/identities/changed?since="+since, nil)
+		rr := httptest.NewRecorder()
+		server.handleChangedIdentities(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("since=%q: expected status 400, got %d", since, rr.Code)
+		}
+	}
+}
+
+func TestLatestIdentitiesCursorPaging(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	insert := func(address, updatedAt string) {
+		t.Helper()
+		if _, err := db.Exec(
+			"INSERT INTO identities (address, state, stake, updated_at) VALUES (?, 'Human', 20000, ?)",
+			address, updatedAt,
+		); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+	insert("0x05", "2024-01-05 00:00:00")
+	insert("0x04", "2024-01-04 00:00:00")
+	insert("0x03b", "2024-01-03 00:00:00")
+	insert("0x03a", "2024-01-03 00:00:00")
+	insert("0x01", "2024-01-01 00:00:00")
+	expected := []string{"0x01", "0x03a", "0x03b", "0x04", "0x05", "0x06"}
+
+	server := &Server{db: db}
+	page := func(query string) ([]Identity, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/identities/latest?"+query, nil)
+		rr := httptest.NewRecorder()
+		server.handleLatestIdentities(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", query, rr.Code)
+		}
+		var identities []Identity
+		if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		return identities, rr.Header().Get("X-Next-Cursor")
+	}
+
+	var seen []string
+	query := "sort=address&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("Cursor paging did not terminate")
+		}
+		identities, next := page(query)
+		for _, identity := range identities {
+			seen = append(seen, identity.Address)
+		}
+		if next == "" {
+			break
+		}
+		// Concurrent writes: a new identity, and a fetch pass touching
+		// every row, as the indexer's upsert does
+		if pages == 0 {
+			insert("0x06", "2024-01-06 00:00:00")
+			db.Exec("UPDATE identities SET updated_at = CURRENT_TIMESTAMP")
+		}
+		query = "limit=2&after=" + next
+	}
+
+	if strings.Join(seen, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, seen)
+	}
+
+	// Offset paging is still available
+	identities, _ := page("limit=2&offset=2")
+	if len(identities) != 2 {
+		t.Errorf("Expected 2 identities with offset paging, got %d", len(identities))
+	}
+
+	req := httptest.NewRequest("GET", "/identities/latest?after=garbage", nil)
+	rr := httptest.NewRecorder()
+	server.handleLatestIdentities(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid cursor, got %d", rr.Code)
+	}
+}
+
+func TestIdentityTags(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	human := "0x1234567890abcdef1234567890abcdef12345678"
+	verified := "0xabcdef1234567890abcdef1234567890abcdef12"
+	server := &Server{db: db, config: Config{APIKey: "secret"}}
+
+	do := func(method, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		return rr
+	}
+	list := func(target string) []string {
+		rr := do("GET", target, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", target, rr.Code)
+		}
+		var identities []Identity
+		if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil {
+			t.Fatalf("%s: response parsing error: %v", target, err)
+		}
+		var addresses []string
+		for _, identity := range identities {
+			addresses = append(addresses, identity.Address)
+		}
+		sort.Strings(addresses)
+		return addresses
+	}
+
+	if rr := do("PUT", "/tags/"+human+"/team", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the API key, got %d", rr.Code)
+	}
+	for _, target := range []string{"/tags/" + human + "/Team", "/tags/" + human + "/team", "/tags/" + human + "/flagged", "/tags/" + verified + "/team"} {
+		if rr := do("PUT", target, "secret"); rr.Code != http.StatusNoContent {
+			t.Errorf("PUT %s: expected 204, got %d", target, rr.Code)
+		}
+	}
+	for _, target := range []string{"/tags/" + human + "/no%20spaces", "/tags/0x1234/team"} {
+		if rr := do("PUT", target, "secret"); rr.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: expected 400, got %d", target, rr.Code)
+		}
+	}
+
+	for target, want := range map[string]string{
+		"/identities/latest?tag=team":                     human + "," + verified,
+		"/identities/latest?tag=FLAGGED":                  human,
+		"/identities/latest?tag=unused":                   "",
+		"/identities/latest?tag=team&limit=10":            human + "," + verified,
+		"/state/Verified?tag=team":                        verified,
+		"/state/Verified?tag=flagged":                     "",
+		"/identities/changed?since=1h&tag=flagged":        "",
+		"/identities/latest?tag=team&offset=0&sort=stake": human + "," + verified,
+	} {
+		if got := strings.Join(list(target), ","); got != want {
+			t.Errorf("%s: expected %q, got %q", target, want, got)
+		}
+	}
+	if rr := do("GET", "/identities/latest?tag=bad!", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid tag filter, got %d", rr.Code)
+	}
+
+	// Tags only show in verbose responses
+	var identity Identity
+	json.Unmarshal(do("GET", "/identity/"+human, "").Body.Bytes(), &identity)
+	if identity.Tags != nil {
+		t.Errorf("Expected no tags without verbose, got %v", identity.Tags)
+	}
+	json.Unmarshal(do("GET", "/identity/"+human+"?verbose=true", "").Body.Bytes(), &identity)
+	if strings.Join(identity.Tags, ",") != "flagged,team" {
+		t.Errorf("Expected tags flagged,team, got %v", identity.Tags)
+	}
+	var whitelist WhitelistResponse
+	json.Unmarshal(do("GET", "/whitelist?verbose=true", "").Body.Bytes(), &whitelist)
+	if len(whitelist.Entries) != 2 || strings.Join(whitelist.Entries[0].Tags, ",") != "flagged,team" {
+		t.Errorf("Expected the whitelist entries to carry tags, got %+v", whitelist.Entries)
+	}
+
+	// Tags leave eligibility alone
+	var check EligibilityCheck
+	json.Unmarshal(do("GET", "/whitelist/check?address="+human, "").Body.Bytes(), &check)
+	if !check.Eligible {
+		t.Errorf("Expected the tagged Human still eligible, got %+v", check)
+	}
+
+	if rr := do("DELETE", "/tags/"+human+"/team", "secret"); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/tags/"+human+"/team", "secret"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing tag, got %d", rr.Code)
+	}
+	if got := strings.Join(list("/identities/latest?tag=team"), ","); got != verified {
+		t.Errorf("Expected only the Verified tagged team, got %s", got)
+	}
+	rr := do("GET", "/tags?tag=flagged", "secret")
+	var tags struct {
+		Tags []Tag `json:"tags"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &tags); err != nil || len(tags.Tags) != 1 || tags.Tags[0].Address != human {
+		t.Errorf("Expected one flagged address, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPaginationLinks(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	server := &Server{db: db}
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", target, rr.Code)
+		}
+		return rr
+	}
+	link := func(offset int, rel string) string {
+		return fmt.Sprintf(`</identities/latest?envelope=true&limit=1&offset=%d&sort=stake>; rel="%s"`, offset, rel)
+	}
+
+	// Second of four pages
+	rr := get("/identities/latest?sort=stake&limit=1&offset=1&envelope=true")
+	expected := strings.Join([]string{link(0, "first"), link(0, "prev"), link(2, "next"), link(3, "last")}, ", ")
+	if got := rr.Header().Get("Link"); got != expected {
+		t.Errorf("Expected Link\n%s\ngot\n%s", expected, got)
+	}
+	var page struct {
+		Data []Identity   `json:"data"`
+		Meta responseMeta `json:"meta"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if page.Meta.Total == nil || *page.Meta.Total != 4 || page.Meta.NextOffset == nil || *page.Meta.NextOffset != 2 {
+		t.Errorf("Expected total 4 and next_offset 2, got %s", rr.Body.String())
+	}
+	if len(page.Data) != 1 || page.Data[0].Address != "0x1234567890abcdef1234567890abcdef12345678" {
+		t.Errorf("Expected the second largest stake, got %+v", page.Data)
+	}
+
+	// The last page has no next
+	rr = get("/identities/latest?sort=stake&limit=1&offset=3&envelope=true")
+	if got := rr.Header().Get("Link"); strings.Contains(got, `rel="next"`) || !strings.Contains(got, link(2, "prev")) {
+		t.Errorf("Unexpected Link on the last page: %s", got)
+	}
+	if strings.Contains(rr.Body.String(), "next_offset") {
+		t.Errorf("Expected no next_offset on the last page, got %s", rr.Body.String())
+	}
+
+	// Merkle leaves page the same way
+	rr = get("/whitelist/paginated-merkle?limit=1")
+	expected = `</whitelist/paginated-merkle?limit=1&offset=0>; rel="first", ` +
+		`</whitelist/paginated-merkle?limit=1&offset=1>; rel="next", ` +
+		`</whitelist/paginated-merkle?limit=1&offset=1>; rel="last"`
+	if got := rr.Header().Get("Link"); got != expected {
+		t.Errorf("Expected Link\n%s\ngot\n%s", expected, got)
+	}
+	if !strings.Contains(rr.Body.String(), `"next_offset":1`) {
+		t.Errorf("Expected next_offset 1, got %s", rr.Body.String())
+	}
+}
+
+func TestLatestIdentitiesSort(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	human := "0x1234567890abcdef1234567890abcdef12345678"
+	verified := "0xabcdef1234567890abcdef1234567890abcdef12"
+	newbie := "0x9876543210fedcba9876543210fedcba98765432"
+	candidate := "0xfedcba0987654321fedcba0987654321fedcba09"
+	for i, address := range []string{newbie, human, candidate, verified} {
+		if _, err := db.Exec("UPDATE identities SET updated_at = ? WHERE address = ?",
+			time.Date(2024, 1, 1, i, 0, 0, 0, time.UTC), address); err != nil {
+			t.Fatalf("Update error: %v", err)
+		}
+	}
+
+	server := &Server{db: db}
+	get := func(query string) (*httptest.ResponseRecorder, []string) {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/identities/latest"+query, nil))
+		var identities []Identity
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil {
+				t.Fatalf("%s: response parsing error: %v", query, err)
+			}
+		}
+		addresses := make([]string, len(identities))
+		for i, identity := range identities {
+			addresses[i] = identity.Address
+		}
+		return rr, addresses
+	}
+
+	for query, want := range map[string][]string{
+		"":                             {verified, candidate, human, newbie},
+		"?sort=updated_at&order=asc":   {newbie, human, candidate, verified},
+		"?sort=stake":                  {verified, human, candidate, newbie},
+		"?sort=stake&order=asc":        {newbie, candidate, human, verified},
+		"?sort=state&order=asc":        {candidate, human, newbie, verified},
+		"?sort=state&order=desc":       {verified, newbie, human, candidate},
+		"?sort=stake&limit=2":          {verified, human},
+		"?sort=stake&limit=2&offset=2": {candidate, newbie},
+		"?sort=address&limit=2":        {human, newbie},
+		"?sort=address&order=desc":     {candidate, verified, newbie, human},
+	} {
+		rr, got := get(query)
+		if rr.Code != http.StatusOK || strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: expected %v, got %d %v", query, want, rr.Code, got)
+		}
+		if strings.Contains(query, "sort=stake&limit") && rr.Header().Get("X-Next-Cursor") != "" {
+			t.Errorf("%s: expected no cursor outside address order", query)
+		}
+		if strings.Contains(query, "sort=address&limit") && rr.Header().Get("X-Next-Cursor") == "" {
+			t.Errorf("%s: expected a cursor in address order", query)
+		}
+	}
+
+	for _, query := range []string{"?sort=addr", "?sort=stake%3BDROP%20TABLE%20identities", "?sort=stake&order=sideways", "?sort=stake&limit=2&after=abc"} {
+		if rr, _ := get(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rr.Code)
+		}
+	}
+}
+
+func TestLatestIdentitiesNDJSON(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/identities/latest?format=ndjson", nil),
+		func() *http.Request {
+			req := httptest.NewRequest("GET", "/identities/latest", nil)
+			req.Header.Set("Accept", "application/x-ndjson")
+			return req
+		}(),
+	} {
+		rr := httptest.NewRecorder()
+		server.handleLatestIdentities(rr, req)
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("Expected NDJSON content type, got %q", ct)
+		}
+
+		scanner := bufio.NewScanner(rr.Body)
+		lines := 0
+		for scanner.Scan() {
+			var identity Identity
+			if err := json.Unmarshal(scanner.Bytes(), &identity); err != nil {
+				t.Fatalf("Line %d is not a JSON object: %v", lines+1, err)
+			}
+			if identity.Address == "" {
+				t.Errorf("Line %d has no address", lines+1)
+			}
+			lines++
+		}
+		if lines != 4 {
+			t.Errorf("Expected 4 lines, got %d", lines)
+		}
+	}
+
+	// Default stays a JSON array
+	rr := httptest.NewRecorder()
+	server.handleLatestIdentities(rr, httptest.NewRequest("GET", "/identities/latest", nil))
+	var identities []Identity
+	if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil || len(identities) != 4 {
+		t.Errorf("Expected JSON array of 4 identities, got %d (%v)", len(identities), err)
+	}
+}
+
+// newMockNode serves dna_identities pages keyed by continuation token ("" for
+// the first page) and counts the calls it receives.
+func newMockNode(t *testing.T, pages map[string]string) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var req struct {
+			Params []map[string]string `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		token := ""
+		if len(req.Params) > 0 {
+			token = req.Params[0]["continuationToken"]
+		}
+		page, ok := pages[token]
+		if !ok {
+			http.Error(w, "unknown token", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":` + page + `}`))
+	}))
+	t.Cleanup(node.Close)
+	return node, &calls
+}
+
+func TestEnrichStake(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	// The node lists a Human and a Newbie without stake; dna_getBalance
+	// knows the Human's and fails for the Newbie
+	var balanceCalls int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "dna_identities":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[
+				{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":null},
+				{"address":"0x2222222222222222222222222222222222222222","state":"Newbie"},
+				{"address":"0x3333333333333333333333333333333333333333","state":"Candidate"},
+				{"address":"0x4444444444444444444444444444444444444444","state":"Verified","stake":"30000"}]}`))
+		case "dna_getBalance":
+			atomic.AddInt32(&balanceCalls, 1)
+			if req.Params[0] == "0x1111111111111111111111111111111111111111" {
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"balance":"5","stake":"20000.5"}}`))
+				return
+			}
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"unavailable"}}`))
+		default:
+			http.Error(w, "unexpected method", http.StatusBadRequest)
+		}
+	}))
+	defer node.Close()
+
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL, EnrichStake: true},
+		stakeCache: newLRUCache(10, time.Hour)}
+	for i := 0; i < 2; i++ {
+		if _, err := server.indexOnce(context.Background()); err != nil {
+			t.Fatalf("indexOnce: %v", err)
+		}
+	}
+	// The Human's stake is cached after the first fetch; the Newbie is
+	// retried, and the Candidate and Verified are never looked up
+	if calls := atomic.LoadInt32(&balanceCalls); calls != 3 {
+		t.Errorf("expected 3 dna_getBalance calls, got %d", calls)
+	}
+
+	expected := map[string]string{
+		"0x1111111111111111111111111111111111111111": "20000.5",
+		"0x2222222222222222222222222222222222222222": "unknown",
+		"0x3333333333333333333333333333333333333333": "unknown",
+		"0x4444444444444444444444444444444444444444": "30000",
+	}
+	for address, want := range expected {
+		var stake sql.NullFloat64
+		if err := db.QueryRow("SELECT stake FROM identities WHERE address = ?", address).Scan(&stake); err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+		got := "unknown"
+		if stake.Valid {
+			got = fmt.Sprint(stake.Float64)
+		}
+		if got != want {
+			t.Errorf("%s: expected stake %s, got %s", address, want, got)
+		}
+	}
+	if eligible, reason := server.checkEligibility("0x1111111111111111111111111111111111111111"); !eligible {
+		t.Errorf("expected the enriched Human to be eligible, got %q", reason)
+	}
+}
+
+func TestFetchValidationData(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	// The node lists one identity with its validation data and two
+	// without; dna_identity knows the first of those and fails for the
+	// second
+	var identityCalls int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "dna_identities":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":[
+				{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000"},
+				{"address":"0x2222222222222222222222222222222222222222","state":"Newbie","stake":"15000"},
+				{"address":"0x3333333333333333333333333333333333333333","state":"Verified","stake":"30000","online":false,"madeFlips":1}]}`))
+		case "dna_identity":
+			atomic.AddInt32(&identityCalls, 1)
+			if req.Params[0] == "0x1111111111111111111111111111111111111111" {
+				w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"address":"0x1111111111111111111111111111111111111111","state":"Human","online":true,"madeFlips":3}}`))
+				return
+			}
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"unavailable"}}`))
+		default:
+			http.Error(w, "unexpected method", http.StatusBadRequest)
+		}
+	}))
+	defer node.Close()
+
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}}
+	if _, err := server.indexOnce(context.Background()); err != nil {
+		t.Fatalf("indexOnce: %v", err)
+	}
+	if calls := atomic.LoadInt32(&identityCalls); calls != 0 {
+		t.Errorf("expected no dna_identity calls without FetchValidationData, got %d", calls)
+	}
+
+	server.config.FetchValidationData = true
+	if _, err := server.indexOnce(context.Background()); err != nil {
+		t.Fatalf("indexOnce: %v", err)
+	}
+	// The identity listed with its data is never looked up
+	if calls := atomic.LoadInt32(&identityCalls); calls != 2 {
+		t.Errorf("expected 2 dna_identity calls, got %d", calls)
+	}
+
+	router := server.routes()
+	expected := map[string]string{
+		"0x1111111111111111111111111111111111111111": "true 3",
+		"0x2222222222222222222222222222222222222222": "unknown",
+		"0x3333333333333333333333333333333333333333": "false 1",
+	}
+	for address, want := range expected {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/identity/"+address, nil))
+		var identity Identity
+		if err := json.Unmarshal(rr.Body.Bytes(), &identity); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", address, err)
+		}
+		got := "unknown"
+		if identity.Online != nil && identity.FlipsCount != nil {
+			got = fmt.Sprint(*identity.Online, *identity.FlipsCount)
+		}
+		if got != want {
+			t.Errorf("%s: expected validation data %s, got %s", address, want, got)
+		}
+	}
+}
+
+func TestTolerantIdentityDecoding(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	// The list moved under "data", fields were renamed or wrapped, the
+	// stake became a number and the token went snake_case
+	node, _ := newMockNode(t, map[string]string{
+		"": `{"data":{"identities":[
+			{"addr":"0x1111111111111111111111111111111111111111","status":"Human","stake":15000},
+			{"identity":{"address":"0x2222222222222222222222222222222222222222","state":"Newbie","stake":"12000.5"}},
+			{"note":"no address"}]},
+			"continuation_token":"next"}`,
+		"next": `{"identities":[{"address":"0x3333333333333333333333333333333333333333","state":"Verified","stake":"30000"}]}`,
+	})
+
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL, StrictDecoding: true}}
+	if _, err := server.indexOnce(context.Background()); err == nil {
+		t.Fatal("expected strict decoding to fail")
+	}
+
+	server.config.StrictDecoding = false
+	count, err := server.indexOnce(context.Background())
+	if err != nil {
+		t.Fatalf("indexOnce: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 identities, got %d", count)
+	}
+	expected := map[string]string{
+		"0x1111111111111111111111111111111111111111": "Human 15000",
+		"0x2222222222222222222222222222222222222222": "Newbie 12000.5",
+		"0x3333333333333333333333333333333333333333": "Verified 30000",
+	}
+	rows, err := db.Query("SELECT address, state, stake FROM identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stored := make(map[string]string)
+	for rows.Next() {
+		var address, state string
+		var stake float64
+		if err := rows.Scan(&address, &state, &stake); err != nil {
+			t.Fatal(err)
+		}
+		stored[address] = fmt.Sprintf("%s %v", state, stake)
+	}
+	if fmt.Sprint(stored) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, stored)
+	}
+
+	// A row whose state can't be found is skipped, not stored without one
+	renamed, _ := newMockNode(t, map[string]string{
+		"": `{"identities":[
+			{"address":"0x1111111111111111111111111111111111111111","condition":"Zombie","stake":"15000"},
+			{"address":"0x3333333333333333333333333333333333333333","state":"Human","stake":"30000"}]}`,
+	})
+	server.config.IdenaRPCURL = renamed.URL
+	if _, err := server.indexOnce(context.Background()); err != nil {
+		t.Fatalf("indexOnce: %v", err)
+	}
+	for address, want := range map[string]string{
+		"0x1111111111111111111111111111111111111111": "Human 15000",
+		"0x3333333333333333333333333333333333333333": "Human 30000",
+	} {
+		var state string
+		var stake float64
+		db.QueryRow("SELECT state, stake FROM identities WHERE address = ?", address).Scan(&state, &stake)
+		if got := fmt.Sprintf("%s %v", state, stake); got != want {
+			t.Errorf("%s: expected %s, got %s", address, want, got)
+		}
+	}
+
+	// Nothing resembling an identity list is still an error
+	broken, _ := newMockNode(t, map[string]string{"": `{"rows":"none"}`})
+	server.config.IdenaRPCURL = broken.URL
+	if _, err := server.indexOnce(context.Background()); err == nil {
+		t.Error("expected an error without an identity list")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	const (
+		a = "0x1111111111111111111111111111111111111111"
+		b = "0x2222222222222222222222222222222222222222"
+	)
+	dir := t.TempDir()
+	snapshots := map[int]string{
+		10: `{"epoch":10,"timestamp":1000,"identities":[
+			{"address":"` + a + `","state":"Newbie","stake":"5000"},
+			{"address":"` + b + `","state":"Human","stake":"20000"}]}`,
+		11: `{"epoch":11,"timestamp":2000,"identities":[
+			{"address":"` + a + `","state":"Verified","stake":"5000"},
+			{"address":"` + b + `","state":"Human","stake":"20000"}]}`,
+		// a JSON-RPC response is accepted as well
+		12: `{"jsonrpc":"2.0","id":1,"result":{"epoch":12,"timestamp":3000,"identities":[
+			{"address":"` + a + `","state":"Verified","stake":"12000"},
+			{"address":"` + b + `","state":"Killed","stake":null}]}}`,
+	}
+	for epoch, snapshot := range snapshots {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", epoch)), []byte(snapshot), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := &Server{db: db, config: Config{BackfillSnapshotDir: dir}}
+
+	added, err := server.runBackfill(context.Background(), 10, 12)
+	if err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+	if added != 5 {
+		t.Errorf("expected 5 history rows, got %d", added)
+	}
+	var rows []string
+	result, err := db.Query("SELECT address, state, stake, changed_at FROM identity_history ORDER BY changed_at, address")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for result.Next() {
+		var address, state string
+		var stake float64
+		var changedAt int64
+		result.Scan(&address, &state, &stake, &changedAt)
+		rows = append(rows, fmt.Sprintf("%d %s %s %g", changedAt, address[:4], state, stake))
+	}
+	result.Close()
+	want := []string{
+		"1000 0x11 Newbie 5000",
+		"1000 0x22 Human 20000",
+		"2000 0x11 Verified 5000",
+		"3000 0x11 Verified 12000",
+		"3000 0x22 Killed 0",
+	}
+	if strings.Join(rows, "\n") != strings.Join(want, "\n") {
+		t.Errorf("history:\n%s\nwant:\n%s", strings.Join(rows, "\n"), strings.Join(want, "\n"))
+	}
+
+	var identities int
+	db.QueryRow("SELECT COUNT(*) FROM identities").Scan(&identities)
+	if identities != 0 {
+		t.Errorf("backfill must not touch identities, found %d", identities)
+	}
+
+	// Running it again adds nothing
+	if added, err := server.runBackfill(context.Background(), 10, 12); err != nil || added != 0 {
+		t.Errorf("rerun: expected 0 rows, got %d (%v)", added, err)
+	}
+	if _, err := server.runBackfill(context.Background(), 12, 13); err == nil {
+		t.Error("expected an error for a missing snapshot")
+	}
+	if _, err := server.runBackfill(context.Background(), 12, 11); err == nil {
+		t.Error("expected an error for an inverted range")
+	}
+
+	// Without a snapshot directory the node's history RPC is asked
+	node, calls := newMockNode(t, map[string]string{
+		"": `{"epoch":13,"timestamp":4000,"identities":[{"address":"` + b + `","state":"Undefined","stake":"0"}]}`,
+	})
+	server.config = Config{IdenaRPCURL: node.URL}
+	if added, err := server.runBackfill(context.Background(), 13, 13); err != nil || added != 1 {
+		t.Errorf("RPC backfill: expected 1 row, got %d (%v)", added, err)
+	}
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("expected 1 RPC call, got %d", *calls)
+	}
+}
+
+func TestValidatedSinceEpoch(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	dump := filepath.Join(t.TempDir(), "identities.json")
+	if err := os.WriteFile(dump, []byte(`[
+		{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"15000","lastValidationEpoch":99},
+		{"address":"0x2222222222222222222222222222222222222222","state":"Human","stake":"15000","lastValidationEpoch":100},
+		{"address":"0x3333333333333333333333333333333333333333","state":"Verified","stake":"15000","lastValidationEpoch":101},
+		{"address":"0x4444444444444444444444444444444444444444","state":"Candidate","stake":null}
+	]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{db: db, config: Config{SourceFile: dump}}
+	if _, err := server.indexOnce(context.Background()); err != nil {
+		t.Fatalf("indexOnce: %v", err)
+	}
+
+	get := func(url string) (int, []Identity, http.Header) {
+		req := httptest.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		var identities []Identity
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &identities); err != nil {
+				t.Fatalf("%s: invalid JSON: %v", url, err)
+			}
+		}
+		return rr.Code, identities, rr.Header()
+	}
+	addresses := func(identities []Identity) string {
+		var prefixes []string
+		for _, identity := range identities {
+			prefixes = append(prefixes, identity.Address[:4])
+		}
+		sort.Strings(prefixes)
+		return strings.Join(prefixes, ",")
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		// 100 is the boundary: validated in 100 is included, 99 is not
+		{"/identities/latest?validated_since_epoch=100", "0x22,0x33"},
+		{"/identities/latest?validated_since_epoch=0", "0x11,0x22,0x33"},
+		{"/identities/latest", "0x11,0x22,0x33,0x44"},
+		{"/identities/latest?validated_since_epoch=102", ""},
+		{"/state/Human?validated_since_epoch=100", "0x22"},
+		{"/identities/changed?since=1h&validated_since_epoch=101", "0x33"},
+	}
+	for _, test := range tests {
+		code, identities, _ := get(test.url)
+		if code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", test.url, code)
+		}
+		if got := addresses(identities); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.url, test.want, got)
+		}
+	}
+
+	// Pages keep the filter
+	code, page, header := get("/identities/latest?validated_since_epoch=100&sort=address&limit=1")
+	cursor := header.Get("X-Next-Cursor")
+	if code != http.StatusOK || len(page) != 1 || cursor == "" {
+		t.Fatalf("expected a first page of 1 with a cursor, got %d, %d, %q", code, len(page), cursor)
+	}
+	_, rest, header := get("/identities/latest?validated_since_epoch=100&limit=1&after=" + cursor)
+	if got := addresses(append(page, rest...)); got != "0x22,0x33" || header.Get("X-Next-Cursor") != "" {
+		t.Errorf("expected pages 0x22,0x33 and no further cursor, got %q", got)
+	}
+
+	_, all, _ := get("/identities/latest")
+	for _, identity := range all {
+		switch identity.Address[:4] {
+		case "0x33":
+			if identity.LastValidationEpoch == nil || *identity.LastValidationEpoch != 101 {
+				t.Errorf("expected last_validation_epoch 101, got %v", identity.LastValidationEpoch)
+			}
+		case "0x44":
+			if identity.LastValidationEpoch != nil {
+				t.Errorf("expected no last_validation_epoch for a candidate, got %d", *identity.LastValidationEpoch)
+			}
+		}
+	}
+
+	for _, value := range []string{"-1", "abc"} {
+		if code, _, _ := get("/identities/latest?validated_since_epoch=" + value); code != http.StatusBadRequest {
+			t.Errorf("validated_since_epoch=%s: expected 400, got %d", value, code)
+		}
+	}
+}
+
+func TestIndexerFollowsContinuationTokens(t *testing.T) {
+	node, calls := newMockNode(t, map[string]string{
+		"": `{"identities":[
+			{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"15000"},
+			{"address":"0x2222222222222222222222222222222222222222","state":"Newbie","stake":"500"}
+		],"continuationToken":"page-2"}`,
+		"page-2": `{"identities":[
+			{"address":"0x3333333333333333333333333333333333333333","state":"Verified","stake":"30000"}
+		]}`,
+	})
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}}
+	if _, err := server.indexOnce(context.Background()); err != nil {
+		t.Fatalf("indexOnce error: %v", err)
+	}
+
+	if atomic.LoadInt32(calls) != 2 {
+		t.Errorf("Expected 2 RPC calls, got %d", atomic.LoadInt32(calls))
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM identities").Scan(&count)
+	if count != 3 {
+		t.Errorf("Expected 3 identities stored, got %d", count)
+	}
+	if eligible, reason := server.checkEligibility("0x3333333333333333333333333333333333333333"); !eligible {
+		t.Errorf("Identity from second page should be eligible, got %q", reason)
+	}
+}
+
+func TestIndexerSinglePage(t *testing.T) {
+	node, calls := newMockNode(t, map[string]string{
+		"": `[{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"15000"}]`,
+	})
+
+	server := &Server{config: Config{IdenaRPCURL: node.URL}}
+	identities, err := server.fetchAllIdentities(context.Background())
+	if err != nil {
+		t.Fatalf("fetchAllIdentities error: %v", err)
+	}
+	if len(identities) != 1 || identities[0].Stake.Value != 15000 || atomic.LoadInt32(calls) != 1 {
+		t.Errorf("Unexpected single-page result: %+v (%d calls)", identities, atomic.LoadInt32(calls))
+	}
+}
+
+func TestIndexerConcurrentPages(t *testing.T) {
+	page := func(addresses ...string) string {
+		var entries []string
+		for _, address := range addresses {
+			entries = append(entries, `{"address":"`+address+`","state":"Human","stake":"15000"}`)
+		}
+		return strings.Join(entries, ",")
+	}
+	node, calls := newMockNode(t, map[string]string{
+		"":  `{"identities":[` + page("0x01", "0x02") + `],"continuationToken":"2","total":5}`,
+		"2": `{"identities":[` + page("0x03", "0x04") + `],"continuationToken":"4","total":5}`,
+		"4": `{"identities":[` + page("0x05") + `],"total":5}`,
+	})
+
+	server := &Server{config: Config{IdenaRPCURL: node.URL, PageConcurrency: 2}}
+	identities, err := server.fetchAllIdentities(context.Background())
+	if err != nil {
+		t.Fatalf("fetchAllIdentities error: %v", err)
+	}
+	if len(identities) != 5 || atomic.LoadInt32(calls) != 3 {
+		t.Fatalf("Expected 5 identities in 3 calls, got %d in %d", len(identities), atomic.LoadInt32(calls))
+	}
+	for i, identity := range identities {
+		if want := fmt.Sprintf("0x%02d", i+1); identity.Address != want {
+			t.Errorf("Pages aggregated out of order: position %d has %s", i, identity.Address)
+		}
+	}
+}
+
+func TestIndexerRateLimit(t *testing.T) {
+	pages := map[string]string{}
+	for i := 0; i < 6; i++ {
+		token, next := "", fmt.Sprint(i+1)
+		if i > 0 {
+			token = fmt.Sprint(i)
+		}
+		if i == 5 {
+			next = ""
+		}
+		pages[token] = `{"identities":[{"address":"0x0` + fmt.Sprint(i) + `","state":"Human","stake":"15000"}],"continuationToken":"` + next + `"}`
+	}
+	node, calls := newMockNode(t, pages)
+
+	// 6 calls at 50/s are spaced at least 20ms apart
+	server := &Server{
+		config:   Config{IdenaRPCURL: node.URL},
+		rpcLimit: newRPCLimiter(50, 0),
+	}
+	start := time.Now()
+	identities, err := server.fetchAllIdentities(context.Background())
+	if err != nil {
+		t.Fatalf("fetchAllIdentities error: %v", err)
+	}
+	if len(identities) != 6 || atomic.LoadInt32(calls) != 6 {
+		t.Fatalf("Expected 6 identities in 6 calls, got %d in %d", len(identities), atomic.LoadInt32(calls))
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected 6 calls at 50/s to take at least 100ms, took %s", elapsed)
+	}
+
+	// The semaphore holds back calls beyond the concurrency limit
+	limiter := newRPCLimiter(0, 2)
+	ctx := context.Background()
+	release1, _ := limiter.acquire(ctx)
+	release2, _ := limiter.acquire(ctx)
+	blocked, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(blocked); err == nil {
+		t.Error("Expected a third concurrent call to wait")
+	}
+	release1()
+	release3, err := limiter.acquire(ctx)
+	if err != nil {
+		t.Fatalf("Expected a slot after release: %v", err)
+	}
+	release2()
+	release3()
+
+	if newRPCLimiter(0, 0) != nil {
+		t.Error("Expected no limiter when both limits are zero")
+	}
+}
+
+func TestAdaptivePollInterval(t *testing.T) {
+	interval := newPollInterval(10*time.Minute, 2*time.Minute, 40*time.Minute)
+
+	steps := []struct {
+		changed  bool
+		expected time.Duration
+	}{
+		{false, 20 * time.Minute},
+		{false, 40 * time.Minute},
+		{false, 40 * time.Minute},
+		{true, 20 * time.Minute},
+		{true, 10 * time.Minute},
+		{true, 5 * time.Minute},
+		{true, 150 * time.Second},
+		{true, 2 * time.Minute},
+		{false, 4 * time.Minute},
+	}
+	for i, step := range steps {
+		if got := interval.next(step.changed); got != step.expected {
+			t.Errorf("Step %d (changed=%t): expected %s, got %s", i, step.changed, step.expected, got)
+		}
+	}
+
+	fixed := newPollInterval(10*time.Minute, 0, 0)
+	for _, changed := range []bool{false, true} {
+		if got := fixed.next(changed); got != 10*time.Minute {
+			t.Errorf("Expected fixed 10m interval without bounds, got %s", got)
+		}
+	}
+}
+
+func TestZeroPollInterval(t *testing.T) {
+	zero := newPollInterval(0, 0, 0)
+	if zero.current != minPollInterval || zero.next(false) != minPollInterval {
+		t.Errorf("Expected a zero interval to be clamped to %s, got %s", minPollInterval, zero.current)
+	}
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	dump := filepath.Join(t.TempDir(), "identities.json")
+	os.WriteFile(dump, []byte(`[{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000"}]`), 0o644)
+	server := &Server{db: db, config: Config{IntervalMinutes: 0, SourceFile: dump}}
+
+	// Unclamped, the indexer would fetch in a tight loop until cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	server.runIndexer(ctx)
+
+	var fetches int
+	db.QueryRow("SELECT COUNT(*) FROM stats_history").Scan(&fetches)
+	if fetches != 1 {
+		t.Errorf("Expected a single fetch with a zero interval, got %d", fetches)
+	}
+}
+
+func TestIndexOnceReportsChanges(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	node, _ := newMockNode(t, map[string]string{
+		"": `[{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000"}]`,
+	})
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}}
+
+	for i, expected := range []int{1, 0} {
+		changes, err := server.indexOnce(context.Background())
+		if err != nil {
+			t.Fatalf("indexOnce error: %v", err)
+		}
+		if changes != expected {
+			t.Errorf("Fetch %d: expected %d changes, got %d", i, expected, changes)
+		}
+	}
+}
+
+func TestCombinedFetchThenQuery(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	node, _ := newMockNode(t, map[string]string{
+		"": `[
+			{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000","online":true,"madeFlips":3},
+			{"address":"0x2222222222222222222222222222222222222222","state":"Candidate","stake":"50000","online":false,"madeFlips":0}
+		]`,
+	})
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}}
+	if _, err := server.runFetch(context.Background()); err != nil {
+		t.Fatalf("runFetch error: %v", err)
+	}
+
+	router := server.routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected status 200, got %d", path, rr.Code)
+		}
+		return rr
+	}
+
+	var whitelist WhitelistResponse
+	json.Unmarshal(get("/whitelist").Body.Bytes(), &whitelist)
+	if whitelist.Count != 1 || whitelist.Addresses[0] != "0x1111111111111111111111111111111111111111" {
+		t.Errorf("Unexpected whitelist after fetch: %+v", whitelist)
+	}
+
+	var identity Identity
+	json.Unmarshal(get("/identity/0x2222222222222222222222222222222222222222").Body.Bytes(), &identity)
+	if identity.State != "Candidate" || identity.Stake != 50000 {
+		t.Errorf("Unexpected identity after fetch: %+v", identity)
+	}
+	if identity.Online == nil || *identity.Online || identity.FlipsCount == nil || *identity.FlipsCount != 0 {
+		t.Errorf("Expected online=false and flips_count=0 from the node, got %v %v", identity.Online, identity.FlipsCount)
+	}
+	identity = Identity{}
+	json.Unmarshal(get("/identity/0x1111111111111111111111111111111111111111").Body.Bytes(), &identity)
+	if identity.Online == nil || !*identity.Online || identity.FlipsCount == nil || *identity.FlipsCount != 3 {
+		t.Errorf("Expected online=true and flips_count=3 from the node, got %v %v", identity.Online, identity.FlipsCount)
+	}
+
+	var stats IndexerStats
+	json.Unmarshal(get("/stats").Body.Bytes(), &stats)
+	if stats.Total != 2 || stats.LastFetch == 0 {
+		t.Errorf("Expected stats to reflect the fetch, got %+v", stats)
+	}
+}
+
+func TestFetchFailureAlerts(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		messages = append(messages, payload["text"])
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	// The node is down: every fetch fails
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{
+		db:     db,
+		config: Config{IdenaRPCURL: node.URL},
+		alerts: newFetchAlerter(newWebhookNotifier(webhook.URL), 2),
+	}
+
+	for i := 0; i < 4; i++ {
+		server.runFetch(context.Background())
+	}
+	mu.Lock()
+	if len(messages) != 1 || !strings.Contains(messages[0], "consecutive fetches failed") {
+		t.Fatalf("Expected a single outage alert, got %q", messages)
+	}
+	mu.Unlock()
+
+	// The node comes back
+	node.Close()
+	node, _ = newMockNode(t, map[string]string{"": `[]`})
+	server.config.IdenaRPCURL = node.URL
+	server.runFetch(context.Background())
+	server.runFetch(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) != 2 || !strings.Contains(messages[1], "recovered") {
+		t.Fatalf("Expected a single recovery alert, got %q", messages)
+	}
+}
+
+func TestFetchRPCAuthFailureEscalates(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		messages = append(messages, payload["text"])
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	// The node rejects the key on every call
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32800,"message":"the key is invalid"}}`))
+	}))
+	defer node.Close()
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	// The generic alert would only fire after 10 failures
+	server := &Server{
+		db:     db,
+		config: Config{IdenaRPCURL: node.URL, IdenaRPCKey: "wrong", RPCAuthGrace: 2},
+		alerts: newFetchAlerter(newWebhookNotifier(webhook.URL), 10),
+	}
+
+	server.runFetch(context.Background())
+	mu.Lock()
+	if len(messages) != 0 {
+		t.Fatalf("Expected no alert within the grace, got %q", messages)
+	}
+	mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		server.runFetch(context.Background())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) != 1 || !strings.Contains(messages[0], "rejected IDENA_RPC_KEY on 2 consecutive fetches") {
+		t.Fatalf("Expected a single key misconfiguration alert, got %q", messages)
+	}
+}
+
+func TestPaginatedMerkle(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	get := func(target string, v interface{}) int {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+				t.Fatalf("Response parsing error: %v", err)
+			}
+		}
+		return rr.Code
+	}
+
+	type page struct {
+		MerkleRoot string       `json:"merkle_root"`
+		Count      int          `json:"count"`
+		Depth      int          `json:"depth"`
+		Nodes      []merkleNode `json:"nodes"`
+	}
+	var leaves page
+	if code := get("/whitelist/paginated-merkle?limit=1", &leaves); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if leaves.Count != 2 || leaves.Depth != 2 || len(leaves.Nodes) != 1 || leaves.Nodes[0].Address != "0x1234567890abcdef1234567890abcdef12345678" {
+		t.Errorf("Unexpected first leaf page: %+v", leaves)
+	}
+	var root page
+	get("/whitelist/paginated-merkle?level=1", &root)
+	if len(root.Nodes) != 1 || root.Nodes[0].Hash != leaves.MerkleRoot {
+		t.Errorf("Expected the top level to hold the root %s, got %+v", leaves.MerkleRoot, root.Nodes)
+	}
+
+	// A write rebuilds the tree
+	newAddress := "0x5555555555555555555555555555555555555555"
+	if err := server.updateDatabase([]Identity{{Address: newAddress, State: "Human", Stake: 50000}}); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+	var proof struct {
+		MerkleRoot string        `json:"merkle_root"`
+		Index      int           `json:"index"`
+		Proof      []merkle.Step `json:"proof"`
+	}
+	if code := get("/whitelist/paginated-merkle?address=0x9876543210fedcba9876543210fedcba98765432", &proof); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an ineligible address, got %d", code)
+	}
+	if code := get("/whitelist/paginated-merkle?address="+newAddress, &proof); code != http.StatusOK {
+		t.Fatalf("Expected 200 for the new address, got %d", code)
+	}
+	want := merkle.Build([]string{"0x1234567890abcdef1234567890abcdef12345678", newAddress, "0xabcdef1234567890abcdef1234567890abcdef12"})
+	if proof.MerkleRoot != want.Root() || proof.Index != 1 || len(proof.Proof) != 2 {
+		t.Errorf("Unexpected proof after update: %+v", proof)
+	}
+
+	// Reads come from the cache, not the table
+	if _, err := db.Exec("DELETE FROM identities"); err != nil {
+		t.Fatalf("Delete error: %v", err)
+	}
+	var cached page
+	get("/whitelist/paginated-merkle", &cached)
+	if cached.Count != 3 || cached.MerkleRoot != want.Root() {
+		t.Errorf("Expected the cached tree to be served, got %+v", cached)
+	}
+
+	if code := get("/whitelist/paginated-merkle?level=9", &cached); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a level past the root, got %d", code)
+	}
+}
+
+func TestIncrementalMerkleRebuild(t *testing.T) {
+	for _, algo := range []merkle.HashAlgo{merkle.SHA256, merkle.Keccak256} {
+		db, err := setupTestDB()
+		if err != nil {
+			t.Fatalf("DB setup error: %v", err)
+		}
+		if err := insertTestData(db); err != nil {
+			t.Fatalf("Data insertion error: %v", err)
+		}
+		server := &Server{db: db, config: Config{MerkleHash: algo}}
+		if _, err := server.merkleTree(); err != nil {
+			t.Fatalf("Merkle tree error: %v", err)
+		}
+
+		// One address joins, one leaves and one only changes stake
+		if err := server.updateDatabase([]Identity{
+			{Address: "0x0000000000000000000000000000000000000001", State: "Human", Stake: 50000},
+			{Address: "0xabcdef1234567890abcdef1234567890abcdef12", State: "Suspended", Stake: 25000},
+			{Address: "0x1234567890abcdef1234567890abcdef12345678", State: "Human", Stake: 16000},
+		}); err != nil {
+			t.Fatalf("Update error: %v", err)
+		}
+		tree, _ := server.merkle.get()
+		addresses, err := server.eligibleAddresses()
+		if err != nil {
+			t.Fatalf("Eligible addresses error: %v", err)
+		}
+		if want := merkle.BuildWith(addresses, algo); tree == nil || tree.Root() != want.Root() || tree.Len() != 2 {
+			t.Errorf("%s: expected the updated tree to match a full rebuild %s", algo, want.Root())
+		}
+		db.Close()
+	}
+}
+
+func TestMerkleCacheDuringRebuild(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	server := &Server{db: db}
+	previous, err := server.merkleTree()
+	if err != nil {
+		t.Fatalf("Merkle tree error: %v", err)
+	}
+
+	// Between the invalidation and the new tree, readers get the previous one
+	generation := server.merkle.invalidate()
+	if tree, err := server.merkleTree(); err != nil || tree != previous {
+		t.Errorf("Expected the previous tree while rebuilding, got %v %v", tree, err)
+	}
+	rebuilt := merkle.Build(previous.Addresses())
+	server.merkle.set(rebuilt, generation)
+	if tree, _ := server.merkleTree(); tree != rebuilt {
+		t.Error("Expected the rebuilt tree once set")
+	}
+
+	// A tree over other addresses is never served
+	server.merkle.set(merkle.Build([]string{"0x1234567890abcdef1234567890abcdef12345678"}), generation)
+	if tree, _ := server.merkleTree(); tree.Root() != previous.Root() {
+		t.Errorf("Expected the tree over the whitelist, got root %s", tree.Root())
+	}
+
+	// A failed rebuild leaves nothing outdated behind
+	db.Close()
+	server.rebuildMerkleTree()
+	if tree, err := server.merkleTree(); err == nil {
+		t.Errorf("Expected the tree to be rebuilt from the failing database, got %s", tree.Root())
+	}
+}
+
+func TestMerkleTreeFollowsOutsideChanges(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	// A Suspended identity within its grace period, per its history
+	suspended := "0x5555555555555555555555555555555555555555"
+	now := time.Now().Unix()
+	if _, err := db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, 'Suspended', 20000)", suspended); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, 'Human', 20000, ?), (?, 'Suspended', 20000, ?)",
+		suspended, now-7200, suspended, now-3600); err != nil {
+		t.Fatalf("History insertion error: %v", err)
+	}
+
+	server := &Server{db: db, config: Config{GracePeriod: 2 * time.Hour}}
+	router := server.routes()
+	get := func(path string, v interface{}) int {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s: response parsing error: %v", path, err)
+			}
+		}
+		return rr.Code
+	}
+	agree := func(step, address string, listed bool) {
+		var root struct {
+			MerkleRoot string `json:"merkle_root"`
+		}
+		if code := get("/merkle_root", &root); code != http.StatusOK {
+			t.Fatalf("%s: /merkle_root answered %d", step, code)
+		}
+		var bundle ClaimBundle
+		code := get("/claim/"+address, &bundle)
+		if !listed {
+			if code != http.StatusNotFound {
+				t.Errorf("%s: expected 404 from /claim, got %d", step, code)
+			}
+			return
+		}
+		if code != http.StatusOK {
+			t.Fatalf("%s: /claim answered %d", step, code)
+		}
+		if bundle.MerkleRoot != root.MerkleRoot {
+			t.Errorf("%s: /claim root %s differs from /merkle_root %s", step, bundle.MerkleRoot, root.MerkleRoot)
+		}
+		if !merkle.VerifyProof(bundle.HashAlgorithm, root.MerkleRoot, address, bundle.Proof) {
+			t.Errorf("%s: /claim proof fails against /merkle_root", step)
+		}
+	}
+
+	human := "0x1234567890abcdef1234567890abcdef12345678"
+	agree("initial", suspended, true)
+
+	// Another process changes the table, as the indexer does in MODE=server
+	if _, err := db.Exec("UPDATE identities SET state = 'Candidate' WHERE address = ?", "0xabcdef1234567890abcdef1234567890abcdef12"); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+	agree("after an outside write", human, true)
+
+	// The grace period runs out without any write
+	if _, err := db.Exec("UPDATE identity_history SET changed_at = changed_at - 7200 WHERE address = ?", suspended); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+	agree("after the grace period", suspended, false)
+	agree("after the grace period", human, true)
+}
+
+func TestPaginatedMerkleKeccak(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db, config: Config{MerkleHash: merkle.Keccak256}}
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist/paginated-merkle", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	var page struct {
+		MerkleRoot    string `json:"merkle_root"`
+		HashAlgorithm string `json:"hash_algorithm"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	want := merkle.BuildWith([]string{"0x1234567890abcdef1234567890abcdef12345678", "0xabcdef1234567890abcdef1234567890abcdef12"}, merkle.Keccak256)
+	if page.HashAlgorithm != "keccak256" || page.MerkleRoot != want.Root() {
+		t.Errorf("Expected keccak256 root %s, got %+v", want.Root(), page)
+	}
+	if sha := merkle.Build([]string{"0x1234567890abcdef1234567890abcdef12345678", "0xabcdef1234567890abcdef1234567890abcdef12"}); sha.Root() == page.MerkleRoot {
+		t.Error("Expected the keccak256 root to differ from the sha256 one")
+	}
+}
+
+func TestClaimBundle(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	key, _ := crypto.HexToECDSA("0000000000000000000000000000000000000000000000000000000000000001")
+	server := &Server{db: db, config: Config{ClaimKey: key}}
+	router := server.routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	address := "0xabcdef1234567890abcdef1234567890abcdef12"
+	rr := get("/claim/" + strings.ToUpper(address[2:]))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var bundle ClaimBundle
+	if err := json.Unmarshal(rr.Body.Bytes(), &bundle); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if bundle.Address != address || bundle.Count != 2 || bundle.HashAlgorithm != merkle.SHA256 {
+		t.Errorf("Unexpected bundle %+v", bundle)
+	}
+
+	// The proof leads to the root of the served tree
+	var published struct {
+		MerkleRoot string `json:"merkle_root"`
+	}
+	json.Unmarshal(get("/whitelist/paginated-merkle").Body.Bytes(), &published)
+	if bundle.MerkleRoot != published.MerkleRoot {
+		t.Errorf("Expected root %s, got %s", published.MerkleRoot, bundle.MerkleRoot)
+	}
+	if !merkle.VerifyProof(bundle.HashAlgorithm, bundle.MerkleRoot, bundle.Address, bundle.Proof) {
+		t.Error("Expected the proof to verify against the root")
+	}
+
+	// The root signature recovers the signer the way ecrecover would
+	if bundle.Signer != "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf" {
+		t.Errorf("Unexpected signer %s", bundle.Signer)
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(bundle.RootSignature, "0x"))
+	if err != nil || len(signature) != 65 || signature[64] < 27 {
+		t.Fatalf("Expected a 65-byte signature with v of 27 or 28, got %s", bundle.RootSignature)
+	}
+	signature[64] -= 27
+	root, _ := hex.DecodeString(bundle.MerkleRoot)
+	digest := crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), root)
+	pub, err := crypto.SigToPub(digest, signature)
+	if err != nil || !strings.EqualFold(crypto.PubkeyToAddress(*pub).Hex(), bundle.Signer) {
+		t.Errorf("Root signature does not recover the signer: %v", err)
+	}
+
+	// Not eligible, or not an address
+	for path, status := range map[string]int{
+		"/claim/0x9876543210fedcba9876543210fedcba98765432": http.StatusNotFound,
+		"/claim/0x0000000000000000000000000000000000000000": http.StatusNotFound,
+		"/claim/0x1234": http.StatusBadRequest,
+	} {
+		if rr := get(path); rr.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, rr.Code)
+		}
+	}
+
+	// A row written behind the server's back is claimable at once, signed
+	// over the root /merkle_root publishes
+	joined := "0x3333333333333333333333333333333333333333"
+	if _, err := db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, 'Human', 20000)", joined); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+	rr = get("/claim/" + joined)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for the new address, got %d", rr.Code)
+	}
+	bundle = ClaimBundle{}
+	json.Unmarshal(rr.Body.Bytes(), &bundle)
+	json.Unmarshal(get("/merkle_root").Body.Bytes(), &published)
+	if bundle.Count != 3 || bundle.MerkleRoot != published.MerkleRoot {
+		t.Errorf("Expected 3 leaves under root %s, got %d under %s", published.MerkleRoot, bundle.Count, bundle.MerkleRoot)
+	}
+	signature, _ = hex.DecodeString(strings.TrimPrefix(bundle.RootSignature, "0x"))
+	signature[64] -= 27
+	root, _ = hex.DecodeString(bundle.MerkleRoot)
+	pub, err = crypto.SigToPub(crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), root), signature)
+	if err != nil || !strings.EqualFold(crypto.PubkeyToAddress(*pub).Hex(), bundle.Signer) {
+		t.Errorf("Root signature does not cover the new root: %v", err)
+	}
+
+	// Without a key the bundle is unsigned
+	server.config.ClaimKey = nil
+	rr = get("/claim/" + address)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "signature") {
+		t.Errorf("Expected an unsigned bundle, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMerkleMultiproof(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	server := &Server{db: db}
+	if err := server.updateDatabase([]Identity{{Address: "0x5555555555555555555555555555555555555555", State: "Human", Stake: 50000}}); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+	post := func(body string, v interface{}) int {
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/merkle_multiproof", strings.NewReader(body)))
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+				t.Fatalf("Response parsing error: %v", err)
+			}
+		}
+		return rr.Code
+	}
+
+	var resp struct {
+		Root       string   `json:"root"`
+		Leaves     []string `json:"leaves"`
+		Addresses  []string `json:"addresses"`
+		Indices    []int    `json:"indices"`
+		Proof      []string `json:"proof"`
+		ProofFlags []bool   `json:"proof_flags"`
+	}
+	requested := []string{"0xABCDEF1234567890ABCDEF1234567890ABCDEF12", "0x5555555555555555555555555555555555555555"}
+	body, _ := json.Marshal(map[string][]string{"addresses": requested})
+	if code := post(string(body), &resp); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	want := merkle.BuildStandard([]string{
+		"0x1234567890abcdef1234567890abcdef12345678",
+		"0x5555555555555555555555555555555555555555",
+		"0xabcdef1234567890abcdef1234567890abcdef12",
+	})
+	if resp.Root != want.Root() {
+		t.Errorf("Expected root %s, got %s", want.Root(), resp.Root)
+	}
+	if len(resp.Leaves) != 2 || len(resp.Addresses) != 2 || len(resp.Indices) != 2 {
+		t.Fatalf("Expected 2 leaves, got %+v", resp)
+	}
+	for i, address := range resp.Addresses {
+		if leaf := "0x" + hex.EncodeToString(merkle.StandardLeaf(address)); leaf != resp.Leaves[i] {
+			t.Errorf("Leaf %d is %s, want %s for %s", i, resp.Leaves[i], leaf, address)
+		}
+	}
+
+	// Rebuild the root the way MerkleProof.processMultiProof does
+	decode := func(h string) []byte {
+		b, err := hex.DecodeString(strings.TrimPrefix(h, "0x"))
+		if err != nil {
+			t.Fatalf("Invalid hash %q", h)
+		}
+		return b
+	}
+	if len(resp.Leaves)+len(resp.Proof) != len(resp.ProofFlags)+1 {
+		t.Fatalf("Invalid multiproof shape: %+v", resp)
+	}
+	queue := make([][]byte, 0, len(resp.Leaves)+len(resp.ProofFlags))
+	for _, leaf := range resp.Leaves {
+		queue = append(queue, decode(leaf))
+	}
+	proof := resp.Proof
+	for _, flag := range resp.ProofFlags {
+		a := queue[0]
+		queue = queue[1:]
+		var b []byte
+		if flag {
+			b, queue = queue[0], queue[1:]
+		} else {
+			b, proof = decode(proof[0]), proof[1:]
+		}
+		if bytes.Compare(a, b) > 0 {
+			a, b = b, a
+		}
+		queue = append(queue, crypto.Keccak256(a, b))
+	}
+	if root := "0x" + hex.EncodeToString(queue[0]); root != resp.Root {
+		t.Errorf("Multiproof rebuilds root %s, want %s", root, resp.Root)
+	}
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"addresses":[]}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+		{`{"addresses":["0x5555555555555555555555555555555555555555","0x5555555555555555555555555555555555555555"]}`, http.StatusBadRequest},
+		{`{"addresses":["0x9876543210fedcba9876543210fedcba98765432"]}`, http.StatusNotFound},
+	} {
+		if code := post(tc.body, &resp); code != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.body, tc.code, code)
+		}
+	}
+}
+
+func TestPoolStake(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	pool := "0x9999999999999999999999999999999999999999"
+	node, _ := newMockNode(t, map[string]string{
+		"": `[
+			{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000","delegatee":"` + pool + `"},
+			{"address":"0x2222222222222222222222222222222222222222","state":"Verified","stake":"15000","delegatee":"` + pool + `"},
+			{"address":"0x3333333333333333333333333333333333333333","state":"Newbie","stake":"4000","delegatee":"` + pool + `"},
+			{"address":"0x4444444444444444444444444444444444444444","state":"Human","stake":"50000","delegatee":"0x8888888888888888888888888888888888888888"},
+			{"address":"0x5555555555555555555555555555555555555555","state":"Human","stake":"30000"}
+		]`,
+	})
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}}
+	if _, err := server.runFetch(context.Background()); err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/pool/"+pool+"/stake", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rr.Code)
+	}
+	var result PoolStake
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if result.Count != 3 || result.EligibleCount != 2 {
+		t.Errorf("Expected 3 delegators with 2 eligible, got %d and %d", result.Count, result.EligibleCount)
+	}
+	if result.TotalStake != 39000 || result.EligibleStake != 35000 {
+		t.Errorf("Expected 39000 delegated with 35000 eligible, got %v and %v", result.TotalStake, result.EligibleStake)
+	}
+	if len(result.Delegators) != 3 || result.Delegators[2].Address != "0x3333333333333333333333333333333333333333" || result.Delegators[2].Eligible {
+		t.Errorf("Unexpected delegators: %+v", result.Delegators)
+	}
+
+	// The delegatee is also reported on the identity itself
+	rr = httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/identity/0x1111111111111111111111111111111111111111", nil))
+	if !strings.Contains(rr.Body.String(), `"delegatee":"`+pool+`"`) {
+		t.Errorf("Expected the identity to carry its delegatee, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/pool/0x7777777777777777777777777777777777777777/stake", nil))
+	if !strings.Contains(rr.Body.String(), `"delegators":[]`) || !strings.Contains(rr.Body.String(), `"count":0`) {
+		t.Errorf("Expected an empty pool, got %s", rr.Body.String())
+	}
+}
+
+func TestNullStakeFromNode(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	node, _ := newMockNode(t, map[string]string{
+		"": `[
+			{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":null},
+			{"address":"0x2222222222222222222222222222222222222222","state":"Human","stake":"0"},
+			{"address":"0x3333333333333333333333333333333333333333","state":"Killed"},
+			{"address":"0x4444444444444444444444444444444444444444","state":"Candidate","stake":""}
+		]`,
+	})
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}}
+	if _, err := server.runFetch(context.Background()); err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+
+	var nulls int
+	db.QueryRow("SELECT COUNT(*) FROM identities WHERE stake IS NULL").Scan(&nulls)
+	if nulls != 3 {
+		t.Errorf("Expected 3 identities stored with a NULL stake, got %d", nulls)
+	}
+
+	tests := []struct {
+		address string
+		reason  string
+	}{
+		{"0x1111111111111111111111111111111111111111", "Stake unknown"},
+		{"0x2222222222222222222222222222222222222222", "Insufficient stake: 0.00 iDNA (minimum 10,000)"},
+		{"0x3333333333333333333333333333333333333333", "Ineligible state: Killed"},
+	}
+	for _, test := range tests {
+		if eligible, reason := server.checkEligibility(test.address); eligible || reason != test.reason {
+			t.Errorf("%s: expected %q, got %t %q", test.address, test.reason, eligible, reason)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/identity/0x1111111111111111111111111111111111111111", nil))
+	var identity Identity
+	if err := json.Unmarshal(rr.Body.Bytes(), &identity); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if !identity.StakeUnknown || identity.Stake != 0 || identity.Tier != "" {
+		t.Errorf("Expected an unknown stake without a tier, got %+v", identity)
+	}
+
+	// A stake reported later is a change
+	node, _ = newMockNode(t, map[string]string{
+		"": `[{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000"}]`,
+	})
+	server.config.IdenaRPCURL = node.URL
+	if changes, err := server.runFetch(context.Background()); err != nil || changes != 1 {
+		t.Fatalf("Expected 1 change, got %d (%v)", changes, err)
+	}
+	if eligible, reason := server.checkEligibility("0x1111111111111111111111111111111111111111"); !eligible {
+		t.Errorf("Expected eligible once the stake is known, got %q", reason)
+	}
+}
+
+func TestWhitelistEnvelope(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+	server := &Server{db: db}
+
+	// Bare by default
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist", nil))
+	var bare map[string]json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &bare); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if _, ok := bare["addresses"]; !ok || bare["meta"] != nil {
+		t.Errorf("Expected the bare whitelist, got %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/whitelist?envelope=true", nil))
+	var wrapped struct {
+		Data []string     `json:"data"`
+		Meta responseMeta `json:"meta"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &wrapped); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if len(wrapped.Data) != 2 || wrapped.Meta.Count != 2 {
+		t.Errorf("Expected 2 addresses in the envelope, got %+v", wrapped)
+	}
+	if wrapped.Meta.MerkleRoot != merkle.Build(wrapped.Data).Root() || wrapped.Meta.ServerVersion != version {
+		t.Errorf("Unexpected meta: %+v", wrapped.Meta)
+	}
+	if time.Since(wrapped.Meta.GeneratedAt) > time.Minute {
+		t.Errorf("Expected a current generated_at, got %s", wrapped.Meta.GeneratedAt)
+	}
+
+	// Identity lists share the envelope
+	rr = httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/state/Human?envelope=true", nil))
+	if !strings.Contains(rr.Body.String(), `"meta":{`) || !strings.Contains(rr.Body.String(), `"count":1`) {
+		t.Errorf("Expected an enveloped state list, got %s", rr.Body.String())
+	}
+}
+
+func TestIndexFromSourceFile(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	// A node dump as saved from a dna_identities call
+	dump := filepath.Join(t.TempDir(), "identities.json")
+	fixture := `{"jsonrpc":"2.0","id":1,"result":[
+		{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000"},
+		{"address":"0x2222222222222222222222222222222222222222","state":"Newbie","stake":"5000"},
+		{"address":"0x3333333333333333333333333333333333333333","state":"Verified","stake":"12000.5"}
+	]}`
+	if err := os.WriteFile(dump, []byte(fixture), 0644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	// The RPC URL points nowhere: the dump must be the only source
+	server := &Server{db: db, config: Config{IdenaRPCURL: "http://127.0.0.1:1", SourceFile: dump}}
+	changes, err := server.runFetch(context.Background())
+	if err != nil || changes != 3 {
+		t.Fatalf("Expected 3 identities ingested, got %d (%v)", changes, err)
+	}
+	if eligible, reason := server.checkEligibility("0x3333333333333333333333333333333333333333"); !eligible {
+		t.Errorf("Expected the Verified identity to be eligible, got %q", reason)
+	}
+
+	// A refreshed dump in the paginated shape is picked up on the next pass
+	fixture = `{"identities":[{"address":"0x2222222222222222222222222222222222222222","state":"Newbie","stake":"15000"}]}`
+	if err := os.WriteFile(dump, []byte(fixture), 0644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if changes, err := server.runFetch(context.Background()); err != nil || changes != 1 {
+		t.Fatalf("Expected 1 change from the refreshed dump, got %d (%v)", changes, err)
+	}
+
+	if err := os.WriteFile(dump, []byte(`not json`), 0644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if _, err := server.runFetch(context.Background()); err == nil {
+		t.Error("Expected a malformed dump to fail the pass")
+	}
+}
+
+func TestStakeScale(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	// Stakes in dna, as some proxies report them
+	dump := filepath.Join(t.TempDir(), "identities.json")
+	fixture := `[
+		{"address":"0x1111111111111111111111111111111111111111","state":"Human","stake":"20000000000000000000000"},
+		{"address":"0x2222222222222222222222222222222222222222","state":"Verified","stake":"12500500000000000000000"},
+		{"address":"0x3333333333333333333333333333333333333333","state":"Candidate","stake":null}
+	]`
+	if err := os.WriteFile(dump, []byte(fixture), 0644); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// Unscaled, the stakes are stored as they came and a warning is logged
+	server := &Server{db: db, config: Config{SourceFile: dump}}
+	if _, err := server.runFetch(context.Background()); err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "2 stakes exceed") {
+		t.Errorf("Expected a scale mismatch warning, got %q", logs.String())
+	}
+
+	logs.Reset()
+	server.config.StakeScale = 1e18
+	if _, err := server.runFetch(context.Background()); err != nil {
+		t.Fatalf("Fetch error: %v", err)
+	}
+	if strings.Contains(logs.String(), "stakes exceed") {
+		t.Errorf("Expected no warning once scaled, got %q", logs.String())
+	}
+	want := map[string]sql.NullFloat64{
+		"0x1111111111111111111111111111111111111111": {Float64: 20000, Valid: true},
+		"0x2222222222222222222222222222222222222222": {Float64: 12500.5, Valid: true},
+		"0x3333333333333333333333333333333333333333": {},
+	}
+	for address, stake := range want {
+		var stored sql.NullFloat64
+		if err := db.QueryRow("SELECT stake FROM identities WHERE address = ?", address).Scan(&stored); err != nil {
+			t.Fatalf("Query error: %v", err)
+		}
+		if stored != stake {
+			t.Errorf("%s: expected stake %+v, got %+v", address, stake, stored)
+		}
+	}
+	if eligible, reason := server.checkEligibility("0x2222222222222222222222222222222222222222"); !eligible {
+		t.Errorf("Expected the scaled Verified identity to be eligible, got %q", reason)
+	}
+}
+
+func TestDisabledEndpointGroups(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	disabled, err := parseDisabledEndpoints(" Export, merkle ,")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := parseDisabledEndpoints("export,metrics"); err == nil {
+		t.Error("Expected an unknown group to be rejected")
+	}
+
+	server := &Server{db: db, config: Config{APIKey: "secret", DisabledEndpoints: disabled}}
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/export", http.StatusNotFound},
+		{"/merkle_root", http.StatusNotFound},
+		{"/whitelist/paginated-merkle", http.StatusNotFound},
+		{"/whitelist", http.StatusOK},
+		{"/signin", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("X-API-Key", "secret")
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.path, test.status, rr.Code)
+		}
+	}
+
+	// Everything is on by default
+	server.config.DisabledEndpoints = nil
+	req := httptest.NewRequest("GET", "/merkle_root", nil)
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected /merkle_root to be enabled by default, got %d", rr.Code)
+	}
+}
+
+func TestIdentityEventsStream(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	ts := httptest.NewServer(server.routes())
+	defer ts.Close()
+
+	const address = "0x1111111111111111111111111111111111111111"
+	resp, err := http.Get(ts.URL + "/identity/" + address + "/events")
+	if err != nil {
+		t.Fatalf("Request error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	// The stream opens with a comment once the subscription is registered
+	if line := <-lines; !strings.HasPrefix(line, ": watching") {
+		t.Fatalf("Unexpected first line %q", line)
+	}
+
+	// Another address changing sends nothing; this one changing does
+	err = server.updateDatabase([]Identity{
+		{Address: "0x3333333333333333333333333333333333333333", State: "Human", Stake: 50000},
+		{Address: address, State: "Suspended", Stake: 12000},
+	})
+	if err != nil {
+		t.Fatalf("updateDatabase error: %v", err)
+	}
+
+	var event IdentityEvent
+	timeout := time.After(5 * time.Second)
+	for event.Address == "" {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatal("Stream closed before an event arrived")
+			}
+			if data := strings.TrimPrefix(line, "data: "); data != line {
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Fatalf("Event parsing error: %v", err)
+				}
+			}
+		case <-timeout:
+			t.Fatal("No event delivered for the change")
+		}
+	}
+	if event.Address != address || event.State != "Suspended" || event.Stake != 12000 {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// Subscribers beyond the cap are turned away
+	server.config.EventsMaxSubscribers = 1
+	resp2, err := http.Get(ts.URL + "/identity/" + address + "/events")
+	if err != nil {
+		t.Fatalf("Request error: %v", err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with the subscriber cap reached, got %d", resp2.StatusCode)
+	}
+
+	// Disconnecting frees the slot
+	resp.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.watchers.mu.Lock()
+		count := server.watchers.count
+		server.watchers.mu.Unlock()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Subscriber not removed after disconnect, %d left", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStakeThresholdCrossingAlerts(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		messages = append(messages, payload["text"])
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db, stakeAlerts: newWebhookNotifier(webhook.URL)}
+	const address = "0x1111111111111111111111111111111111111111"
+	steps := []struct {
+		stake stakeAmount
+		want  string
+	}{
+		{9000, ""},       // first sighting, nothing to compare with
+		{9500, ""},       // still below
+		{10000, "above"}, // reaches the threshold
+		{25000, ""},      // still above
+		{9999, "below"},  // drops under it
+	}
+	for _, step := range steps {
+		mu.Lock()
+		messages = nil
+		mu.Unlock()
+		err := server.updateDatabase([]Identity{{Address: address, State: "Human", Stake: step.stake}})
+		if err != nil {
+			t.Fatalf("updateDatabase error: %v", err)
+		}
+		mu.Lock()
+		got := messages
+		mu.Unlock()
+		if step.want == "" {
+			if len(got) != 0 {
+				t.Errorf("stake %v: expected no alert, got %q", step.stake, got)
+			}
+			continue
+		}
+		if len(got) != 1 || !strings.Contains(got[0], address) || !strings.Contains(got[0], " "+step.want+" ") {
+			t.Errorf("stake %v: expected one %q alert, got %q", step.stake, step.want, got)
+		}
+	}
+	if !strings.Contains(messages[0], "(25,000.00 iDNA -> 9,999.00 iDNA)") {
+		t.Errorf("Expected old and new stake in %q", messages[0])
+	}
+
+	// An unknown stake is not a crossing
+	server.updateDatabase([]Identity{{Address: address, State: "Human", StakeUnknown: true}})
+	server.updateDatabase([]Identity{{Address: address, State: "Human", Stake: 50000}})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(messages) != 1 {
+		t.Errorf("Expected no alerts around an unknown stake, got %q", messages[1:])
+	}
+}
+
+func TestStakeEncoding(t *testing.T) {
+	identity := Identity{Address: "0x01", State: "Human", Stake: 1e22}
+	tests := []struct {
+		asString bool
+		stake    stakeAmount
+		want     string
+	}{
+		{false, 15000, `"stake":15000,`},
+		{false, 1e22, `"stake":10000000000000000000000,`},
+		{false, 0.0000001, `"stake":0.0000001,`},
+		{true, 15000, `"stake":"15000.000000000000000000",`},
+		{true, 1e22, `"stake":"10000000000000000000000.000000000000000000",`},
+		{true, 1234.5, `"stake":"1234.500000000000000000",`},
+	}
+	for _, test := range tests {
+		server := &Server{config: Config{StakeAsString: test.asString}}
+		identity.Stake = test.stake
+		data, err := server.marshalJSON(identity)
+		if err != nil {
+			t.Fatalf("Marshal error: %v", err)
+		}
+		if !strings.Contains(string(data), test.want) {
+			t.Errorf("Expected %s in %s", test.want, data)
+		}
+
+		var decoded Identity
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal error: %v", err)
+		}
+		if decoded.Stake != test.stake {
+			t.Errorf("Round trip changed %v to %v", test.stake, decoded.Stake)
+		}
+	}
+
+	if _, err := parseStakeEncoding("hex"); err == nil {
+		t.Error("Expected an unknown encoding to be rejected")
+	}
+}
+
+func TestStakeEncodingResponses(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	// Each server encodes by its own config, so both can serve side by side
+	asNumbers := (&Server{db: db}).routes()
+	asStrings := (&Server{db: db, config: Config{StakeAsString: true, StateThresholds: map[string]float64{"Newbie": 20000}}}).routes()
+	get := func(router http.Handler, target string) string {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", target, rr.Code)
+		}
+		return rr.Body.String()
+	}
+
+	address := "/identity/0x1234567890abcdef1234567890abcdef12345678"
+	if body := get(asNumbers, address); !strings.Contains(body, `"stake":15000`) {
+		t.Errorf("Expected a numeric stake, got %s", body)
+	}
+	if body := get(asStrings, address); !strings.Contains(body, `"stake":"15000.000000000000000000"`) {
+		t.Errorf("Expected a string stake, got %s", body)
+	}
+	if body := get(asStrings, address+"?case=camel"); !strings.Contains(body, `"stake":"15000.000000000000000000"`) {
+		t.Errorf("Expected a string stake with camelCase keys, got %s", body)
+	}
+	body := get(asStrings, "/config/eligibility")
+	for _, want := range []string{`"min_stake":"10000.000000000000000000"`, `"Newbie":"20000.000000000000000000"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in %s", want, body)
+		}
+	}
+	if body := get(asStrings, "/identities/latest?format=ndjson"); !strings.Contains(body, `"stake":"25000.000000000000000000"`) {
+		t.Errorf("Expected string stakes in NDJSON, got %s", body)
+	}
+}
+
+func TestShutdownDrainsEventStreams(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	server := &Server{db: db, config: Config{ShutdownGrace: 5 * time.Second}}
+	ts := httptest.NewServer(server.routes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/identity/0x1111111111111111111111111111111111111111/events")
+	if err != nil {
+		t.Fatalf("Request error: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, ": watching") {
+		t.Fatalf("Unexpected first line %q", line)
+	}
+
+	// A long-poll is answered rather than cut off
+	rr := httptest.NewRecorder()
+	server.handleWhitelist(rr, httptest.NewRequest("GET", "/whitelist", nil))
+	poll := make(chan int)
+	go func() {
+		req := httptest.NewRequest("GET", "/whitelist?wait=30s", nil)
+		req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+		rr := httptest.NewRecorder()
+		server.handleWhitelist(rr, req)
+		poll <- rr.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	shutdown := make(chan error)
+	go func() { shutdown <- server.shutdown(ts.Config) }()
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Expected a clean end of stream, got %v", err)
+	}
+	if !strings.Contains(string(rest), "event: shutdown") {
+		t.Errorf("Expected a final shutdown event, got %q", rest)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Shutdown waited %s for drained streams", elapsed)
+	}
+	if code := <-poll; code != http.StatusNotModified {
+		t.Errorf("Expected the long-poll to end with 304, got %d", code)
+	}
+}
+
+func TestEligibilityCacheResetsOnEpoch(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	var epoch int32 = 10
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":1,"result":{"epoch":%d}}`, atomic.LoadInt32(&epoch))
+	}))
+	defer node.Close()
+
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL}, eligibility: newEpochCache(16)}
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+	check := func() (EligibilityCheck, string) {
+		req := httptest.NewRequest("GET", "/whitelist/check?address="+address, nil)
+		rr := httptest.NewRecorder()
+		server.handleWhitelistCheck(rr, req)
+
+		var response EligibilityCheck
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Response parsing error: %v", err)
+		}
+		return response, rr.Header().Get("X-Cache")
+	}
+
+	// Nothing is cached until the epoch is known
+	check()
+	if _, cache := check(); cache == "HIT" {
+		t.Fatal("Expected no caching before the epoch is known")
+	}
+
+	server.refreshEpoch(context.Background())
+	if response, cache := check(); !response.Eligible || cache != "MISS" {
+		t.Fatalf("Expected uncached eligible result, got eligible=%v X-Cache=%s", response.Eligible, cache)
+	}
+
+	// A change the indexer didn't store is not seen within the epoch
+	db.Exec("UPDATE identities SET stake = 100 WHERE address = ?", address)
+	if response, cache := check(); !response.Eligible || cache != "HIT" {
+		t.Fatalf("Expected cached eligible result, got eligible=%v X-Cache=%s", response.Eligible, cache)
+	}
+	server.refreshEpoch(context.Background())
+	if _, cache := check(); cache != "HIT" {
+		t.Fatalf("Expected the cache to survive a refresh within the epoch, got X-Cache=%s", cache)
+	}
+
+	// The next epoch starts from an empty cache
+	atomic.StoreInt32(&epoch, 11)
+	server.refreshEpoch(context.Background())
+	response, cache := check()
+	if cache != "MISS" || response.Eligible {
+		t.Errorf("Expected a fresh ineligible result after the epoch advanced, got eligible=%v X-Cache=%s", response.Eligible, cache)
+	}
+}
+
+const seedFixture = `address,state,stake
+0x1111111111111111111111111111111111111111,Human,15000
+0xABCDEF1234567890ABCDEF1234567890ABCDEF12, Newbie ,500.5
+0x2222222222222222222222222222222222222222,Verified,
+`
+
+func TestSeedFromCSV(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	path := filepath.Join(t.TempDir(), "seed.csv")
+	if err := os.WriteFile(path, []byte(seedFixture), 0o644); err != nil {
+		t.Fatalf("write fixture: %v", err)
+	}
+
+	server := &Server{db: db}
+	count, err := server.seedFromCSV(path)
+	if err != nil {
+		t.Fatalf("seedFromCSV error: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 seeded identities, got %d", count)
+	}
+
+	rows, err := db.Query("SELECT " + identitySelectColumns + " FROM identities")
+	if err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	byAddress := make(map[string]Identity)
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			t.Fatalf("Scan error: %v", err)
+		}
+		byAddress[identity.Address] = identity
+	}
+	rows.Close()
+	if got := byAddress["0xabcdef1234567890abcdef1234567890abcdef12"]; got.State != "Newbie" || got.Stake != 500.5 {
+		t.Errorf("Expected a lowercased, trimmed Newbie row, got %+v", got)
+	}
+	if got := byAddress["0x2222222222222222222222222222222222222222"]; !got.StakeUnknown {
+		t.Errorf("Expected an empty stake to be stored as unknown, got %+v", got)
+	}
+	if eligible, _ := server.checkEligibility("0x1111111111111111111111111111111111111111"); !eligible {
+		t.Error("Expected the seeded Human to be eligible")
+	}
+
+	bad := []struct {
+		name string
+		csv  string
+	}{
+		{"wrong header", "addr,state,stake\n"},
+		{"missing column", "address,state,stake\n0x1111111111111111111111111111111111111111,Human\n"},
+		{"bad address", "address,state,stake\n0x1234,Human,1\n"},
+		{"missing state", "address,state,stake\n0x1111111111111111111111111111111111111111,,1\n"},
+		{"bad stake", "address,state,stake\n0x1111111111111111111111111111111111111111,Human,lots\n"},
+	}
+	for _, test := range bad {
+		if _, err := readSeedCSV(strings.NewReader(test.csv)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestEligibleStableFetches(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	const (
+		longEligible = "0x1111111111111111111111111111111111111111"
+		justEligible = "0x2222222222222222222222222222222222222222"
+		flipped      = "0x3333333333333333333333333333333333333333"
+		noHistory    = "0x4444444444444444444444444444444444444444"
+	)
+	now := time.Now()
+	hoursAgo := func(h int) int64 { return now.Add(-time.Duration(h) * time.Hour).Unix() }
+	history := []struct {
+		address string
+		state   string
+		stake   float64
+		at      int64
+	}{
+		{longEligible, "Newbie", 20000, hoursAgo(72)},
+		{longEligible, "Verified", 20000, hoursAgo(48)}, // still eligible: the run continues
+		{justEligible, "Newbie", 5000, hoursAgo(72)},
+		{justEligible, "Newbie", 15000, hoursAgo(2)},
+		{flipped, "Human", 20000, hoursAgo(72)},
+		{flipped, "Suspended", 20000, hoursAgo(30)},
+		{flipped, "Human", 20000, hoursAgo(20)},
+	}
+	for _, h := range history {
+		db.Exec("INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, ?, ?, ?)",
+			h.address, h.state, h.stake, h.at)
+	}
+	for _, address := range []string{longEligible, justEligible, flipped, noHistory} {
+		db.Exec("INSERT INTO identities (address, state, stake) VALUES (?, 'Human', 20000)", address)
+	}
+	// Each fetch leaves a stats_history row; with 3 required, a run must
+	// have begun by the fetch 30h ago
+	recordFetch := func(at int64) {
+		db.Exec("INSERT INTO stats_history (recorded_at, total, eligible, total_stake) VALUES (?, 4, 4, 80000)", at)
+	}
+	for _, h := range []int{72, 48, 30, 20, 2} {
+		recordFetch(hoursAgo(h))
+	}
+
+	server := &Server{db: db, config: Config{StableFetches: 3}}
+	addresses, err := server.eligibleAddresses()
+	if err != nil {
+		t.Fatalf("eligibleAddresses error: %v", err)
+	}
+	if want := []string{longEligible, noHistory}; strings.Join(addresses, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v on the whitelist, got %v", want, addresses)
+	}
+
+	if eligible, reason := server.checkEligibility(justEligible); eligible || !strings.HasPrefix(reason, "Not yet stable: eligible in 1 of 3") {
+		t.Errorf("Expected a just-eligible address to be held back, got %v %q", eligible, reason)
+	}
+	if eligible, reason := server.checkEligibility(longEligible); !eligible {
+		t.Errorf("Expected a long-eligible address to pass, got %q", reason)
+	}
+	if epochCacheable(server.evaluateEligibility(justEligible)) {
+		t.Error("Expected not-yet-stable results to stay out of the epoch cache")
+	}
+
+	req := httptest.NewRequest("GET", "/whitelist?verbose=true", nil)
+	rr := httptest.NewRecorder()
+	server.handleWhitelist(rr, req)
+	var response WhitelistResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if len(response.Entries) != 2 {
+		t.Fatalf("Expected 2 verbose entries, got %+v", response.Entries)
+	}
+	if got := response.Entries[0].StableSince; got == nil || got.Unix() != hoursAgo(72) {
+		t.Errorf("Expected stable_since 72h ago for %s, got %v", longEligible, got)
+	}
+	if response.Entries[1].StableSince != nil {
+		t.Errorf("Expected no stable_since without history, got %v", response.Entries[1].StableSince)
+	}
+
+	// Time alone doesn't make a run stable, another fetch does
+	if eligible, _ := server.checkEligibility(flipped); eligible {
+		t.Errorf("Expected %s, eligible in 2 fetches, to be held back", flipped)
+	}
+	recordFetch(now.Unix())
+	if eligible, reason := server.checkEligibility(flipped); !eligible {
+		t.Errorf("Expected %s to pass after its third fetch, got %q", flipped, reason)
+	}
+
+	// Too few fetches on record hold back every address with history
+	server.config.StableFetches = 10
+	if addresses, _ := server.eligibleAddresses(); strings.Join(addresses, ",") != noHistory {
+		t.Errorf("Expected only %s with 10 fetches required, got %v", noHistory, addresses)
+	}
+
+	// The requirement is off by default
+	server.config.StableFetches = 0
+	if addresses, _ := server.eligibleAddresses(); len(addresses) != 4 {
+		t.Errorf("Expected every address without a requirement, got %v", addresses)
+	}
+}
+
+func TestMaxEpochsSinceValidation(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	const (
+		latest  = "0x1111111111111111111111111111111111111111"
+		atLimit = "0x2222222222222222222222222222222222222222"
+		tooOld  = "0x3333333333333333333333333333333333333333"
+		never   = "0x4444444444444444444444444444444444444444"
+	)
+	epochs := map[string]interface{}{latest: 100, atLimit: 98, tooOld: 97, never: nil}
+	for address, epoch := range epochs {
+		db.Exec("INSERT INTO identities (address, state, stake, last_validation_epoch) VALUES (?, 'Human', 20000, ?)",
+			address, epoch)
+	}
+
+	server := &Server{db: db, config: Config{MaxEpochsSinceValidation: 2}}
+	addresses, err := server.eligibleAddresses()
+	if err != nil {
+		t.Fatalf("eligibleAddresses error: %v", err)
+	}
+	if want := []string{latest, atLimit}; strings.Join(addresses, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v on the whitelist, got %v", want, addresses)
+	}
+
+	tests := []struct {
+		address  string
+		eligible bool
+		code     EligibilityCode
+		reason   string
+	}{
+		{latest, true, codeOK, "Eligible"},
+		{atLimit, true, codeOK, "Eligible"},
+		{tooOld, false, codeNotRecentlyValidated, "Last validated 3 epochs ago, at most 2 allowed"},
+		{never, false, codeNotRecentlyValidated, "No validation on record"},
+	}
+	for _, tt := range tests {
+		check := server.evaluateEligibility(tt.address)
+		if check.Eligible != tt.eligible || check.Code != tt.code || check.Reason != tt.reason {
+			t.Errorf("%s: expected %v %s %q, got %+v", tt.address, tt.eligible, tt.code, tt.reason, check)
+		}
+	}
+
+	// The rule is off by default
+	server.config.MaxEpochsSinceValidation = 0
+	if addresses, _ := server.eligibleAddresses(); len(addresses) != 4 {
+		t.Errorf("Expected every address without the rule, got %v", addresses)
+	}
+	if eligible, reason := server.checkEligibility(never); !eligible {
+		t.Errorf("Expected an identity without validations to pass without the rule, got %q", reason)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	day := 24 * time.Hour
+	churned := "0x1111111111111111111111111111111111111111"
+	graced := "0x2222222222222222222222222222222222222222"
+	leaving := "0x3333333333333333333333333333333333333333"
+	history := []struct {
+		address string
+		state   string
+		ago     time.Duration
+	}{
+		{churned, "Candidate", 100 * day},
+		{churned, "Newbie", 80 * day},
+		{churned, "Verified", 60 * day},
+		{churned, "Human", 40 * day},
+		{churned, "Suspended", time.Hour},
+		{graced, "Human", 200 * day},
+		{graced, "Suspended", 150 * day},
+		{graced, "Human", 10 * day},
+		{graced, "Suspended", time.Hour},
+		// Left Human 36 hours ago and has changed state twice since: the
+		// grace period rests on the Human row
+		{leaving, "Human", 3 * day},
+		{leaving, "Zombie", 36 * time.Hour},
+		{leaving, "Suspended", 30 * time.Hour},
+		{leaving, "Zombie", 24 * time.Hour},
+	}
+	for _, row := range history {
+		if _, err := db.Exec("INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, ?, 20000, ?)",
+			row.address, row.state, now.Add(-row.ago).Unix()); err != nil {
+			t.Fatalf("history insert: %v", err)
+		}
+	}
+
+	server := &Server{db: db, config: Config{GracePeriod: 48 * time.Hour}}
+	if deleted, err := server.pruneHistory(now); err != nil || deleted != 0 {
+		t.Fatalf("Expected no pruning without a policy, got %d (%v)", deleted, err)
+	}
+
+	server.config.HistoryKeep = 2
+	server.config.HistoryMaxAge = 30 * day
+	deleted, err := server.pruneHistory(now)
+	if err != nil {
+		t.Fatalf("pruneHistory: %v", err)
+	}
+	if deleted != 5 {
+		t.Errorf("Expected 5 rows pruned, got %d", deleted)
+	}
+	expected := map[string]string{
+		churned: "Human Suspended",
+		graced:  "Human Suspended",
+		leaving: "Human Zombie Suspended Zombie",
+	}
+	for address, want := range expected {
+		rows, err := db.Query("SELECT state FROM identity_history WHERE address = ? ORDER BY changed_at", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var states []string
+		for rows.Next() {
+			var state string
+			rows.Scan(&state)
+			states = append(states, state)
+		}
+		rows.Close()
+		if got := strings.Join(states, " "); got != want {
+			t.Errorf("%s: expected history %q, got %q", address, want, got)
+		}
+	}
+	for _, address := range []string{graced, leaving} {
+		if ok, err := server.inGracePeriod(address, now); err != nil || !ok {
+			t.Errorf("%s: expected the grace period to survive pruning (%v)", address, err)
+		}
+	}
+
+	// Nothing more to prune
+	if deleted, err := server.pruneHistory(now); err != nil || deleted != 0 {
+		t.Errorf("Expected a second prune to delete nothing, got %d (%v)", deleted, err)
+	}
+
+	// A stability requirement keeps every row until enough fetches are on
+	// record, then the rows since the oldest fetch it counts
+	server.config = Config{HistoryKeep: 1, StableFetches: 2}
+	if deleted, err := server.pruneHistory(now); err != nil || deleted != 0 {
+		t.Errorf("Expected no pruning before 2 fetches, got %d (%v)", deleted, err)
+	}
+	for _, ago := range []time.Duration{day, 2 * time.Hour} {
+		db.Exec("INSERT INTO stats_history (recorded_at, total, eligible, total_stake) VALUES (?, 3, 0, 0)", now.Add(-ago).Unix())
+	}
+	if deleted, err := server.pruneHistory(now); err != nil || deleted != 3 {
+		t.Errorf("Expected the 3 rows before the older fetch pruned, got %d (%v)", deleted, err)
+	}
+}
+
+func TestEvictionKeepsRecentIdentities(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	addresses := []string{
+		"0x1111111111111111111111111111111111111111",
+		"0x2222222222222222222222222222222222222222",
+		"0x3333333333333333333333333333333333333333",
+		"0x4444444444444444444444444444444444444444",
+	}
+	// 0x11.. was updated most recently, 0x44.. longest ago
+	for i, address := range addresses {
+		_, err := db.Exec("INSERT INTO identities (address, state, stake, updated_at) VALUES (?, 'Human', 20000, ?)",
+			address, time.Now().Add(-time.Duration(i)*time.Hour).UTC().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		db.Exec("INSERT INTO identity_history (address, state, stake, changed_at) VALUES (?, 'Human', 20000, ?)",
+			address, time.Now().Add(-48*time.Hour).Unix())
+	}
+
+	server := &Server{db: db, config: Config{MaxIdentities: 2}}
+	evicted, err := server.evictIdentities()
+	if err != nil {
+		t.Fatalf("evictIdentities error: %v", err)
+	}
+	if evicted != 2 {
+		t.Errorf("Expected 2 evicted rows, got %d", evicted)
+	}
+
+	whitelist, err := server.eligibleAddresses()
+	if err != nil {
+		t.Fatalf("eligibleAddresses error: %v", err)
+	}
+	if strings.Join(whitelist, ",") != strings.Join(addresses[:2], ",") {
+		t.Errorf("Expected the two most recent identities to remain, got %v", whitelist)
+	}
+	if eligible, reason := server.checkEligibility(addresses[3]); eligible || reason != "Address not found in database" {
+		t.Errorf("Expected an evicted address to be unknown, got %v %q", eligible, reason)
+	}
+
+	// An evicted identity that comes back unchanged is not a change
+	changes, err := server.storeIdentities([]Identity{{Address: addresses[3], State: "Human", Stake: 20000}})
+	if err != nil {
+		t.Fatalf("storeIdentities error: %v", err)
+	}
+	if changes != 0 {
+		t.Errorf("Expected an unchanged returning identity not to count as a change, got %d", changes)
+	}
+	changes, _ = server.storeIdentities([]Identity{{Address: addresses[2], State: "Newbie", Stake: 20000}})
+	if changes != 1 {
+		t.Errorf("Expected a returning identity with a new state to count as a change, got %d", changes)
+	}
+
+	if evicted, _ := server.evictIdentities(); evicted != 2 {
+		t.Errorf("Expected the table to be trimmed back to 2, evicted %d", evicted)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM identities").Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected 2 identities after eviction, got %d", count)
+	}
+
+	server.config.MaxIdentities = 0
+	if evicted, _ := server.evictIdentities(); evicted != 0 {
+		t.Errorf("Expected no eviction without a cap, got %d", evicted)
+	}
+}
+
+// Benchmark for performance
+func BenchmarkCheckEligibility(b *testing.B) {
+	db, err := setupTestDB()
+	if err != nil {
+		b.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		b.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.checkEligibility(address)
+	}
+}
+func benchmarkSingleIdentity(b *testing.B, cache *lruCache) {
+	db, err := setupTestDB()
+	if err != nil {
+		b.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		b.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db, cache: cache}
+	router := mux.NewRouter()
+	router.HandleFunc("/identity/{address}", server.handleSingleIdentity)
+	req := httptest.NewRequest("GET", "/identity/0x1234567890abcdef1234567890abcdef12345678", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkSingleIdentityUncached(b *testing.B) {
+	benchmarkSingleIdentity(b, nil)
+}
+
+func BenchmarkSingleIdentityCached(b *testing.B) {
+	benchmarkSingleIdentity(b, newLRUCache(16, time.Minute))
+}
+
+func benchmarkWhitelistCheck(b *testing.B, eligibility *epochCache) {
+	db, err := setupTestDB()
+	if err != nil {
+		b.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		b.Fatalf("Data insertion error: %v", err)
+	}
+
+	eligibility.setEpoch(10)
+	server := &Server{db: db, eligibility: eligibility}
+	req := httptest.NewRequest("GET", "/whitelist/check?address=0x1234567890abcdef1234567890abcdef12345678", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.handleWhitelistCheck(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkWhitelistCheckUncached(b *testing.B) {
+	benchmarkWhitelistCheck(b, nil)
+}
+
+func BenchmarkWhitelistCheckEpochCached(b *testing.B) {
+	benchmarkWhitelistCheck(b, newEpochCache(16))
+}
+
+func TestEligibleAddressesCache(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	server := &Server{db: db}
+	if _, ok := server.eligible.get(); ok {
+		t.Fatal("expected nothing cached before the first write")
+	}
+	agree := func(step string) {
+		t.Helper()
+		cached, ok := server.eligible.get()
+		if !ok {
+			t.Fatalf("%s: expected the whitelist to be cached", step)
+		}
+		fresh, err := server.loadEligibleAddresses()
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if fmt.Sprint(cached) != fmt.Sprint(fresh) {
+			t.Errorf("%s: cached %v, fresh %v", step, cached, fresh)
+		}
+		if got, _ := server.eligibleAddresses(); fmt.Sprint(got) != fmt.Sprint(fresh) {
+			t.Errorf("%s: eligibleAddresses returned %v, want %v", step, got, fresh)
+		}
+	}
+
+	server.rebuildMerkleTree()
+	agree("initial")
+	// A write refreshes the cache: the Newbie qualifies, the Human leaves
+	server.updateDatabase([]Identity{
+		{Address: "0x9876543210fedcba9876543210fedcba98765432", State: "Newbie", Stake: 20000},
+		{Address: "0x1234567890abcdef1234567890abcdef12345678", State: "Suspended", Stake: 15000},
+	})
+	agree("after update")
+	if cached, _ := server.eligible.get(); len(cached) != 2 || cached[0] != "0x9876543210fedcba9876543210fedcba98765432" {
+		t.Errorf("expected the Verified and the Newbie, got %v", cached)
+	}
+
+	// With a grace period the whitelist depends on the clock; never cached
+	server.config.GracePeriod = time.Hour
+	server.rebuildMerkleTree()
+	if _, ok := server.eligible.get(); ok {
+		t.Error("expected no caching with a grace period")
+	}
+}
+
+func benchmarkEligibleAddresses(b *testing.B, cached bool) {
+	db, err := setupTestDB()
+	if err != nil {
+		b.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	identities := make([]Identity, 5000)
+	for i := range identities {
+		identities[i] = Identity{Address: fmt.Sprintf("0x%040x", i), State: "Human", Stake: 20000}
+	}
+	server := &Server{db: db}
+	if err := server.updateDatabase(identities); err != nil {
+		b.Fatalf("updateDatabase: %v", err)
+	}
+	if !cached {
+		server.eligible.invalidate()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.eligibleAddresses(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEligibleAddressesFresh(b *testing.B) {
+	benchmarkEligibleAddresses(b, false)
+}
+
+func BenchmarkEligibleAddressesCached(b *testing.B) {
+	benchmarkEligibleAddresses(b, true)
+}
+
+func TestExportNDJSONGzip(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	router := (&Server{db: db, config: Config{APIKey: "secret"}}).routes()
+
+	for key, expected := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", "/export?format=ndjson.gz", nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != expected {
+			t.Errorf("Key %q: expected %d, got %d", key, expected, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/export?format=ndjson.gz", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("gzip error: %v", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("gzip read error: %v", err)
+	}
+
+	rows := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var identity Identity
+		if err := json.Unmarshal(scanner.Bytes(), &identity); err != nil {
+			t.Fatalf("Line %d is not an identity: %v", rows+1, err)
+		}
+		rows++
+	}
+	if rows != 4 {
+		t.Errorf("Expected 4 rows, got %d", rows)
+	}
+
+	trailer := rr.Result().Trailer
+	sum := sha256.Sum256(data)
+	if got := trailer.Get("X-Content-SHA256"); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("Checksum trailer %q does not match the content", got)
+	}
+	if got := trailer.Get("X-Row-Count"); got != "4" {
+		t.Errorf("Expected X-Row-Count 4, got %q", got)
+	}
+
+	// Without a configured key the endpoint is off
+	rr = httptest.NewRecorder()
+	(&Server{db: db}).routes().ServeHTTP(rr, httptest.NewRequest("GET", "/export", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without API_KEY, got %d", rr.Code)
+	}
+}
+
+func TestExportResume(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	router := (&Server{db: db, config: Config{APIKey: "secret"}}).routes()
+	export := func(query string) ([]string, http.Header, int) {
+		req := httptest.NewRequest("GET", "/export"+query, nil)
+		req.Header.Set("X-API-Key", "secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			return nil, nil, rr.Code
+		}
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("gzip error: %v", err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("gzip read error: %v", err)
+		}
+		var addresses []string
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var identity Identity
+			if err := json.Unmarshal(scanner.Bytes(), &identity); err != nil {
+				t.Fatalf("Line is not an identity: %v", err)
+			}
+			addresses = append(addresses, identity.Address)
+		}
+		return addresses, rr.Result().Trailer, rr.Code
+	}
+
+	full, trailer, _ := export("")
+	if len(full) != 4 || trailer.Get("X-Last-Address") != full[3] {
+		t.Fatalf("Expected 4 rows ending at X-Last-Address, got %v (%q)", full, trailer.Get("X-Last-Address"))
+	}
+
+	// The download broke off after two lines: resume after the last one
+	received := full[:2]
+	rest, _, _ := export("?format=ndjson.gz&after=" + strings.ToUpper(received[1]))
+	if resumed := append(received, rest...); strings.Join(resumed, ",") != strings.Join(full, ",") {
+		t.Errorf("Expected the resumed export to complete the table, got %v", resumed)
+	}
+
+	// Or pull the table in chunks, following X-Last-Address
+	var chunked []string
+	after := ""
+	for i := 0; i < 10; i++ {
+		chunk, trailer, _ := export("?limit=3&after=" + after)
+		chunked = append(chunked, chunk...)
+		if len(chunk) < 3 {
+			break
+		}
+		after = trailer.Get("X-Last-Address")
+	}
+	if strings.Join(chunked, ",") != strings.Join(full, ",") {
+		t.Errorf("Expected chunks to add up to the table, got %v", chunked)
+	}
+
+	for _, query := range []string{"?after=0x123", "?after=" + full[0][2:], "?limit=0", "?limit=x"} {
+		if _, _, code := export(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestDebugRPCIdentity(t *testing.T) {
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+	raw := `{"jsonrpc":"2.0","id":1,"result":{"address":"0x1234567890ABCDEF1234567890abcdef12345678","state":"Human","stake":"15000.5"}}`
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string   `json:"method"`
+			Params []string `json:"params"`
+			Key    string   `json:"key"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Method != "dna_identity" || len(req.Params) != 1 || req.Params[0] != address || req.Key != "node-key" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(raw))
+	}))
+	defer node.Close()
+
+	config := Config{IdenaRPCURL: node.URL, IdenaRPCKey: "node-key", APIKey: "secret", DebugEnabled: true}
+	get := func(server *Server, target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		server.routes().ServeHTTP(rr, req)
+		return rr
+	}
+	server := &Server{config: config}
+
+	rr := get(server, "/debug/rpc/identity?address=0x1234", "secret")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed address, got %d", rr.Code)
+	}
+	rr = get(server, "/debug/rpc/identity?address=0x1234567890ABCDEF1234567890abcdef12345678", "secret")
+	if rr.Code != http.StatusOK || rr.Body.String() != raw {
+		t.Errorf("Expected the node response verbatim, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected no-store, got %q", rr.Header().Get("Cache-Control"))
+	}
+	if rr := get(server, "/debug/rpc/identity?address="+address, "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the API key, got %d", rr.Code)
+	}
+
+	config.DebugEnabled = false
+	if rr := get(&Server{config: config}, "/debug/rpc/identity?address="+address, "secret"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with debug endpoints disabled, got %d", rr.Code)
+	}
+
+	node.Close()
+	if rr := get(server, "/debug/rpc/identity?address="+address, "secret"); rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 when the node is down, got %d", rr.Code)
+	}
+}
+
+func TestConcurrentWritesRetryOnBusy(t *testing.T) {
+	db, err := initDB(filepath.Join(t.TempDir(), "identities.db"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+	server := &Server{db: db}
+
+	// Each transaction reads before it writes, so two running at once
+	// deadlock and one gets SQLITE_BUSY however long busy_timeout is
+	const writers, rounds = 8, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*rounds)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				address := fmt.Sprintf("0x%040x", w*rounds+round+1)
+				errs <- server.updateDatabase([]Identity{{Address: address, State: "Human", Stake: stakeAmount(10000 + round)}})
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent write failed: %v", err)
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM identities").Scan(&count); err != nil || count != writers*rounds {
+		t.Errorf("Expected %d identities, got %d (%v)", writers*rounds, count, err)
+	}
+
+	if dsn := sqliteDSN("file:x.db?mode=rwc", 2*time.Second); dsn != "file:x.db?mode=rwc&_busy_timeout=2000" {
+		t.Errorf("Unexpected DSN %q", dsn)
+	}
+}
+
+func TestInternalErrorID(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	db.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	server := &Server{db: db}
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/identities/latest", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, got %d", rr.Code)
+	}
+	var body struct {
+		Error   string `json:"error"`
+		ErrorID string `json:"error_id"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Response parsing error: %v (%q)", err, rr.Body.String())
+	}
+	if len(body.ErrorID) != 12 || rr.Header().Get("X-Error-ID") != body.ErrorID {
+		t.Errorf("Expected a 12 character error ID in body and header, got %+v", body)
+	}
+	if strings.Contains(rr.Body.String(), "sql") {
+		t.Errorf("Expected the database error to stay out of the body, got %q", rr.Body.String())
+	}
+	if want := "Error " + body.ErrorID + ": GET /identities/latest: sql: database is closed"; !strings.Contains(logs.String(), want) {
+		t.Errorf("Expected log line %q, got %q", want, logs.String())
+	}
+	if newErrorID() == newErrorID() {
+		t.Error("Expected distinct error IDs")
+	}
+}
+
+func TestReconcileReportsDrift(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	defer db.Close()
+
+	if err := insertTestData(db); err != nil {
+		t.Fatalf("Data insertion error: %v", err)
+	}
+
+	// Human unchanged, Verified lost stake, one new identity; the Newbie and
+	// Candidate are gone from the node
+	node, _ := newMockNode(t, map[string]string{
+		"": `[
+			{"address":"0x1234567890ABCDEF1234567890abcdef12345678","state":"Human","stake":"15000"},
+			{"address":"0xabcdef1234567890abcdef1234567890abcdef12","state":"Verified","stake":"9000"},
+			{"address":"0x5555555555555555555555555555555555555555","state":"Newbie","stake":"11000"}
+		]`,
+	})
+
+	server := &Server{db: db, config: Config{IdenaRPCURL: node.URL, APIKey: "secret"}}
+	req := httptest.NewRequest("GET", "/reconcile", nil)
+	req.Header.Set("X-API-Key", "secret")
+	rr := httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var report ReconcileReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Response parsing error: %v", err)
+	}
+	if report.NodeTotal != 3 || report.DBTotal != 4 {
+		t.Errorf("Expected 3 node and 4 DB identities, got %d and %d", report.NodeTotal, report.DBTotal)
+	}
+	if report.MissingFromDB.Count != 1 || report.MissingFromDB.Addresses[0] != "0x5555555555555555555555555555555555555555" {
+		t.Errorf("Unexpected missing_from_db: %+v", report.MissingFromDB)
+	}
+	if report.Differing.Count != 1 || report.Differing.Addresses[0] != "0xabcdef1234567890abcdef1234567890abcdef12" {
+		t.Errorf("Unexpected differing: %+v", report.Differing)
+	}
+	if report.GoneFromNode.Count != 2 {
+		t.Errorf("Expected 2 identities gone from the node, got %+v", report.GoneFromNode)
+	}
+
+	// Read-only: the table is untouched
+	var stake float64
+	db.QueryRow("SELECT stake FROM identities WHERE address = ?", "0xabcdef1234567890abcdef1234567890abcdef12").Scan(&stake)
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM identities").Scan(&count)
+	if stake != 25000 || count != 4 {
+		t.Errorf("Reconcile modified the database: stake=%v, count=%d", stake, count)
+	}
+
+	rr = httptest.NewRecorder()
+	server.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/reconcile", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the API key, got %d", rr.Code)
+	}
+}
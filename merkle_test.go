@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
 
 func TestComputeMerkleRootEmpty(t *testing.T) {
 	if res := computeMerkleRoot([]string{}); res != "" {
@@ -36,3 +42,58 @@ func TestMerkleProof(t *testing.T) {
 		t.Fatalf("proof verification failed")
 	}
 }
+
+func TestMerkleVerifyHandler(t *testing.T) {
+	addrs := []string{
+		"0x0000000000000000000000000000000000000001",
+		"0x0000000000000000000000000000000000000002",
+		"0x0000000000000000000000000000000000000003",
+		"0x0000000000000000000000000000000000000004",
+	}
+	root := computeMerkleRoot(addrs)
+	proof, _ := computeMerkleProof(addrs, addrs[2])
+
+	tampered := make([]ProofStep, len(proof))
+	copy(tampered, proof)
+	tampered[0].Hash = strings.Repeat("0", 64)
+
+	tests := []struct {
+		name    string
+		address string
+		proof   []ProofStep
+		want    bool
+	}{
+		{"valid proof", addrs[2], proof, true},
+		{"tampered sibling", addrs[2], tampered, false},
+		{"wrong leaf", addrs[0], proof, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]interface{}{
+				"address": test.address,
+				"proof":   test.proof,
+				"root":    root,
+			})
+			rr := httptest.NewRecorder()
+			merkleVerifyHandler(rr, httptest.NewRequest("POST", "/merkle_verify", strings.NewReader(string(body))))
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rr.Code)
+			}
+			var resp map[string]bool
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode error: %v", err)
+			}
+			if resp["valid"] != test.want {
+				t.Fatalf("expected valid=%t, got %t", test.want, resp["valid"])
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	merkleVerifyHandler(rr, httptest.NewRequest("GET", "/merkle_verify", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// nonceStore remembers consumed nonces and the signatures used with them so
+// an old signature can't be replayed, even after its session is gone.
+// Entries expire after ttl and are evicted by sweep.
+type nonceStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	nonces     map[string]time.Time
+	signatures map[string]time.Time
+}
+
+func newNonceStore(ttl time.Duration) *nonceStore {
+	return &nonceStore{
+		ttl:        ttl,
+		nonces:     make(map[string]time.Time),
+		signatures: make(map[string]time.Time),
+	}
+}
+
+// consume records nonce and signature as used. It returns false if either
+// was already used and has not expired yet.
+func (s *nonceStore) consume(nonce, signature string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.usedLocked(nonce, signature, now) {
+		return false
+	}
+	expires := now.Add(s.ttl)
+	s.nonces[nonce] = expires
+	if signature != "" {
+		s.signatures[signature] = expires
+	}
+	return true
+}
+
+// used reports whether nonce or signature was consumed and has not expired.
+func (s *nonceStore) used(nonce, signature string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usedLocked(nonce, signature, now)
+}
+
+func (s *nonceStore) usedLocked(nonce, signature string, now time.Time) bool {
+	if expires, ok := s.nonces[nonce]; ok && now.Before(expires) {
+		return true
+	}
+	if expires, ok := s.signatures[signature]; ok && signature != "" && now.Before(expires) {
+		return true
+	}
+	return false
+}
+
+// sweep drops expired entries and returns how many were removed.
+func (s *nonceStore) sweep(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for _, m := range []map[string]time.Time{s.nonces, s.signatures} {
+		for key, expires := range m {
+			if !now.Before(expires) {
+				delete(m, key)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// runSweeper evicts expired entries every interval, forever.
+func (s *nonceStore) runSweeper(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.sweep(time.Now())
+	}
+}
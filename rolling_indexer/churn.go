@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Eligibility as the main backend applies it by default: one of these
+// states with at least churnMinStake staked.
+var churnEligibleStates = map[string]bool{"Human": true, "Verified": true, "Newbie": true}
+
+const churnMinStake = 10000
+
+// churnPoint compares a snapshot with the one taken before it.
+type churnPoint struct {
+	Timestamp         time.Time
+	PreviousTimestamp time.Time
+	Identities        int
+	Added             int
+	Removed           int
+	Eligible          int
+	EligibleAdded     int
+	EligibleRemoved   int
+}
+
+// NetEligible is the change in eligible identities since the previous
+// snapshot.
+func (p churnPoint) NetEligible() int {
+	return p.EligibleAdded - p.EligibleRemoved
+}
+
+// loadSnapshotDir loads every .json and .json.gz snapshot in dir, several
+// at a time, and returns them oldest first.
+func loadSnapshotDir(dir string) ([]*Snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	snapshots := make([]*Snapshot, len(files))
+	errs := make([]error, len(files))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, file := range files {
+		wg.Add(1)
+		go func(i int, file string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			snapshots[i], errs[i] = loadSnapshot(file)
+		}(i, file)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", files[i], err)
+		}
+	}
+
+	// files are in name order, so equal timestamps keep it
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+	})
+	return snapshots, nil
+}
+
+// computeChurn returns one point per consecutive pair of snapshots.
+// Addresses are compared case-insensitively.
+func computeChurn(snapshots []*Snapshot) []churnPoint {
+	var points []churnPoint
+	var previous, previousEligible map[string]bool
+	for i, snapshot := range snapshots {
+		present := make(map[string]bool, len(snapshot.Identities))
+		eligible := make(map[string]bool)
+		for _, identity := range snapshot.Identities {
+			address := strings.ToLower(identity.Address)
+			present[address] = true
+			if churnEligibleStates[identity.State] && identity.Stake >= churnMinStake {
+				eligible[address] = true
+			}
+		}
+		if i > 0 {
+			point := churnPoint{
+				Timestamp:         snapshot.Timestamp,
+				PreviousTimestamp: snapshots[i-1].Timestamp,
+				Identities:        len(present),
+				Eligible:          len(eligible),
+			}
+			point.Added, point.Removed = setDiff(previous, present)
+			point.EligibleAdded, point.EligibleRemoved = setDiff(previousEligible, eligible)
+			points = append(points, point)
+		}
+		previous, previousEligible = present, eligible
+	}
+	return points
+}
+
+// setDiff counts the members of after missing from before, and those of
+// before missing from after.
+func setDiff(before, after map[string]bool) (added, removed int) {
+	for address := range after {
+		if !before[address] {
+			added++
+		}
+	}
+	for address := range before {
+		if !after[address] {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// writeChurnCSV writes points as CSV with a header row, timestamps in
+// RFC 3339 UTC.
+func writeChurnCSV(w io.Writer, points []churnPoint) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"timestamp", "previous_timestamp", "identities", "added", "removed",
+		"eligible", "eligible_added", "eligible_removed", "net_eligible_change"})
+	for _, p := range points {
+		cw.Write([]string{
+			p.Timestamp.UTC().Format(time.RFC3339),
+			p.PreviousTimestamp.UTC().Format(time.RFC3339),
+			strconv.Itoa(p.Identities),
+			strconv.Itoa(p.Added),
+			strconv.Itoa(p.Removed),
+			strconv.Itoa(p.Eligible),
+			strconv.Itoa(p.EligibleAdded),
+			strconv.Itoa(p.EligibleRemoved),
+			strconv.Itoa(p.NetEligible()),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runChurn writes the churn time series for the snapshots in dir to
+// output, or stdout when output is empty.
+func runChurn(dir, output string) error {
+	snapshots, err := loadSnapshotDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) < 2 {
+		return fmt.Errorf("%s: need at least two snapshots, found %d", dir, len(snapshots))
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return writeChurnCSV(w, computeChurn(snapshots))
+}
@@ -1,7 +1,15 @@
-module rolling-indexer
+module idenauthgo/rolling_indexer
 
 go 1.21
 
 toolchain go1.22.3
 
-require github.com/mattn/go-sqlite3 v1.14.28
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/mattn/go-sqlite3 v1.14.28
+	gopkg.in/yaml.v3 v3.0.1
+	idenauthgo v0.0.0-00010101000000-000000000000
+)
+
+// Shares internal packages with the main module
+replace idenauthgo => ../
@@ -4,14 +4,34 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"idenauthgo/internal/idenarpc"
+	"idenauthgo/internal/pathtemplate"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
 )
 
 type FetcherConfig struct {
@@ -21,44 +41,201 @@ type FetcherConfig struct {
 	AddressListFile string `json:"address_list_file"`
 	BatchSize       int    `json:"batch_size"`
 	TimeoutSeconds  int    `json:"timeout_seconds"`
+	// FetchValidationData also records online status and flip count for
+	// each identity. Off by default to keep the base snapshot small.
+	FetchValidationData bool `json:"fetch_validation_data"`
+	// BatchRPC sends each batch of addresses as one JSON-RPC batch request
+	// instead of one request per address.
+	BatchRPC bool `json:"batch_rpc"`
+	// CompactOutput writes the snapshot without indentation.
+	CompactOutput bool `json:"compact_output"`
+	// GzipOutput gzips the snapshot and adds a .gz suffix to OutputFile.
+	GzipOutput bool `json:"gzip_output"`
+	// NodePublicKey is the hex-encoded ed25519 key of the node. When set,
+	// every dna_identity result must carry a valid signature from it.
+	NodePublicKey string `json:"node_public_key"`
+	// BreakerThreshold consecutive node failures make the remaining
+	// addresses fail fast as circuit_open for BreakerCooldownSeconds
+	// (default 60), rather than each waiting on a node that is down. Zero
+	// disables the breaker.
+	BreakerThreshold       int `json:"breaker_threshold"`
+	BreakerCooldownSeconds int `json:"breaker_cooldown_seconds"`
+	// RPCCAFile, RPCClientCert and RPCClientKey are PEM files for nodes
+	// behind a private CA or requiring mutual TLS. RPCInsecureSkipVerify
+	// disables certificate checks altogether, for testing only.
+	RPCCAFile             string `json:"rpc_ca_file"`
+	RPCClientCert         string `json:"rpc_client_cert"`
+	RPCClientKey          string `json:"rpc_client_key"`
+	RPCInsecureSkipVerify bool   `json:"rpc_insecure_skip_verify"`
 }
 
-type RPCRequest struct {
-	Method string        `json:"method"`
-	Params []interface{} `json:"params"`
-	ID     int           `json:"id"`
+// rpcTLS returns the TLS settings for the node.
+func (c *FetcherConfig) rpcTLS() idenarpc.TLSOptions {
+	return idenarpc.TLSOptions{
+		CAFile:             c.RPCCAFile,
+		CertFile:           c.RPCClientCert,
+		KeyFile:            c.RPCClientKey,
+		InsecureSkipVerify: c.RPCInsecureSkipVerify,
+	}
 }
 
-type RPCResponse struct {
-	Result *IdentityInfo `json:"result"`
-	Error  *RPCError     `json:"error"`
-	ID     int           `json:"id"`
+// newRPCClient returns a client for the node with the TLS settings, which
+// loadConfig has already checked, applied.
+func (c *FetcherConfig) newRPCClient() *idenarpc.Client {
+	timeout := time.Duration(c.TimeoutSeconds) * time.Second
+	client := idenarpc.NewClient(c.RPCURL, c.RPCKey, timeout)
+	if httpClient, err := c.rpcTLS().HTTPClient(timeout); err == nil {
+		client.HTTP = httpClient
+	}
+	return client
 }
 
-type RPCError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+// SignedResponse is a dna_identity response from signing nodes and proxies:
+// the signature covers the raw bytes of "result" exactly as sent.
+type SignedResponse struct {
+	idenarpc.Response
+	Signature string `json:"signature"`
 }
 
+var errInvalidSignature = errors.New("invalid response signature")
+
 type IdentityInfo struct {
-	Address string  `json:"address"`
-	State   string  `json:"state"`
-	Stake   float64 `json:"stake"`
+	Address    string  `json:"address"`
+	State      string  `json:"state"`
+	Stake      float64 `json:"stake"`
+	Online     *bool   `json:"online,omitempty"`
+	FlipsCount *int    `json:"flips_count,omitempty"`
+}
+
+// ValidationInfo holds the dna_identity fields describing the identity's
+// participation in validation. Only decoded when FetchValidationData is set.
+type ValidationInfo struct {
+	Online    bool `json:"online"`
+	MadeFlips int  `json:"madeFlips"`
 }
 
+// snapshotSchemaVersion is the Snapshot layout written by this version.
+// Version 0 files predate the field and only list failed addresses.
+const snapshotSchemaVersion = 1
+
 type Snapshot struct {
-	Timestamp  time.Time       `json:"timestamp"`
-	Identities []IdentityInfo  `json:"identities"`
-	Total      int             `json:"total"`
-	Successful int             `json:"successful"`
-	Failed     []string        `json:"failed"`
+	SchemaVersion int            `json:"schema_version"`
+	Timestamp     time.Time      `json:"timestamp"`
+	Identities    []IdentityInfo `json:"identities"`
+	Total         int            `json:"total"`
+	Successful    int            `json:"successful"`
+	// FailedAddresses is the addresses-only view of Failed, kept under
+	// "failed" for existing consumers.
+	FailedAddresses []string      `json:"failed"`
+	Failed          []FailedEntry `json:"failures"`
+}
+
+// FailedEntry records why an address could not be fetched.
+type FailedEntry struct {
+	Address  string `json:"address"`
+	Error    string `json:"error"`
+	Category string `json:"category"`
+	// RPCCode and RPCMessage are the node's JSON-RPC error object, set for
+	// rpc_error failures.
+	RPCCode    *int   `json:"rpc_code,omitempty"`
+	RPCMessage string `json:"rpc_message,omitempty"`
+}
+
+// Failure categories, from most to least specific.
+const (
+	failureSignature = "signature"
+	failureNotFound  = "not_found"
+	failureRPC       = "rpc_error"
+	failureHTTP      = "http_status"
+	failureTimeout   = "timeout"
+	failureNetwork   = "network"
+	failureDecode    = "decode"
+	failureCircuit   = "circuit_open"
+	failureOther     = "other"
+	// failureUnknown marks entries migrated from snapshots that only kept
+	// the address.
+	failureUnknown = "unknown"
+)
+
+// classifyFailure maps a fetch error to one of the failure categories.
+func classifyFailure(err error) string {
+	var rpcErr *idenarpc.Error
+	var httpErr *idenarpc.HTTPError
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, errInvalidSignature):
+		return failureSignature
+	case errors.Is(err, idenarpc.ErrCircuitOpen):
+		return failureCircuit
+	case errors.Is(err, idenarpc.ErrNoResult):
+		return failureNotFound
+	case errors.As(err, &rpcErr):
+		return failureRPC
+	case errors.As(err, &httpErr):
+		return failureHTTP
+	case errors.Is(err, context.DeadlineExceeded):
+		return failureTimeout
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return failureTimeout
+		}
+		return failureNetwork
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return failureDecode
+	}
+	return failureOther
+}
+
+// recordFailure adds address to both failure views.
+func (s *Snapshot) recordFailure(address string, err error) {
+	entry := FailedEntry{
+		Address:  address,
+		Error:    err.Error(),
+		Category: classifyFailure(err),
+	}
+	var rpcErr *idenarpc.Error
+	if errors.As(err, &rpcErr) {
+		code := rpcErr.Code
+		entry.RPCCode = &code
+		entry.RPCMessage = rpcErr.Message
+	}
+	s.FailedAddresses = append(s.FailedAddresses, address)
+	s.Failed = append(s.Failed, entry)
 }
 
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run identity_fetcher.go <config_file>")
+		log.Fatal("Usage: go run identity_fetcher.go [--validate-config] <config_file> | churn <snapshot_dir> [output.csv]")
+	}
+	if os.Args[1] == "--validate-config" {
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run identity_fetcher.go --validate-config <config_file>")
+		}
+		if _, err := loadConfig(os.Args[2]); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		log.Printf("%s is valid", os.Args[2])
+		return
+	}
+	if os.Args[1] == "churn" {
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run identity_fetcher.go churn <snapshot_dir> [output.csv]")
+		}
+		output := ""
+		if len(os.Args) > 3 {
+			output = os.Args[3]
+		}
+		if err := runChurn(os.Args[2], output); err != nil {
+			log.Fatalf("Error computing churn: %v", err)
+		}
+		return
 	}
 
+	log.Printf("identity fetcher %s (commit %s, built %s)", version, commit, buildTime)
+
 	configFile := os.Args[1]
 	config, err := loadConfig(configFile)
 	if err != nil {
@@ -75,15 +252,18 @@ func main() {
 	fetcher := NewIdentityFetcher(config)
 	snapshot := fetcher.FetchIdentities(addresses)
 
-	if err := saveSnapshot(snapshot, config.OutputFile); err != nil {
+	if err := saveSnapshot(snapshot, config); err != nil {
 		log.Fatalf("Error saving snapshot: %v", err)
 	}
 
 	log.Printf("Completed! %d/%d identities fetched successfully", 
 		snapshot.Successful, snapshot.Total)
+	if state := fetcher.client.Breaker.State(); state != idenarpc.BreakerClosed {
+		log.Printf("Node circuit %s after %d consecutive failures", state, fetcher.client.Breaker.Failures())
+	}
 	
-	if len(snapshot.Failed) > 0 {
-		log.Printf("Failed addresses: %v", snapshot.Failed)
+	for _, failure := range snapshot.Failed {
+		log.Printf("Failed %s (%s): %s", failure.Address, failure.Category, failure.Error)
 	}
 }
 
@@ -93,11 +273,16 @@ func loadConfig(filename string) (*FetcherConfig, error) {
 		return nil, err
 	}
 
-	var config FetcherConfig
-	if err := json.Unmarshal(data, &config); err != nil {
+	data, err = configJSON(filename, data)
+	if err != nil {
 		return nil, err
 	}
 
+	var config FetcherConfig
+	if err := decodeConfigStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
 	// Default values
 	if config.BatchSize == 0 {
 		config.BatchSize = 100
@@ -105,13 +290,69 @@ func loadConfig(filename string) (*FetcherConfig, error) {
 	if config.TimeoutSeconds == 0 {
 		config.TimeoutSeconds = 30
 	}
+	if _, err := config.rpcTLS().Config(); err != nil {
+		return nil, fmt.Errorf("invalid RPC TLS settings: %v", err)
+	}
+	if config.RPCInsecureSkipVerify {
+		log.Println("WARNING: rpc_insecure_skip_verify is set; the node's TLS certificate is NOT verified and RPC traffic can be intercepted")
+	}
+	if config.BreakerThreshold > 0 && config.BreakerCooldownSeconds == 0 {
+		config.BreakerCooldownSeconds = 60
+	}
 	if config.OutputFile == "" {
 		config.OutputFile = "snapshot.json"
 	}
+	config.OutputFile, err = pathtemplate.Expand(config.OutputFile, pathtemplate.Vars{
+		Now: time.Now(),
+		EpochFunc: func() (int, error) {
+			return config.newRPCClient().Epoch(context.Background())
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid output_file: %v", err)
+	}
+	if _, err := config.nodePublicKey(); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+// configJSON converts a YAML or TOML config, chosen by file extension, to
+// JSON so every format is decoded with the same struct tags. Anything else
+// is taken to be JSON already.
+func configJSON(filename string, data []byte) ([]byte, error) {
+	var values map[string]interface{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("invalid YAML config: %v", err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("invalid TOML config: %v", err)
+		}
+	default:
+		return data, nil
+	}
+	return json.Marshal(values)
+}
+
+// decodeConfigStrict decodes the JSON form of a config into v, rejecting
+// keys v has no field for, so a typo such as "rpc_ulr" fails instead of
+// being silently ignored.
+func decodeConfigStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Errorf("unknown key %s", field)
+		}
+		return err
+	}
+	return nil
+}
+
 func loadAddresses(filename string) ([]string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -134,24 +375,27 @@ func loadAddresses(filename string) ([]string, error) {
 
 type IdentityFetcher struct {
 	config *FetcherConfig
-	client *http.Client
+	client *idenarpc.Client
 }
 
 func NewIdentityFetcher(config *FetcherConfig) *IdentityFetcher {
+	client := config.newRPCClient()
+	client.Breaker = idenarpc.NewBreaker(config.BreakerThreshold,
+		time.Duration(config.BreakerCooldownSeconds)*time.Second)
 	return &IdentityFetcher{
 		config: config,
-		client: &http.Client{
-			Timeout: time.Duration(config.TimeoutSeconds) * time.Second,
-		},
+		client: client,
 	}
 }
 
 func (f *IdentityFetcher) FetchIdentities(addresses []string) *Snapshot {
 	snapshot := &Snapshot{
-		Timestamp:  time.Now(),
-		Identities: make([]IdentityInfo, 0),
-		Total:      len(addresses),
-		Failed:     make([]string, 0),
+		SchemaVersion:   snapshotSchemaVersion,
+		Timestamp:       time.Now(),
+		Identities:      make([]IdentityInfo, 0),
+		Total:           len(addresses),
+		FailedAddresses: make([]string, 0),
+		Failed:          make([]FailedEntry, 0),
 	}
 
 	// Process in batches to avoid server overload
@@ -164,15 +408,27 @@ func (f *IdentityFetcher) FetchIdentities(addresses []string) *Snapshot {
 		batch := addresses[i:end]
 		log.Printf("Processing batch %d-%d/%d", i+1, end, len(addresses))
 
-		for _, address := range batch {
-			identity, err := f.fetchIdentity(address)
+		var results map[string]batchResult
+		if f.config.BatchRPC {
+			var err error
+			results, err = f.fetchBatch(batch)
 			if err != nil {
-				log.Printf("Error for %s: %v", address, err)
-				snapshot.Failed = append(snapshot.Failed, address)
+				log.Printf("Batch request failed, falling back to per-address: %v", err)
+			}
+		}
+
+		for _, address := range batch {
+			result, ok := results[address]
+			if !ok {
+				result.identity, result.err = f.fetchIdentity(address)
+			}
+			if result.err != nil {
+				log.Printf("Error for %s: %v", address, result.err)
+				snapshot.recordFailure(address, result.err)
 				continue
 			}
 
-			snapshot.Identities = append(snapshot.Identities, *identity)
+			snapshot.Identities = append(snapshot.Identities, *result.identity)
 			snapshot.Successful++
 		}
 
@@ -186,62 +442,231 @@ func (f *IdentityFetcher) FetchIdentities(addresses []string) *Snapshot {
 }
 
 func (f *IdentityFetcher) fetchIdentity(address string) (*IdentityInfo, error) {
-	request := RPCRequest{
-		Method: "dna_identity",
-		Params: []interface{}{address},
-		ID:     1,
-	}
-
-	jsonData, err := json.Marshal(request)
+	// Posted directly rather than via Call: the signature sits next to the
+	// result in the envelope
+	body, err := f.client.Post(context.Background(), f.client.NewRequest(1, "dna_identity", address))
 	if err != nil {
 		return nil, err
 	}
+	return f.parseIdentity(address, body)
+}
 
-	req, err := http.NewRequest("POST", f.config.RPCURL, bytes.NewBuffer(jsonData))
+// batchResult is the outcome of one address within a batch request.
+type batchResult struct {
+	identity *IdentityInfo
+	err      error
+}
+
+// fetchBatch looks up addresses with a single JSON-RPC batch request. The
+// returned map only holds addresses the node answered; callers fetch the
+// rest individually. An error means the batch as a whole failed.
+func (f *IdentityFetcher) fetchBatch(addresses []string) (map[string]batchResult, error) {
+	requests := make([]idenarpc.Request, len(addresses))
+	for i, address := range addresses {
+		requests[i] = f.client.NewRequest(i+1, "dna_identity", address)
+	}
+
+	body, err := f.client.Post(context.Background(), requests)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if f.config.RPCKey != "" {
-		req.Header.Set("Authorization", "Bearer "+f.config.RPCKey)
+	var responses []json.RawMessage
+	if err := json.Unmarshal(body, &responses); err != nil {
+		return nil, fmt.Errorf("node does not support batch requests: %v", err)
 	}
 
-	resp, err := f.client.Do(req)
-	if err != nil {
-		return nil, err
+	results := make(map[string]batchResult, len(addresses))
+	for _, raw := range responses {
+		var envelope struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &envelope); err != nil || envelope.ID < 1 || envelope.ID > len(addresses) {
+			continue
+		}
+		address := addresses[envelope.ID-1]
+		identity, err := f.parseIdentity(address, raw)
+		results[address] = batchResult{identity: identity, err: err}
 	}
-	defer resp.Body.Close()
+	return results, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+// parseIdentity decodes a single dna_identity response for address.
+func (f *IdentityFetcher) parseIdentity(address string, body []byte) (*IdentityInfo, error) {
+	var response SignedResponse
+	if err := json.Unmarshal(body, &response); err != nil {
 		return nil, err
 	}
 
-	var rpcResponse RPCResponse
-	if err := json.Unmarshal(body, &rpcResponse); err != nil {
-		return nil, err
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	if len(response.Result) == 0 || string(response.Result) == "null" {
+		return nil, fmt.Errorf("%w for address %s", idenarpc.ErrNoResult, address)
 	}
 
-	if rpcResponse.Error != nil {
-		return nil, fmt.Errorf("RPC error: %s", rpcResponse.Error.Message)
+	if err := f.verifyResponse(&response); err != nil {
+		return nil, fmt.Errorf("%w for address %s", err, address)
 	}
 
-	if rpcResponse.Result == nil {
-		return nil, fmt.Errorf("no result for address %s", address)
+	var identity IdentityInfo
+	if err := json.Unmarshal(response.Result, &identity); err != nil {
+		return nil, err
 	}
 
 	// Ensure address is set
-	rpcResponse.Result.Address = address
+	identity.Address = address
+
+	if f.config.FetchValidationData {
+		// dna_identity already carries the validation fields, so decode them
+		// from the same result rather than issuing another request.
+		var extra ValidationInfo
+		if err := json.Unmarshal(response.Result, &extra); err != nil {
+			return nil, err
+		}
+		identity.Online = &extra.Online
+		identity.FlipsCount = &extra.MadeFlips
+	} else {
+		// "online" shares its name with the node field and is decoded with
+		// the base fields; drop it so snapshots stay unchanged by default.
+		identity.Online = nil
+	}
+
+	return &identity, nil
+}
+
+// nodePublicKey decodes NodePublicKey. It returns nil when no key is
+// configured, in which case responses are accepted unsigned.
+func (c *FetcherConfig) nodePublicKey() (ed25519.PublicKey, error) {
+	if c.NodePublicKey == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(c.NodePublicKey, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid node_public_key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid node_public_key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifyResponse checks the signature of a dna_identity response against
+// the configured node key. Without a key it accepts everything.
+func (f *IdentityFetcher) verifyResponse(signed *SignedResponse) error {
+	key, err := f.config.nodePublicKey()
+	if err != nil || key == nil {
+		return err
+	}
+
+	if signed.Signature == "" {
+		return fmt.Errorf("%w: response is not signed", errInvalidSignature)
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(signed.Signature, "0x"))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidSignature, err)
+	}
+	if !ed25519.Verify(key, signed.Result, signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
 
-	return rpcResponse.Result, nil
+// snapshotPath returns the file saveSnapshot writes to.
+func snapshotPath(config *FetcherConfig) string {
+	if config.GzipOutput && !strings.HasSuffix(config.OutputFile, ".gz") {
+		return config.OutputFile + ".gz"
+	}
+	return config.OutputFile
 }
 
-func saveSnapshot(snapshot *Snapshot, filename string) error {
-	data, err := json.MarshalIndent(snapshot, "", "  ")
+func saveSnapshot(snapshot *Snapshot, config *FetcherConfig) error {
+	var data []byte
+	var err error
+	if config.CompactOutput {
+		data, err = json.Marshal(snapshot)
+	} else {
+		data, err = json.MarshalIndent(snapshot, "", "  ")
+	}
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(filename, data, 0644)
+	if config.GzipOutput {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	return ioutil.WriteFile(snapshotPath(config), data, 0644)
+}
+
+// loadSnapshot reads a snapshot written by saveSnapshot, gunzipping files
+// ending in .gz.
+func loadSnapshot(filename string) (*Snapshot, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	}
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if err := migrateSnapshot(&snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &snapshot, nil
+}
+
+// migrateSnapshot upgrades a snapshot decoded from an older schema version
+// to the current one in place. Snapshots from a newer version are rejected
+// rather than silently losing fields.
+func migrateSnapshot(snapshot *Snapshot) error {
+	if snapshot.SchemaVersion > snapshotSchemaVersion {
+		return fmt.Errorf("snapshot schema version %d is newer than the supported version %d; upgrade the fetcher",
+			snapshot.SchemaVersion, snapshotSchemaVersion)
+	}
+
+	if snapshot.SchemaVersion < 1 {
+		// v0 kept failures as bare addresses
+		if len(snapshot.Failed) == 0 {
+			for _, address := range snapshot.FailedAddresses {
+				snapshot.Failed = append(snapshot.Failed, FailedEntry{Address: address, Category: failureUnknown})
+			}
+		}
+		if snapshot.Total == 0 {
+			snapshot.Total = snapshot.Successful + len(snapshot.FailedAddresses)
+		}
+	}
+
+	if snapshot.Identities == nil {
+		snapshot.Identities = make([]IdentityInfo, 0)
+	}
+	if snapshot.FailedAddresses == nil {
+		snapshot.FailedAddresses = make([]string, 0)
+	}
+	if snapshot.Failed == nil {
+		snapshot.Failed = make([]FailedEntry, 0)
+	}
+	snapshot.SchemaVersion = snapshotSchemaVersion
+	return nil
 }
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"idenauthgo/internal/idenarpc"
+)
+
+func newMockNode(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{
+  "rpc_url": "http://node:9009",
+  "rpc_key": "secret",
+  "address_list_file": "addresses.txt",
+  "batch_size": 25,
+  "batch_rpc": true
+}`,
+		"config.yaml": `# node connection
+rpc_url: http://node:9009
+rpc_key: secret
+address_list_file: addresses.txt
+batch_size: 25
+batch_rpc: true
+`,
+		"config.yml": `{rpc_url: "http://node:9009", rpc_key: secret, address_list_file: addresses.txt, batch_size: 25, batch_rpc: true}`,
+		"config.toml": `# node connection
+rpc_url = "http://node:9009"
+rpc_key = "secret"
+address_list_file = "addresses.txt"
+batch_size = 25
+batch_rpc = true
+`,
+		// Unknown extensions are read as JSON
+		"config.conf": `{"rpc_url": "http://node:9009", "rpc_key": "secret", "address_list_file": "addresses.txt", "batch_size": 25, "batch_rpc": true}`,
+	}
+
+	expected := &FetcherConfig{
+		RPCURL:          "http://node:9009",
+		RPCKey:          "secret",
+		OutputFile:      "snapshot.json",
+		AddressListFile: "addresses.txt",
+		BatchSize:       25,
+		TimeoutSeconds:  30,
+		BatchRPC:        true,
+	}
+
+	dir := t.TempDir()
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := loadConfig(path)
+			if err != nil {
+				t.Fatalf("loadConfig error: %v", err)
+			}
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, config)
+			}
+		})
+	}
+
+	path := filepath.Join(dir, "broken.yaml")
+	if err := os.WriteFile(path, []byte("rpc_url: [unterminated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("Expected an error for invalid YAML")
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{"rpc_url": "http://node:9009", "rpc_ulr": "http://other:9009"}`,
+		"config.yaml": "rpc_url: http://node:9009\nbatch_szie: 25\n",
+		"config.toml": "rpc_url = \"http://node:9009\"\n[rpc]\nkey = \"secret\"\n",
+	}
+	keys := map[string]string{"config.json": "rpc_ulr", "config.yaml": "batch_szie", "config.toml": "rpc"}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), `unknown key "`+keys[name]+`"`) {
+			t.Errorf("%s: expected the unknown key %q to be reported, got %v", name, keys[name], err)
+		}
+	}
+}
+
+func TestLoadConfigOutputTemplate(t *testing.T) {
+	node := newMockNode(t, `{"id":1,"result":{"epoch":142}}`)
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"rpc_url": "` + node.URL + `", "output_file": "out/{{.Epoch}}/snapshot-{{.Date}}.json"}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig error: %v", err)
+	}
+	expected := "out/142/snapshot-" + time.Now().UTC().Format("2006-01-02") + ".json"
+	if config.OutputFile != expected {
+		t.Errorf("Expected output_file %q, got %q", expected, config.OutputFile)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"output_file": "snapshot-{{.Nope}}.json"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Error("Expected an error for an unknown template variable")
+	}
+}
+
+func TestFetchIdentityValidationData(t *testing.T) {
+	node := newMockNode(t, `{"id":1,"result":{"state":"Human","stake":15000,"online":true,"madeFlips":3}}`)
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := NewIdentityFetcher(&FetcherConfig{
+				RPCURL:              node.URL,
+				TimeoutSeconds:      5,
+				FetchValidationData: test.enabled,
+			})
+
+			identity, err := fetcher.fetchIdentity(address)
+			if err != nil {
+				t.Fatalf("fetchIdentity error: %v", err)
+			}
+			if identity.State != "Human" || identity.Stake != 15000 {
+				t.Errorf("Unexpected identity: %+v", identity)
+			}
+
+			if !test.enabled {
+				if identity.Online != nil || identity.FlipsCount != nil {
+					t.Errorf("Validation data should be omitted when disabled")
+				}
+				return
+			}
+			if identity.Online == nil || !*identity.Online {
+				t.Errorf("Expected online=true, got %v", identity.Online)
+			}
+			if identity.FlipsCount == nil || *identity.FlipsCount != 3 {
+				t.Errorf("Expected flips_count=3, got %v", identity.FlipsCount)
+			}
+		})
+	}
+}
+
+func TestFetchIdentitySignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Key generation error: %v", err)
+	}
+	result := `{"state":"Human","stake":15000}`
+	signature := hex.EncodeToString(ed25519.Sign(priv, []byte(result)))
+	tampered := `{"state":"Human","stake":99000}`
+	address := "0x1234567890abcdef1234567890abcdef12345678"
+
+	tests := []struct {
+		name    string
+		key     string
+		body    string
+		wantErr bool
+	}{
+		{"no key configured", "", `{"id":1,"result":` + tampered + `}`, false},
+		{"valid signature", hex.EncodeToString(pub), `{"id":1,"result":` + result + `,"signature":"` + signature + `"}`, false},
+		{"tampered result", hex.EncodeToString(pub), `{"id":1,"result":` + tampered + `,"signature":"` + signature + `"}`, true},
+		{"missing signature", hex.EncodeToString(pub), `{"id":1,"result":` + result + `}`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newMockNode(t, test.body)
+			fetcher := NewIdentityFetcher(&FetcherConfig{
+				RPCURL:         node.URL,
+				TimeoutSeconds: 5,
+				NodePublicKey:  test.key,
+			})
+
+			identity, err := fetcher.fetchIdentity(address)
+			if test.wantErr {
+				if !errors.Is(err, errInvalidSignature) {
+					t.Fatalf("Expected invalid signature error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchIdentity error: %v", err)
+			}
+			if identity.State != "Human" {
+				t.Errorf("Expected state Human, got %s", identity.State)
+			}
+		})
+	}
+}
+
+// newBatchNode serves dna_identity with state "Human" and a stake derived
+// from the address. Batch requests are answered in reverse order unless
+// supportsBatch is false, in which case they get a JSON-RPC error object.
+func newBatchNode(t *testing.T, supportsBatch bool) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	answer := func(req idenarpc.Request) map[string]interface{} {
+		address := req.Params[0].(string)
+		return map[string]interface{}{
+			"id":     req.ID,
+			"result": map[string]interface{}{"state": "Human", "stake": float64(len(strings.TrimLeft(address, "0x")))},
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+
+		if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+			if !supportsBatch {
+				w.Write([]byte(`{"id":null,"error":{"code":-32600,"message":"batch not supported"}}`))
+				return
+			}
+			var reqs []idenarpc.Request
+			json.Unmarshal(body, &reqs)
+			var resps []map[string]interface{}
+			for i := len(reqs) - 1; i >= 0; i-- {
+				resps = append(resps, answer(reqs[i]))
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+		var req idenarpc.Request
+		json.Unmarshal(body, &req)
+		json.NewEncoder(w).Encode(answer(req))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestFetchIdentitiesBatchRPC(t *testing.T) {
+	addresses := []string{"0x1", "0x22", "0x333", "0x4444", "0x55555"}
+
+	tests := []struct {
+		name          string
+		supportsBatch bool
+		expectedCalls int32
+	}{
+		{"batch node", true, 2},
+		{"fallback", false, 2 + int32(len(addresses))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node, calls := newBatchNode(t, test.supportsBatch)
+			fetcher := NewIdentityFetcher(&FetcherConfig{
+				RPCURL:         node.URL,
+				TimeoutSeconds: 5,
+				BatchSize:      3,
+				BatchRPC:       true,
+			})
+
+			snapshot := fetcher.FetchIdentities(addresses)
+			if snapshot.Successful != len(addresses) {
+				t.Fatalf("Expected %d identities, got %d (failed: %v)", len(addresses), snapshot.Successful, snapshot.Failed)
+			}
+			for i, identity := range snapshot.Identities {
+				if identity.Address != addresses[i] {
+					t.Errorf("Expected %s at %d, got %s", addresses[i], i, identity.Address)
+				}
+				if want := float64(i + 1); identity.Stake != want {
+					t.Errorf("%s: expected stake %v, got %v", identity.Address, want, identity.Stake)
+				}
+			}
+			if got := atomic.LoadInt32(calls); got != test.expectedCalls {
+				t.Errorf("Expected %d HTTP requests, got %d", test.expectedCalls, got)
+			}
+		})
+	}
+}
+
+func TestFetchIdentitiesFailureCategories(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req idenarpc.Request
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch req.Params[0].(string) {
+		case "0xok":
+			w.Write([]byte(`{"id":1,"result":{"state":"Human","stake":15000}}`))
+		case "0xmissing":
+			w.Write([]byte(`{"id":1,"result":null}`))
+		case "0xrpc":
+			w.Write([]byte(`{"id":1,"error":{"code":-32000,"message":"unknown address"}}`))
+		case "0xhttp":
+			w.WriteHeader(http.StatusBadGateway)
+		case "0xgarbled":
+			w.Write([]byte(`{"id":1,"result":`))
+		case "0xslow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(node.Close)
+
+	fetcher := NewIdentityFetcher(&FetcherConfig{RPCURL: node.URL, BatchSize: 10})
+	fetcher.client.HTTP.Timeout = 50 * time.Millisecond
+
+	addresses := []string{"0xok", "0xmissing", "0xrpc", "0xhttp", "0xgarbled", "0xslow"}
+	snapshot := fetcher.FetchIdentities(addresses)
+
+	expected := map[string]string{
+		"0xmissing": failureNotFound,
+		"0xrpc":     failureRPC,
+		"0xhttp":    failureHTTP,
+		"0xgarbled": failureDecode,
+		"0xslow":    failureTimeout,
+	}
+	if snapshot.Successful != 1 || len(snapshot.Failed) != len(expected) {
+		t.Fatalf("Expected 1 success and %d failures, got %d and %+v", len(expected), snapshot.Successful, snapshot.Failed)
+	}
+	for i, failure := range snapshot.Failed {
+		if failure.Category != expected[failure.Address] {
+			t.Errorf("%s: expected category %s, got %s (%s)", failure.Address, expected[failure.Address], failure.Category, failure.Error)
+		}
+		if failure.Error == "" {
+			t.Errorf("%s: missing error message", failure.Address)
+		}
+		if snapshot.FailedAddresses[i] != failure.Address {
+			t.Errorf("Expected failed[%d] = %s, got %s", i, failure.Address, snapshot.FailedAddresses[i])
+		}
+		if (failure.RPCCode != nil) != (failure.Category == failureRPC) {
+			t.Errorf("%s: expected an RPC code only for RPC errors, got %v", failure.Address, failure.RPCCode)
+		}
+	}
+
+	if got := classifyFailure(fmt.Errorf("%w for address 0x1", errInvalidSignature)); got != failureSignature {
+		t.Errorf("Expected signature category, got %s", got)
+	}
+}
+
+func TestFetcherCircuitBreaker(t *testing.T) {
+	var calls int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(node.Close)
+
+	fetcher := NewIdentityFetcher(&FetcherConfig{RPCURL: node.URL, BatchSize: 10,
+		BreakerThreshold: 2, BreakerCooldownSeconds: 60})
+	snapshot := fetcher.FetchIdentities([]string{"0x1", "0x2", "0x3", "0x4", "0x5"})
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected the node to be called 2 times, got %d", n)
+	}
+	for i, failure := range snapshot.Failed {
+		want := failureHTTP
+		if i >= 2 {
+			want = failureCircuit
+		}
+		if failure.Category != want {
+			t.Errorf("%s: expected category %s, got %s", failure.Address, want, failure.Category)
+		}
+	}
+	if state := fetcher.client.Breaker.State(); state != idenarpc.BreakerOpen {
+		t.Errorf("Expected an open circuit, got %s", state)
+	}
+}
+
+func TestFetcherCustomCA(t *testing.T) {
+	node := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1,"result":{"state":"Human","stake":15000}}`))
+	}))
+	t.Cleanup(node.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: node.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range []*FetcherConfig{
+		{RPCURL: node.URL, BatchSize: 10, TimeoutSeconds: 5},
+		{RPCURL: node.URL, BatchSize: 10, TimeoutSeconds: 5, RPCCAFile: caFile},
+	} {
+		snapshot := NewIdentityFetcher(config).FetchIdentities([]string{"0x1"})
+		want := 0
+		if config.RPCCAFile != "" {
+			want = 1
+		}
+		if snapshot.Successful != want {
+			t.Errorf("CA file %q: expected %d successes, got %d (%+v)", config.RPCCAFile, want, snapshot.Successful, snapshot.Failed)
+		}
+	}
+}
+
+func TestSnapshotKeepsRPCError(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1,"error":{"code":-32602,"message":"invalid address"}}`))
+	}))
+	t.Cleanup(node.Close)
+
+	config := &FetcherConfig{RPCURL: node.URL, BatchSize: 10, OutputFile: filepath.Join(t.TempDir(), "snapshot.json")}
+	snapshot := NewIdentityFetcher(config).FetchIdentities([]string{"0xbad"})
+	if err := saveSnapshot(snapshot, config); err != nil {
+		t.Fatalf("saveSnapshot error: %v", err)
+	}
+
+	data, err := os.ReadFile(snapshotPath(config))
+	if err != nil {
+		t.Fatalf("Output missing: %v", err)
+	}
+	if !strings.Contains(string(data), `"rpc_code": -32602`) || !strings.Contains(string(data), `"rpc_message": "invalid address"`) {
+		t.Errorf("Expected the RPC error in the saved snapshot, got %s", data)
+	}
+
+	loaded, err := loadSnapshot(snapshotPath(config))
+	if err != nil {
+		t.Fatalf("loadSnapshot error: %v", err)
+	}
+	if len(loaded.Failed) != 1 || loaded.Failed[0].RPCCode == nil || *loaded.Failed[0].RPCCode != -32602 {
+		t.Errorf("Expected rpc_code -32602 after loading, got %+v", loaded.Failed)
+	}
+}
+
+func TestSaveSnapshotFormats(t *testing.T) {
+	online := true
+	snapshot := &Snapshot{
+		SchemaVersion: snapshotSchemaVersion,
+		Timestamp:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Identities: []IdentityInfo{
+			{Address: "0x1111111111111111111111111111111111111111", State: "Human", Stake: 15000, Online: &online},
+			{Address: "0x2222222222222222222222222222222222222222", State: "Newbie", Stake: 2500.5},
+		},
+		Total:           3,
+		Successful:      2,
+		FailedAddresses: []string{"0x3333333333333333333333333333333333333333"},
+		Failed: []FailedEntry{
+			{Address: "0x3333333333333333333333333333333333333333", Error: "node returned HTTP 502", Category: failureHTTP},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		compact bool
+		gzip    bool
+	}{
+		{"pretty", false, false},
+		{"compact", true, false},
+		{"gzip", false, true},
+		{"compact gzip", true, true},
+	}
+
+	sizes := make(map[string]int64)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &FetcherConfig{
+				OutputFile:    filepath.Join(t.TempDir(), "snapshot.json"),
+				CompactOutput: test.compact,
+				GzipOutput:    test.gzip,
+			}
+			if err := saveSnapshot(snapshot, config); err != nil {
+				t.Fatalf("saveSnapshot error: %v", err)
+			}
+
+			path := snapshotPath(config)
+			if test.gzip != strings.HasSuffix(path, ".json.gz") {
+				t.Errorf("Unexpected output path %s", path)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Output missing: %v", err)
+			}
+			sizes[test.name] = info.Size()
+
+			loaded, err := loadSnapshot(path)
+			if err != nil {
+				t.Fatalf("loadSnapshot error: %v", err)
+			}
+			if !reflect.DeepEqual(loaded, snapshot) {
+				t.Errorf("Round trip mismatch: got %+v", loaded)
+			}
+		})
+	}
+
+	if sizes["compact"] >= sizes["pretty"] {
+		t.Errorf("Expected compact output (%d bytes) smaller than pretty (%d bytes)", sizes["compact"], sizes["pretty"])
+	}
+}
+
+func TestLoadSnapshotMigratesV0(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "v0.json")
+	v0 := `{
+  "timestamp": "2024-01-02T03:04:05Z",
+  "identities": [{"address": "0x1111111111111111111111111111111111111111", "state": "Human", "stake": 15000}],
+  "total": 2,
+  "successful": 1,
+  "failed": ["0x2222222222222222222222222222222222222222"]
+}`
+	if err := os.WriteFile(path, []byte(v0), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("loadSnapshot error: %v", err)
+	}
+	expected := &Snapshot{
+		SchemaVersion: snapshotSchemaVersion,
+		Timestamp:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Identities: []IdentityInfo{
+			{Address: "0x1111111111111111111111111111111111111111", State: "Human", Stake: 15000},
+		},
+		Total:           2,
+		Successful:      1,
+		FailedAddresses: []string{"0x2222222222222222222222222222222222222222"},
+		Failed: []FailedEntry{
+			{Address: "0x2222222222222222222222222222222222222222", Category: failureUnknown},
+		},
+	}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, snapshot)
+	}
+
+	// Missing lists come back empty rather than nil
+	path = filepath.Join(dir, "v0-minimal.json")
+	if err := os.WriteFile(path, []byte(`{"timestamp": "2024-01-02T03:04:05Z", "successful": 0}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err = loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("loadSnapshot error: %v", err)
+	}
+	if snapshot.Identities == nil || snapshot.FailedAddresses == nil || snapshot.Failed == nil {
+		t.Errorf("Expected empty lists, got %+v", snapshot)
+	}
+
+	path = filepath.Join(dir, "future.json")
+	if err := os.WriteFile(path, []byte(`{"schema_version": 99, "timestamp": "2024-01-02T03:04:05Z"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSnapshot(path); err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Errorf("Expected a schema version error, got %v", err)
+	}
+}
+
+func TestChurnTimeSeries(t *testing.T) {
+	const (
+		a1 = "0x1111111111111111111111111111111111111111"
+		a2 = "0x2222222222222222222222222222222222222222"
+		a3 = "0x3333333333333333333333333333333333333333"
+		a4 = "0x4444444444444444444444444444444444444444"
+	)
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	dir := t.TempDir()
+	// File names deliberately out of timestamp order
+	fixtures := []struct {
+		file     string
+		snapshot *Snapshot
+	}{
+		{"b.json.gz", &Snapshot{Timestamp: day(1), Identities: []IdentityInfo{
+			{Address: a1, State: "Human", Stake: 15000},
+			{Address: a2, State: "Newbie", Stake: 5000},
+		}}},
+		{"d.json", &Snapshot{Timestamp: day(2), Identities: []IdentityInfo{
+			{Address: a1, State: "Human", Stake: 15000},
+			{Address: a2, State: "Newbie", Stake: 12000},
+			{Address: a3, State: "Candidate", Stake: 20000},
+		}}},
+		{"c.json", &Snapshot{Timestamp: day(3), Identities: []IdentityInfo{
+			{Address: a2, State: "Newbie", Stake: 12000},
+			{Address: strings.ToUpper(a3), State: "Human", Stake: 20000},
+		}}},
+		{"a.json", &Snapshot{Timestamp: day(4), Identities: []IdentityInfo{
+			{Address: a3, State: "Suspended", Stake: 20000},
+			{Address: a4, State: "Verified", Stake: 30000},
+		}}},
+	}
+	for _, fixture := range fixtures {
+		config := &FetcherConfig{
+			OutputFile: filepath.Join(dir, fixture.file),
+			GzipOutput: strings.HasSuffix(fixture.file, ".gz"),
+		}
+		if err := saveSnapshot(fixture.snapshot, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a snapshot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "churn.csv")
+	if err := runChurn(dir, output); err != nil {
+		t.Fatalf("runChurn error: %v", err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `timestamp,previous_timestamp,identities,added,removed,eligible,eligible_added,eligible_removed,net_eligible_change
+2024-01-02T00:00:00Z,2024-01-01T00:00:00Z,3,1,0,2,1,0,1
+2024-01-03T00:00:00Z,2024-01-02T00:00:00Z,2,0,1,2,1,1,0
+2024-01-04T00:00:00Z,2024-01-03T00:00:00Z,2,1,1,1,1,2,-1
+`
+	if string(data) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, data)
+	}
+
+	// A single snapshot has nothing to compare
+	single := t.TempDir()
+	if err := saveSnapshot(fixtures[0].snapshot, &FetcherConfig{OutputFile: filepath.Join(single, "only.json")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runChurn(single, ""); err == nil {
+		t.Error("Expected an error for a single snapshot")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches on exact paths and enforces each route's methods: a
+// known path with the wrong method gets 405 and an Allow header, OPTIONS
+// gets 204 with the same header, and unknown paths go to fallback for
+// GET/HEAD (static files) or get 404.
+type router struct {
+	routes   map[string]route
+	fallback http.Handler
+}
+
+type route struct {
+	handler http.HandlerFunc
+	methods []string
+	allow   string
+}
+
+func newRouter(fallback http.Handler) *router {
+	return &router{routes: make(map[string]route), fallback: fallback}
+}
+
+// handle registers handler for path. GET routes also answer HEAD.
+func (rt *router) handle(path string, handler http.HandlerFunc, methods ...string) {
+	for _, method := range methods {
+		if method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+			break
+		}
+	}
+	sort.Strings(methods)
+	rt.routes[path] = route{
+		handler: handler,
+		methods: methods,
+		allow:   strings.Join(append(methods, http.MethodOptions), ", "),
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := rt.routes[r.URL.Path]
+	if !ok {
+		if rt.fallback != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			rt.fallback.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", route.allow)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, method := range route.methods {
+		if r.Method == method {
+			route.handler(w, r)
+			return
+		}
+	}
+	w.Header().Set("Allow", route.allow)
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
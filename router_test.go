@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRouterMethodsAndPaths(t *testing.T) {
+	handler := routes()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{"GET", "/version", http.StatusOK, ""},
+		{"HEAD", "/version", http.StatusOK, ""},
+		{"POST", "/whitelist", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"DELETE", "/merkle_root", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"GET", "/auth/v1/authenticate", http.StatusMethodNotAllowed, "POST, OPTIONS"},
+		{"OPTIONS", "/auth/v1/authenticate", http.StatusNoContent, "POST, OPTIONS"},
+		{"GET", "/no-such-endpoint", http.StatusNotFound, ""},
+		{"POST", "/no-such-endpoint", http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(test.method, test.path, nil))
+			if rr.Code != test.status {
+				t.Errorf("Expected %d, got %d", test.status, rr.Code)
+			}
+			if got := rr.Header().Get("Allow"); got != test.allow {
+				t.Errorf("Expected Allow %q, got %q", test.allow, got)
+			}
+		})
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	srv := newHTTPServer(listenAddr, routes())
+	if srv.ReadHeaderTimeout != 5*time.Second || srv.ReadTimeout != 15*time.Second ||
+		srv.WriteTimeout != 30*time.Second || srv.IdleTimeout != 120*time.Second {
+		t.Errorf("Unexpected default timeouts: header %s, read %s, write %s, idle %s",
+			srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	// A client that never finishes its headers is disconnected
+	origTimeout := HTTP_READ_HEADER_TIMEOUT
+	HTTP_READ_HEADER_TIMEOUT = 100 * time.Millisecond
+	t.Cleanup(func() { HTTP_READ_HEADER_TIMEOUT = origTimeout })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	srv = newHTTPServer(ln.Addr().String(), routes())
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /version HTTP/1.1\r\nHost: localhost\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Expected the server to close the slow connection, got %v", err)
+	}
+}
@@ -4,16 +4,37 @@ CREATE TABLE IF NOT EXISTS identities (
     address TEXT PRIMARY KEY,
     state TEXT NOT NULL,
     stake REAL NOT NULL,
+    online INTEGER,
+    flips_count INTEGER,
     timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
     updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
+-- State/stake transitions, one row per detected change
+CREATE TABLE IF NOT EXISTS identity_history (
+    address TEXT NOT NULL,
+    state TEXT NOT NULL,
+    stake REAL NOT NULL,
+    changed_at INTEGER NOT NULL
+);
+
+-- Totals recorded after each indexer update, for /stats/history
+CREATE TABLE IF NOT EXISTS stats_history (
+    recorded_at INTEGER NOT NULL,
+    total INTEGER NOT NULL,
+    eligible INTEGER NOT NULL,
+    total_stake REAL NOT NULL
+);
+
 -- Indexes for performance improvement
 CREATE INDEX IF NOT EXISTS idx_state ON identities(state);
 CREATE INDEX IF NOT EXISTS idx_stake ON identities(stake);
 CREATE INDEX IF NOT EXISTS idx_eligible ON identities(state, stake);
 CREATE INDEX IF NOT EXISTS idx_timestamp ON identities(timestamp);
 CREATE INDEX IF NOT EXISTS idx_updated_at ON identities(updated_at);
+CREATE INDEX IF NOT EXISTS idx_history_address ON identity_history(address, changed_at);
+CREATE INDEX IF NOT EXISTS idx_history_changed_at ON identity_history(changed_at);
+CREATE INDEX IF NOT EXISTS idx_stats_recorded_at ON stats_history(recorded_at);
 
 -- View for eligible identities
 CREATE VIEW IF NOT EXISTS eligible_identities AS
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// signInHash returns the digest a sign-in signature is checked against:
+// Keccak-256 of the Keccak-256 of the nonce's UTF-8 bytes, exactly as
+// passed to the authentication endpoint (prefix included), with no length
+// prefix or other framing. It follows idena-go's default dna_sign format
+// (signatureHash) as read from its source; it has not been checked against
+// a signature made by the Idena app or idena-sign-in, and a digest that
+// differs from theirs recovers a random address so the login fails.
+func signInHash(nonce string) []byte {
+	return crypto.Keccak256(crypto.Keccak256([]byte(nonce)))
+}
+
+// recoverSignInAddress returns the lowercase address whose key signed
+// signInHash(nonce). signatureHex is the 65-byte r || s || v signature,
+// with or without 0x. The Idena app sends v as the recovery id 0 or 1;
+// the Ethereum-style 27 or 28 some libraries produce is accepted too.
+func recoverSignInAddress(nonce, signatureHex string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(signatureHex), "0x"))
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return "", errors.New("signature must be 65 bytes of hex")
+	}
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pubKey, err := crypto.SigToPub(signInHash(nonce), sig)
+	if err != nil {
+		return "", err
+	}
+	address, _ := normalizeAddress(crypto.PubkeyToAddress(*pubKey).Hex())
+	return address, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setupSnapshotDB points the package-level db at a fresh in-memory database.
+func setupSnapshotDB(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("DB setup error: %v", err)
+	}
+	// Every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	createSessionTable()
+	createSnapshotTable()
+	createAuthAttemptsTable()
+}
+
+func TestWhitelistSnapshotConsistency(t *testing.T) {
+	setupSnapshotDB(t)
+	stakeThreshold = 10000
+	recordIdentitySnapshot("0x0000000000000000000000000000000000000003", "Human", 20000)
+	recordIdentitySnapshot("0x0000000000000000000000000000000000000001", "Verified", 15000)
+	recordIdentitySnapshot("0x0000000000000000000000000000000000000002", "Newbie", 12000)
+	recordIdentitySnapshot("0x0000000000000000000000000000000000000004", "Candidate", 50000)
+
+	req := httptest.NewRequest("GET", "/whitelist/snapshot", nil)
+	rr := httptest.NewRecorder()
+	whitelistSnapshotHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); !strings.Contains(cd, "whitelist.json") {
+		t.Errorf("unexpected Content-Disposition %q", cd)
+	}
+
+	var snap WhitelistSnapshot
+	if err := json.Unmarshal(rr.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if snap.Version != whitelistSnapshotVersion || snap.HashAlgorithm != "sha256" {
+		t.Errorf("unexpected header fields: %+v", snap)
+	}
+	if snap.GeneratedAt == 0 {
+		t.Errorf("generated_at missing")
+	}
+	if snap.Count != 3 || len(snap.Addresses) != 3 {
+		t.Fatalf("expected 3 addresses, got count=%d len=%d", snap.Count, len(snap.Addresses))
+	}
+	for i := 1; i < len(snap.Addresses); i++ {
+		if snap.Addresses[i-1] > snap.Addresses[i] {
+			t.Fatalf("addresses not ordered: %v", snap.Addresses)
+		}
+	}
+	if got := computeMerkleRoot(snap.Addresses); got != snap.MerkleRoot {
+		t.Fatalf("root %s does not match recomputed %s", snap.MerkleRoot, got)
+	}
+}